@@ -0,0 +1,120 @@
+package chain
+
+import (
+	"encoding/hex"
+	"errors"
+	"go.etcd.io/bbolt"
+	"log"
+)
+
+// CoinbaseMaturity 为 coinbase 输出可以被花费所需的确认数
+const CoinbaseMaturity = 10
+
+// ErrImmatureCoinbase 表示交易花费了确认数不足 CoinbaseMaturity 的 coinbase 输出
+var ErrImmatureCoinbase = errors.New("coinbase output is not mature")
+
+// Coin 为 UTXO 集合中的一个未花费输出，Height 和 Coinbase 来自包含它的交易
+type Coin struct {
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// Mature 判断 coin 能否被高度为 spendHeight 的区块中的交易花费
+func (c Coin) Mature(spendHeight int) bool {
+	return Mature(c.Coinbase, c.Height, spendHeight)
+}
+
+// Balance 描述某个地址的余额构成
+type Balance struct {
+	// Confirmed 为确认数不少于 minConf 的成熟输出之和
+	Confirmed int
+	// Unconfirmed 为已上链但确认数少于 minConf 的输出之和
+	Unconfirmed int
+	// Immature 为确认数不足 CoinbaseMaturity 的 coinbase 输出之和
+	Immature int
+	// PendingIncoming 和 PendingOutgoing 为内存池中尚未上链的收款与支出
+	PendingIncoming int
+	PendingOutgoing int
+}
+
+// Total 返回链上余额与内存池变动之和
+func (b Balance) Total() int {
+	return b.Confirmed + b.Unconfirmed + b.Immature + b.PendingIncoming - b.PendingOutgoing
+}
+
+// Confirmations 返回高度为 height 的输出在链顶 tipHeight 处的确认数
+func Confirmations(height, tipHeight int) int {
+	return tipHeight - height + 1
+}
+
+// Mature 判断高度为 height 的输出能否被高度为 spendHeight 的区块中的交易花费：
+// coinbase 输出在前一区块处需要至少 CoinbaseMaturity 个确认，其他输出总是成熟的。
+func Mature(coinbase bool, height, spendHeight int) bool {
+	return !coinbase || Confirmations(height, spendHeight-1) >= CoinbaseMaturity
+}
+
+// Balance 统计 pubKeyHash 的余额。minConf 为计入 Confirmed 所需的最少确认数；
+// pending 为内存池中的交易，用于计算未上链的收款与支出，可以为 nil。
+func (u *UTXOSet) Balance(pubKeyHash []byte, minConf int, pending []*Transaction) Balance {
+	var balance Balance
+	tipHeight := u.Blockchain.GetBestHeight()
+
+	err := u.Blockchain.Db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+			confirmations := Confirmations(outs.Height, tipHeight)
+			mature := Mature(outs.Coinbase, outs.Height, tipHeight+1)
+
+			for _, out := range outs.Outputs {
+				if !out.IsLockedWithKey(pubKeyHash) {
+					continue
+				}
+				switch {
+				case !mature:
+					balance.Immature += out.Value
+				case confirmations < minConf:
+					balance.Unconfirmed += out.Value
+				default:
+					balance.Confirmed += out.Value
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// 内存池中的交易可能相互引用，先记录它们的输出以便查找被花费的金额
+	pendingOutputs := make(map[string][]TXOutput)
+	for _, tx := range pending {
+		pendingOutputs[hex.EncodeToString(tx.ID)] = tx.Vout
+	}
+	for _, tx := range pending {
+		for _, out := range tx.Vout {
+			if out.IsLockedWithKey(pubKeyHash) {
+				balance.PendingIncoming += out.Value
+			}
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if outs, ok := pendingOutputs[hex.EncodeToString(vin.Txid)]; ok {
+				if vin.Vout < len(outs) && outs[vin.Vout].IsLockedWithKey(pubKeyHash) {
+					balance.PendingOutgoing += outs[vin.Vout].Value
+				}
+				continue
+			}
+			if out, ok := u.FindOutput(vin.Txid, vin.Vout); ok && out.IsLockedWithKey(pubKeyHash) {
+				balance.PendingOutgoing += out.Value
+			}
+		}
+	}
+
+	return balance
+}
@@ -0,0 +1,64 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUTXOSet_Balance(t *testing.T) {
+	alice := []byte("alice-pubkey-hash-01")
+	bob := []byte("bob-pubkey-hash-0002")
+
+	genesis := &Block{Hash: []byte("block-0"), PreBlockHash: []byte{}, Height: 0,
+		Transactions: []*Transaction{testCoinbase(0x01, alice)}}
+	pay := &Transaction{
+		ID:   []byte{0x02},
+		Vin:  []TXInput{{Txid: []byte{0x01}, Vout: 0}},
+		Vout: []TXOutput{{Value: 5, PubKeyHash: bob}, {Value: 15, PubKeyHash: alice}},
+	}
+	block1 := &Block{Hash: []byte("block-1"), PreBlockHash: genesis.Hash, Height: 1,
+		Transactions: []*Transaction{pay, testCoinbase(0x03, bob)}}
+	block2 := &Block{Hash: []byte("block-2"), PreBlockHash: block1.Hash, Height: 2,
+		Transactions: []*Transaction{testCoinbase(0x04, alice)}}
+
+	bc := newTestChain(t, genesis, block1, block2)
+	UTXOSet := UTXOSet{Blockchain: bc}
+	UTXOSet.Reindex()
+
+	pending := []*Transaction{{
+		ID:   []byte{0x05},
+		Vin:  []TXInput{{Txid: []byte{0x02}, Vout: 1}},
+		Vout: []TXOutput{{Value: 10, PubKeyHash: bob}, {Value: 5, PubKeyHash: alice}},
+	}}
+
+	tests := []struct {
+		name    string
+		minConf int
+		pending []*Transaction
+		want    Balance
+	}{
+		{
+			name:    "one confirmation",
+			minConf: 1,
+			want:    Balance{Confirmed: 15, Immature: 20},
+		},
+		{
+			name:    "three confirmations",
+			minConf: 3,
+			want:    Balance{Unconfirmed: 15, Immature: 20},
+		},
+		{
+			name:    "with mempool",
+			minConf: 1,
+			pending: pending,
+			want:    Balance{Confirmed: 15, Immature: 20, PendingIncoming: 5, PendingOutgoing: 15},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := UTXOSet.Balance(alice, tt.minConf, tt.pending)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
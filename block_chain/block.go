@@ -2,12 +2,19 @@ package chain
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"time"
 )
 
+// BlockVersion 为新挖出的区块的版本。版本 0 为旧区块，工作量证明不包含版本；
+// 版本 1 起版本号参与工作量证明的哈希，转发区块的节点无法修改它。
+const BlockVersion = 1
+
 type Block struct {
+	// Version 为区块的版本，没有这个字段的旧区块解码后为 0
+	Version      int
 	TimeStamp    int64
 	PreBlockHash []byte
 	Hash         []byte
@@ -22,7 +29,14 @@ func NewGenesisBlock(coinbase *Transaction) *Block {
 }
 
 func NewBlock(transactions []*Transaction, preBlockHash []byte, height int) *Block {
+	block, _ := newBlockContext(context.Background(), transactions, preBlockHash, height)
+	return block
+}
+
+// newBlockContext 与 NewBlock 相同，ctx 被取消时停止工作量证明并返回错误
+func newBlockContext(ctx context.Context, transactions []*Transaction, preBlockHash []byte, height int) (*Block, error) {
 	block := &Block{
+		Version:      BlockVersion,
 		TimeStamp:    time.Now().Unix(),
 		Transactions: transactions,
 		PreBlockHash: preBlockHash,
@@ -31,10 +45,13 @@ func NewBlock(transactions []*Transaction, preBlockHash []byte, height int) *Blo
 		Height:       height,
 	}
 	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
+	nonce, hash, err := pow.RunContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	block.Hash = hash[:]
 	block.Nonce = nonce
-	return block
+	return block, nil
 }
 
 // HashTransactions 计算块中所有交易的哈希值
@@ -51,7 +68,7 @@ func (b *Block) HashTransactions() []byte {
 	// 优化：使用 merkle tree, 返回根节点的 hash
 	var transactions [][]byte
 	for _, tx := range b.Transactions {
-		transactions = append(transactions, tx.Serialize())
+		transactions = append(transactions, tx.merkleData())
 	}
 	mTree := NewMerkleTree(transactions)
 
@@ -69,11 +86,19 @@ func (b *Block) Serialize() []byte {
 }
 
 func DeSerializeBlock(d []byte) *Block {
-	var block Block
-	decoder := gob.NewDecoder(bytes.NewReader(d))
-	err := decoder.Decode(&block)
+	block, err := DecodeBlock(d)
 	if err != nil {
 		panic(err)
 	}
-	return &block
+	return block
+}
+
+// DecodeBlock 与 DeSerializeBlock 相同，但在数据无效时返回错误，用于解码来自网络的数据
+func DecodeBlock(d []byte) (*Block, error) {
+	var block Block
+	decoder := gob.NewDecoder(bytes.NewReader(d))
+	if err := decoder.Decode(&block); err != nil {
+		return nil, err
+	}
+	return &block, nil
 }
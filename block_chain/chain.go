@@ -2,6 +2,7 @@ package chain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
@@ -28,40 +29,41 @@ func CreateBlockchain(address, nodeID string) *BlockChain {
 		os.Exit(1)
 	}
 
-	var tip []byte
-
 	cbtx := NewCoinBaseTX(address, genesisCoinbaseData)
-	genesis := NewGenesisBlock(cbtx)
-
-	db, err := bbolt.Open(dbFile, 0600, nil)
+	bc, err := CreateBlockchainAt(dbFile, NewGenesisBlock(cbtx))
 	if err != nil {
 		log.Panic(err)
 	}
+	return bc
+}
+
+// CreateBlockchainAt 在 path 上创建以 genesis 为创世区块的新数据库。
+// 多个节点使用同一个创世区块才能互相同步，模拟网络用它为每个节点创建自己的链。
+func CreateBlockchainAt(path string, genesis *Block) (*BlockChain, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	err = db.Update(func(tx *bbolt.Tx) error {
 		b, err := tx.CreateBucket([]byte(blocksBucket))
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-
-		err = b.Put(genesis.Hash, genesis.Serialize())
-		if err != nil {
-			log.Panic(err)
+		if err = b.Put(genesis.Hash, genesis.Serialize()); err != nil {
+			return err
 		}
-
-		err = b.Put([]byte("l"), genesis.Hash)
-		if err != nil {
-			log.Panic(err)
+		if err = b.Put([]byte("l"), genesis.Hash); err != nil {
+			return err
 		}
-		tip = genesis.Hash
-
-		return nil
+		return setMainChain(tx, genesis)
 	})
 	if err != nil {
-		log.Panic(err)
+		_ = db.Close()
+		return nil, err
 	}
 
-	return &BlockChain{tip, db}
+	return &BlockChain{genesis.Hash, db}, nil
 }
 
 // NewBlockChain 返回区块链实例
@@ -83,7 +85,7 @@ func NewBlockChain(nodeID string) *BlockChain {
 	}
 	err = db.Update(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
+		tip = bytes.Clone(b.Get([]byte("l")))
 
 		return nil
 	})
@@ -122,6 +124,7 @@ func (bc *BlockChain) AddBlock(block *Block) {
 				log.Panic(err)
 			}
 			bc.tip = block.Hash
+			return setMainChain(tx, block)
 		}
 
 		return nil
@@ -133,19 +136,37 @@ func (bc *BlockChain) AddBlock(block *Block) {
 
 // GetBestHeight returns the height of the latest block
 func (bc *BlockChain) GetBestHeight() int {
-	var lastBlock Block
+	return bc.GetBestBlock().Height
+}
+
+// GetBestBlock returns the latest block
+func (bc *BlockChain) GetBestBlock() *Block {
+	var lastBlock *Block
 	err := bc.Db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		lastHash := b.Get([]byte("l"))
 		blockData := b.Get(lastHash)
-		lastBlock = *DeSerializeBlock(blockData)
+		lastBlock = DeSerializeBlock(blockData)
 
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
-	return lastBlock.Height
+	return lastBlock
+}
+
+// GenesisHash 返回创世区块的哈希。由快照启动且历史区块尚未下载完时返回 nil
+func (bc *BlockChain) GenesisHash() []byte {
+	block := bc.GetBestBlock()
+	for len(block.PreBlockHash) > 0 {
+		prev, err := bc.GetBlock(block.PreBlockHash)
+		if err != nil {
+			return nil
+		}
+		block = &prev
+	}
+	return block.Hash
 }
 
 // GetBlock 返回指定的区块, 如果区块不存在则返回错误.
@@ -172,22 +193,6 @@ func (bc *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
-// GetBlockHashes 只返回所有区块的哈希值.
-func (bc *BlockChain) GetBlockHashes() [][]byte {
-	var blocks [][]byte
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
-
-		blocks = append(blocks, block.Hash)
-
-		if len(block.PreBlockHash) == 0 {
-			break
-		}
-	}
-	return blocks
-}
 func (bc *BlockChain) Iterator() *BlockChainIterator {
 	bci := &BlockChainIterator{
 		currentHash: bc.tip,
@@ -196,20 +201,52 @@ func (bc *BlockChain) Iterator() *BlockChainIterator {
 	return bci
 }
 
+// ErrStaleTip 表示挖矿期间链顶已被其他区块更新，挖出的区块不再接在链顶之后
+var ErrStaleTip = errors.New("chain tip changed while mining")
+
+// ErrInvalidTransaction 表示待打包的交易没有通过验证
+var ErrInvalidTransaction = errors.New("invalid transaction")
+
+// ErrInvalidPoW 表示区块哈希不满足工作量证明要求或与区块内容不符
+var ErrInvalidPoW = errors.New("block does not satisfy proof of work")
+
 func (bc *BlockChain) MineBlock(transactions []*Transaction) *Block {
+	newBlock, err := bc.MineBlockContext(context.Background(), transactions)
+	if err != nil {
+		log.Panic(err)
+	}
+	return newBlock
+}
+
+// MineBlockContext 在当前链顶之上打包 transactions 并进行工作量证明，然后将区块写入数据库并设为链顶。
+// 挖矿期间链顶发生变化时返回 ErrStaleTip，区块不会被写入。其余规则见 NewBlockContext。
+func (bc *BlockChain) MineBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	newBlock, err := bc.NewBlockContext(ctx, transactions)
+	if err != nil {
+		return nil, err
+	}
+	if err = bc.connectTip(newBlock); err != nil {
+		return nil, err
+	}
+
+	return newBlock, nil
+}
+
+// NewBlockContext 在当前链顶之上打包 transactions 并进行工作量证明，区块不会被写入数据库。
+// transactions 以 coinbase 开头，必须通过 VerifyTransactions 的检查，否则返回 ErrInvalidTransaction；
+// 交易可以花费同一区块中排在它之前的交易的输出。ctx 被取消时返回 ctx.Err()。
+func (bc *BlockChain) NewBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
 	var latestHash []byte
 	var lastHeight int
 
-	for _, tx := range transactions {
-		// TODO: ignore transaction if it's not valid
-		if bc.VerifyTransaction(tx) != true {
-			log.Panic("ERROR: Invalid transaction")
-		}
+	if err := bc.VerifyTransactions(transactions); err != nil {
+		return nil, err
 	}
 
 	err := bc.Db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		latestHash = b.Get([]byte("l"))
+		// Get 返回的切片只在事务内有效，新区块在事务之外引用它
+		latestHash = bytes.Clone(b.Get([]byte("l")))
 
 		blockData := b.Get(latestHash)
 		block := DeSerializeBlock(blockData)
@@ -219,29 +256,54 @@ func (bc *BlockChain) MineBlock(transactions []*Transaction) *Block {
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	newBlock := NewBlock(transactions, latestHash, lastHeight+1)
-	err = bc.Db.Update(func(tx *bbolt.Tx) error {
+	return newBlockContext(ctx, transactions, latestHash, lastHeight+1)
+}
+
+// SubmitBlock 验证由外部矿工求解的区块并将其接到链顶：区块必须指向当前链顶，
+// 哈希与区块内容一致并满足工作量证明，交易全部通过验证。
+func (bc *BlockChain) SubmitBlock(block *Block) error {
+	if err := CheckBlock(block); err != nil {
+		return err
+	}
+	if !bytes.Equal(block.PreBlockHash, bc.GetBestBlock().Hash) {
+		return ErrStaleTip
+	}
+	if err := bc.checkBlockTransactions(block); err != nil {
+		return err
+	}
+	return bc.connectTip(block)
+}
+
+// connectTip 在一个事务中将 block 写入数据库、设为链顶并更新 UTXO 集合。
+// block 的前一区块必须是当前链顶，否则返回 ErrStaleTip。
+func (bc *BlockChain) connectTip(block *Block) error {
+	return bc.Db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(blocksBucket))
-		err = bucket.Put(newBlock.Hash, newBlock.Serialize())
+		tip := bucket.Get([]byte("l"))
+		if !bytes.Equal(block.PreBlockHash, tip) {
+			return ErrStaleTip
+		}
+		if tipBlock := DeSerializeBlock(bucket.Get(tip)); block.Height != tipBlock.Height+1 {
+			return fmt.Errorf("block height %d does not follow tip height %d", block.Height, tipBlock.Height)
+		}
+		err := bucket.Put(block.Hash, block.Serialize())
 		if err != nil {
 			return err
 		}
-		err = bucket.Put([]byte("l"), newBlock.Hash)
+		err = bucket.Put([]byte("l"), block.Hash)
 		if err != nil {
 			return err
 		}
-		bc.tip = newBlock.Hash
+		if err = updateUTXO(tx, block); err != nil {
+			return err
+		}
+		bc.tip = block.Hash
 
-		return nil
+		return setMainChain(tx, block)
 	})
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return newBlock
 }
 
 func (bc *BlockChain) Close() {
@@ -286,6 +348,9 @@ func (bc *BlockChain) FindUnSpentTransactions(address string) []Transaction {
 	bci := bc.Iterator()
 	for {
 		block := bci.Next()
+		if block == nil {
+			break
+		}
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
 		outputs:
@@ -320,13 +385,35 @@ func (bc *BlockChain) FindUnSpentTransactions(address string) []Transaction {
 	return unspentTXs
 }
 
+// FindUTXO 遍历区块链，返回当前链顶的全部未花费输出
 func (bc *BlockChain) FindUTXO() map[string]TXOutputs {
+	return bc.findUTXOFrom(bc.tip, true)
+}
+
+// findUTXOFrom 从 hash 指定的区块向前遍历，返回该区块处的全部未花费输出。
+// useSnapshot 为 true 且链由尚未验证的快照启动时，遍历到快照基块即以快照中的 UTXO 集合补齐，
+// 不再依赖基块之前的历史区块。
+func (bc *BlockChain) findUTXOFrom(hash []byte, useSnapshot bool) map[string]TXOutputs {
 	UTXO := make(map[string]TXOutputs)
 	spentTXOs := make(map[string][]int)
-	bci := bc.Iterator()
+	bci := &BlockChainIterator{currentHash: hash, db: bc.Db}
+
+	var base *SnapshotBase
+	if useSnapshot {
+		if b, ok := bc.SnapshotBase(); ok && !b.Verified {
+			base = b
+		}
+	}
 
 	for {
+		if base != nil && bytes.Equal(bci.currentHash, base.Hash) {
+			bc.addSnapshotOutputs(UTXO, spentTXOs)
+			break
+		}
 		block := bci.Next()
+		if block == nil {
+			break
+		}
 
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
@@ -344,6 +431,9 @@ func (bc *BlockChain) FindUTXO() map[string]TXOutputs {
 
 				outs := UTXO[txID]
 				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIdx)
+				outs.Height = block.Height
+				outs.Coinbase = tx.IsCoinbase()
 				UTXO[txID] = outs
 			}
 
@@ -368,6 +458,9 @@ func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 	bci := bc.Iterator()
 	for {
 		block := bci.Next()
+		if block == nil {
+			break
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
@@ -383,14 +476,9 @@ func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 
 // SignTransaction 对交易进行签名
 func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
-
-	for _, vin := range tx.Vin {
-		prevTX, err := bc.FindTransaction(vin.Txid)
-		if err != nil {
-			panic(err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	prevTXs, err := bc.findPrevTransactions(tx, nil)
+	if err != nil {
+		panic(err)
 	}
 
 	tx.Sign(privKey, prevTXs)
@@ -398,19 +486,70 @@ func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey)
 
 // VerifyTransaction 验证交易
 func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
+	return bc.VerifyTransactionInBlock(tx, nil) == nil
+}
+
+// VerifyTransactions 检查 txs 能否作为链顶之后下一个区块的全部交易，规则与验证收到的区块相同：
+// 第一笔是唯一的 coinbase，其余交易通过 TxChecker 的检查，coinbase 不超过出块奖励加手续费。
+func (bc *BlockChain) VerifyTransactions(txs []*Transaction) error {
+	block := &Block{Height: bc.GetBestHeight() + 1, Transactions: txs}
+	if err := checkTransactionList(txs); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidTransaction, err)
+	}
+	if err := bc.checkBlockTransactions(block); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidTransaction, err)
+	}
+	return nil
+}
+
+// VerifyTransactionInBlock 验证交易，earlier 为同一区块中排在它之前的交易（十六进制 ID -> 交易），可以为 nil。
+// 交易无效时返回 ErrInvalidTransaction
+func (bc *BlockChain) VerifyTransactionInBlock(tx *Transaction, earlier map[string]Transaction) error {
 	if tx.IsCoinbase() {
-		return true
+		return nil
+	}
+	prevTXs, err := bc.findPrevTransactions(tx, earlier)
+	if err != nil {
+		// 引用的交易尚未见过（可能是乱序到达的孤儿交易），无法验证
+		return fmt.Errorf("%w: %x: %w", ErrInvalidTransaction, tx.ID, err)
+	}
+	if !tx.Verify(prevTXs) {
+		return fmt.Errorf("%w: %x has an invalid signature", ErrInvalidTransaction, tx.ID)
 	}
+	return nil
+}
+
+// findPrevTransactions 收集 tx 各输入所引用的前序交易。
+// 先在 earlier 中查找；若历史区块中找不到（链由 UTXO 快照启动），则用 UTXO 集合中的输出还原出只含被引用输出的交易。
+func (bc *BlockChain) findPrevTransactions(tx *Transaction, earlier map[string]Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
+	UTXOSet := UTXOSet{Blockchain: bc}
 
 	for _, vin := range tx.Vin {
+		txID := hex.EncodeToString(vin.Txid)
+		if prevTX, ok := earlier[txID]; ok {
+			prevTXs[txID] = prevTX
+			continue
+		}
 		prevTX, err := bc.FindTransaction(vin.Txid)
-		if err != nil {
-			panic(err)
+		if err == nil {
+			prevTXs[txID] = prevTX
+			continue
+		}
+
+		out, ok := UTXOSet.FindOutput(vin.Txid, vin.Vout)
+		if !ok {
+			return nil, err
+		}
+		prevTX = prevTXs[txID]
+		prevTX.ID = vin.Txid
+		for len(prevTX.Vout) <= vin.Vout {
+			prevTX.Vout = append(prevTX.Vout, TXOutput{})
 		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		prevTX.Vout[vin.Vout] = out
+		prevTXs[txID] = prevTX
 	}
-	return tx.Verify(prevTXs)
+	return prevTXs, nil
 }
 
 func dbExists(file string) bool {
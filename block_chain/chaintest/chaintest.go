@@ -0,0 +1,64 @@
+// Package chaintest 为其他包的测试创建临时的区块链
+package chaintest
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+// lowTargetBits 为测试挖矿使用的难度
+const lowTargetBits = 4
+
+// NewChain 在临时目录中创建一条以 genesis 开始、随后接上 blocks 的链并建立 UTXO 集合。
+// genesis 不需要工作量证明，blocks 通常来自 MatureBlocks。
+func NewChain(t testing.TB, genesis *chain.Block, blocks ...*chain.Block) *chain.BlockChain {
+	bc, err := chain.CreateBlockchainAt(filepath.Join(t.TempDir(), "chain.db"), genesis)
+	require.NoError(t, err)
+	t.Cleanup(bc.Close)
+
+	UTXOSet := chain.UTXOSet{Blockchain: bc}
+	UTXOSet.Reindex()
+	if len(blocks) > 0 {
+		defer chain.SetTargetBits(lowTargetBits)()
+	}
+	for _, block := range blocks {
+		require.NoError(t, bc.SubmitBlock(block))
+	}
+	return bc
+}
+
+// NewFundedChain 创建一条临时链，其创世区块包含 coinbases 笔支付给 w 的 coinbase 交易，金额分别为 20、21……
+// 创世区块之后接上 MatureBlocks，w 的输出在下一个区块中可以花费。
+func NewFundedChain(t testing.TB, w *wallet.Wallet, coinbases int) *chain.BlockChain {
+	var txs []*chain.Transaction
+	for i := 0; i < coinbases; i++ {
+		cbTx := chain.NewCoinBaseTX(string(w.GetAddress()), "")
+		cbTx.Vout[0].Value += i
+		cbTx.ID = cbTx.Hash()
+		txs = append(txs, cbTx)
+	}
+	genesis := &chain.Block{Hash: []byte("genesis"), PreBlockHash: []byte{}, Transactions: txs}
+	return NewChain(t, genesis, MatureBlocks(t, genesis)...)
+}
+
+// MatureBlocks 在 genesis 之后挖出 CoinbaseMaturity-1 个只包含 coinbase 的区块，使 genesis 中的 coinbase 输出成熟。
+// 新区块的 coinbase 支付给一个临时地址。挖矿时临时降低难度，NewChain 接上这些区块时同样如此；
+// 多个节点用同一组区块创建的链完全相同。
+func MatureBlocks(t testing.TB, genesis *chain.Block) []*chain.Block {
+	bc := NewChain(t, genesis)
+	defer chain.SetTargetBits(lowTargetBits)()
+
+	miner := wallet.NewWallet()
+	var blocks []*chain.Block
+	for i := 1; i < chain.CoinbaseMaturity; i++ {
+		block, err := bc.MineBlockContext(context.Background(), []*chain.Transaction{chain.NewCoinBaseTX(string(miner.GetAddress()), "")})
+		require.NoError(t, err)
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
@@ -0,0 +1,241 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// 交易大小估算（字节）。交易以 JSON 序列化，签名和公钥各 64 字节，base64 编码后约 88 字节。
+const (
+	txBaseSize   = 60
+	txInputSize  = 260
+	txOutputSize = 70
+)
+
+// maxBnBTries 限制 branch-and-bound 搜索的节点数，避免 UTXO 很多时卡住
+const maxBnBTries = 100000
+
+var (
+	// ErrInsufficientFunds 表示可用输出不足以支付金额和手续费
+	ErrInsufficientFunds = errors.New("not enough funds")
+	// ErrNoChangelessSolution 表示 branch-and-bound 没有找到无需找零的组合
+	ErrNoChangelessSolution = errors.New("no changeless input selection found")
+)
+
+// SpendableOutput 是一个可以被新交易引用的未花费输出
+type SpendableOutput struct {
+	Txid  []byte
+	Index int
+	Value int
+}
+
+// CoinSelectionParams 描述一次选币的目标
+type CoinSelectionParams struct {
+	// Target 为支付给收款方的金额
+	Target int
+	// FeeRate 为每 1000 字节交易大小的手续费
+	FeeRate int
+	// DustThreshold 为找零的最小金额，低于该值的找零不会生成输出而是并入手续费
+	DustThreshold int
+}
+
+// fee 返回含 inputs 个输入、outputs 个输出的交易按费率应付的手续费
+func (p CoinSelectionParams) fee(inputs, outputs int) int {
+	size := txBaseSize + inputs*txInputSize + outputs*txOutputSize
+	return (size*p.FeeRate + 999) / 1000
+}
+
+// CoinSelection 为选币结果。Total = Target + Fee + Change。
+type CoinSelection struct {
+	Inputs []SpendableOutput
+	Total  int
+	Fee    int
+	// Change 为 0 时交易不包含找零输出
+	Change int
+}
+
+// CoinSelector 从候选输出中选出用于支付的输入
+type CoinSelector interface {
+	Select(utxos []SpendableOutput, params CoinSelectionParams) (*CoinSelection, error)
+}
+
+// NewCoinSelector 根据名称返回选币策略：largest、smallest、bnb、random
+func NewCoinSelector(name string) (CoinSelector, error) {
+	switch name {
+	case "", "largest":
+		return LargestFirst{}, nil
+	case "smallest":
+		return SmallestFirst{}, nil
+	case "bnb":
+		return BranchAndBound{Fallback: LargestFirst{}}, nil
+	case "random":
+		return RandomSelector{}, nil
+	default:
+		return nil, fmt.Errorf("unknown coin selection strategy %q", name)
+	}
+}
+
+// LargestFirst 优先使用金额最大的输出，输入数最少
+type LargestFirst struct{}
+
+func (LargestFirst) Select(utxos []SpendableOutput, params CoinSelectionParams) (*CoinSelection, error) {
+	sorted := append([]SpendableOutput(nil), utxos...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value > sorted[j].Value })
+	return accumulate(sorted, params)
+}
+
+// SmallestFirst 优先使用金额最小的输出，用于合并碎片化的小额输出
+type SmallestFirst struct{}
+
+func (SmallestFirst) Select(utxos []SpendableOutput, params CoinSelectionParams) (*CoinSelection, error) {
+	sorted := append([]SpendableOutput(nil), utxos...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value < sorted[j].Value })
+	return accumulate(sorted, params)
+}
+
+// RandomSelector 以随机顺序使用输出，降低地址之间的关联性
+type RandomSelector struct {
+	// Rand 为空时使用全局随机源
+	Rand *rand.Rand
+}
+
+func (s RandomSelector) Select(utxos []SpendableOutput, params CoinSelectionParams) (*CoinSelection, error) {
+	shuffled := append([]SpendableOutput(nil), utxos...)
+	swap := func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] }
+	if s.Rand != nil {
+		s.Rand.Shuffle(len(shuffled), swap)
+	} else {
+		rand.Shuffle(len(shuffled), swap)
+	}
+	return accumulate(shuffled, params)
+}
+
+// accumulate 按给定顺序累加输出，直到覆盖金额和手续费
+func accumulate(utxos []SpendableOutput, params CoinSelectionParams) (*CoinSelection, error) {
+	selection := &CoinSelection{}
+
+	for _, utxo := range utxos {
+		selection.Inputs = append(selection.Inputs, utxo)
+		selection.Total += utxo.Value
+
+		if finishSelection(selection, params) {
+			return selection, nil
+		}
+	}
+	return nil, ErrInsufficientFunds
+}
+
+// finishSelection 判断当前输入是否足够，并计算手续费与找零。
+// 找零低于粉尘阈值（或不够支付找零输出自身的手续费）时不生成找零，剩余部分计入手续费。
+func finishSelection(selection *CoinSelection, params CoinSelectionParams) bool {
+	n := len(selection.Inputs)
+
+	feeWithChange := params.fee(n, 2)
+	change := selection.Total - params.Target - feeWithChange
+	if change > 0 && change >= params.DustThreshold {
+		selection.Fee = feeWithChange
+		selection.Change = change
+		return true
+	}
+
+	feeNoChange := params.fee(n, 1)
+	if selection.Total >= params.Target+feeNoChange {
+		selection.Fee = selection.Total - params.Target
+		selection.Change = 0
+		return true
+	}
+	return false
+}
+
+// BranchAndBound 搜索一组输入，使其金额扣除手续费后恰好落在
+// [Target, Target+找零成本] 区间内，从而无需找零输出。
+// 找不到时使用 Fallback；Fallback 为空则返回 ErrNoChangelessSolution。
+type BranchAndBound struct {
+	Fallback CoinSelector
+}
+
+func (s BranchAndBound) Select(utxos []SpendableOutput, params CoinSelectionParams) (*CoinSelection, error) {
+	if selection := branchAndBound(utxos, params); selection != nil {
+		return selection, nil
+	}
+	if s.Fallback != nil {
+		return s.Fallback.Select(utxos, params)
+	}
+	return nil, ErrNoChangelessSolution
+}
+
+func branchAndBound(utxos []SpendableOutput, params CoinSelectionParams) *CoinSelection {
+	inputFee := params.fee(1, 0) - params.fee(0, 0)
+	target := params.Target + params.fee(0, 1)
+	// 找零成本：多一个输出的手续费，加上找零至少要达到的粉尘阈值
+	costOfChange := params.fee(0, 2) - params.fee(0, 1) + params.DustThreshold
+
+	// 只考虑有效金额为正的输出，按有效金额降序
+	type candidate struct {
+		utxo      SpendableOutput
+		effective int
+	}
+	var candidates []candidate
+	remaining := 0
+	for _, utxo := range utxos {
+		effective := utxo.Value - inputFee
+		if effective > 0 {
+			candidates = append(candidates, candidate{utxo, effective})
+			remaining += effective
+		}
+	}
+	if remaining < target {
+		return nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].effective > candidates[j].effective })
+
+	var (
+		best      []bool
+		bestWaste = -1
+		chosen    = make([]bool, len(candidates))
+		tries     = 0
+	)
+
+	var search func(depth, value, remaining int)
+	search = func(depth, value, remaining int) {
+		tries++
+		if tries > maxBnBTries || value > target+costOfChange || value+remaining < target {
+			return
+		}
+		if value >= target {
+			if waste := value - target; bestWaste < 0 || waste < bestWaste {
+				bestWaste = waste
+				best = append(best[:0], chosen...)
+			}
+			return
+		}
+		if depth == len(candidates) {
+			return
+		}
+
+		c := candidates[depth]
+		// 上一个候选被跳过且金额相同时，包含当前候选的组合已经以包含上一个候选的形式搜索过
+		if depth == 0 || chosen[depth-1] || candidates[depth-1].effective != c.effective {
+			chosen[depth] = true
+			search(depth+1, value+c.effective, remaining-c.effective)
+			chosen[depth] = false
+		}
+		search(depth+1, value, remaining-c.effective)
+	}
+	search(0, 0, remaining)
+
+	if best == nil {
+		return nil
+	}
+	selection := &CoinSelection{}
+	for i, ok := range best {
+		if ok {
+			selection.Inputs = append(selection.Inputs, candidates[i].utxo)
+			selection.Total += candidates[i].utxo.Value
+		}
+	}
+	selection.Fee = selection.Total - params.Target
+	return selection
+}
@@ -0,0 +1,113 @@
+package chain
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testOutputs(values ...int) []SpendableOutput {
+	var outs []SpendableOutput
+	for i, v := range values {
+		outs = append(outs, SpendableOutput{Txid: []byte{byte(i)}, Index: 0, Value: v})
+	}
+	return outs
+}
+
+func selectedValues(selection *CoinSelection) []int {
+	var values []int
+	for _, in := range selection.Inputs {
+		values = append(values, in.Value)
+	}
+	return values
+}
+
+func TestCoinSelectors(t *testing.T) {
+	utxos := testOutputs(1, 4, 10, 2, 7)
+
+	tests := []struct {
+		name     string
+		selector CoinSelector
+		params   CoinSelectionParams
+		inputs   []int
+		change   int
+		fee      int
+		err      error
+	}{
+		{
+			name:     "largest first",
+			selector: LargestFirst{},
+			params:   CoinSelectionParams{Target: 12},
+			inputs:   []int{10, 7},
+			change:   5,
+		},
+		{
+			name:     "smallest first",
+			selector: SmallestFirst{},
+			params:   CoinSelectionParams{Target: 6},
+			inputs:   []int{1, 2, 4},
+			change:   1,
+		},
+		{
+			name:     "change below dust goes to fee",
+			selector: SmallestFirst{},
+			params:   CoinSelectionParams{Target: 6, DustThreshold: 2},
+			inputs:   []int{1, 2, 4},
+			fee:      1,
+		},
+		{
+			name:     "fee rate is charged per 1000 bytes",
+			selector: LargestFirst{},
+			params:   CoinSelectionParams{Target: 5, FeeRate: 10},
+			inputs:   []int{10},
+			// 60 + 260 + 2*70 = 460 字节，手续费 5
+			fee:    5,
+			change: 0,
+		},
+		{
+			name:     "branch and bound finds changeless set",
+			selector: BranchAndBound{},
+			params:   CoinSelectionParams{Target: 13},
+			inputs:   []int{10, 2, 1},
+		},
+		{
+			name:     "branch and bound without solution",
+			selector: BranchAndBound{},
+			params:   CoinSelectionParams{Target: 30},
+			err:      ErrNoChangelessSolution,
+		},
+		{
+			name:     "insufficient funds",
+			selector: LargestFirst{},
+			params:   CoinSelectionParams{Target: 25},
+			err:      ErrInsufficientFunds,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection, err := tt.selector.Select(utxos, tt.params)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.inputs, selectedValues(selection))
+			require.Equal(t, tt.change, selection.Change)
+			require.Equal(t, tt.fee, selection.Fee)
+			require.Equal(t, selection.Total, tt.params.Target+selection.Fee+selection.Change)
+		})
+	}
+}
+
+func TestRandomSelector_CoversTarget(t *testing.T) {
+	selector := RandomSelector{Rand: rand.New(rand.NewSource(1))}
+	for i := 0; i < 20; i++ {
+		selection, err := selector.Select(testOutputs(1, 4, 10, 2, 7), CoinSelectionParams{Target: 15, DustThreshold: 3})
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, selection.Total, 15)
+		if selection.Change > 0 {
+			require.GreaterOrEqual(t, selection.Change, 3)
+		}
+	}
+}
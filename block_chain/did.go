@@ -23,11 +23,24 @@ func NewDidDocumentTransaction(w *wallet.Wallet, data []byte) *Transaction {
 	return tx
 }
 
+// IsDidDocument 判断 tx 是否为 NewDidDocumentTransaction 创建的 DID 文档交易：
+// 没有输入和输出，Payload 为 DID 文档及其签名
+func (tx *Transaction) IsDidDocument() bool {
+	if len(tx.Vin) != 0 || len(tx.Vout) != 0 || len(tx.Payload) != 2 {
+		return false
+	}
+	doc, err := chain_did.DeserializeDidDocument([]byte(tx.Payload[0]))
+	return err == nil && doc.ID.String() != ""
+}
+
 func FindDidDocument(bc *BlockChain, targetDID string) *did.Document {
 	bci := bc.Iterator()
 
 	for {
 		block := bci.Next()
+		if block == nil {
+			break
+		}
 
 		for _, tx := range block.Transactions {
 			if tx.IsCoinbase() == false {
@@ -0,0 +1,218 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+
+	"go.etcd.io/bbolt"
+)
+
+// heightsBucket 为主链的高度索引：高度 -> 区块哈希
+const heightsBucket = "heights"
+
+// BlockHeader 为区块头：区块中除交易以外的字段加上交易的默克尔根，足以验证工作量证明。
+// 同步时先下载并验证区块头，再按高度下载区块。
+type BlockHeader struct {
+	Version      int
+	TimeStamp    int64
+	PreBlockHash []byte
+	Hash         []byte
+	MerkleRoot   []byte
+	Nonce        int
+	Height       int
+}
+
+// Header 返回区块的区块头
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{
+		Version:      b.Version,
+		TimeStamp:    b.TimeStamp,
+		PreBlockHash: b.PreBlockHash,
+		Hash:         b.Hash,
+		MerkleRoot:   b.HashTransactions(),
+		Nonce:        b.Nonce,
+		Height:       b.Height,
+	}
+}
+
+// CheckHeader 检查区块头的哈希与内容一致并满足工作量证明
+func CheckHeader(h *BlockHeader) error {
+	hash := powHash(h.Version, h.PreBlockHash, h.MerkleRoot, h.TimeStamp, h.Nonce)
+	if !bytes.Equal(hash, h.Hash) || !meetsTarget(hash) {
+		return ErrInvalidPoW
+	}
+	return nil
+}
+
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
+
+// setMainChain 在链顶变为 tip 之后更新高度索引：删除高于 tip 的记录，
+// 从 tip 向前写入，直到遇到已经在索引中的祖先。索引不存在时（旧版本的数据库）从 tip 一直建到最早的区块。
+func setMainChain(tx *bbolt.Tx, tip *Block) error {
+	heights, err := tx.CreateBucketIfNotExists([]byte(heightsBucket))
+	if err != nil {
+		return err
+	}
+	c := heights.Cursor()
+	for k, _ := c.Seek(heightKey(tip.Height + 1)); k != nil; k, _ = c.Next() {
+		if err = c.Delete(); err != nil {
+			return err
+		}
+	}
+
+	blocks := tx.Bucket([]byte(blocksBucket))
+	block := tip
+	for {
+		key := heightKey(block.Height)
+		if bytes.Equal(heights.Get(key), block.Hash) {
+			return nil
+		}
+		if err = heights.Put(key, block.Hash); err != nil {
+			return err
+		}
+		if len(block.PreBlockHash) == 0 {
+			return nil
+		}
+		data := blocks.Get(block.PreBlockHash)
+		if data == nil {
+			// 由快照启动的链没有更早的区块
+			return nil
+		}
+		block = DeSerializeBlock(data)
+	}
+}
+
+// viewHeights 在只读事务中访问高度索引，索引不存在时先建立它
+func (bc *BlockChain) viewHeights(fn func(heights, blocks *bbolt.Bucket) error) error {
+	missing := false
+	err := bc.Db.View(func(tx *bbolt.Tx) error {
+		missing = tx.Bucket([]byte(heightsBucket)) == nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if missing {
+		err = bc.Db.Update(func(tx *bbolt.Tx) error {
+			blocks := tx.Bucket([]byte(blocksBucket))
+			return setMainChain(tx, DeSerializeBlock(blocks.Get(blocks.Get([]byte("l")))))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return bc.Db.View(func(tx *bbolt.Tx) error {
+		return fn(tx.Bucket([]byte(heightsBucket)), tx.Bucket([]byte(blocksBucket)))
+	})
+}
+
+// BlockHashAt 返回主链上高度为 height 的区块哈希，没有时返回 false
+func (bc *BlockChain) BlockHashAt(height int) ([]byte, bool) {
+	var hash []byte
+	err := bc.viewHeights(func(heights, _ *bbolt.Bucket) error {
+		if v := heights.Get(heightKey(height)); v != nil {
+			hash = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return hash, hash != nil
+}
+
+// HasBlock 判断区块是否在本地数据库中（主链或分叉上）
+func (bc *BlockChain) HasBlock(hash []byte) bool {
+	found := false
+	err := bc.Db.View(func(tx *bbolt.Tx) error {
+		found = tx.Bucket([]byte(blocksBucket)).Get(hash) != nil
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return found
+}
+
+// BlockLocator 返回描述本地主链的区块定位器：从链顶开始的 10 个区块哈希，
+// 之后每次间隔加倍，最后是本地最早的区块（通常是创世区块）。
+// 对方用它找到双方主链的分叉点，只回复分叉点之后的区块头。
+func (bc *BlockChain) BlockLocator() [][]byte {
+	var locator [][]byte
+	err := bc.viewHeights(func(heights, blocks *bbolt.Bucket) error {
+		tip := DeSerializeBlock(blocks.Get(blocks.Get([]byte("l"))))
+		locator = locatorFrom(heights, tip.Height)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return locator
+}
+
+// locatorFrom 按高度索引 heights 返回从 tipHeight 开始的区块定位器
+func locatorFrom(heights *bbolt.Bucket, tipHeight int) [][]byte {
+	var locator [][]byte
+	first, _ := heights.Cursor().First()
+	if first == nil {
+		return nil
+	}
+	lowest := int(binary.BigEndian.Uint64(first))
+
+	step := 1
+	for height := tipHeight; height > lowest; height -= step {
+		if hash := heights.Get(heightKey(height)); hash != nil {
+			locator = append(locator, append([]byte{}, hash...))
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, append([]byte{}, heights.Get(first)...))
+}
+
+// LocateHeaders 返回 locator 中第一个在本地主链上的区块之后的区块头，最多 max 个，包含 stop 时到 stop 为止。
+// locator 中没有主链上的区块（例如 locator 为空）时从本地最早的区块开始，并包含该区块。
+func (bc *BlockChain) LocateHeaders(locator [][]byte, stop []byte, max int) []BlockHeader {
+	var headers []BlockHeader
+	err := bc.viewHeights(func(heights, blocks *bbolt.Bucket) error {
+		start := -1
+		for _, hash := range locator {
+			data := blocks.Get(hash)
+			if data == nil {
+				continue
+			}
+			block := DeSerializeBlock(data)
+			if bytes.Equal(heights.Get(heightKey(block.Height)), hash) {
+				start = block.Height + 1
+				break
+			}
+		}
+		if start < 0 {
+			first, _ := heights.Cursor().First()
+			start = int(binary.BigEndian.Uint64(first))
+		}
+
+		c := heights.Cursor()
+		for k, hash := c.Seek(heightKey(start)); k != nil && len(headers) < max; k, hash = c.Next() {
+			data := blocks.Get(hash)
+			if data == nil {
+				break
+			}
+			headers = append(headers, DeSerializeBlock(data).Header())
+			if bytes.Equal(hash, stop) {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return headers
+}
@@ -0,0 +1,218 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.etcd.io/bbolt"
+)
+
+// headerDBFile 为轻节点保存区块头的数据库文件
+const headerDBFile = "./components/headers_%s.db"
+
+const headersBucket = "headers"
+
+// HeaderChain 为轻节点的区块头链：只保存区块头，按最长链选择链顶并维护主链的高度索引。
+// 创世区块头由调用方按哈希信任，之后的区块头必须满足工作量证明并接在已知的区块头上。
+type HeaderChain struct {
+	Db *bbolt.DB
+}
+
+// HeaderChainPath 返回节点 nodeID 的区块头数据库路径
+func HeaderChainPath(nodeID string) string {
+	return fmt.Sprintf(headerDBFile, nodeID)
+}
+
+// OpenHeaderChain 打开 path 处的区块头链，文件不存在时创建一条空链
+func OpenHeaderChain(path string) (*HeaderChain, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(headersBucket)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists([]byte(heightsBucket))
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &HeaderChain{Db: db}, nil
+}
+
+// Close 关闭区块头数据库
+func (hc *HeaderChain) Close() error {
+	return hc.Db.Close()
+}
+
+func serializeHeader(h *BlockHeader) []byte {
+	var result bytes.Buffer
+	if err := gob.NewEncoder(&result).Encode(h); err != nil {
+		panic(err)
+	}
+	return result.Bytes()
+}
+
+func deserializeHeader(data []byte) BlockHeader {
+	var h BlockHeader
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&h); err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// Tip 返回链顶的区块头，链为空时返回 false
+func (hc *HeaderChain) Tip() (BlockHeader, bool) {
+	var tip BlockHeader
+	found := false
+	_ = hc.Db.View(func(tx *bbolt.Tx) error {
+		headers := tx.Bucket([]byte(headersBucket))
+		if hash := headers.Get([]byte("l")); hash != nil {
+			tip, found = deserializeHeader(headers.Get(hash)), true
+		}
+		return nil
+	})
+	return tip, found
+}
+
+// Height 返回链顶的高度，链为空时返回 -1
+func (hc *HeaderChain) Height() int {
+	tip, ok := hc.Tip()
+	if !ok {
+		return -1
+	}
+	return tip.Height
+}
+
+// Header 返回哈希为 hash 的区块头
+func (hc *HeaderChain) Header(hash []byte) (BlockHeader, bool) {
+	var h BlockHeader
+	found := false
+	_ = hc.Db.View(func(tx *bbolt.Tx) error {
+		if data := tx.Bucket([]byte(headersBucket)).Get(hash); data != nil {
+			h, found = deserializeHeader(data), true
+		}
+		return nil
+	})
+	return h, found
+}
+
+// HeaderAt 返回主链上高度为 height 的区块头
+func (hc *HeaderChain) HeaderAt(height int) (BlockHeader, bool) {
+	var h BlockHeader
+	found := false
+	_ = hc.Db.View(func(tx *bbolt.Tx) error {
+		if hash := tx.Bucket([]byte(heightsBucket)).Get(heightKey(height)); hash != nil {
+			h, found = deserializeHeader(tx.Bucket([]byte(headersBucket)).Get(hash)), true
+		}
+		return nil
+	})
+	return h, found
+}
+
+// GenesisHash 返回创世区块头的哈希，链为空时返回 nil
+func (hc *HeaderChain) GenesisHash() []byte {
+	genesis, ok := hc.HeaderAt(0)
+	if !ok {
+		return nil
+	}
+	return genesis.Hash
+}
+
+// BlockLocator 返回描述主链的区块定位器，用于向全节点请求之后的区块头
+func (hc *HeaderChain) BlockLocator() [][]byte {
+	var locator [][]byte
+	_ = hc.Db.View(func(tx *bbolt.Tx) error {
+		headers := tx.Bucket([]byte(headersBucket))
+		if hash := headers.Get([]byte("l")); hash != nil {
+			tip := deserializeHeader(headers.Get(hash))
+			locator = locatorFrom(tx.Bucket([]byte(heightsBucket)), tip.Height)
+		}
+		return nil
+	})
+	return locator
+}
+
+// AddHeaders 依次加入区块头，返回新加入的数量。链为空时第一个区块头必须是创世区块头；
+// 之后的区块头前一区块未知时返回 ErrOrphanBlock，不满足工作量证明时返回 ErrInvalidPoW。
+// 新的区块头所在的链更长时切换链顶。
+func (hc *HeaderChain) AddHeaders(hs []BlockHeader) (int, error) {
+	added := 0
+	err := hc.Db.Update(func(tx *bbolt.Tx) error {
+		headers := tx.Bucket([]byte(headersBucket))
+		heights := tx.Bucket([]byte(heightsBucket))
+		for i := range hs {
+			h := &hs[i]
+			if headers.Get(h.Hash) != nil {
+				continue
+			}
+			tipHash := headers.Get([]byte("l"))
+			if tipHash == nil {
+				if len(h.PreBlockHash) != 0 || h.Height != 0 {
+					return fmt.Errorf("%w: header chain must start at the genesis block", ErrOrphanBlock)
+				}
+			} else {
+				if err := CheckHeader(h); err != nil {
+					return err
+				}
+				prevData := headers.Get(h.PreBlockHash)
+				if prevData == nil {
+					return ErrOrphanBlock
+				}
+				if prev := deserializeHeader(prevData); h.Height != prev.Height+1 {
+					return fmt.Errorf("%w: height %d does not follow %d", ErrInvalidBlock, h.Height, prev.Height)
+				}
+			}
+			if err := headers.Put(h.Hash, serializeHeader(h)); err != nil {
+				return err
+			}
+			added++
+
+			if tipHash != nil && h.Height <= deserializeHeader(headers.Get(tipHash)).Height {
+				continue
+			}
+			if err := headers.Put([]byte("l"), h.Hash); err != nil {
+				return err
+			}
+			if err := setHeaderMainChain(headers, heights, h); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return added, err
+}
+
+// setHeaderMainChain 与 setMainChain 相同，在链顶变为 tip 之后更新区块头链的高度索引
+func setHeaderMainChain(headers, heights *bbolt.Bucket, tip *BlockHeader) error {
+	c := heights.Cursor()
+	for k, _ := c.Seek(heightKey(tip.Height + 1)); k != nil; k, _ = c.Next() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	h := *tip
+	for {
+		key := heightKey(h.Height)
+		if bytes.Equal(heights.Get(key), h.Hash) {
+			return nil
+		}
+		if err := heights.Put(key, h.Hash); err != nil {
+			return err
+		}
+		data := headers.Get(h.PreBlockHash)
+		if len(h.PreBlockHash) == 0 || data == nil {
+			return nil
+		}
+		h = deserializeHeader(data)
+	}
+}
@@ -0,0 +1,128 @@
+package chain
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+// testBlocks 返回一条从创世区块开始、共 count 个区块的链，区块不满足工作量证明
+func testBlocks(prefix string, parent *Block, count int) []*Block {
+	var blocks []*Block
+	for i := 0; i < count; i++ {
+		b := &Block{Version: BlockVersion, Hash: []byte(fmt.Sprintf("%s-%d", prefix, i)), PreBlockHash: []byte{}}
+		if parent != nil {
+			b.PreBlockHash = parent.Hash
+			b.Height = parent.Height + 1
+		}
+		b.Transactions = []*Transaction{testCoinbase(byte(b.Height), []byte(prefix))}
+		blocks = append(blocks, b)
+		parent = b
+	}
+	return blocks
+}
+
+func TestBlockHeader_HashMatchesProofOfWork(t *testing.T) {
+	b := testBlocks("main", nil, 1)[0]
+	b.TimeStamp = 1700000000
+	b.Nonce = 42
+	h := b.Header()
+	require.Equal(t, NewProofOfWork(b).HashWithNonce(b.Nonce), powHash(h.Version, h.PreBlockHash, h.MerkleRoot, h.TimeStamp, h.Nonce))
+	require.ErrorIs(t, CheckHeader(&h), ErrInvalidPoW)
+}
+
+func TestBlock_MerkleRootSurvivesSerialization(t *testing.T) {
+	address := string(wallet.NewWallet().GetAddress())
+	b := &Block{Version: BlockVersion, Hash: []byte("block"), PreBlockHash: []byte{},
+		Transactions: []*Transaction{NewCoinBaseTX(address, ""), NewCoinBaseTX(address, "data")}}
+	require.Equal(t, b.HashTransactions(), DeSerializeBlock(b.Serialize()).HashTransactions())
+}
+
+func TestBlock_LegacyVersionSurvivesSerialization(t *testing.T) {
+	t.Cleanup(SetTargetBits(4))
+	address := string(wallet.NewWallet().GetAddress())
+	// 与旧代码构造的交易相同：coinbase 的空字段和转账交易的 Payload 为空值，DID 交易没有输入输出
+	txs := []*Transaction{
+		NewCoinBaseTX(address, "data"),
+		{ID: []byte("transfer"), Vin: []TXInput{{[]byte("prev"), 0, []byte("sig"), []byte("pub")}},
+			Vout: []TXOutput{{5, []byte("hash")}}, Payload: []string{}},
+		{ID: []byte("did"), Payload: []string{"document"}},
+	}
+	legacy := &Block{TimeStamp: 1700000000, PreBlockHash: []byte{}, Transactions: txs}
+	legacy.Nonce, legacy.Hash = NewProofOfWork(legacy).Run()
+
+	// 旧版本以交易的 JSON 编码为叶子，并且工作量证明不包含版本
+	var data [][]byte
+	for _, tx := range txs {
+		data = append(data, tx.Serialize())
+	}
+	require.Equal(t, NewMerkleTree(data).RootNode.Data, legacy.HashTransactions())
+	require.NoError(t, CheckBlock(legacy))
+
+	decoded := DeSerializeBlock(legacy.Serialize())
+	require.Equal(t, legacy.HashTransactions(), decoded.HashTransactions())
+	require.NoError(t, CheckBlock(decoded))
+
+	proof, err := decoded.MerkleProof(1)
+	require.NoError(t, err)
+	require.True(t, VerifyMerkleProof(legacy.HashTransactions(), txs[1], proof))
+}
+
+func TestBlock_VersionIsCommittedByProofOfWork(t *testing.T) {
+	t.Cleanup(SetTargetBits(4))
+	address := string(wallet.NewWallet().GetAddress())
+	b := NewBlock([]*Transaction{NewCoinBaseTX(address, "")}, []byte{}, 0)
+	require.NoError(t, CheckBlock(b))
+
+	h := b.Header()
+	require.NoError(t, CheckHeader(&h))
+	h.Version = 0
+	require.ErrorIs(t, CheckHeader(&h), ErrInvalidPoW)
+	b.Version = 2
+	require.ErrorIs(t, CheckBlock(b), ErrInvalidPoW)
+}
+
+func TestBlockChain_LocatorAndHeaders(t *testing.T) {
+	main := testBlocks("main", nil, 30)
+	// 从高度 5 分叉的另一条链，比主链短
+	fork := testBlocks("fork", main[5], 3)
+	bc := newTestChain(t, append(append([]*Block{}, fork...), main...)...)
+
+	locator := bc.BlockLocator()
+	var heights []int
+	for _, hash := range locator {
+		b, err := bc.GetBlock(hash)
+		require.NoError(t, err)
+		heights = append(heights, b.Height)
+	}
+	require.Equal(t, []int{29, 28, 27, 26, 25, 24, 23, 22, 21, 20, 18, 14, 6, 0}, heights)
+
+	hash, ok := bc.BlockHashAt(12)
+	require.True(t, ok)
+	require.Equal(t, main[12].Hash, hash)
+	_, ok = bc.BlockHashAt(30)
+	require.False(t, ok)
+
+	// 对方只有前 13 个区块：只返回缺少的部分
+	headers := bc.LocateHeaders([][]byte{main[12].Hash, main[0].Hash}, nil, 2000)
+	require.Len(t, headers, 17)
+	require.Equal(t, main[13].Hash, headers[0].Hash)
+	require.Equal(t, main[29].Hash, headers[16].Hash)
+	require.Equal(t, main[13].HashTransactions(), headers[0].MerkleRoot)
+
+	// 对方在分叉上：分叉区块不在主链上，从分叉点之后开始
+	headers = bc.LocateHeaders([][]byte{fork[2].Hash, fork[0].Hash, main[5].Hash}, nil, 2000)
+	require.Equal(t, main[6].Hash, headers[0].Hash)
+
+	headers = bc.LocateHeaders([][]byte{main[12].Hash}, main[15].Hash, 2000)
+	require.Len(t, headers, 3)
+	headers = bc.LocateHeaders([][]byte{main[12].Hash}, nil, 5)
+	require.Len(t, headers, 5)
+
+	// 空的定位器从创世区块开始
+	headers = bc.LocateHeaders(nil, main[1].Hash, 2000)
+	require.Len(t, headers, 2)
+	require.Equal(t, main[0].Hash, headers[0].Hash)
+}
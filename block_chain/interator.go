@@ -8,15 +8,20 @@ type BlockChainIterator struct {
 	db          *bbolt.DB
 }
 
+// Next 返回当前区块并将迭代器移动到前一个区块。
+// 区块不在本地数据库中时返回 nil（例如由 UTXO 快照启动、历史区块尚未下载）。
 func (i *BlockChainIterator) Next() *Block {
 	var block *Block
 	err := i.db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		encodedBlock := b.Get(i.currentHash)
+		if encodedBlock == nil {
+			return nil
+		}
 		block = DeSerializeBlock(encodedBlock)
 		return nil
 	})
-	if err != nil {
+	if err != nil || block == nil {
 		return nil
 	}
 	i.currentHash = block.PreBlockHash
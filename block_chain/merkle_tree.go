@@ -1,6 +1,10 @@
 package chain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
 
 type MerkleTree struct {
 	RootNode *MerkleNode
@@ -12,20 +16,32 @@ type MerkleNode struct {
 	Data  []byte
 }
 
+// MerkleProof 证明一笔交易在区块中：Index 为交易在区块中的位置，
+// Hashes 为从叶子到根每一层的兄弟节点哈希。
+// 轻节点用它和区块头中的默克尔根验证交易。
+type MerkleProof struct {
+	Index  int
+	Hashes [][]byte
+}
+
 // NewMerkleTree creates a new Merkle Tree,自底向上
+// 每一层的节点数为奇数时复制最后一个节点，只有一个叶子时它与自身配对。
+// 旧版本只在叶子层补齐，1 到 4 个叶子时结果与现在相同，更多叶子时无法建树，因此已有的区块不受影响。
 func NewMerkleTree(data [][]byte) *MerkleTree {
-	var nodes []MerkleNode
-
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
+	if len(data) == 0 {
+		return &MerkleTree{NewMerkleNode(nil, nil, nil)}
 	}
+	var nodes []MerkleNode
 
 	for _, datum := range data {
 		node := NewMerkleNode(nil, nil, datum)
 		nodes = append(nodes, *node)
 	}
 
-	for i := 0; i < len(data)/2; i++ {
+	for {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
 		var newLevel []MerkleNode
 
 		for j := 0; j < len(nodes); j += 2 {
@@ -33,8 +49,10 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 			newLevel = append(newLevel, *node)
 		}
 		nodes = newLevel
+		if len(nodes) == 1 {
+			return &MerkleTree{&nodes[0]}
+		}
 	}
-	return &MerkleTree{&nodes[0]}
 }
 
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
@@ -52,3 +70,53 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	mNode.Right = right
 	return &mNode
 }
+
+// MerkleProof 返回区块中第 index 笔交易的默克尔证明
+func (b *Block) MerkleProof(index int) (MerkleProof, error) {
+	if index < 0 || index >= len(b.Transactions) {
+		return MerkleProof{}, errors.New("transaction index out of range")
+	}
+	var level [][]byte
+	for _, tx := range b.Transactions {
+		hash := sha256.Sum256(tx.merkleData())
+		level = append(level, hash[:])
+	}
+
+	proof := MerkleProof{Index: index}
+	for i := index; ; i /= 2 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+		proof.Hashes = append(proof.Hashes, level[i^1])
+
+		var next [][]byte
+		for j := 0; j < len(level); j += 2 {
+			hash := sha256.Sum256(append(append([]byte{}, level[j]...), level[j+1]...))
+			next = append(next, hash[:])
+		}
+		level = next
+		if len(level) == 1 {
+			return proof, nil
+		}
+	}
+}
+
+// VerifyMerkleProof 验证 tx 按 proof 可以算出默克尔根 root
+func VerifyMerkleProof(root []byte, tx *Transaction, proof MerkleProof) bool {
+	if proof.Index < 0 || len(proof.Hashes) == 0 {
+		return false
+	}
+	hash := sha256.Sum256(tx.merkleData())
+	current := hash[:]
+	index := proof.Index
+	for _, sibling := range proof.Hashes {
+		if index%2 == 0 {
+			hash = sha256.Sum256(append(append([]byte{}, current...), sibling...))
+		} else {
+			hash = sha256.Sum256(append(append([]byte{}, sibling...), current...))
+		}
+		current = hash[:]
+		index /= 2
+	}
+	return index == 0 && bytes.Equal(current, root)
+}
@@ -2,14 +2,23 @@ package chain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"math/big"
+	"sync/atomic"
 )
 
-const targetBits = 24
+// defaultTargetBits 为主网使用的难度
+const defaultTargetBits = 24
 const maxNonce = 100000000
 
+// cancelCheckInterval 为 RunContext 检查是否被取消的间隔（尝试的 nonce 数）
+const cancelCheckInterval = 1 << 12
+
+// targetBits 不为 0 时代替 defaultTargetBits，只用于测试和模拟网络
+var targetBits atomic.Int32
+
 // ProofOfWork 工作量证明
 type ProofOfWork struct {
 	block  *Block
@@ -18,7 +27,7 @@ type ProofOfWork struct {
 
 func NewProofOfWork(b *Block) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target.Lsh(target, uint(256-TargetBits()))
 
 	pow := &ProofOfWork{
 		block:  b,
@@ -28,17 +37,35 @@ func NewProofOfWork(b *Block) *ProofOfWork {
 }
 
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.block.PreBlockHash,
-			pow.block.HashTransactions(),
-			IntToHex(pow.block.TimeStamp),
-			IntToHex(int64(targetBits)),
-			IntToHex(int64(nonce)),
-		},
-		[]byte{},
-	)
-	return data
+	return powData(pow.block.Version, pow.block.PreBlockHash, pow.block.HashTransactions(), pow.block.TimeStamp, nonce)
+}
+
+// powData 返回工作量证明哈希的数据，区块和区块头使用相同的数据。
+// 版本 0 的区块保持旧的数据，版本 1 起在末尾加上版本号。
+func powData(version int, preBlockHash, merkleRoot []byte, timeStamp int64, nonce int) []byte {
+	parts := [][]byte{
+		preBlockHash,
+		merkleRoot,
+		IntToHex(timeStamp),
+		IntToHex(int64(TargetBits())),
+		IntToHex(int64(nonce)),
+	}
+	if version >= 1 {
+		parts = append(parts, IntToHex(int64(version)))
+	}
+	return bytes.Join(parts, []byte{})
+}
+
+func powHash(version int, preBlockHash, merkleRoot []byte, timeStamp int64, nonce int) []byte {
+	hash := sha256.Sum256(powData(version, preBlockHash, merkleRoot, timeStamp, nonce))
+	return hash[:]
+}
+
+// meetsTarget 判断哈希是否小于工作量证明的目标值
+func meetsTarget(hash []byte) bool {
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-TargetBits()))
+	return new(big.Int).SetBytes(hash).Cmp(target) == -1
 }
 
 func IntToHex(i int64) []byte {
@@ -52,11 +79,23 @@ func IntToHex(i int64) []byte {
 	return b
 }
 func (pow *ProofOfWork) Run() (int, []byte) {
+	nonce, hash, _ := pow.RunContext(context.Background())
+	return nonce, hash
+}
+
+// RunContext 与 Run 相同，但在 ctx 被取消时（例如链顶已经改变）放弃挖矿并返回 ctx.Err()
+func (pow *ProofOfWork) RunContext(ctx context.Context) (int, []byte, error) {
 	var hashInt big.Int
 	var hash [32]byte
 	nonce := 0
 	fmt.Printf("Mining a new block")
 	for nonce < maxNonce {
+		if nonce%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				fmt.Println()
+				return 0, nil, err
+			}
+		}
 		data := pow.prepareData(nonce)
 		hash = sha256.Sum256(data)
 		hashInt.SetBytes(hash[:])
@@ -69,14 +108,43 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 		}
 	}
 	fmt.Println()
-	return nonce, hash[:]
+	return nonce, hash[:], nil
 }
 
 func (pow *ProofOfWork) Validate() bool {
 	var hashInt big.Int
-	data := pow.prepareData(pow.block.Nonce)
-	hash := sha256.Sum256(data)
-	hashInt.SetBytes(hash[:])
+	hashInt.SetBytes(pow.HashWithNonce(pow.block.Nonce))
 
 	return hashInt.Cmp(pow.target) == -1
 }
+
+// HashWithNonce 返回区块使用 nonce 时的哈希。被哈希的数据依次为
+// PreBlockHash、交易默克尔根、IntToHex(TimeStamp)、IntToHex(TargetBits())、IntToHex(nonce)，
+// 版本 1 起再加上 IntToHex(Version)。
+func (pow *ProofOfWork) HashWithNonce(nonce int) []byte {
+	hash := sha256.Sum256(pow.prepareData(nonce))
+	return hash[:]
+}
+
+// Target 返回区块哈希必须小于的目标值
+func (pow *ProofOfWork) Target() *big.Int {
+	return new(big.Int).Set(pow.target)
+}
+
+// TargetBits 返回工作量证明的难度：区块哈希的前 TargetBits 位必须为 0
+func TargetBits() int {
+	if bits := targetBits.Load(); bits != 0 {
+		return int(bits)
+	}
+	return defaultTargetBits
+}
+
+// SetTargetBits 修改进程内所有链使用的难度，返回恢复原难度的函数。
+// 难度不同的节点无法验证彼此的区块，只应在测试和模拟网络中使用。
+func SetTargetBits(bits int) (restore func()) {
+	if bits <= 0 || bits >= 256 {
+		panic(fmt.Sprintf("invalid target bits %d", bits))
+	}
+	previous := targetBits.Swap(int32(bits))
+	return func() { targetBits.Store(previous) }
+}
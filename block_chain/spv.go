@@ -0,0 +1,103 @@
+package chain
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nuts-foundation/go-did/did"
+	chain_did "github.com/qujing226/blockchain/did"
+	"github.com/qujing226/blockchain/wallet"
+)
+
+// SPVTransaction 为轻节点收到的、已经用默克尔证明确认在区块中的交易
+type SPVTransaction struct {
+	Tx        *Transaction
+	BlockHash []byte
+	Height    int
+}
+
+// FilterElements 返回轻节点过滤器用来匹配交易的数据：交易 ID、每个输出的公钥哈希、
+// 每个输入的公钥哈希（用于发现花费），以及交易中 DID 文档的 DID
+func (tx *Transaction) FilterElements() [][]byte {
+	elements := [][]byte{tx.ID}
+	for _, out := range tx.Vout {
+		elements = append(elements, out.PubKeyHash)
+	}
+	if !tx.IsCoinbase() {
+		for _, vin := range tx.Vin {
+			elements = append(elements, wallet.HashPubKey(vin.PubKey))
+		}
+	}
+	for _, data := range tx.Payload {
+		if !strings.HasPrefix(strings.TrimSpace(data), "{") {
+			continue
+		}
+		if doc, err := chain_did.DeserializeDidDocument([]byte(data)); err == nil {
+			elements = append(elements, []byte(doc.ID.String()))
+		}
+	}
+	return elements
+}
+
+// didDocumentIn 返回 tx 中包含 targetDID 的 DID 文档，没有时返回 nil
+func didDocumentIn(tx *Transaction, targetDID string) (*did.Document, bool) {
+	if tx.IsCoinbase() {
+		return nil, false
+	}
+	for _, data := range tx.Payload {
+		if strings.Contains(data, targetDID) {
+			doc, err := chain_did.DeserializeDidDocument([]byte(data))
+			return doc, err == nil
+		}
+	}
+	return nil, false
+}
+
+// FindDidDocumentInTransactions 在轻节点收到的交易中查找 targetDID 最新的 DID 文档
+func FindDidDocumentInTransactions(txs []SPVTransaction, targetDID string) *did.Document {
+	var found *did.Document
+	height := -1
+	for _, stx := range txs {
+		if doc, ok := didDocumentIn(stx.Tx, targetDID); ok && stx.Height >= height {
+			found, height = doc, stx.Height
+		}
+	}
+	return found
+}
+
+// SPVBalance 根据轻节点收到的交易统计 pubKeyHash 的余额：txs 必须包含所有支付给它以及花费它的交易，
+// tipHeight 为本地区块头链的高度，minConf 的含义与 UTXOSet.Balance 相同
+func SPVBalance(txs []SPVTransaction, pubKeyHash []byte, tipHeight, minConf int) Balance {
+	spent := make(map[string]bool)
+	for _, stx := range txs {
+		if stx.Tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range stx.Tx.Vin {
+			spent[outpointKey(vin.Txid, vin.Vout)] = true
+		}
+	}
+
+	var balance Balance
+	for _, stx := range txs {
+		confirmations := Confirmations(stx.Height, tipHeight)
+		for i, out := range stx.Tx.Vout {
+			if !out.IsLockedWithKey(pubKeyHash) || spent[outpointKey(stx.Tx.ID, i)] {
+				continue
+			}
+			switch {
+			case stx.Tx.IsCoinbase() && confirmations < CoinbaseMaturity:
+				balance.Immature += out.Value
+			case confirmations < minConf:
+				balance.Unconfirmed += out.Value
+			default:
+				balance.Confirmed += out.Value
+			}
+		}
+	}
+	return balance
+}
+
+func outpointKey(txid []byte, index int) string {
+	return fmt.Sprintf("%x:%d", txid, index)
+}
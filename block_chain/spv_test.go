@@ -0,0 +1,77 @@
+package chain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlock_MerkleProofsMatchRoot(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		b := &Block{Version: BlockVersion}
+		for i := 0; i < count; i++ {
+			b.Transactions = append(b.Transactions, testCoinbase(byte(i), []byte("pubkey-hash")))
+		}
+		root := b.HashTransactions()
+		for i, tx := range b.Transactions {
+			proof, err := b.MerkleProof(i)
+			require.NoError(t, err)
+			require.True(t, VerifyMerkleProof(root, tx, proof), "transaction %d of %d", i, count)
+
+			// 证明只对原来的位置和交易有效
+			other := b.Transactions[(i+1)%count]
+			if count > 1 && proof.Index != count-1 {
+				require.False(t, VerifyMerkleProof(root, other, proof))
+			}
+			proof.Index += 1 << len(proof.Hashes)
+			require.False(t, VerifyMerkleProof(root, tx, proof))
+		}
+		_, err := b.MerkleProof(count)
+		require.Error(t, err)
+	}
+}
+
+func TestHeaderChain_StartsAtGenesisAndChecksHeaders(t *testing.T) {
+	hc, err := OpenHeaderChain(filepath.Join(t.TempDir(), "headers.db"))
+	require.NoError(t, err)
+	defer hc.Close()
+	require.Equal(t, -1, hc.Height())
+	require.Nil(t, hc.BlockLocator())
+
+	blocks := testBlocks("main", nil, 2)
+	_, err = hc.AddHeaders([]BlockHeader{blocks[1].Header()})
+	require.ErrorIs(t, err, ErrOrphanBlock, "the first header must be the genesis block")
+
+	added, err := hc.AddHeaders([]BlockHeader{blocks[0].Header()})
+	require.NoError(t, err)
+	require.Equal(t, 1, added)
+	require.Equal(t, blocks[0].Hash, hc.GenesisHash())
+	require.Equal(t, [][]byte{blocks[0].Hash}, hc.BlockLocator())
+
+	// 创世区块之后的区块头必须满足工作量证明
+	_, err = hc.AddHeaders([]BlockHeader{blocks[1].Header()})
+	require.ErrorIs(t, err, ErrInvalidPoW)
+	require.Equal(t, 0, hc.Height())
+}
+
+func TestSPVBalance_CountsUnspentOutputs(t *testing.T) {
+	alice := []byte("alice-pubkey-hash-01")
+	bob := []byte("bob-pubkey-hash-0002")
+	old := testCoinbase(1, alice)
+	fresh := testCoinbase(2, alice)
+	spend := &Transaction{
+		ID:   []byte{3},
+		Vin:  []TXInput{{Txid: old.ID, Vout: 0}},
+		Vout: []TXOutput{{Value: 15, PubKeyHash: bob}, {Value: 5, PubKeyHash: alice}},
+	}
+	txs := []SPVTransaction{
+		{Tx: old, Height: 0},
+		{Tx: spend, Height: 21},
+		{Tx: fresh, Height: 25},
+	}
+
+	balance := SPVBalance(txs, alice, 25, 6)
+	require.Equal(t, Balance{Unconfirmed: 5, Immature: 20}, balance)
+	require.Equal(t, Balance{Confirmed: 15}, SPVBalance(txs, bob, 26, 6))
+}
@@ -45,6 +45,20 @@ func (o *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 
 type TXOutputs struct {
 	Outputs []TXOutput
+	// Indexes 记录 Outputs 中每个输出在原交易 Vout 中的下标。
+	// 部分输出被花费后 Outputs 会被压缩，下标不再与位置一致；旧数据中该字段为空，此时按位置计算。
+	Indexes []int
+	// Height 为包含该交易的区块高度，Coinbase 标记该交易是否为 coinbase，用于计算确认数和成熟度
+	Height   int
+	Coinbase bool
+}
+
+// OutputIndex 返回 Outputs[i] 在原交易中的输出下标
+func (outs TXOutputs) OutputIndex(i int) int {
+	if i < len(outs.Indexes) {
+		return outs.Indexes[i]
+	}
+	return i
 }
 
 // Serialize serializes TXOutputs
@@ -95,42 +109,49 @@ type Transaction struct {
 
 // NewUTXOTransaction 创建一个 unspent transaction output 交易
 func NewUTXOTransaction(w *wallet.Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+	tx, err := NewUTXOTransactionWithSelector(w, to, amount, UTXOSet, LargestFirst{}, CoinSelectionParams{})
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+	return tx
+}
+
+// NewUTXOTransactionWithSelector 使用 selector 选择输入来创建交易。
+// params.Target 会被设置为 amount；手续费为输入总额与输出总额之差，低于粉尘阈值的找零不会生成输出。
+func NewUTXOTransactionWithSelector(w *wallet.Wallet, to string, amount int, UTXOSet *UTXOSet,
+	selector CoinSelector, params CoinSelectionParams) (*Transaction, error) {
 	var inputs []TXInput
 	var outputs []TXOutput
 
 	pubKeyHash := wallet.HashPubKey(w.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutPuts(pubKeyHash, amount)
-	if acc < amount {
-		fmt.Println("ERROR: Not enough funds")
-		os.Exit(1)
+	params.Target = amount
+	selection, err := selector.Select(UTXOSet.ListSpendable(pubKeyHash), params)
+	if err != nil {
+		return nil, err
 	}
 	// Build a list of inouts
-	for txid, outs := range validOutputs {
-		txID, err := hex.DecodeString(txid)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		for _, out := range outs {
-			input := TXInput{txID, out, nil, nil}
-			inputs = append(inputs, input)
-		}
+	for _, utxo := range selection.Inputs {
+		inputs = append(inputs, TXInput{utxo.Txid, utxo.Index, nil, nil})
 	}
 
 	// Build a list of outputs
 	from := fmt.Sprintf("%s", w.GetAddress())
 	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
+	if selection.Change > 0 {
 		// a change
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+		outputs = append(outputs, *NewTXOutput(selection.Change, from))
 	}
 	tx := &Transaction{nil, inputs, outputs, time.Now().UnixMilli(), []string{}}
 	tx.ID = tx.Hash()
 
 	UTXOSet.Blockchain.SignTransaction(tx, w.PrivateKey)
-	return tx
+	return tx, nil
 }
 
+// subsidy 为每个区块的出块奖励
+const subsidy = 20
+
 // NewCoinBaseTX 创建一个 coinbase 交易
 // coinbase 交易的输入和输出都是由系统自动生成的，不需要用户参与，因此 coinbase 交易没有输入和输出。
 // coinbase 交易的 Vin 数组长度为 1，并且第一个输入的 Txid 为空字节，Vout 为 -1。
@@ -144,8 +165,9 @@ func NewCoinBaseTX(to, data string) *Transaction {
 
 		data = fmt.Sprintf("%x", randData)
 	}
-	txin := TXInput{[]byte{}, -1, []byte{}, []byte{}}
-	txout := NewTXOutput(20, to)
+	// data 同时写入输入的签名字段：Payload 不参与交易哈希，否则支付给同一地址的 coinbase 交易 ID 会相同
+	txin := TXInput{[]byte{}, -1, []byte(data), []byte{}}
+	txout := NewTXOutput(subsidy, to)
 	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}, time.Now().UnixMilli(), []string{data}}
 	tx.ID = tx.Hash()
 	return &tx
@@ -297,6 +319,37 @@ func (tx *Transaction) Serialize() []byte {
 	return buf
 }
 
+// merkleData 返回交易在区块默克尔树中的数据。区块用 gob 编码保存和传输，gob 不区分空切片和 nil，
+// 而交易的 JSON 编码区分两者（"" 与 null），因此先把为 nil 的字节字段和 Payload 换成空值，
+// 使区块解码前后的默克尔根相同。旧版本直接以 JSON 编码为叶子，而旧代码构造的交易中
+// 这些字段为空时都是空值而不是 nil，所以已有区块的默克尔根不变。
+func (tx *Transaction) merkleData() []byte {
+	orEmpty := func(b []byte) []byte {
+		if b == nil {
+			return []byte{}
+		}
+		return b
+	}
+	txCopy := *tx
+	txCopy.ID = orEmpty(tx.ID)
+	if txCopy.Payload == nil {
+		txCopy.Payload = []string{}
+	}
+	if tx.Vin != nil {
+		txCopy.Vin = make([]TXInput, len(tx.Vin))
+		for i, vin := range tx.Vin {
+			txCopy.Vin[i] = TXInput{orEmpty(vin.Txid), vin.Vout, orEmpty(vin.Signature), orEmpty(vin.PubKey)}
+		}
+	}
+	if tx.Vout != nil {
+		txCopy.Vout = make([]TXOutput, len(tx.Vout))
+		for i, vout := range tx.Vout {
+			txCopy.Vout[i] = TXOutput{vout.Value, orEmpty(vout.PubKeyHash)}
+		}
+	}
+	return txCopy.Serialize()
+}
+
 func (tx *Transaction) SerializeV1() []byte {
 	var encoded bytes.Buffer
 
@@ -311,9 +364,7 @@ func (tx *Transaction) SerializeV1() []byte {
 
 // DeserializeTransaction deserializes a transaction
 func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
-
-	err := json.Unmarshal(data, &transaction)
+	transaction, err := DecodeTransaction(data)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -321,6 +372,14 @@ func DeserializeTransaction(data []byte) Transaction {
 	return transaction
 }
 
+// DecodeTransaction 与 DeserializeTransaction 相同，但在数据无效时返回错误，用于解码来自网络的数据
+func DecodeTransaction(data []byte) (Transaction, error) {
+	var transaction Transaction
+
+	err := json.Unmarshal(data, &transaction)
+	return transaction, err
+}
+
 func DeserializeTransactionV1(data []byte) Transaction {
 	var transaction Transaction
 
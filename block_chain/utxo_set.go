@@ -27,10 +27,10 @@ func (u *UTXOSet) FindSpendableOutPuts(pubkeyHash []byte, amount int) (int, map[
 			txID := hex.EncodeToString(k)
 			outs := DeserializeOutputs(v)
 
-			for outIdx, out := range outs.Outputs {
+			for i, out := range outs.Outputs {
 				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
 					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+					unspentOutputs[txID] = append(unspentOutputs[txID], outs.OutputIndex(i))
 				}
 			}
 		}
@@ -43,6 +43,38 @@ func (u *UTXOSet) FindSpendableOutPuts(pubkeyHash []byte, amount int) (int, map[
 	return accumulated, unspentOutputs
 }
 
+// ListSpendable 返回 pubkeyHash 可以在下一个区块中花费的全部输出，供 CoinSelector 选择。尚未成熟的 coinbase 输出不会被返回。
+func (u *UTXOSet) ListSpendable(pubkeyHash []byte) []SpendableOutput {
+	var spendable []SpendableOutput
+	db := u.Blockchain.Db
+	spendHeight := u.Blockchain.GetBestHeight() + 1
+
+	err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+			if !Mature(outs.Coinbase, outs.Height, spendHeight) {
+				continue
+			}
+
+			for i, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubkeyHash) {
+					txid := append([]byte(nil), k...)
+					spendable = append(spendable, SpendableOutput{txid, outs.OutputIndex(i), out.Value})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return spendable
+}
+
 func (u *UTXOSet) FindUTXO(pubkeyHash []byte) []TXOutput {
 	UTXO := make([]TXOutput, 0)
 	db := u.Blockchain.Db
@@ -67,6 +99,57 @@ func (u *UTXOSet) FindUTXO(pubkeyHash []byte) []TXOutput {
 	return UTXO
 }
 
+// FindOutput 返回 txid 交易中下标为 index 的未花费输出
+func (u *UTXOSet) FindOutput(txid []byte, index int) (TXOutput, bool) {
+	coin, found := u.FindCoin(txid, index)
+	return coin.Output, found
+}
+
+// FindCoin 返回 txid 交易中下标为 index 的未花费输出以及该交易的高度和类型
+func (u *UTXOSet) FindCoin(txid []byte, index int) (Coin, bool) {
+	var coin Coin
+	found := false
+
+	err := u.Blockchain.Db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		if b == nil {
+			return nil
+		}
+		outsBytes := b.Get(txid)
+		if outsBytes == nil {
+			return nil
+		}
+		outs := DeserializeOutputs(outsBytes)
+		for i, out := range outs.Outputs {
+			if outs.OutputIndex(i) == index {
+				coin = Coin{Output: out, Height: outs.Height, Coinbase: outs.Coinbase}
+				found = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return coin, found
+}
+
+// HasTransaction 判断 UTXO 集合中是否有 txid 的记录（即该交易已上链且仍有未花费输出）
+func (u *UTXOSet) HasTransaction(txid []byte) bool {
+	found := false
+
+	err := u.Blockchain.Db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		found = b != nil && b.Get(txid) != nil
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return found
+}
+
 // CountTransactions returns the number of transactions in the UTXO set
 func (u *UTXOSet) CountTransactions() int {
 	db := u.Blockchain.Db
@@ -88,120 +171,108 @@ func (u *UTXOSet) CountTransactions() int {
 }
 
 // Reindex rebuilds the UTXO set
+// 新的集合在一个事务中替换旧集合，重建过程中进程退出时旧集合保持不变
 func (u *UTXOSet) Reindex() {
 	db := u.Blockchain.Db
-	bucketName := []byte(utxoBucket)
+	UTXO := u.Blockchain.FindUTXO()
 
 	err := db.Update(func(tx *bbolt.Tx) error {
-		err := tx.DeleteBucket(bucketName)
-		if err != nil {
-			if !errors.Is(err, bbolt.ErrBucketNotFound) {
-				return err
-			}
-		}
-		_, err = tx.CreateBucket(bucketName)
-		if err != nil {
-			return err
-		}
-		return err
+		return putUTXO(tx, UTXO)
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+}
 
-	UTXO := u.Blockchain.FindUTXO()
-
-	err = db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket(bucketName)
+// putUTXO 在事务 tx 中用 UTXO（十六进制交易 ID -> 未花费输出）替换整个 UTXO 集合
+func putUTXO(tx *bbolt.Tx, UTXO map[string]TXOutputs) error {
+	bucketName := []byte(utxoBucket)
+	err := tx.DeleteBucket(bucketName)
+	if err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+		return err
+	}
+	b, err := tx.CreateBucket(bucketName)
+	if err != nil {
+		return err
+	}
 
-		for txId, outs := range UTXO {
-			key, err := hex.DecodeString(txId)
-			if err != nil {
-				log.Panic(err)
-			}
-			err = b.Put(key, outs.Serialize())
-			if err != nil {
-				log.Panic(err)
-			}
+	for txId, outs := range UTXO {
+		key, err := hex.DecodeString(txId)
+		if err != nil {
+			return err
 		}
-
-		return nil
-	})
+		if err = b.Put(key, outs.Serialize()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Update updates the UTXO set with transactions from the Block
 // is considered to be the tip of a blockchain
+// 区块接到链顶时 UTXO 集合已在同一事务中更新，Update 只用于在链之外修改 UTXO 集合
 func (u *UTXOSet) Update(block *Block) {
 	db := u.Blockchain.Db
 
 	err := db.Update(func(tx *bbolt.Tx) error {
-		// 获取 utxoBucket
-		b := tx.Bucket([]byte(utxoBucket))
-		if b == nil {
-			//return fmt.Errorf("bucket %s not found", utxoBucket)
-		}
+		return updateUTXO(tx, block)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
 
-		// 遍历当前区块中的每一笔交易
-		for _, tx := range block.Transactions {
-			// 如果不是 coinbase 交易：
-			if !tx.IsCoinbase() {
-				// 遍历该交易中的每个 vin（输入）
-				for _, vin := range tx.Vin {
-					//fmt.Printf("Processing vin with Txid: %x, Vout: %d\n", vin.Txid, vin.Vout)
-
-					updatedOuts := TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					if outsBytes == nil {
-						//fmt.Printf("No UTXO found for Txid: %x\n", vin.Txid)
-						continue
-					}
-					outs := DeserializeOutputs(outsBytes)
-					//fmt.Printf("Original outputs for Txid %x: %+v\n", vin.Txid, outs)
-
-					// 剔除已经被引用的输出
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						} else {
-							//fmt.Printf("Spending output index %d from Txid: %x\n", outIdx, vin.Txid)
-						}
-					}
+// updateUTXO 在事务 tx 中删除 block 中交易花费的输出并加入它们的新输出
+func updateUTXO(tx *bbolt.Tx, block *Block) error {
+	// 获取 utxoBucket
+	b, err := tx.CreateBucketIfNotExists([]byte(utxoBucket))
+	if err != nil {
+		return err
+	}
 
-					if len(updatedOuts.Outputs) == 0 {
-						// 如果 <txid> 下所有输出都已被花费，则删除该键
-						err := b.Delete(vin.Txid)
-						if err != nil {
-							log.Panic(err)
-						}
-						//fmt.Printf("Deleted UTXO entry for Txid: %x\n", vin.Txid)
-					} else {
-						// 否则，更新该键对应的 value
-						err := b.Put(vin.Txid, updatedOuts.Serialize())
-						if err != nil {
-							log.Panic(err)
-						}
-						//fmt.Printf("Updated UTXO entry for Txid: %x, new outputs: %+v\n", vin.Txid, updatedOuts)
+	// 遍历当前区块中的每一笔交易
+	for _, tx := range block.Transactions {
+		// 如果不是 coinbase 交易：
+		if !tx.IsCoinbase() {
+			// 遍历该交易中的每个 vin（输入）
+			for _, vin := range tx.Vin {
+				outsBytes := b.Get(vin.Txid)
+				if outsBytes == nil {
+					continue
+				}
+				outs := DeserializeOutputs(outsBytes)
+				updatedOuts := TXOutputs{Height: outs.Height, Coinbase: outs.Coinbase}
+
+				// 剔除已经被引用的输出
+				for i, out := range outs.Outputs {
+					if outs.OutputIndex(i) != vin.Vout {
+						updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+						updatedOuts.Indexes = append(updatedOuts.Indexes, outs.OutputIndex(i))
 					}
-					//fmt.Println("-----")
 				}
-			}
 
-			// 将当前交易的输出写入数据库：无论是否 coinbase
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
-			}
-			err := b.Put(tx.ID, newOutputs.Serialize())
-			if err != nil {
-				log.Panic(err)
+				if len(updatedOuts.Outputs) == 0 {
+					// 如果 <txid> 下所有输出都已被花费，则删除该键
+					err = b.Delete(vin.Txid)
+				} else {
+					// 否则，更新该键对应的 value
+					err = b.Put(vin.Txid, updatedOuts.Serialize())
+				}
+				if err != nil {
+					return err
+				}
 			}
-			//fmt.Printf("Added new UTXO for transaction %x: %+v\n", tx.ID, newOutputs)
-			//fmt.Println("===========")
 		}
 
-		return nil
-	})
-	if err != nil {
-		log.Panic(err)
+		// 将当前交易的输出写入数据库：无论是否 coinbase
+		newOutputs := TXOutputs{Height: block.Height, Coinbase: tx.IsCoinbase()}
+		for outIdx, out := range tx.Vout {
+			newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
+		}
+		if err = b.Put(tx.ID, newOutputs.Serialize()); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,434 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"hash"
+	"log"
+	"os"
+	"sort"
+)
+
+const snapshotBucket = "snapshot"
+const snapshotStateBucket = "snapshotState"
+
+var (
+	// ErrHistoryIncomplete 表示快照基块之前的历史区块尚未全部下载
+	ErrHistoryIncomplete = errors.New("snapshot history is incomplete")
+	// ErrSnapshotMismatch 表示根据历史区块重建的 UTXO 集合与快照承诺不一致
+	ErrSnapshotMismatch = errors.New("utxo snapshot commitment mismatch")
+	// ErrSnapshotUntrusted 表示快照的承诺哈希不是操作者指定的哈希
+	ErrSnapshotUntrusted = errors.New("utxo snapshot hash does not match the expected hash")
+)
+
+// UTXOSetInfo 汇总链顶处 UTXO 集合的统计信息以及承诺哈希
+type UTXOSetInfo struct {
+	Height       int
+	BestBlock    []byte
+	Transactions int
+	Outputs      int
+	TotalAmount  int
+	Hash         []byte
+}
+
+// utxoCommitment 计算 UTXO 集合的承诺哈希。
+// 条目必须按交易 ID 升序写入（bbolt 游标天然有序），每个输出编码为
+// txid || index || height || coinbase || value || len(pubKeyHash) || pubKeyHash 后依次送入 SHA-256。
+type utxoCommitment struct {
+	h hash.Hash
+}
+
+func newUTXOCommitment() *utxoCommitment {
+	return &utxoCommitment{h: sha256.New()}
+}
+
+func (c *utxoCommitment) add(txid []byte, outs TXOutputs) {
+	var buf [8]byte
+	for i, out := range outs.Outputs {
+		c.h.Write(txid)
+		binary.BigEndian.PutUint32(buf[:4], uint32(outs.OutputIndex(i)))
+		c.h.Write(buf[:4])
+		binary.BigEndian.PutUint32(buf[:4], uint32(outs.Height))
+		c.h.Write(buf[:4])
+		if outs.Coinbase {
+			c.h.Write([]byte{1})
+		} else {
+			c.h.Write([]byte{0})
+		}
+		binary.BigEndian.PutUint64(buf[:], uint64(out.Value))
+		c.h.Write(buf[:])
+		binary.BigEndian.PutUint32(buf[:4], uint32(len(out.PubKeyHash)))
+		c.h.Write(buf[:4])
+		c.h.Write(out.PubKeyHash)
+	}
+}
+
+func (c *utxoCommitment) sum() []byte {
+	return c.h.Sum(nil)
+}
+
+// Info 统计 chainState 中的交易数、输出数、总金额，并计算承诺哈希
+func (u *UTXOSet) Info() UTXOSetInfo {
+	var info UTXOSetInfo
+	commitment := newUTXOCommitment()
+
+	err := u.Blockchain.Db.View(func(tx *bbolt.Tx) error {
+		blocks := tx.Bucket([]byte(blocksBucket))
+		info.BestBlock = blocks.Get([]byte("l"))
+		info.Height = DeSerializeBlock(blocks.Get(info.BestBlock)).Height
+
+		b := tx.Bucket([]byte(utxoBucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+			if len(outs.Outputs) == 0 {
+				continue
+			}
+			info.Transactions++
+			for _, out := range outs.Outputs {
+				info.Outputs++
+				info.TotalAmount += out.Value
+			}
+			commitment.add(k, outs)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	info.Hash = commitment.sum()
+	return info
+}
+
+// SnapshotEntry 是快照中的一条 UTXO 记录
+type SnapshotEntry struct {
+	Txid    []byte
+	Outputs TXOutputs
+}
+
+// UTXOSnapshot 是某一高度处完整的 UTXO 集合。
+// 新节点加载快照后即可从该高度开始验证新区块，历史区块可以之后在后台下载并校验。
+type UTXOSnapshot struct {
+	Height    int
+	BlockHash []byte
+	// Block 为快照基块的序列化数据，新节点以它作为链顶
+	Block   []byte
+	Entries []SnapshotEntry
+	Hash    []byte
+}
+
+// Commitment 根据快照条目重新计算承诺哈希
+func (s *UTXOSnapshot) Commitment() []byte {
+	commitment := newUTXOCommitment()
+	for _, entry := range s.Entries {
+		if len(entry.Outputs.Outputs) == 0 {
+			continue
+		}
+		commitment.add(entry.Txid, entry.Outputs)
+	}
+	return commitment.sum()
+}
+
+// SaveToFile 将快照写入文件
+func (s *UTXOSnapshot) SaveToFile(path string) error {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(s); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buff.Bytes(), 0644)
+}
+
+// check 校验快照条目与承诺哈希一致，且承诺哈希等于操作者从可信来源得到的 expected。
+// 快照自带的哈希只能发现损坏，不能说明快照可信，因此 expected 不能为空。
+func (s *UTXOSnapshot) check(expected []byte) error {
+	if len(expected) == 0 {
+		return errors.New("expected utxo snapshot hash is required")
+	}
+	if !bytes.Equal(s.Commitment(), s.Hash) {
+		return ErrSnapshotMismatch
+	}
+	if !bytes.Equal(s.Hash, expected) {
+		return ErrSnapshotUntrusted
+	}
+	return nil
+}
+
+// LoadUTXOSnapshotFile 从文件读取快照，校验其承诺哈希为 expected
+func LoadUTXOSnapshotFile(path string, expected []byte) (*UTXOSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s UTXOSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return nil, err
+	}
+	if err := s.check(expected); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// DumpUTXOSnapshot 导出 height 高度处的 UTXO 快照
+func (bc *BlockChain) DumpUTXOSnapshot(height int) (*UTXOSnapshot, error) {
+	block, err := bc.blockAtHeight(height)
+	if err != nil {
+		return nil, err
+	}
+
+	UTXO := bc.findUTXOFrom(block.Hash, true)
+	txIDs := make([]string, 0, len(UTXO))
+	for txID := range UTXO {
+		txIDs = append(txIDs, txID)
+	}
+	sort.Strings(txIDs)
+
+	snapshot := &UTXOSnapshot{
+		Height:    block.Height,
+		BlockHash: block.Hash,
+		Block:     block.Serialize(),
+	}
+	for _, txID := range txIDs {
+		key, err := hex.DecodeString(txID)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Entries = append(snapshot.Entries, SnapshotEntry{key, UTXO[txID]})
+	}
+	snapshot.Hash = snapshot.Commitment()
+
+	return snapshot, nil
+}
+
+// blockAtHeight 从链顶向前查找指定高度的区块
+func (bc *BlockChain) blockAtHeight(height int) (*Block, error) {
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		if block == nil {
+			break
+		}
+		if block.Height == height {
+			return block, nil
+		}
+		if block.Height < height || len(block.PreBlockHash) == 0 {
+			break
+		}
+	}
+	return nil, fmt.Errorf("block at height %d not found", height)
+}
+
+// CreateBlockchainFromSnapshot 用快照初始化一个新节点的区块链。
+// 快照的承诺哈希必须为 expected。快照基块成为链顶，UTXO 集合直接取自快照；基块之前的历史区块此时并不存在。
+func CreateBlockchainFromSnapshot(snapshot *UTXOSnapshot, expected []byte, nodeID string) (*BlockChain, error) {
+	dbFile := fmt.Sprintf(dbFile, nodeID)
+	if dbExists(dbFile) {
+		return nil, errors.New("blockchain already exists")
+	}
+	if err := snapshot.check(expected); err != nil {
+		return nil, err
+	}
+	base := DeSerializeBlock(snapshot.Block)
+	if !bytes.Equal(base.Hash, snapshot.BlockHash) || base.Height != snapshot.Height {
+		return nil, errors.New("snapshot base block does not match snapshot header")
+	}
+	if !NewProofOfWork(base).Validate() {
+		return nil, errors.New("snapshot base block has invalid proof of work")
+	}
+
+	db, err := bbolt.Open(dbFile, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		blocks, err := tx.CreateBucket([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+		if err = blocks.Put(base.Hash, snapshot.Block); err != nil {
+			return err
+		}
+		if err = blocks.Put([]byte("l"), base.Hash); err != nil {
+			return err
+		}
+		if err = setMainChain(tx, base); err != nil {
+			return err
+		}
+
+		utxo, err := tx.CreateBucket([]byte(utxoBucket))
+		if err != nil {
+			return err
+		}
+		state, err := tx.CreateBucket([]byte(snapshotStateBucket))
+		if err != nil {
+			return err
+		}
+		for _, entry := range snapshot.Entries {
+			if err = utxo.Put(entry.Txid, entry.Outputs.Serialize()); err != nil {
+				return err
+			}
+			if err = state.Put(entry.Txid, entry.Outputs.Serialize()); err != nil {
+				return err
+			}
+		}
+
+		return putSnapshotBase(tx, &SnapshotBase{
+			Height:     snapshot.Height,
+			Hash:       snapshot.BlockHash,
+			Commitment: snapshot.Hash,
+		})
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &BlockChain{tip: base.Hash, Db: db}, nil
+}
+
+// SnapshotBase 记录由快照启动的链的基块信息
+type SnapshotBase struct {
+	Height     int
+	Hash       []byte
+	Commitment []byte
+	// Verified 表示历史区块已下载并重建出了与快照一致的 UTXO 集合
+	Verified bool
+}
+
+// SnapshotBase 返回链的快照基块信息；链不是由快照启动时返回 false
+func (bc *BlockChain) SnapshotBase() (*SnapshotBase, bool) {
+	var base *SnapshotBase
+
+	err := bc.Db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(snapshotBucket))
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte("base"))
+		if data == nil {
+			return nil
+		}
+		base = &SnapshotBase{}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(base)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return base, base != nil
+}
+
+func putSnapshotBase(tx *bbolt.Tx, base *SnapshotBase) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(snapshotBucket))
+	if err != nil {
+		return err
+	}
+	var buff bytes.Buffer
+	if err = gob.NewEncoder(&buff).Encode(base); err != nil {
+		return err
+	}
+	return b.Put([]byte("base"), buff.Bytes())
+}
+
+// addSnapshotOutputs 将快照中的 UTXO（排除 spentTXOs 中已被后续区块花费的输出）并入 UTXO
+func (bc *BlockChain) addSnapshotOutputs(UTXO map[string]TXOutputs, spentTXOs map[string][]int) {
+	err := bc.Db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(snapshotStateBucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			txID := hex.EncodeToString(k)
+			outs := DeserializeOutputs(v)
+
+		Outputs:
+			for i, out := range outs.Outputs {
+				outIdx := outs.OutputIndex(i)
+				for _, spentOutIdx := range spentTXOs[txID] {
+					if spentOutIdx == outIdx {
+						continue Outputs
+					}
+				}
+				unspent := UTXO[txID]
+				unspent.Outputs = append(unspent.Outputs, out)
+				unspent.Indexes = append(unspent.Indexes, outIdx)
+				unspent.Height = outs.Height
+				unspent.Coinbase = outs.Coinbase
+				UTXO[txID] = unspent
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// VerifySnapshotHistory 在历史区块下载完成后，从创世块重放到快照基块并核对承诺哈希。
+// 历史不完整时返回 ErrHistoryIncomplete；核对通过后快照被标记为已验证，快照状态随之删除。
+func (bc *BlockChain) VerifySnapshotHistory() error {
+	base, ok := bc.SnapshotBase()
+	if !ok || base.Verified {
+		return nil
+	}
+
+	// 确认基块之前的每一个区块都已在本地
+	bci := &BlockChainIterator{currentHash: base.Hash, db: bc.Db}
+	for {
+		block := bci.Next()
+		if block == nil {
+			return ErrHistoryIncomplete
+		}
+		if len(block.PreBlockHash) == 0 {
+			break
+		}
+	}
+
+	UTXO := bc.findUTXOFrom(base.Hash, false)
+	txIDs := make([]string, 0, len(UTXO))
+	for txID := range UTXO {
+		txIDs = append(txIDs, txID)
+	}
+	sort.Strings(txIDs)
+
+	commitment := newUTXOCommitment()
+	for _, txID := range txIDs {
+		key, err := hex.DecodeString(txID)
+		if err != nil {
+			return err
+		}
+		commitment.add(key, UTXO[txID])
+	}
+	if !bytes.Equal(commitment.sum(), base.Commitment) {
+		return ErrSnapshotMismatch
+	}
+
+	base.Verified = true
+	return bc.Db.Update(func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket([]byte(snapshotStateBucket))
+		if err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+			return err
+		}
+		// 历史区块此时才加入高度索引，重建整个索引
+		err = tx.DeleteBucket([]byte(heightsBucket))
+		if err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+			return err
+		}
+		blocks := tx.Bucket([]byte(blocksBucket))
+		if err = setMainChain(tx, DeSerializeBlock(blocks.Get(blocks.Get([]byte("l"))))); err != nil {
+			return err
+		}
+		return putSnapshotBase(tx, base)
+	})
+}
@@ -0,0 +1,136 @@
+package chain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+// newTestChain 在临时目录中创建一条只含 blocks 的链，区块不经过挖矿
+func newTestChain(t *testing.T, blocks ...*Block) *BlockChain {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "chain.db"), 0600, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+		for _, block := range blocks {
+			if err = b.Put(block.Hash, block.Serialize()); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte("l"), blocks[len(blocks)-1].Hash)
+	})
+	require.NoError(t, err)
+
+	return &BlockChain{tip: blocks[len(blocks)-1].Hash, Db: db}
+}
+
+func testCoinbase(id byte, pubKeyHash []byte) *Transaction {
+	return &Transaction{
+		ID:   []byte{id},
+		Vin:  []TXInput{{Txid: []byte{}, Vout: -1}},
+		Vout: []TXOutput{{Value: 20, PubKeyHash: pubKeyHash}},
+	}
+}
+
+func TestUTXOSnapshot_CommitmentMatchesInfo(t *testing.T) {
+	alice := []byte("alice-pubkey-hash-01")
+	bob := []byte("bob-pubkey-hash-0002")
+
+	genesis := &Block{Hash: []byte("block-0"), PreBlockHash: []byte{}, Height: 0,
+		Transactions: []*Transaction{testCoinbase(0x01, alice)}}
+	pay := &Transaction{
+		ID:   []byte{0x02},
+		Vin:  []TXInput{{Txid: []byte{0x01}, Vout: 0}},
+		Vout: []TXOutput{{Value: 5, PubKeyHash: bob}, {Value: 15, PubKeyHash: alice}},
+	}
+	block1 := &Block{Hash: []byte("block-1"), PreBlockHash: genesis.Hash, Height: 1,
+		Transactions: []*Transaction{pay, testCoinbase(0x03, bob)}}
+
+	bc := newTestChain(t, genesis, block1)
+	UTXOSet := UTXOSet{Blockchain: bc}
+	UTXOSet.Reindex()
+
+	info := UTXOSet.Info()
+	require.Equal(t, 1, info.Height)
+	require.Equal(t, 2, info.Transactions)
+	require.Equal(t, 3, info.Outputs)
+	require.Equal(t, 40, info.TotalAmount)
+
+	snapshot, err := bc.DumpUTXOSnapshot(1)
+	require.NoError(t, err)
+	require.Equal(t, info.Hash, snapshot.Hash)
+
+	older, err := bc.DumpUTXOSnapshot(0)
+	require.NoError(t, err)
+	require.Len(t, older.Entries, 1)
+	require.NotEqual(t, snapshot.Hash, older.Hash)
+}
+
+func TestUTXOSet_UpdateKeepsOutputIndexes(t *testing.T) {
+	alice := []byte("alice-pubkey-hash-01")
+	bob := []byte("bob-pubkey-hash-0002")
+
+	genesis := &Block{Hash: []byte("block-0"), PreBlockHash: []byte{}, Height: 0,
+		Transactions: []*Transaction{{
+			ID:   []byte{0x01},
+			Vin:  []TXInput{{Txid: []byte{}, Vout: -1}},
+			Vout: []TXOutput{{Value: 5, PubKeyHash: alice}, {Value: 7, PubKeyHash: bob}},
+		}}}
+	bc := newTestChain(t, genesis)
+	UTXOSet := UTXOSet{Blockchain: bc}
+	UTXOSet.Reindex()
+
+	spend := &Transaction{
+		ID:   []byte{0x02},
+		Vin:  []TXInput{{Txid: []byte{0x01}, Vout: 0}},
+		Vout: []TXOutput{{Value: 5, PubKeyHash: bob}},
+	}
+	UTXOSet.Update(&Block{Hash: []byte("block-1"), PreBlockHash: genesis.Hash, Height: 1,
+		Transactions: []*Transaction{spend}})
+
+	_, ok := UTXOSet.FindOutput([]byte{0x01}, 0)
+	require.False(t, ok)
+	out, ok := UTXOSet.FindOutput([]byte{0x01}, 1)
+	require.True(t, ok)
+	require.Equal(t, 7, out.Value)
+
+	_, spendable := UTXOSet.FindSpendableOutPuts(bob, 7)
+	require.Equal(t, []int{1}, spendable["01"])
+}
+
+func TestLoadUTXOSnapshotFile_RequiresExpectedHash(t *testing.T) {
+	genesis := &Block{Hash: []byte("block-0"), PreBlockHash: []byte{}, Height: 0,
+		Transactions: []*Transaction{testCoinbase(0x01, []byte("alice-pubkey-hash-01"))}}
+	bc := newTestChain(t, genesis)
+	UTXOSet := UTXOSet{Blockchain: bc}
+	UTXOSet.Reindex()
+
+	snapshot, err := bc.DumpUTXOSnapshot(0)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "snapshot.dat")
+	require.NoError(t, snapshot.SaveToFile(path))
+
+	loaded, err := LoadUTXOSnapshotFile(path, snapshot.Hash)
+	require.NoError(t, err)
+	require.Equal(t, snapshot.Hash, loaded.Hash)
+
+	// 快照与自带的哈希一致并不够，必须是操作者指定的哈希
+	_, err = LoadUTXOSnapshotFile(path, nil)
+	require.Error(t, err)
+	_, err = LoadUTXOSnapshotFile(path, make([]byte, 32))
+	require.ErrorIs(t, err, ErrSnapshotUntrusted)
+
+	// 篡改条目后重新计算自带的哈希也无法通过
+	snapshot.Entries[0].Outputs.Outputs[0].Value = 1000000
+	snapshot.Hash = snapshot.Commitment()
+	require.NoError(t, snapshot.SaveToFile(path))
+	_, err = LoadUTXOSnapshotFile(path, loaded.Hash)
+	require.ErrorIs(t, err, ErrSnapshotUntrusted)
+}
@@ -0,0 +1,359 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// ErrInvalidBlock 表示区块没有通过验证，发送这种区块的节点应被惩罚
+	ErrInvalidBlock = errors.New("invalid block")
+	// ErrDuplicateBlock 表示区块已经在数据库中
+	ErrDuplicateBlock = errors.New("block already known")
+	// ErrOrphanBlock 表示区块的前一区块尚未见过，需要先下载前面的区块
+	ErrOrphanBlock = errors.New("previous block is unknown")
+)
+
+// CheckBlock 检查不依赖链上数据的规则：哈希与区块内容一致且满足工作量证明，
+// 第一笔交易是唯一的 coinbase，交易 ID 不重复。
+func CheckBlock(block *Block) error {
+	pow := NewProofOfWork(block)
+	if !pow.Validate() || !bytes.Equal(pow.HashWithNonce(block.Nonce), block.Hash) {
+		return ErrInvalidPoW
+	}
+	return checkTransactionList(block.Transactions)
+}
+
+// checkTransactionList 检查区块的交易列表：第一笔交易是唯一的 coinbase，交易 ID 不重复
+func checkTransactionList(txs []*Transaction) error {
+	if len(txs) == 0 || txs[0] == nil || !txs[0].IsCoinbase() {
+		return fmt.Errorf("%w: first transaction is not a coinbase", ErrInvalidBlock)
+	}
+	seen := make(map[string]bool, len(txs))
+	for i, tx := range txs {
+		if tx == nil {
+			return fmt.Errorf("%w: empty transaction %d", ErrInvalidBlock, i)
+		}
+		if i > 0 && tx.IsCoinbase() {
+			return fmt.Errorf("%w: more than one coinbase", ErrInvalidBlock)
+		}
+		id := string(tx.ID)
+		if seen[id] {
+			return fmt.Errorf("%w: duplicate transaction %x", ErrInvalidBlock, tx.ID)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// TxChecker 基于当前 UTXO 集合按顺序检查将被打包进同一区块的交易。
+// 区块验证和区块模板都使用它，保证矿工只打包区块验证会接受的交易。
+type TxChecker struct {
+	// coins 查找未花费输出，通常为当前 UTXO 集合，验证分叉时为分叉上的 utxoView
+	coins  func(txid []byte, index int) (Coin, bool)
+	height int
+	// earlier 为已通过检查的交易（十六进制 ID -> 交易），spent 为它们花费的输出
+	earlier map[string]Transaction
+	spent   map[string]bool
+	fees    int
+}
+
+// NewTxChecker 返回检查高度为 height 的区块中交易的 TxChecker，区块必须接在当前链顶之后
+func (bc *BlockChain) NewTxChecker(height int) *TxChecker {
+	UTXOSet := UTXOSet{Blockchain: bc}
+	return newTxChecker(height, UTXOSet.FindCoin)
+}
+
+func newTxChecker(height int, coins func(txid []byte, index int) (Coin, bool)) *TxChecker {
+	return &TxChecker{
+		coins:   coins,
+		height:  height,
+		earlier: make(map[string]Transaction),
+		spent:   make(map[string]bool),
+	}
+}
+
+// Add 检查 tx 能否排在已通过检查的交易之后：每个输入花费的输出在 UTXO 集合或前面的交易中且未被花费，
+// coinbase 输出已经成熟，输出不超过输入，签名有效。通过时记录 tx 的花费和输出。
+func (c *TxChecker) Add(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: %x is a coinbase", ErrInvalidTransaction, tx.ID)
+	}
+	var outpoints []string
+	// prevTXs 只含被引用的输出，足以验证签名，也适用于不在主链上的前序交易
+	prevTXs := make(map[string]Transaction)
+	in := 0
+	for _, vin := range tx.Vin {
+		txID := hex.EncodeToString(vin.Txid)
+		outpoint := fmt.Sprintf("%s:%d", txID, vin.Vout)
+		if c.spent[outpoint] || slices.Contains(outpoints, outpoint) {
+			return fmt.Errorf("%w: %x double spends %s", ErrInvalidTransaction, tx.ID, outpoint)
+		}
+		outpoints = append(outpoints, outpoint)
+
+		var out TXOutput
+		var ok bool
+		if prev, inBlock := c.earlier[txID]; inBlock {
+			if ok = vin.Vout >= 0 && vin.Vout < len(prev.Vout); ok {
+				out = prev.Vout[vin.Vout]
+			}
+		} else {
+			var coin Coin
+			coin, ok = c.coins(vin.Txid, vin.Vout)
+			if ok && !coin.Mature(c.height) {
+				return fmt.Errorf("%w: %x spends output %s: %w", ErrInvalidTransaction, tx.ID, outpoint, ErrImmatureCoinbase)
+			}
+			out = coin.Output
+		}
+		if !ok {
+			return fmt.Errorf("%w: %x spends missing or spent output %s", ErrInvalidTransaction, tx.ID, outpoint)
+		}
+		in += out.Value
+
+		prevTX := prevTXs[txID]
+		prevTX.ID = vin.Txid
+		for len(prevTX.Vout) <= vin.Vout {
+			prevTX.Vout = append(prevTX.Vout, TXOutput{})
+		}
+		prevTX.Vout[vin.Vout] = out
+		prevTXs[txID] = prevTX
+	}
+	out := 0
+	for _, vout := range tx.Vout {
+		if vout.Value < 0 {
+			return fmt.Errorf("%w: %x has a negative output", ErrInvalidTransaction, tx.ID)
+		}
+		out += vout.Value
+	}
+	if out > in {
+		return fmt.Errorf("%w: %x spends %d but has only %d", ErrInvalidTransaction, tx.ID, out, in)
+	}
+	if !tx.Verify(prevTXs) {
+		return fmt.Errorf("%w: %x has an invalid signature", ErrInvalidTransaction, tx.ID)
+	}
+
+	for _, outpoint := range outpoints {
+		c.spent[outpoint] = true
+	}
+	c.earlier[hex.EncodeToString(tx.ID)] = *tx
+	c.fees += in - out
+	return nil
+}
+
+// Fees 返回已通过检查的交易的手续费之和
+func (c *TxChecker) Fees() int {
+	return c.fees
+}
+
+// checkBlockTransactions 基于当前 UTXO 集合用 TxChecker 依次检查区块中的交易，
+// 并检查 coinbase 不超过出块奖励加手续费。只能用于接在当前链顶之后的区块。
+func (bc *BlockChain) checkBlockTransactions(block *Block) error {
+	return checkTransactionsWith(bc.NewTxChecker(block.Height), block)
+}
+
+// checkTransactionsWith 用 checker 依次检查区块中的交易，并检查 coinbase 不超过出块奖励加手续费
+func checkTransactionsWith(checker *TxChecker, block *Block) error {
+	for _, tx := range block.Transactions[1:] {
+		if err := checker.Add(tx); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidBlock, err)
+		}
+	}
+
+	reward := 0
+	for _, vout := range block.Transactions[0].Vout {
+		reward += vout.Value
+	}
+	if reward > subsidy+checker.Fees() {
+		return fmt.Errorf("%w: coinbase pays %d, more than subsidy %d plus fees %d", ErrInvalidBlock, reward, subsidy, checker.Fees())
+	}
+	return nil
+}
+
+// AcceptBlock 验证从其他节点收到的区块并写入数据库。
+// 接在链顶之后的区块经过完整验证后成为新链顶；前一区块已知但不是链顶的区块属于分叉，
+// 不比主链长时只检查工作量证明和高度后保存，更长时由 reorganize 完整验证整个分叉后切换链顶，
+// 并返回 reorg = true。两种情况下 UTXO 集合都与链顶在同一事务中更新。
+// 由快照启动的链在快照验证之前直接保存快照高度以下的历史区块。
+// 前一区块未知时返回 ErrOrphanBlock，已有的区块返回 ErrDuplicateBlock。
+func (bc *BlockChain) AcceptBlock(block *Block) (reorg bool, err error) {
+	if err = CheckBlock(block); err != nil {
+		return false, err
+	}
+	if bc.HasBlock(block.Hash) {
+		return false, ErrDuplicateBlock
+	}
+	if base, ok := bc.SnapshotBase(); ok && !base.Verified && block.Height < base.Height {
+		// 快照之前的历史区块只保存，VerifySnapshotHistory 重放历史时核对
+		return false, bc.Db.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket([]byte(blocksBucket)).Put(block.Hash, block.Serialize())
+		})
+	}
+	prev, err := bc.GetBlock(block.PreBlockHash)
+	if err != nil {
+		return false, ErrOrphanBlock
+	}
+	if block.Height != prev.Height+1 {
+		return false, fmt.Errorf("%w: height %d does not follow %d", ErrInvalidBlock, block.Height, prev.Height)
+	}
+
+	tip := bc.GetBestBlock()
+	if bytes.Equal(block.PreBlockHash, tip.Hash) {
+		if err = bc.checkBlockTransactions(block); err != nil {
+			return false, err
+		}
+		if err = bc.connectTip(block); errors.Is(err, ErrStaleTip) {
+			// 验证期间链顶被其他区块更新（例如本节点挖出了区块），按新的链顶重新处理
+			return bc.AcceptBlock(block)
+		}
+		return false, err
+	}
+
+	if block.Height <= tip.Height {
+		// 切换到这条分叉之前无法验证其中的交易
+		return false, bc.Db.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket([]byte(blocksBucket)).Put(block.Hash, block.Serialize())
+		})
+	}
+	return bc.reorganize(block, tip)
+}
+
+// reorganize 切换到以 block 结尾、比链顶 tip 更长的分叉：UTXO 集合回到分叉点，
+// 再按顺序对分叉上的每个区块做与链顶区块相同的完整验证。全部通过后在一个事务中保存 block、
+// 移动链顶并写入新的 UTXO 集合；任一区块无效时拒绝整个分叉，已保存的无效区块及其后代被删除。
+func (bc *BlockChain) reorganize(block, tip *Block) (bool, error) {
+	branch, err := bc.SideBranch(block.PreBlockHash)
+	if err != nil {
+		return false, err
+	}
+	branch = append(branch, block)
+	forkHeight := branch[0].Height - 1
+	if base, ok := bc.SnapshotBase(); ok && !base.Verified && forkHeight < base.Height {
+		return false, fmt.Errorf("fork at height %d is below the snapshot base at height %d", forkHeight, base.Height)
+	}
+
+	view := utxoView(bc.findUTXOFrom(branch[0].PreBlockHash, true))
+	for i, b := range branch {
+		if err = checkTransactionsWith(newTxChecker(b.Height, view.coin), b); err != nil {
+			bc.deleteBlocks(branch[i : len(branch)-1])
+			return false, fmt.Errorf("fork block %x at height %d: %w", b.Hash, b.Height, err)
+		}
+		view.connect(b)
+	}
+
+	err = bc.Db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		if !bytes.Equal(b.Get([]byte("l")), tip.Hash) {
+			return ErrStaleTip
+		}
+		if err := b.Put(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("l"), block.Hash); err != nil {
+			return err
+		}
+		if err := setMainChain(tx, block); err != nil {
+			return err
+		}
+		if err := putUTXO(tx, view); err != nil {
+			return err
+		}
+		bc.tip = block.Hash
+		return nil
+	})
+	if errors.Is(err, ErrStaleTip) {
+		// 验证期间链顶已经改变，按新的链顶重新处理
+		return bc.AcceptBlock(block)
+	}
+	return err == nil, err
+}
+
+// SideBranch 返回 hash 所指区块及其不在主链上的祖先，从低到高排列；hash 在主链上时返回空列表
+func (bc *BlockChain) SideBranch(hash []byte) ([]*Block, error) {
+	var branch []*Block
+	for {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		if main, ok := bc.BlockHashAt(block.Height); ok && bytes.Equal(main, block.Hash) {
+			break
+		}
+		branch = append(branch, &block)
+		hash = block.PreBlockHash
+	}
+	slices.Reverse(branch)
+	return branch, nil
+}
+
+// deleteBlocks 从数据库删除不在主链上的 blocks
+func (bc *BlockChain) deleteBlocks(blocks []*Block) {
+	err := bc.Db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		for _, block := range blocks {
+			if err := b.Delete(block.Hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// utxoView 为内存中的 UTXO 集合（十六进制交易 ID -> 未花费输出），用于在不修改数据库的情况下验证分叉
+type utxoView map[string]TXOutputs
+
+// coin 与 UTXOSet.FindCoin 相同，在 v 中查找未花费输出
+func (v utxoView) coin(txid []byte, index int) (Coin, bool) {
+	outs, ok := v[hex.EncodeToString(txid)]
+	if !ok {
+		return Coin{}, false
+	}
+	for i, out := range outs.Outputs {
+		if outs.OutputIndex(i) == index {
+			return Coin{Output: out, Height: outs.Height, Coinbase: outs.Coinbase}, true
+		}
+	}
+	return Coin{}, false
+}
+
+// connect 与 UTXOSet.Update 相同，删除 block 中交易花费的输出并加入它们的新输出
+func (v utxoView) connect(block *Block) {
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, vin := range tx.Vin {
+				txID := hex.EncodeToString(vin.Txid)
+				outs, ok := v[txID]
+				if !ok {
+					continue
+				}
+				updated := TXOutputs{Height: outs.Height, Coinbase: outs.Coinbase}
+				for i, out := range outs.Outputs {
+					if outs.OutputIndex(i) != vin.Vout {
+						updated.Outputs = append(updated.Outputs, out)
+						updated.Indexes = append(updated.Indexes, outs.OutputIndex(i))
+					}
+				}
+				if len(updated.Outputs) == 0 {
+					delete(v, txID)
+				} else {
+					v[txID] = updated
+				}
+			}
+		}
+
+		outs := TXOutputs{Height: block.Height, Coinbase: tx.IsCoinbase()}
+		for outIdx, out := range tx.Vout {
+			outs.Outputs = append(outs.Outputs, out)
+			outs.Indexes = append(outs.Indexes, outIdx)
+		}
+		v[hex.EncodeToString(tx.ID)] = outs
+	}
+}
@@ -0,0 +1,117 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckBlock_RejectsBadProofOfWork(t *testing.T) {
+	b := &Block{Hash: []byte("block-1"), PreBlockHash: []byte("block-0"), Height: 1,
+		Transactions: []*Transaction{testCoinbase(0x01, []byte("alice"))}}
+	require.ErrorIs(t, CheckBlock(b), ErrInvalidPoW)
+}
+
+func TestCheckBlockTransactions(t *testing.T) {
+	alice := []byte("alice-pubkey-hash-01")
+	bob := []byte("bob-pubkey-hash-0002")
+
+	genesis := &Block{Hash: []byte("block-0"), PreBlockHash: []byte{}, Height: 0,
+		Transactions: []*Transaction{testCoinbase(0x01, alice)}}
+	bc := newTestChain(t, genesis)
+	UTXOSet := UTXOSet{Blockchain: bc}
+	UTXOSet.Reindex()
+
+	spend := func(id byte, txid []byte, value int) *Transaction {
+		return &Transaction{
+			ID:   []byte{id},
+			Vin:  []TXInput{{Txid: txid, Vout: 0}},
+			Vout: []TXOutput{{Value: value, PubKeyHash: bob}},
+		}
+	}
+	blockWith := func(txs ...*Transaction) *Block {
+		return &Block{Hash: []byte("block-1"), PreBlockHash: genesis.Hash, Height: CoinbaseMaturity,
+			Transactions: append([]*Transaction{testCoinbase(0x10, bob)}, txs...)}
+	}
+
+	tests := []struct {
+		name  string
+		block *Block
+		ok    bool
+	}{
+		{"coinbase only", blockWith(), true},
+		{"missing input", blockWith(spend(0x02, []byte{0x99}, 5)), false},
+		{"spends more than input", blockWith(spend(0x02, []byte{0x01}, 21)), false},
+		{"double spend in block", blockWith(spend(0x02, []byte{0x01}, 5), spend(0x03, []byte{0x01}, 5)), false},
+		{"coinbase pays too much", &Block{Hash: []byte("block-1"), PreBlockHash: genesis.Hash, Height: 1,
+			Transactions: []*Transaction{{ID: []byte{0x10}, Vin: []TXInput{{Txid: []byte{}, Vout: -1}},
+				Vout: []TXOutput{{Value: subsidy + 1, PubKeyHash: bob}}}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := bc.checkBlockTransactions(tt.block)
+			if tt.ok {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrInvalidBlock)
+			}
+		})
+	}
+
+	// 在高度 1 花费创世区块的 coinbase 时它还没有成熟
+	immature := blockWith(spend(0x02, []byte{0x01}, 5))
+	immature.Height = 1
+	require.ErrorIs(t, bc.checkBlockTransactions(immature), ErrImmatureCoinbase)
+}
+
+func TestAcceptBlock_ValidatesForkBeforeSwitching(t *testing.T) {
+	t.Cleanup(SetTargetBits(4))
+	alice := []byte("alice-pubkey-hash-01")
+	bob := []byte("bob-pubkey-hash-0002")
+
+	genesis := &Block{Hash: []byte("block-0"), PreBlockHash: []byte{}, Height: 0,
+		Transactions: []*Transaction{testCoinbase(0x01, alice)}}
+	bc := newTestChain(t, genesis)
+	UTXOSet := UTXOSet{Blockchain: bc}
+	UTXOSet.Reindex()
+
+	mine := func(parent *Block, coinbase *Transaction) *Block {
+		return NewBlock([]*Transaction{coinbase}, parent.Hash, parent.Height+1)
+	}
+	main := mine(genesis, testCoinbase(0x10, alice))
+	reorg, err := bc.AcceptBlock(main)
+	require.NoError(t, err)
+	require.False(t, reorg)
+	// 接在链顶之后的区块与 UTXO 集合在同一事务中写入
+	_, ok := UTXOSet.FindCoin(main.Transactions[0].ID, 0)
+	require.True(t, ok)
+
+	// 分叉上的第一个区块多付了出块奖励，保存时还无法发现，分叉变长时整个分叉被拒绝
+	overpay := testCoinbase(0x20, bob)
+	overpay.Vout[0].Value = subsidy + 1
+	invalid := mine(genesis, overpay)
+	reorg, err = bc.AcceptBlock(invalid)
+	require.NoError(t, err)
+	require.False(t, reorg)
+	child := mine(invalid, testCoinbase(0x21, bob))
+	_, err = bc.AcceptBlock(child)
+	require.ErrorIs(t, err, ErrInvalidBlock)
+	require.Equal(t, main.Hash, bc.GetBestBlock().Hash)
+	require.False(t, bc.HasBlock(invalid.Hash))
+	require.False(t, bc.HasBlock(child.Hash))
+	require.True(t, UTXOSet.HasTransaction([]byte{0x10}))
+
+	// 有效的分叉更长时切换链顶，UTXO 集合回到分叉点后接上分叉的区块
+	fork := mine(genesis, testCoinbase(0x30, bob))
+	_, err = bc.AcceptBlock(fork)
+	require.NoError(t, err)
+	tip := mine(fork, testCoinbase(0x31, bob))
+	reorg, err = bc.AcceptBlock(tip)
+	require.NoError(t, err)
+	require.True(t, reorg)
+	require.Equal(t, tip.Hash, bc.GetBestBlock().Hash)
+	require.False(t, UTXOSet.HasTransaction([]byte{0x10}))
+	coin, ok := UTXOSet.FindCoin([]byte{0x31}, 0)
+	require.True(t, ok)
+	require.Equal(t, Coin{Output: tip.Transactions[0].Vout[0], Height: 2, Coinbase: true}, coin)
+}
@@ -3,11 +3,18 @@ package cli
 import (
 	"flag"
 	"fmt"
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/mining"
+	"github.com/qujing226/blockchain/server"
 	"log"
 
 	"os"
+	"strings"
 )
 
+// defaultAdminAddr 为管理命令默认连接的节点管理接口地址
+const defaultAdminAddr = "localhost:8334"
+
 // CLI responsible for processing command line arguments
 type CLI struct{}
 
@@ -15,12 +22,27 @@ func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
 	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
-	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
+	fmt.Println("  getbalance -address ADDRESS [-minconf N] [-rpc ADDR] - Get confirmed, unconfirmed, immature and pending balance of ADDRESS")
 	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
 	fmt.Println("  printchain - Print all the blocks of the blockchain")
 	fmt.Println("  reindexutxo - Rebuilds the UTXO set")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set.")
+	fmt.Println("  gettxoutsetinfo - Print count, total value and commitment hash of the UTXO set at the tip")
+	fmt.Println("  dumptxoutset -height HEIGHT -file FILE - Export the UTXO set at HEIGHT to FILE")
+	fmt.Println("  loadtxoutset -file FILE -hash HASH - Initialize a new node from the UTXO snapshot in FILE whose hash must be HASH")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine -node ADDRS - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set, otherwise submit to the first reachable node in ADDRS.")
+	fmt.Println("       [-strategy largest|smallest|bnb|random] [-feerate RATE] [-dust THRESHOLD] - Coin selection, fee per 1000 bytes and minimum change")
 	fmt.Println("  startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("       [-mintx N] [-maxwait DURATION] [-emptyblock DURATION] [-blocksize BYTES] - Mining policy")
+	fmt.Println("       [-rpc HOST:PORT] - Serve getblocktemplate/submitblock for external miners, mempool and balance queries on HOST:PORT")
+	fmt.Println("       [-admin HOST:PORT] - Serve admin commands on HOST:PORT, which must be a loopback address, e.g. localhost:8334")
+	fmt.Println("       [-encrypt] [-requireencryption] [-cipher aes-gcm|chacha20-poly1305] [-rekeybytes N] [-rekeyinterval DURATION] - Post-quantum encrypted peer connections")
+	fmt.Println("       [-allowdid DIDS] - Permissioned mode: only peer with nodes proving one of DIDS")
+	fmt.Println("       [-verifysnapshot=false] - Do not download and verify history before a loaded UTXO snapshot")
+	fmt.Println("  getpeerinfo -admin HOST:PORT - List connected peers with their DIDs")
+	fmt.Println("  listbanned -admin HOST:PORT - List peers banned by the node serving admin commands on HOST:PORT")
+	fmt.Println("  setban -addr ADDR|DID [-remove] [-duration DURATION] [-reason REASON] -admin HOST:PORT - Ban or unban ADDR (host or host:port)")
+	fmt.Println("  clearbanned -admin HOST:PORT - Remove all bans")
+	fmt.Println("  lightsync -node ADDRS [-address ADDRESS] [-did DID] [-start HEIGHT] [-minconf N] [-encrypt] - Sync block headers only and scan full nodes in ADDRS for transactions of ADDRESS or DID")
 }
 
 func (cli *CLI) validateArgs() {
@@ -47,20 +69,67 @@ func (cli *CLI) Run() {
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	getTxOutSetInfoCmd := flag.NewFlagSet("gettxoutsetinfo", flag.ExitOnError)
+	dumpTxOutSetCmd := flag.NewFlagSet("dumptxoutset", flag.ExitOnError)
+	loadTxOutSetCmd := flag.NewFlagSet("loadtxoutset", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 	createDidCmd := flag.NewFlagSet("createdid", flag.ExitOnError)
+	getPeerInfoCmd := flag.NewFlagSet("getpeerinfo", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	setBanCmd := flag.NewFlagSet("setban", flag.ExitOnError)
+	clearBannedCmd := flag.NewFlagSet("clearbanned", flag.ExitOnError)
+	lightSyncCmd := flag.NewFlagSet("lightsync", flag.ExitOnError)
 
 	webServCmd := flag.NewFlagSet("startweb", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
+	getBalanceMinConf := getBalanceCmd.Int("minconf", 1, "Only count outputs with at least this many confirmations as confirmed")
+	getBalanceRPC := getBalanceCmd.String("rpc", "", "RPC address of the running node (its startnode -rpc), used to include mempool transactions")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendStrategy := sendCmd.String("strategy", "largest", "Coin selection strategy: largest, smallest, bnb or random")
+	sendFeeRate := sendCmd.Int("feerate", 0, "Fee per 1000 bytes of transaction size")
+	sendDust := sendCmd.Int("dust", 0, "Change below this amount is added to the fee instead of creating an output")
+	sendNodes := sendCmd.String("node", "", "Comma-separated node addresses to submit the transaction to, default localhost:NODE_ID")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	defaultPolicy := mining.DefaultPolicy()
+	defaultTransport := server.DefaultTransportConfig()
+	startNodeMinTx := startNodeCmd.Int("mintx", defaultPolicy.MinTxCount, "Start mining as soon as the mempool has this many transactions")
+	startNodeMaxWait := startNodeCmd.Duration("maxwait", defaultPolicy.MaxWait, "Mine fewer than -mintx transactions once the oldest has waited this long, 0 waits forever")
+	startNodeEmptyBlock := startNodeCmd.Duration("emptyblock", defaultPolicy.EmptyBlockInterval, "Mine an empty block when no block was found for this long, 0 disables empty blocks")
+	startNodeBlockSize := startNodeCmd.Int("blocksize", defaultPolicy.MaxBlockSize, "Maximum total size in bytes of transactions in a mined block")
+	startNodeRPC := startNodeCmd.String("rpc", "", "Address to serve block templates to external miners on, e.g. localhost:8332")
+	startNodeAdmin := startNodeCmd.String("admin", "", "Loopback address to serve admin commands on, e.g. "+defaultAdminAddr)
+	startNodeEncrypt := startNodeCmd.Bool("encrypt", false, "Encrypt outbound connections with the Kyber/X25519 transport")
+	startNodeRequireEncryption := startNodeCmd.Bool("requireencryption", false, "Refuse inbound connections that are not encrypted")
+	startNodeCipher := startNodeCmd.String("cipher", server.CipherAESGCM.String(), "Cipher for encrypted connections: aes-gcm or chacha20-poly1305")
+	startNodeRekeyBytes := startNodeCmd.Int64("rekeybytes", defaultTransport.RekeyBytes, "Rotate the session key after encrypting this many bytes")
+	startNodeAllowDIDs := startNodeCmd.String("allowdid", "", "Comma-separated DIDs; when set, only peers proving one of them are accepted")
+	startNodeRekeyInterval := startNodeCmd.Duration("rekeyinterval", defaultTransport.RekeyInterval, "Rotate the session key after this long")
+	startNodeVerifySnapshot := startNodeCmd.Bool("verifysnapshot", true, "Download history before a loaded UTXO snapshot and verify the snapshot against it")
 	didStr := createDidCmd.String("pubkey", "", "The public key of the DID")
+	dumpHeight := dumpTxOutSetCmd.Int("height", -1, "Height of the snapshot, defaults to the tip")
+	dumpFile := dumpTxOutSetCmd.String("file", "", "File to write the snapshot to")
+	loadFile := loadTxOutSetCmd.String("file", "", "Snapshot file to load")
+	loadHash := loadTxOutSetCmd.String("hash", "", "Expected hash of the snapshot, obtained from a trusted source")
+	getPeerInfoAdmin := getPeerInfoCmd.String("admin", defaultAdminAddr, "Admin address of the running node")
+	listBannedAdmin := listBannedCmd.String("admin", defaultAdminAddr, "Admin address of the running node")
+	setBanAdmin := setBanCmd.String("admin", defaultAdminAddr, "Admin address of the running node")
+	setBanAddr := setBanCmd.String("addr", "", "Address to ban, host or host:port")
+	setBanRemove := setBanCmd.Bool("remove", false, "Remove the ban instead of adding it")
+	setBanDuration := setBanCmd.Duration("duration", 0, "How long to ban, defaults to the node's ban duration")
+	setBanReason := setBanCmd.String("reason", "", "Reason recorded with the ban")
+	clearBannedAdmin := clearBannedCmd.String("admin", defaultAdminAddr, "Admin address of the running node")
+	lightSyncNodes := lightSyncCmd.String("node", "", "Comma-separated full node addresses to sync from, default localhost:3000")
+	lightSyncAddress := lightSyncCmd.String("address", "", "Wallet address to scan transactions for")
+	lightSyncDID := lightSyncCmd.String("did", "", "DID to scan DID document transactions for")
+	lightSyncStart := lightSyncCmd.Int("start", 0, "Height to start scanning transactions from")
+	lightSyncMinConf := lightSyncCmd.Int("minconf", 1, "Only count outputs with at least this many confirmations as confirmed")
+	lightSyncEncrypt := lightSyncCmd.Bool("encrypt", false, "Encrypt connections to full nodes")
 
 	switch os.Args[1] {
 	case "getbalance":
@@ -98,6 +167,21 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "gettxoutsetinfo":
+		err := getTxOutSetInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumptxoutset":
+		err := dumpTxOutSetCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "loadtxoutset":
+		err := loadTxOutSetCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "send":
 		err := sendCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -114,6 +198,31 @@ func (cli *CLI) Run() {
 			log.Panic(err)
 
 		}
+	case "getpeerinfo":
+		err := getPeerInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listbanned":
+		err := listBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "setban":
+		err := setBanCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "clearbanned":
+		err := clearBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "lightsync":
+		err := lightSyncCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "startweb":
 		err := webServCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -129,7 +238,7 @@ func (cli *CLI) Run() {
 			getBalanceCmd.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
+		cli.getBalance(*getBalanceAddress, nodeID, *getBalanceMinConf, *getBalanceRPC)
 	}
 
 	if createBlockchainCmd.Parsed() {
@@ -160,13 +269,38 @@ func (cli *CLI) Run() {
 		cli.reindexUTXO(nodeID)
 	}
 
+	if getTxOutSetInfoCmd.Parsed() {
+		cli.getTxOutSetInfo(nodeID)
+	}
+
+	if dumpTxOutSetCmd.Parsed() {
+		if *dumpFile == "" {
+			dumpTxOutSetCmd.Usage()
+			os.Exit(1)
+		}
+		cli.dumpTxOutSet(nodeID, *dumpHeight, *dumpFile)
+	}
+
+	if loadTxOutSetCmd.Parsed() {
+		if *loadFile == "" || *loadHash == "" {
+			loadTxOutSetCmd.Usage()
+			os.Exit(1)
+		}
+		cli.loadTxOutSet(nodeID, *loadFile, *loadHash)
+	}
+
 	if sendCmd.Parsed() {
 		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		params := chain.CoinSelectionParams{FeeRate: *sendFeeRate, DustThreshold: *sendDust}
+		nodes := []string{fmt.Sprintf("localhost:%s", nodeID)}
+		if *sendNodes != "" {
+			nodes = strings.Split(*sendNodes, ",")
+		}
+		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine, *sendStrategy, params, nodes)
 	}
 
 	if startNodeCmd.Parsed() {
@@ -175,7 +309,34 @@ func (cli *CLI) Run() {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		policy := mining.Policy{
+			MinTxCount:         *startNodeMinTx,
+			MaxWait:            *startNodeMaxWait,
+			EmptyBlockInterval: *startNodeEmptyBlock,
+			MaxBlockSize:       *startNodeBlockSize,
+		}
+		cipher, err := server.ParseCipherSuite(*startNodeCipher)
+		if err != nil {
+			log.Panic(err)
+		}
+		transport := server.TransportConfig{
+			Encrypt:           *startNodeEncrypt,
+			RequireEncryption: *startNodeRequireEncryption,
+			Cipher:            cipher,
+			RekeyBytes:        *startNodeRekeyBytes,
+			RekeyInterval:     *startNodeRekeyInterval,
+		}
+		cfg := server.DefaultConfig(nodeID)
+		cfg.MinerAddress = *startNodeMiner
+		cfg.Policy = policy
+		cfg.RPCAddr = *startNodeRPC
+		cfg.AdminAddr = *startNodeAdmin
+		cfg.Transport = transport
+		cfg.VerifySnapshot = *startNodeVerifySnapshot
+		if *startNodeAllowDIDs != "" {
+			cfg.AllowedDIDs = strings.Split(*startNodeAllowDIDs, ",")
+		}
+		cli.startNode(cfg)
 	}
 
 	if createDidCmd.Parsed() {
@@ -186,6 +347,42 @@ func (cli *CLI) Run() {
 		cli.createDid(nodeID, *didStr)
 	}
 
+	if getPeerInfoCmd.Parsed() {
+		cli.getPeerInfo(*getPeerInfoAdmin)
+	}
+
+	if listBannedCmd.Parsed() {
+		cli.listBanned(*listBannedAdmin)
+	}
+
+	if setBanCmd.Parsed() {
+		if *setBanAddr == "" {
+			setBanCmd.Usage()
+			os.Exit(1)
+		}
+		command := "add"
+		if *setBanRemove {
+			command = "remove"
+		}
+		cli.setBan(*setBanAdmin, *setBanAddr, command, *setBanDuration, *setBanReason)
+	}
+
+	if clearBannedCmd.Parsed() {
+		cli.clearBanned(*clearBannedAdmin)
+	}
+
+	if lightSyncCmd.Parsed() {
+		if *lightSyncAddress == "" && *lightSyncDID == "" {
+			lightSyncCmd.Usage()
+			os.Exit(1)
+		}
+		nodes := []string{"localhost:3000"}
+		if *lightSyncNodes != "" {
+			nodes = strings.Split(*lightSyncNodes, ",")
+		}
+		cli.lightSync(nodeID, nodes, *lightSyncAddress, *lightSyncDID, *lightSyncStart, *lightSyncMinConf, *lightSyncEncrypt)
+	}
+
 	if webServCmd.Parsed() {
 		cli.startWeb()
 	}
@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/qujing226/blockchain/server"
+)
+
+// adminRequest 调用运行中节点在 addr 上的 HTTP 接口（startnode -admin 或 -rpc），将 JSON 回复解码到 out
+func adminRequest(addr, method, path string, body any, out any) error {
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://"+addr+path, &reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("%s: %s %s", resp.Status, failure.Message, failure.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (cli *CLI) getPeerInfo(adminAddr string) {
+	var result struct {
+		Peers []server.PeerInfo `json:"peers"`
+	}
+	if err := adminRequest(adminAddr, http.MethodGet, "/admin/getpeerinfo", nil, &result); err != nil {
+		log.Panic(err)
+	}
+	if len(result.Peers) == 0 {
+		fmt.Println("No connected peers")
+		return
+	}
+	for _, peer := range result.Peers {
+		direction := "outbound"
+		if peer.Inbound {
+			direction = "inbound"
+		}
+		did := peer.DID
+		if did == "" {
+			did = "-"
+		}
+		fmt.Printf("%s %s %s height %d, %s, %s, latency %dms, score %d\n",
+			peer.Addr, did, direction, peer.Height, peer.UserAgent, peer.Transport, peer.LatencyMs, peer.Score)
+	}
+}
+
+func (cli *CLI) listBanned(adminAddr string) {
+	var result struct {
+		Banned []server.BanEntry `json:"banned"`
+	}
+	if err := adminRequest(adminAddr, http.MethodGet, "/admin/listbanned", nil, &result); err != nil {
+		log.Panic(err)
+	}
+	if len(result.Banned) == 0 {
+		fmt.Println("No banned addresses")
+		return
+	}
+	for _, entry := range result.Banned {
+		fmt.Printf("%s until %s: %s\n", entry.Addr, entry.Until.Local().Format(time.DateTime), entry.Reason)
+	}
+}
+
+func (cli *CLI) setBan(adminAddr, addr, command string, duration time.Duration, reason string) {
+	req := server.SetBanRequest{Addr: addr, Command: command, Reason: reason}
+	if duration > 0 {
+		req.Duration = duration.String()
+	}
+	var result server.BanEntry
+	if err := adminRequest(adminAddr, http.MethodPost, "/admin/setban", req, &result); err != nil {
+		log.Panic(err)
+	}
+	if command == "remove" {
+		fmt.Printf("Unbanned %s\n", addr)
+		return
+	}
+	fmt.Printf("Banned %s until %s\n", result.Addr, result.Until.Local().Format(time.DateTime))
+}
+
+func (cli *CLI) clearBanned(adminAddr string) {
+	var result struct {
+		Cleared int `json:"cleared"`
+	}
+	if err := adminRequest(adminAddr, http.MethodPost, "/admin/clearbanned", nil, &result); err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Cleared %d bans\n", result.Cleared)
+}
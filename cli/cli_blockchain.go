@@ -29,6 +29,9 @@ func (cli *CLI) printChain(nodeID string) {
 
 	for {
 		block := bci.Next()
+		if block == nil {
+			break
+		}
 
 		fmt.Printf("============ Block %x ============\n", block.Hash)
 		fmt.Printf("Height: %d\n", block.Height)
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/server"
+)
+
+// lightSync 以轻节点的方式从 nodes 同步区块头，扫描与 address 和 did 相关的交易并打印余额和 DID 文档
+func (cli *CLI) lightSync(nodeID string, nodes []string, address, targetDID string, startHeight, minConf int, encrypt bool) {
+	headers, err := chain.OpenHeaderChain(chain.HeaderChainPath(nodeID))
+	if err != nil {
+		log.Panic(err)
+	}
+	defer headers.Close()
+
+	cfg := server.DefaultLightConfig(nodes...)
+	cfg.StartHeight = startHeight
+	cfg.Transport.Encrypt = encrypt
+	client := server.NewLightClient(cfg, headers)
+	if address != "" {
+		if err = client.WatchAddress(address); err != nil {
+			log.Panic(err)
+		}
+	}
+	if targetDID != "" {
+		client.WatchDID(targetDID)
+	}
+	if err = client.Sync(context.Background()); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Headers synced to height %d\n", headers.Height())
+	for _, stx := range client.Transactions() {
+		fmt.Printf("Transaction %x in block %x (height %d)\n", stx.Tx.ID, stx.BlockHash, stx.Height)
+	}
+	if address != "" {
+		balance, _ := client.Balance(address, minConf)
+		fmt.Printf("Balance of '%s': %d\n", address, balance.Total())
+		fmt.Printf("  Confirmed:   %d\n", balance.Confirmed)
+		fmt.Printf("  Unconfirmed: %d\n", balance.Unconfirmed)
+		fmt.Printf("  Immature:    %d\n", balance.Immature)
+	}
+	if targetDID != "" {
+		doc := client.DidDocument(targetDID)
+		if doc == nil {
+			fmt.Printf("DID document of %s not found\n", targetDID)
+			return
+		}
+		data, _ := json.MarshalIndent(doc, "", "  ")
+		fmt.Println(string(data))
+	}
+}
@@ -19,14 +19,14 @@ func (cli *CLI) listAddresses(nodeID string) {
 	}
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
-	fmt.Printf("Starting node %s\n", nodeID)
-	if len(minerAddress) > 0 {
-		if wallet.ValidateAddress(minerAddress) {
-			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
+func (cli *CLI) startNode(cfg server.Config) {
+	fmt.Printf("Starting node %s\n", cfg.NodeID)
+	if len(cfg.MinerAddress) > 0 {
+		if wallet.ValidateAddress(cfg.MinerAddress) {
+			fmt.Println("Mining is on. Address to receive rewards: ", cfg.MinerAddress)
 		} else {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	server.StartServer(nodeID, minerAddress)
+	server.StartServer(cfg)
 }
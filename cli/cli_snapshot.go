@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"encoding/hex"
+	"fmt"
+	chain "github.com/qujing226/blockchain/block_chain"
+	"log"
+)
+
+func (cli *CLI) getTxOutSetInfo(nodeID string) {
+	bc := chain.NewBlockChain(nodeID)
+	defer bc.Close()
+
+	UTXOSet := chain.UTXOSet{Blockchain: bc}
+	info := UTXOSet.Info()
+
+	fmt.Printf("Height:       %d\n", info.Height)
+	fmt.Printf("Best block:   %x\n", info.BestBlock)
+	fmt.Printf("Transactions: %d\n", info.Transactions)
+	fmt.Printf("Outputs:      %d\n", info.Outputs)
+	fmt.Printf("Total amount: %d\n", info.TotalAmount)
+	fmt.Printf("Hash:         %x\n", info.Hash)
+	if base, ok := bc.SnapshotBase(); ok {
+		fmt.Printf("Snapshot:     height %d, verified: %t\n", base.Height, base.Verified)
+	}
+}
+
+func (cli *CLI) dumpTxOutSet(nodeID string, height int, file string) {
+	bc := chain.NewBlockChain(nodeID)
+	defer bc.Close()
+
+	if height < 0 {
+		height = bc.GetBestHeight()
+	}
+	snapshot, err := bc.DumpUTXOSnapshot(height)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = snapshot.SaveToFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Dumped %d transactions at height %d to %s\n", len(snapshot.Entries), snapshot.Height, file)
+	fmt.Printf("Hash: %x\n", snapshot.Hash)
+}
+
+// loadTxOutSet 用 file 中的快照初始化节点，快照的哈希必须为 hash，hash 应来自可信的来源而不是快照的提供者
+func (cli *CLI) loadTxOutSet(nodeID string, file string, hash string) {
+	expected, err := hex.DecodeString(hash)
+	if err != nil {
+		log.Panic(err)
+	}
+	snapshot, err := chain.LoadUTXOSnapshotFile(file, expected)
+	if err != nil {
+		log.Panic(err)
+	}
+	bc, err := chain.CreateBlockchainFromSnapshot(snapshot, expected, nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer bc.Close()
+
+	fmt.Printf("Loaded snapshot at height %d (block %x)\n", snapshot.Height, snapshot.BlockHash)
+	fmt.Println("History before the snapshot will be downloaded and verified in the background by startnode unless -verifysnapshot=false.")
+}
@@ -7,6 +7,8 @@ import (
 	"github.com/qujing226/blockchain/server"
 	"github.com/qujing226/blockchain/wallet"
 	"log"
+	"net/http"
+	"net/url"
 )
 
 func (cli *CLI) reindexUTXO(nodeID string) {
@@ -18,13 +20,17 @@ func (cli *CLI) reindexUTXO(nodeID string) {
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool, strategy string, params chain.CoinSelectionParams, nodes []string) {
 	if !wallet.ValidateAddress(from) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
 	if !wallet.ValidateAddress(to) {
 		log.Panic("ERROR: Recipient address is not valid")
 	}
+	selector, err := chain.NewCoinSelector(strategy)
+	if err != nil {
+		log.Panic(err)
+	}
 
 	bc := chain.NewBlockChain(nodeID)
 	UTXOSet := chain.UTXOSet{Blockchain: bc}
@@ -36,35 +42,53 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 	}
 	wallet := wallets.GetWallet(from)
 
-	tx := chain.NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	tx, err := chain.NewUTXOTransactionWithSelector(&wallet, to, amount, &UTXOSet, selector, params)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
 	if mineNow {
 		cbTx := chain.NewCoinBaseTX(from, "")
 		txs := []*chain.Transaction{cbTx, tx}
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
-	} else {
-		server.SendTx(tx)
+		bc.MineBlock(txs)
+	} else if err = server.SendTx(tx, nodes...); err != nil {
+		fmt.Println("ERROR:", err)
+		return
 	}
 
 	fmt.Println("Success!")
 }
 
-func (cli *CLI) getBalance(address, nodeID string) {
+// getBalance 读取本地数据库中的余额。给出 rpcAddr 时（节点以 startnode -rpc 启动）改为向运行中的节点查询，
+// 这样内存池中的交易计入未上链的收款与支出；节点不可达时仍读取本地数据库，此时不包含内存池。
+func (cli *CLI) getBalance(address, nodeID string, minConf int, rpcAddr string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc := chain.NewBlockChain(nodeID)
-	UTXOSet := chain.UTXOSet{Blockchain: bc}
-	defer bc.Close()
 
-	balance := 0
-	pubKeyHash := base58.Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
-	//fmt.Println(UTXOs, pubKeyHash)
-	for _, out := range UTXOs {
-		balance += out.Value
+	var balance chain.Balance
+	remote := false
+	if rpcAddr != "" {
+		path := fmt.Sprintf("/wallet/balance?address=%s&minconf=%d", url.QueryEscape(address), minConf)
+		if err := adminRequest(rpcAddr, http.MethodGet, path, nil, &balance); err != nil {
+			fmt.Printf("Node at %s is not reachable (%v), pending transactions are not included\n", rpcAddr, err)
+		} else {
+			remote = true
+		}
+	}
+	if !remote {
+		bc := chain.NewBlockChain(nodeID)
+		UTXOSet := chain.UTXOSet{Blockchain: bc}
+		defer bc.Close()
+
+		pubKeyHash := base58.Decode(address)
+		pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+		balance = UTXOSet.Balance(pubKeyHash, minConf, nil)
 	}
 
-	fmt.Printf("Balance of '%s': %d\n", address, balance)
+	fmt.Printf("Balance of '%s': %d\n", address, balance.Confirmed)
+	fmt.Printf("  Unconfirmed (< %d confirmations): %d\n", minConf, balance.Unconfirmed)
+	fmt.Printf("  Immature coinbase:               %d\n", balance.Immature)
+	fmt.Printf("  Pending incoming:                %d\n", balance.PendingIncoming)
+	fmt.Printf("  Pending outgoing:                %d\n", balance.PendingOutgoing)
 }
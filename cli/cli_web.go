@@ -1,8 +1,24 @@
 package cli
 
-import "github.com/qujing226/blockchain/server"
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/qujing226/blockchain/server"
+)
+
+// startWeb 运行 DID 服务直到收到 SIGINT 或 SIGTERM，退出前关闭数据库
 func (cli *CLI) startWeb() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
 	server.InitConfig()
-	server.StartDidService()
+	defer server.CloseConfig()
+	if err := server.StartDidService(ctx); err != nil {
+		log.Panic(err)
+	}
 }
@@ -16,12 +16,17 @@ import (
 
 const method = "easyblock"
 
-func GenerateDidDocument(pubKey *ecdsa.PublicKey) *did.Document {
+// DIDFromPublicKey 返回公钥对应的 DID，标识符为压缩公钥哈希的后 20 字节，因此 DID 可以由公钥验证
+func DIDFromPublicKey(pubKey *ecdsa.PublicKey) string {
 	hash := pubKeyHash(pubKey)
 	idBytes := hash[len(hash)-20:]
 	// 构造唯一标识符
 	identifier := base58.Encode(idBytes)
-	didStr := fmt.Sprintf("did:%s:%s", method, identifier)
+	return fmt.Sprintf("did:%s:%s", method, identifier)
+}
+
+func GenerateDidDocument(pubKey *ecdsa.PublicKey) *did.Document {
+	didStr := DIDFromPublicKey(pubKey)
 	fmt.Println(didStr)
 	// 解析didStr 为DID类型
 	newDid, err := did.ParseDID(didStr)
@@ -77,7 +82,9 @@ func VerifyDidDocument(doc *did.Document, pubKey ecdsa.PublicKey) bool {
 		return false
 	}
 	for _, m := range doc.AssertionMethod {
-		if publicKeyEqual(m.PublicKey, pubKey) {
+		// PublicKey 是从 JWK 解析公钥的方法，需要调用后才能比较
+		key, err := m.PublicKey()
+		if err == nil && publicKeyEqual(key, pubKey) {
 			return true
 		}
 	}
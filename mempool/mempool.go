@@ -0,0 +1,477 @@
+// Package mempool 保存已通过验证、等待被打包进区块的交易。
+// Pool 的所有方法都可以被多个连接处理协程并发调用。
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+)
+
+var (
+	ErrInvalidTx        = errors.New("transaction is malformed")
+	ErrAlreadyHave      = errors.New("transaction already in mempool")
+	ErrAlreadyInChain   = errors.New("transaction already in the chain")
+	ErrCoinbase         = errors.New("coinbase transaction is not accepted into the mempool")
+	ErrMissingInputs    = errors.New("transaction references unknown or spent outputs")
+	ErrImmatureSpend    = errors.New("transaction spends an immature coinbase output")
+	ErrDoubleSpend      = errors.New("transaction conflicts with a mempool transaction")
+	ErrInvalidSignature = errors.New("transaction signature is invalid")
+	ErrInvalidAmount    = errors.New("transaction outputs exceed inputs")
+	ErrFeeTooLow        = errors.New("transaction fee rate is below the mempool minimum")
+	ErrPoolFull         = errors.New("mempool is full")
+)
+
+// Config 为内存池的限制与策略
+type Config struct {
+	// MaxCount 与 MaxSize 分别限制交易数和交易序列化后的总字节数
+	MaxCount int
+	MaxSize  int
+	// Expiry 为交易在内存池中的最长停留时间
+	Expiry time.Duration
+	// MinFeeRate 为每 1000 字节的最低手续费
+	MinFeeRate int
+
+	// MaxOrphans、MaxOrphanSize 限制孤儿池的交易数和单笔交易大小，
+	// OrphanExpiry 为孤儿交易等待父交易的最长时间
+	MaxOrphans    int
+	MaxOrphanSize int
+	OrphanExpiry  time.Duration
+}
+
+// DefaultConfig 返回节点默认使用的内存池配置
+func DefaultConfig() Config {
+	return Config{
+		MaxCount:   5000,
+		MaxSize:    16 << 20,
+		Expiry:     72 * time.Hour,
+		MinFeeRate: 0,
+
+		MaxOrphans:    100,
+		MaxOrphanSize: 100 << 10,
+		OrphanExpiry:  20 * time.Minute,
+	}
+}
+
+// TxDesc 描述内存池中的一笔交易
+type TxDesc struct {
+	Tx    *chain.Transaction
+	Added time.Time
+	// Height 为交易进入内存池时的链高度
+	Height int
+	Size   int
+	Fee    int
+	// FeeRate 为每 1000 字节的手续费
+	FeeRate int
+}
+
+// outpoint 标识一个交易输出
+type outpoint struct {
+	txid  string
+	index int
+}
+
+// Pool 是线程安全的交易内存池
+type Pool struct {
+	mu  sync.RWMutex
+	cfg Config
+	bc  *chain.BlockChain
+
+	txs map[string]*TxDesc
+	// spent 记录内存池交易花费的输出 -> 花费它的交易 ID，用于检测冲突
+	spent map[outpoint]string
+	size  int
+
+	// orphans 保存缺少父交易的交易，orphansByPrev 为父交易 ID -> 依赖它的孤儿交易 ID
+	orphans       map[string]*orphanTx
+	orphansByPrev map[string]map[string]struct{}
+
+	now func() time.Time
+}
+
+// New 创建一个基于 bc 的 UTXO 集合做验证的内存池
+func New(bc *chain.BlockChain, cfg Config) *Pool {
+	return &Pool{
+		cfg:   cfg,
+		bc:    bc,
+		txs:   make(map[string]*TxDesc),
+		spent: make(map[outpoint]string),
+
+		orphans:       make(map[string]*orphanTx),
+		orphansByPrev: make(map[string]map[string]struct{}),
+
+		now: time.Now,
+	}
+}
+
+// Add 验证交易并将其加入内存池。
+// 验证内容包括：输入引用的输出存在（在 UTXO 集合或内存池中）且 coinbase 输出已经成熟、不与内存池中的交易冲突、
+// 签名有效、输出总额不超过输入总额以及手续费率不低于下限。内存池已满时淘汰费率最低的交易。
+// 缺少父交易时返回 ErrMissingInputs，需要孤儿交易处理的调用方应使用 ProcessTransaction。
+func (p *Pool) Add(tx *chain.Transaction) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.accept(tx)
+}
+
+// validate 在持有锁的情况下检查交易，返回可以加入内存池的描述
+func (p *Pool) validate(tx *chain.Transaction) (*TxDesc, error) {
+	txID := hex.EncodeToString(tx.ID)
+	if len(tx.ID) == 0 {
+		return nil, fmt.Errorf("%w: empty transaction id", ErrInvalidTx)
+	}
+	if _, ok := p.txs[txID]; ok {
+		return nil, ErrAlreadyHave
+	}
+	if tx.IsCoinbase() {
+		return nil, ErrCoinbase
+	}
+	// 没有输入或输出的交易不付手续费也能通过验证，只接受 DID 文档交易
+	if (len(tx.Vin) == 0 || len(tx.Vout) == 0) && !tx.IsDidDocument() {
+		return nil, fmt.Errorf("%w: transaction has no inputs or no outputs", ErrInvalidTx)
+	}
+
+	prevTXs := make(map[string]chain.Transaction)
+	UTXOSet := chain.UTXOSet{Blockchain: p.bc}
+	// 其他节点转发已经上链的交易时，交易的输入已被花费，不应当作孤儿交易。
+	// 交易还有未花费的输出时可以从 UTXO 集合判断它已上链
+	if UTXOSet.HasTransaction(tx.ID) {
+		return nil, ErrAlreadyInChain
+	}
+	inputTotal := 0
+	seen := make(map[outpoint]bool)
+
+	for _, vin := range tx.Vin {
+		op := outpoint{hex.EncodeToString(vin.Txid), vin.Vout}
+		if seen[op] {
+			return nil, fmt.Errorf("%w: output %s:%d spent twice", ErrDoubleSpend, op.txid, op.index)
+		}
+		seen[op] = true
+		if spender, ok := p.spent[op]; ok {
+			return nil, fmt.Errorf("%w: output %s:%d already spent by %s", ErrDoubleSpend, op.txid, op.index, spender)
+		}
+
+		var out chain.TXOutput
+		if parent, ok := p.txs[op.txid]; ok {
+			if vin.Vout < 0 || vin.Vout >= len(parent.Tx.Vout) {
+				return nil, ErrMissingInputs
+			}
+			out = parent.Tx.Vout[vin.Vout]
+		} else {
+			coin, found := UTXOSet.FindCoin(vin.Txid, vin.Vout)
+			if !found {
+				return nil, ErrMissingInputs
+			}
+			if !coin.Mature(p.bc.GetBestHeight() + 1) {
+				return nil, fmt.Errorf("%w: output %s:%d", ErrImmatureSpend, op.txid, op.index)
+			}
+			out = coin.Output
+		}
+		inputTotal += out.Value
+
+		prevTX := prevTXs[op.txid]
+		prevTX.ID = vin.Txid
+		for len(prevTX.Vout) <= vin.Vout {
+			prevTX.Vout = append(prevTX.Vout, chain.TXOutput{})
+		}
+		prevTX.Vout[vin.Vout] = out
+		prevTXs[op.txid] = prevTX
+	}
+
+	outputTotal := 0
+	for _, out := range tx.Vout {
+		if out.Value < 0 {
+			return nil, fmt.Errorf("%w: negative output value", ErrInvalidTx)
+		}
+		outputTotal += out.Value
+	}
+	if outputTotal > inputTotal {
+		return nil, ErrInvalidAmount
+	}
+	if !tx.Verify(prevTXs) {
+		return nil, ErrInvalidSignature
+	}
+
+	size := len(tx.Serialize())
+	fee := inputTotal - outputTotal
+	desc := &TxDesc{
+		Tx:      tx,
+		Added:   p.now(),
+		Height:  p.bc.GetBestHeight(),
+		Size:    size,
+		Fee:     fee,
+		FeeRate: fee * 1000 / size,
+	}
+	if desc.FeeRate < p.cfg.MinFeeRate {
+		return nil, ErrFeeTooLow
+	}
+	return desc, nil
+}
+
+// makeRoom 在加入 desc 之前按费率从低到高淘汰交易，直到满足数量与大小限制。
+// 若 desc 本身的费率不高于需要淘汰的交易，则拒绝 desc。
+func (p *Pool) makeRoom(desc *TxDesc) error {
+	for p.overLimit(desc) {
+		victim := p.lowestFeeRate()
+		if victim == nil || victim.FeeRate >= desc.FeeRate {
+			return ErrPoolFull
+		}
+		p.removeWithDescendants(hex.EncodeToString(victim.Tx.ID))
+	}
+	return nil
+}
+
+func (p *Pool) overLimit(desc *TxDesc) bool {
+	if p.cfg.MaxCount > 0 && len(p.txs)+1 > p.cfg.MaxCount {
+		return true
+	}
+	return p.cfg.MaxSize > 0 && p.size+desc.Size > p.cfg.MaxSize
+}
+
+func (p *Pool) lowestFeeRate() *TxDesc {
+	var lowest *TxDesc
+	for _, desc := range p.txs {
+		if lowest == nil || desc.FeeRate < lowest.FeeRate {
+			lowest = desc
+		}
+	}
+	return lowest
+}
+
+func (p *Pool) insert(desc *TxDesc) {
+	txID := hex.EncodeToString(desc.Tx.ID)
+	p.txs[txID] = desc
+	p.size += desc.Size
+	for _, vin := range desc.Tx.Vin {
+		p.spent[outpoint{hex.EncodeToString(vin.Txid), vin.Vout}] = txID
+	}
+}
+
+// remove 删除一笔交易，不处理依赖它的交易
+func (p *Pool) remove(txID string) {
+	desc, ok := p.txs[txID]
+	if !ok {
+		return
+	}
+	delete(p.txs, txID)
+	p.size -= desc.Size
+	for _, vin := range desc.Tx.Vin {
+		op := outpoint{hex.EncodeToString(vin.Txid), vin.Vout}
+		if p.spent[op] == txID {
+			delete(p.spent, op)
+		}
+	}
+}
+
+// removeWithDescendants 删除一笔交易以及所有花费其输出的内存池交易
+func (p *Pool) removeWithDescendants(txID string) {
+	desc, ok := p.txs[txID]
+	if !ok {
+		return
+	}
+	p.remove(txID)
+	for outIdx := range desc.Tx.Vout {
+		if child, ok := p.spent[outpoint{txID, outIdx}]; ok {
+			p.removeWithDescendants(child)
+		}
+	}
+}
+
+// Remove 从内存池删除一笔交易及其后代交易
+func (p *Pool) Remove(id []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.removeWithDescendants(hex.EncodeToString(id))
+}
+
+// RemoveBlock 在新区块连接到链上后调用：删除区块中已包含的交易，
+// 以及与区块交易花费了相同输出的冲突交易（连同它们的后代）。
+func (p *Pool) RemoveBlock(block *chain.Block) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+		// 被打包的交易的子交易仍然有效，只删除它本身
+		p.remove(txID)
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if spender, ok := p.spent[outpoint{hex.EncodeToString(vin.Txid), vin.Vout}]; ok {
+				p.removeWithDescendants(spender)
+			}
+		}
+	}
+}
+
+// Reorg 在链切换到另一条分叉后调用，disconnected 为离开主链的区块，从低到高排列。
+// 这些区块中的交易和内存池原有的交易按顺序基于新的链顶重新验证：已经在新链上、与新链冲突
+// 或花费了不再成熟的 coinbase 输出的交易被丢弃。返回回到内存池的断开区块交易数和被删除的原有交易数。
+func (p *Pool) Reorg(disconnected []*chain.Block) (restored, removed int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var pending []*TxDesc
+	for _, block := range disconnected {
+		for _, tx := range block.Transactions {
+			if !tx.IsCoinbase() {
+				pending = append(pending, &TxDesc{Tx: tx, Added: p.now()})
+			}
+		}
+	}
+	// 先进入内存池的交易通常是后进入交易的父交易，按时间顺序重新验证
+	var previous []*TxDesc
+	for _, desc := range p.txs {
+		previous = append(previous, desc)
+	}
+	sort.SliceStable(previous, func(i, j int) bool {
+		return previous[i].Added.Before(previous[j].Added)
+	})
+	pending = append(pending, previous...)
+
+	p.txs = make(map[string]*TxDesc)
+	p.spent = make(map[outpoint]string)
+	p.size = 0
+	for progress := true; progress && len(pending) > 0; {
+		progress = false
+		var retry []*TxDesc
+		for _, entry := range pending {
+			desc, err := p.validate(entry.Tx)
+			if errors.Is(err, ErrMissingInputs) {
+				// 父交易可能排在后面，下一轮再试
+				retry = append(retry, entry)
+				continue
+			}
+			if err == nil {
+				desc.Added = entry.Added
+				err = p.makeRoom(desc)
+			}
+			if err != nil {
+				continue
+			}
+			p.insert(desc)
+			progress = true
+		}
+		pending = retry
+	}
+
+	kept := 0
+	for _, desc := range previous {
+		if _, ok := p.txs[hex.EncodeToString(desc.Tx.ID)]; ok {
+			kept++
+		}
+	}
+	return len(p.txs) - kept, len(previous) - kept
+}
+
+// Expire 删除停留时间超过 Config.Expiry 的交易，返回被删除的交易 ID
+func (p *Pool) Expire() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cfg.Expiry <= 0 {
+		return nil
+	}
+	deadline := p.now().Add(-p.cfg.Expiry)
+	var expired []string
+	for txID, desc := range p.txs {
+		if desc.Added.Before(deadline) {
+			expired = append(expired, txID)
+		}
+	}
+	for _, txID := range expired {
+		p.removeWithDescendants(txID)
+	}
+	return expired
+}
+
+// Has 判断内存池中是否有指定交易
+func (p *Pool) Has(id []byte) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	_, ok := p.txs[hex.EncodeToString(id)]
+	return ok
+}
+
+// Get 返回内存池中的交易
+func (p *Pool) Get(id []byte) (*chain.Transaction, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	desc, ok := p.txs[hex.EncodeToString(id)]
+	if !ok {
+		return nil, false
+	}
+	return desc.Tx, true
+}
+
+// Descs 返回所有交易的描述，按费率从高到低排序，费率相同时先进入的在前
+func (p *Pool) Descs() []*TxDesc {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	descs := make([]*TxDesc, 0, len(p.txs))
+	for _, desc := range p.txs {
+		copied := *desc
+		descs = append(descs, &copied)
+	}
+	sort.SliceStable(descs, func(i, j int) bool {
+		if descs[i].FeeRate != descs[j].FeeRate {
+			return descs[i].FeeRate > descs[j].FeeRate
+		}
+		return descs[i].Added.Before(descs[j].Added)
+	})
+	return descs
+}
+
+// Transactions 返回所有交易，顺序与 Descs 相同
+func (p *Pool) Transactions() []*chain.Transaction {
+	descs := p.Descs()
+	txs := make([]*chain.Transaction, 0, len(descs))
+	for _, desc := range descs {
+		txs = append(txs, desc.Tx)
+	}
+	return txs
+}
+
+// Info 汇总内存池状态
+type Info struct {
+	Count      int
+	Size       int
+	MaxCount   int
+	MaxSize    int
+	MinFeeRate int
+	Orphans    int
+}
+
+// Info 返回内存池的交易数、总大小和限制
+func (p *Pool) Info() Info {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return Info{
+		Count:      len(p.txs),
+		Size:       p.size,
+		MaxCount:   p.cfg.MaxCount,
+		MaxSize:    p.cfg.MaxSize,
+		MinFeeRate: p.cfg.MinFeeRate,
+		Orphans:    len(p.orphans),
+	}
+}
+
+// Count 返回内存池中的交易数
+func (p *Pool) Count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.txs)
+}
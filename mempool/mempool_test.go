@@ -0,0 +1,180 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+// unusedFirst 跳过已经被内存池交易花费的输出，避免测试中构造出互相冲突的交易
+type unusedFirst struct {
+	pool *Pool
+}
+
+func (s unusedFirst) Select(utxos []chain.SpendableOutput, params chain.CoinSelectionParams) (*chain.CoinSelection, error) {
+	var unused []chain.SpendableOutput
+	for _, utxo := range utxos {
+		s.pool.mu.RLock()
+		_, spent := s.pool.spent[outpoint{hex.EncodeToString(utxo.Txid), utxo.Index}]
+		s.pool.mu.RUnlock()
+		if !spent {
+			unused = append(unused, utxo)
+		}
+	}
+	return chain.LargestFirst{}.Select(unused, params)
+}
+
+func newPayment(t *testing.T, pool *Pool, from *wallet.Wallet, to string, amount int, params chain.CoinSelectionParams) *chain.Transaction {
+	UTXOSet := chain.UTXOSet{Blockchain: pool.bc}
+	tx, err := chain.NewUTXOTransactionWithSelector(from, to, amount, &UTXOSet, unusedFirst{pool}, params)
+	require.NoError(t, err)
+	return tx
+}
+
+func TestPool_AddValidatesTransactions(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	bc := chaintest.NewFundedChain(t, alice, 1)
+	pool := New(bc, DefaultConfig())
+
+	tx := newPayment(t, pool, alice, string(bob.GetAddress()), 5, chain.CoinSelectionParams{})
+	require.NoError(t, pool.Add(tx))
+	require.ErrorIs(t, pool.Add(tx), ErrAlreadyHave)
+
+	// 花费同一个输出的另一笔交易与内存池冲突
+	UTXOSet := chain.UTXOSet{Blockchain: bc}
+	conflict, err := chain.NewUTXOTransactionWithSelector(alice, string(bob.GetAddress()), 7, &UTXOSet, chain.LargestFirst{}, chain.CoinSelectionParams{})
+	require.NoError(t, err)
+	require.ErrorIs(t, pool.Add(conflict), ErrDoubleSpend)
+
+	pool.Remove(tx.ID)
+	tampered := newPayment(t, pool, alice, string(bob.GetAddress()), 3, chain.CoinSelectionParams{})
+	tampered.Vout[0].Value = 2
+	require.ErrorIs(t, pool.Add(tampered), ErrInvalidSignature)
+
+	missing := newPayment(t, pool, alice, string(bob.GetAddress()), 3, chain.CoinSelectionParams{})
+	missing.Vin[0].Txid = []byte("unknown")
+	require.ErrorIs(t, pool.Add(missing), ErrMissingInputs)
+
+	require.ErrorIs(t, pool.Add(chain.NewCoinBaseTX(string(bob.GetAddress()), "")), ErrCoinbase)
+
+	// 没有输入或输出的交易不付手续费，不能进入内存池
+	empty := &chain.Transaction{Payload: []string{"spam"}}
+	empty.ID = empty.Hash()
+	require.ErrorIs(t, pool.Add(empty), ErrInvalidTx)
+	burn := newPayment(t, pool, alice, string(bob.GetAddress()), 3, chain.CoinSelectionParams{})
+	burn.Vout = nil
+	burn.ID = burn.Hash()
+	require.ErrorIs(t, pool.Add(burn), ErrInvalidTx)
+	require.Equal(t, 0, pool.Count())
+}
+
+func TestPool_RejectsImmatureCoinbase(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	cbTx := chain.NewCoinBaseTX(string(alice.GetAddress()), "")
+	bc := chaintest.NewChain(t, &chain.Block{Hash: []byte("genesis"), PreBlockHash: []byte{}, Transactions: []*chain.Transaction{cbTx}})
+	pool := New(bc, DefaultConfig())
+
+	// 创世区块的 coinbase 还没有成熟，钱包不会选择它，直接花费它的交易被拒绝
+	UTXOSet := chain.UTXOSet{Blockchain: bc}
+	require.Empty(t, UTXOSet.ListSpendable(wallet.HashPubKey(alice.PublicKey)))
+
+	tx := &chain.Transaction{
+		Vin:  []chain.TXInput{{Txid: cbTx.ID, Vout: 0, PubKey: alice.PublicKey}},
+		Vout: []chain.TXOutput{*chain.NewTXOutput(cbTx.Vout[0].Value-1, string(bob.GetAddress()))},
+	}
+	tx.ID = tx.Hash()
+	tx.Sign(alice.PrivateKey, map[string]chain.Transaction{hex.EncodeToString(cbTx.ID): *cbTx})
+	require.ErrorIs(t, pool.Add(tx), ErrImmatureSpend)
+}
+
+func TestPool_EvictsLowestFeeRate(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := string(wallet.NewWallet().GetAddress())
+	bc := chaintest.NewFundedChain(t, alice, 3)
+
+	cfg := DefaultConfig()
+	cfg.MaxCount = 2
+	pool := New(bc, cfg)
+
+	cheap := newPayment(t, pool, alice, bob, 5, chain.CoinSelectionParams{})
+	require.NoError(t, pool.Add(cheap))
+	pricey := newPayment(t, pool, alice, bob, 5, chain.CoinSelectionParams{FeeRate: 10})
+	require.NoError(t, pool.Add(pricey))
+	priciest := newPayment(t, pool, alice, bob, 5, chain.CoinSelectionParams{FeeRate: 20})
+	require.NoError(t, pool.Add(priciest))
+
+	require.Equal(t, 2, pool.Count())
+	require.False(t, pool.Has(cheap.ID))
+	txs := pool.Transactions()
+	require.Equal(t, priciest.ID, txs[0].ID)
+	require.Equal(t, pricey.ID, txs[1].ID)
+}
+
+func TestPool_RemoveBlockAndExpire(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := string(wallet.NewWallet().GetAddress())
+	bc := chaintest.NewFundedChain(t, alice, 2)
+	pool := New(bc, DefaultConfig())
+
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	first := newPayment(t, pool, alice, bob, 5, chain.CoinSelectionParams{})
+	require.NoError(t, pool.Add(first))
+	second := newPayment(t, pool, alice, bob, 5, chain.CoinSelectionParams{})
+	require.NoError(t, pool.Add(second))
+
+	pool.RemoveBlock(&chain.Block{Transactions: []*chain.Transaction{first}})
+	require.False(t, pool.Has(first.ID))
+	require.True(t, pool.Has(second.ID))
+
+	now = now.Add(DefaultConfig().Expiry + time.Second)
+	require.Len(t, pool.Expire(), 1)
+	require.Equal(t, 0, pool.Count())
+}
+
+func TestPool_ReorgRevalidatesAgainstTheNewChain(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := string(wallet.NewWallet().GetAddress())
+	bc := chaintest.NewFundedChain(t, alice, 2)
+	pool := New(bc, DefaultConfig())
+	t.Cleanup(chain.SetTargetBits(4))
+
+	// conflict 与 second 花费同一个输出，first 花费另一个
+	UTXOSet := chain.UTXOSet{Blockchain: bc}
+	conflict, err := chain.NewUTXOTransactionWithSelector(alice, bob, 7, &UTXOSet, chain.SmallestFirst{}, chain.CoinSelectionParams{})
+	require.NoError(t, err)
+	first := newPayment(t, pool, alice, bob, 5, chain.CoinSelectionParams{})
+	require.NoError(t, pool.Add(first))
+	second := newPayment(t, pool, alice, bob, 5, chain.CoinSelectionParams{})
+	require.NoError(t, pool.Add(second))
+	require.Equal(t, conflict.Vin[0].Txid, second.Vin[0].Txid)
+
+	tip := bc.GetBestBlock()
+	mined := chain.NewBlock([]*chain.Transaction{chain.NewCoinBaseTX(bob, ""), first}, tip.Hash, tip.Height+1)
+	_, err = bc.AcceptBlock(mined)
+	require.NoError(t, err)
+	pool.RemoveBlock(mined)
+
+	// 包含 conflict 的更长分叉取代了打包 first 的区块
+	fork := chain.NewBlock([]*chain.Transaction{chain.NewCoinBaseTX(bob, ""), conflict}, tip.Hash, tip.Height+1)
+	_, err = bc.AcceptBlock(fork)
+	require.NoError(t, err)
+	forkTip := chain.NewBlock([]*chain.Transaction{chain.NewCoinBaseTX(bob, "")}, fork.Hash, fork.Height+1)
+	reorg, err := bc.AcceptBlock(forkTip)
+	require.NoError(t, err)
+	require.True(t, reorg)
+
+	restored, removed := pool.Reorg([]*chain.Block{mined})
+	require.Equal(t, 1, restored)
+	require.Equal(t, 1, removed)
+	require.True(t, pool.Has(first.ID))
+	require.False(t, pool.Has(second.ID))
+}
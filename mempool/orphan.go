@@ -0,0 +1,229 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+)
+
+// ErrOrphanTooLarge 表示孤儿交易超过了允许缓存的大小
+var ErrOrphanTooLarge = errors.New("orphan transaction is too large")
+
+// orphanTx 是一笔引用了未知父交易的交易
+type orphanTx struct {
+	tx      *chain.Transaction
+	from    string
+	expires time.Time
+}
+
+// ProcessTransaction 处理从 from 收到的交易。
+// 交易被接受时，依赖它的孤儿交易会被依次尝试加入内存池，accepted 中包含所有新进入内存池的交易；
+// 交易缺少父交易时被放入孤儿池，missing 返回尚未见过的父交易 ID，调用方应向 from 请求它们。
+func (p *Pool) ProcessTransaction(tx *chain.Transaction, from string) (accepted []*chain.Transaction, missing [][]byte, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err = p.accept(tx)
+	if errors.Is(err, ErrMissingInputs) {
+		missing = p.missingParents(tx)
+		if len(missing) == 0 {
+			// 父交易都已知但输出已被花费，交易不可能再变得有效
+			return nil, nil, err
+		}
+		if err = p.addOrphan(tx, from); err != nil {
+			return nil, nil, err
+		}
+		return nil, missing, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accepted = append(accepted, tx)
+	accepted = append(accepted, p.processOrphans([][]byte{tx.ID})...)
+	return accepted, nil, nil
+}
+
+// ProcessOrphans 在 parents 中的交易可用之后（例如随新区块上链）重新尝试依赖它们的孤儿交易，
+// 返回新进入内存池的交易
+func (p *Pool) ProcessOrphans(parents [][]byte) []*chain.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.processOrphans(parents)
+}
+
+// accept 在持有锁的情况下验证交易并加入内存池
+func (p *Pool) accept(tx *chain.Transaction) error {
+	desc, err := p.validate(tx)
+	if err != nil {
+		return err
+	}
+	if err = p.makeRoom(desc); err != nil {
+		return err
+	}
+	p.insert(desc)
+	return nil
+}
+
+func (p *Pool) processOrphans(parents [][]byte) []*chain.Transaction {
+	var accepted []*chain.Transaction
+	queue := append([][]byte(nil), parents...)
+
+	for len(queue) > 0 {
+		parentID := hex.EncodeToString(queue[0])
+		queue = queue[1:]
+
+		for orphanID := range p.orphansByPrev[parentID] {
+			orphan, ok := p.orphans[orphanID]
+			if !ok {
+				continue
+			}
+			err := p.accept(orphan.tx)
+			if errors.Is(err, ErrMissingInputs) {
+				// 还缺少其他父交易，继续等待
+				continue
+			}
+			p.removeOrphan(orphanID)
+			if err == nil {
+				accepted = append(accepted, orphan.tx)
+				queue = append(queue, orphan.tx.ID)
+			}
+		}
+	}
+	return accepted
+}
+
+// missingParents 返回 tx 引用的、既不在 UTXO 集合也不在内存池中的父交易 ID
+func (p *Pool) missingParents(tx *chain.Transaction) [][]byte {
+	var missing [][]byte
+	seen := make(map[string]bool)
+	UTXOSet := chain.UTXOSet{Blockchain: p.bc}
+
+	for _, vin := range tx.Vin {
+		parentID := hex.EncodeToString(vin.Txid)
+		if seen[parentID] {
+			continue
+		}
+		seen[parentID] = true
+		if _, ok := p.txs[parentID]; ok {
+			continue
+		}
+		if UTXOSet.HasTransaction(vin.Txid) {
+			continue
+		}
+		missing = append(missing, vin.Txid)
+	}
+	return missing
+}
+
+func (p *Pool) addOrphan(tx *chain.Transaction, from string) error {
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := p.orphans[txID]; ok {
+		return nil
+	}
+	size := len(tx.Serialize())
+	if p.cfg.MaxOrphanSize > 0 && size > p.cfg.MaxOrphanSize {
+		return ErrOrphanTooLarge
+	}
+	if p.cfg.MaxOrphans <= 0 {
+		return ErrMissingInputs
+	}
+	for len(p.orphans) >= p.cfg.MaxOrphans {
+		p.removeOrphan(p.oldestOrphan())
+	}
+
+	p.orphans[txID] = &orphanTx{
+		tx:      tx,
+		from:    from,
+		expires: p.now().Add(p.cfg.OrphanExpiry),
+	}
+	for _, vin := range tx.Vin {
+		parentID := hex.EncodeToString(vin.Txid)
+		if p.orphansByPrev[parentID] == nil {
+			p.orphansByPrev[parentID] = make(map[string]struct{})
+		}
+		p.orphansByPrev[parentID][txID] = struct{}{}
+	}
+	return nil
+}
+
+func (p *Pool) oldestOrphan() string {
+	var oldestID string
+	var oldest *orphanTx
+	for txID, orphan := range p.orphans {
+		if oldest == nil || orphan.expires.Before(oldest.expires) {
+			oldestID, oldest = txID, orphan
+		}
+	}
+	return oldestID
+}
+
+func (p *Pool) removeOrphan(txID string) {
+	orphan, ok := p.orphans[txID]
+	if !ok {
+		return
+	}
+	delete(p.orphans, txID)
+	for _, vin := range orphan.tx.Vin {
+		parentID := hex.EncodeToString(vin.Txid)
+		delete(p.orphansByPrev[parentID], txID)
+		if len(p.orphansByPrev[parentID]) == 0 {
+			delete(p.orphansByPrev, parentID)
+		}
+	}
+}
+
+// ExpireOrphans 删除超过 Config.OrphanExpiry 仍未等到父交易的孤儿交易，返回被删除的数量
+func (p *Pool) ExpireOrphans() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var expired []string
+	for txID, orphan := range p.orphans {
+		if now.After(orphan.expires) {
+			expired = append(expired, txID)
+		}
+	}
+	for _, txID := range expired {
+		p.removeOrphan(txID)
+	}
+	return len(expired)
+}
+
+// RemoveOrphansFrom 删除由 from 发来的全部孤儿交易，返回删除的数量
+func (p *Pool) RemoveOrphansFrom(from string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var removed []string
+	for txID, orphan := range p.orphans {
+		if orphan.from == from {
+			removed = append(removed, txID)
+		}
+	}
+	for _, txID := range removed {
+		p.removeOrphan(txID)
+	}
+	return len(removed)
+}
+
+// HasOrphan 判断孤儿池中是否有指定交易
+func (p *Pool) HasOrphan(id []byte) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	_, ok := p.orphans[hex.EncodeToString(id)]
+	return ok
+}
+
+// OrphanCount 返回孤儿池中的交易数
+func (p *Pool) OrphanCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.orphans)
+}
@@ -0,0 +1,100 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+// newChild 构造一笔花费 parent 第 index 个输出的交易，parent 不必在链上
+func newChild(t *testing.T, from *wallet.Wallet, parent *chain.Transaction, index int, to string) *chain.Transaction {
+	child := &chain.Transaction{
+		Vin:  []chain.TXInput{{Txid: parent.ID, Vout: index, PubKey: from.PublicKey}},
+		Vout: []chain.TXOutput{*chain.NewTXOutput(parent.Vout[index].Value, to)},
+	}
+	child.ID = child.Hash()
+	child.Sign(from.PrivateKey, map[string]chain.Transaction{hex.EncodeToString(parent.ID): *parent})
+	return child
+}
+
+func TestPool_ProcessTransactionOrphans(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	bc := chaintest.NewFundedChain(t, alice, 1)
+	pool := New(bc, DefaultConfig())
+
+	parent := newPayment(t, pool, alice, string(bob.GetAddress()), 5, chain.CoinSelectionParams{})
+	child := newChild(t, bob, parent, 0, string(alice.GetAddress()))
+
+	// 子交易先于父交易到达，进入孤儿池并请求父交易
+	accepted, missing, err := pool.ProcessTransaction(child, "peer-1")
+	require.NoError(t, err)
+	require.Empty(t, accepted)
+	require.Equal(t, [][]byte{parent.ID}, missing)
+	require.True(t, pool.HasOrphan(child.ID))
+	require.False(t, pool.Has(child.ID))
+
+	accepted, missing, err = pool.ProcessTransaction(parent, "peer-1")
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	require.Equal(t, []*chain.Transaction{parent, child}, accepted)
+	require.Equal(t, 0, pool.OrphanCount())
+	require.True(t, pool.Has(child.ID))
+}
+
+func TestPool_ProcessTransactionAlreadyInChain(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	bc := chaintest.NewFundedChain(t, alice, 1)
+	pool := New(bc, DefaultConfig())
+
+	tx := newPayment(t, pool, alice, string(bob.GetAddress()), 5, chain.CoinSelectionParams{})
+	t.Cleanup(chain.SetTargetBits(4))
+	bc.MineBlock([]*chain.Transaction{chain.NewCoinBaseTX(string(bob.GetAddress()), ""), tx})
+
+	// 其他节点再次转发已经上链的交易时，它的输入已被花费，但不是孤儿交易
+	_, missing, err := pool.ProcessTransaction(tx, "peer-1")
+	require.ErrorIs(t, err, ErrAlreadyInChain)
+	require.Empty(t, missing)
+	require.Equal(t, 0, pool.OrphanCount())
+}
+
+func TestPool_OrphanLimits(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	bc := chaintest.NewFundedChain(t, alice, 1)
+
+	cfg := DefaultConfig()
+	cfg.MaxOrphans = 2
+	pool := New(bc, cfg)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	// 父交易从未广播过，子交易只能留在孤儿池
+	var orphans []*chain.Transaction
+	for i := 0; i < 3; i++ {
+		parent := &chain.Transaction{Vout: []chain.TXOutput{*chain.NewTXOutput(10+i, string(bob.GetAddress()))}}
+		parent.ID = parent.Hash()
+		orphan := newChild(t, bob, parent, 0, string(alice.GetAddress()))
+		_, missing, err := pool.ProcessTransaction(orphan, "peer-1")
+		require.NoError(t, err)
+		require.Len(t, missing, 1)
+		orphans = append(orphans, orphan)
+		now = now.Add(time.Second)
+	}
+
+	// 超出上限时最早的孤儿交易被淘汰
+	require.Equal(t, 2, pool.OrphanCount())
+	require.False(t, pool.HasOrphan(orphans[0].ID))
+	require.True(t, pool.HasOrphan(orphans[2].ID))
+
+	now = now.Add(cfg.OrphanExpiry - time.Second)
+	require.Equal(t, 1, pool.ExpireOrphans())
+	require.Equal(t, 1, pool.RemoveOrphansFrom("peer-1"))
+	require.Equal(t, 0, pool.OrphanCount())
+}
@@ -0,0 +1,130 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+)
+
+// mempoolFile 为节点保存内存池的文件
+const mempoolFile = "./components/mempool_%s.dat"
+
+// persistVersion 为内存池文件的格式版本
+const persistVersion = 1
+
+// persistedTx 为文件中的一笔交易及其进入内存池的时间，重新加载时沿用原时间计算过期
+type persistedTx struct {
+	Tx    []byte
+	Added time.Time
+}
+
+type persistedPool struct {
+	Version int
+	Txs     []persistedTx
+}
+
+// FilePath 返回节点 nodeID 的内存池文件路径
+func FilePath(nodeID string) string {
+	return fmt.Sprintf(mempoolFile, nodeID)
+}
+
+// SaveToFile 将内存池中的交易写入 path。先写临时文件再重命名，避免中途退出留下损坏的文件。
+// 孤儿交易不会被保存。
+func (p *Pool) SaveToFile(path string) error {
+	p.mu.RLock()
+	data := persistedPool{Version: persistVersion}
+	for _, desc := range p.txs {
+		data.Txs = append(data.Txs, persistedTx{Tx: desc.Tx.Serialize(), Added: desc.Added})
+	}
+	p.mu.RUnlock()
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(data); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, content.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadFromFile 读取 SaveToFile 保存的交易，并基于当前链顶重新验证后加入内存池。
+// 已过期、已上链或不再有效的交易被丢弃。文件不存在时什么也不做。
+// 返回加入内存池与被丢弃的交易数。
+func (p *Pool) LoadFromFile(path string) (loaded, dropped int, err error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var data persistedPool
+	if err = gob.NewDecoder(bytes.NewReader(content)).Decode(&data); err != nil {
+		return 0, 0, err
+	}
+	if data.Version != persistVersion {
+		return 0, 0, fmt.Errorf("unsupported mempool file version %d", data.Version)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// 先进入内存池的交易通常是后进入交易的父交易，按时间顺序加载
+	sort.SliceStable(data.Txs, func(i, j int) bool {
+		return data.Txs[i].Added.Before(data.Txs[j].Added)
+	})
+	var deadline time.Time
+	if p.cfg.Expiry > 0 {
+		deadline = p.now().Add(-p.cfg.Expiry)
+	}
+
+	pending := data.Txs
+	for progress := true; progress && len(pending) > 0; {
+		progress = false
+		var retry []persistedTx
+		for _, entry := range pending {
+			if entry.Added.Before(deadline) {
+				dropped++
+				continue
+			}
+			tx, err := chain.DecodeTransaction(entry.Tx)
+			if err != nil {
+				// 文件中损坏的条目不影响其他交易的加载
+				dropped++
+				continue
+			}
+			desc, err := p.validate(&tx)
+			if errors.Is(err, ErrMissingInputs) {
+				// 父交易可能排在后面，下一轮再试
+				retry = append(retry, entry)
+				continue
+			}
+			if err == nil {
+				desc.Added = entry.Added
+				err = p.makeRoom(desc)
+			}
+			if err != nil {
+				dropped++
+				continue
+			}
+			p.insert(desc)
+			loaded++
+			progress = true
+		}
+		pending = retry
+	}
+	dropped += len(pending)
+	return loaded, dropped, nil
+}
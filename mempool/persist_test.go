@@ -0,0 +1,80 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_SaveAndLoad(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	bc := chaintest.NewFundedChain(t, alice, 3)
+	path := filepath.Join(t.TempDir(), "mempool.dat")
+
+	pool := New(bc, DefaultConfig())
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	old := newPayment(t, pool, alice, string(bob.GetAddress()), 5, chain.CoinSelectionParams{})
+	require.NoError(t, pool.Add(old))
+	now = now.Add(time.Hour)
+	parent := newPayment(t, pool, alice, string(bob.GetAddress()), 5, chain.CoinSelectionParams{})
+	require.NoError(t, pool.Add(parent))
+	child := newChild(t, bob, parent, 0, string(alice.GetAddress()))
+	require.NoError(t, pool.Add(child))
+	mined := newPayment(t, pool, alice, string(bob.GetAddress()), 5, chain.CoinSelectionParams{})
+	require.NoError(t, pool.Add(mined))
+	require.NoError(t, pool.SaveToFile(path))
+
+	// mined 在重启前被打包上链，其输入已不在 UTXO 集合中
+	UTXOSet := chain.UTXOSet{Blockchain: bc}
+	UTXOSet.Update(&chain.Block{Height: 1, Transactions: []*chain.Transaction{mined}})
+
+	reloaded := New(bc, DefaultConfig())
+	reloaded.now = func() time.Time { return now.Add(DefaultConfig().Expiry - time.Minute) }
+	loaded, dropped, err := reloaded.LoadFromFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 2, loaded)
+	require.Equal(t, 2, dropped)
+	require.False(t, reloaded.Has(old.ID))
+	require.False(t, reloaded.Has(mined.ID))
+	require.True(t, reloaded.Has(parent.ID))
+	require.True(t, reloaded.Has(child.ID))
+
+	// 文件不存在时不报错
+	loaded, dropped, err = New(bc, DefaultConfig()).LoadFromFile(filepath.Join(t.TempDir(), "missing.dat"))
+	require.NoError(t, err)
+	require.Zero(t, loaded+dropped)
+}
+
+func TestPool_LoadDropsCorruptEntries(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	bc := chaintest.NewFundedChain(t, alice, 1)
+	path := filepath.Join(t.TempDir(), "mempool.dat")
+
+	pool := New(bc, DefaultConfig())
+	payment := newPayment(t, pool, alice, string(bob.GetAddress()), 5, chain.CoinSelectionParams{})
+	data := persistedPool{Version: persistVersion, Txs: []persistedTx{
+		{Tx: []byte("not a transaction"), Added: time.Now()},
+		{Tx: payment.Serialize(), Added: time.Now()},
+	}}
+	var content bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&content).Encode(data))
+	require.NoError(t, os.WriteFile(path, content.Bytes(), 0644))
+
+	loaded, dropped, err := pool.LoadFromFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, loaded)
+	require.Equal(t, 1, dropped)
+	require.True(t, pool.Has(payment.ID))
+}
@@ -0,0 +1,156 @@
+package mining
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/mempool"
+)
+
+// retryInterval 为挖矿出错后重试前的等待时间
+const retryInterval = 5 * time.Second
+
+// ConnectFunc 验证挖出的区块并将其接到链上，同时更新内存池。
+// 节点提供的 ConnectFunc 持有与处理收到的区块相同的锁，并在区块成为链顶后转发它；
+// 区块没有成为链顶（挖矿期间链顶已经改变）时返回 chain.ErrStaleTip。
+type ConnectFunc func(*chain.Block) error
+
+// DirectConnect 返回不经过节点、直接把区块接到 bc 链顶并更新 pool 的 ConnectFunc，
+// 只应在 bc 没有被节点使用时使用
+func DirectConnect(bc *chain.BlockChain, pool *mempool.Pool) ConnectFunc {
+	return func(b *chain.Block) error {
+		if err := bc.SubmitBlock(b); err != nil {
+			return err
+		}
+		pool.RemoveBlock(b)
+		return nil
+	}
+}
+
+// Miner 在独立的协程中按 Policy 从内存池组装区块并挖矿。
+// 链顶改变时正在进行的工作量证明会被放弃，并在新链顶上重新组装模板。
+type Miner struct {
+	bc      *chain.BlockChain
+	pool    *mempool.Pool
+	address string
+	policy  Policy
+	// connect 把挖出的区块接到链上
+	connect ConnectFunc
+
+	newTx  chan struct{}
+	newTip chan struct{}
+	now    func() time.Time
+}
+
+// NewMiner 创建一个将奖励支付给 address 的矿工，挖出的区块交给 connect，为 nil 时使用 DirectConnect
+func NewMiner(bc *chain.BlockChain, pool *mempool.Pool, address string, policy Policy, connect ConnectFunc) *Miner {
+	if connect == nil {
+		connect = DirectConnect(bc, pool)
+	}
+	return &Miner{
+		bc:      bc,
+		pool:    pool,
+		address: address,
+		policy:  policy,
+		connect: connect,
+		newTx:   make(chan struct{}, 1),
+		newTip:  make(chan struct{}, 1),
+		now:     time.Now,
+	}
+}
+
+// NotifyTx 通知矿工内存池中有新交易，不会阻塞
+func (m *Miner) NotifyTx() {
+	notify(m.newTx)
+}
+
+// NotifyTip 通知矿工链顶已改变（收到了其他节点的区块），不会阻塞
+func (m *Miner) NotifyTip() {
+	notify(m.newTip)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Run 持续挖矿直到 ctx 被取消
+func (m *Miner) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		descs := m.pool.Descs()
+		oldest := m.now()
+		for _, desc := range descs {
+			if desc.Added.Before(oldest) {
+				oldest = desc.Added
+			}
+		}
+		lastBlock := time.Unix(m.bc.GetBestBlock().TimeStamp, 0)
+		now := m.now()
+
+		wait := m.policy.nextCheck(len(descs), oldest, lastBlock, now)
+		if m.policy.ShouldMine(len(descs), oldest, lastBlock, now) {
+			if err := m.mine(ctx); err != nil {
+				fmt.Printf("Mining failed: %v\n", err)
+				wait = retryInterval
+			} else {
+				continue
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+		case <-m.newTx:
+		case <-m.newTip:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// mine 组装一个模板并进行工作量证明。收到新链顶时放弃当前区块，返回 nil 以便重新开始。
+func (m *Miner) mine(ctx context.Context) error {
+	tmpl := NewTemplate(m.bc, m.pool, m.address, m.policy.MaxBlockSize)
+	for _, id := range tmpl.Invalid {
+		fmt.Printf("Removing invalid transaction %x from mempool\n", id)
+		m.pool.Remove(id)
+	}
+	fmt.Printf("Mining block %d with %d transactions\n", tmpl.Height, len(tmpl.Transactions)-1)
+
+	mineCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.newTip:
+			cancel()
+		case <-mineCtx.Done():
+		}
+	}()
+
+	block, err := m.bc.NewBlockContext(mineCtx, tmpl.Transactions)
+	if err == nil {
+		err = m.connect(block)
+	}
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, chain.ErrStaleTip):
+		if ctx.Err() == nil {
+			fmt.Println("Chain tip changed, restarting mining")
+		}
+		return nil
+	case err != nil:
+		return err
+	}
+
+	// 节点接上这个区块时同样会调用 NotifyTip，丢弃这个通知，否则下一轮挖矿会被立即取消
+	select {
+	case <-m.newTip:
+	default:
+	}
+	fmt.Printf("New block %x mined at height %d\n", block.Hash, block.Height)
+	return nil
+}
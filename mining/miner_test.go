@@ -0,0 +1,34 @@
+package mining
+
+import (
+	"context"
+	"testing"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/mempool"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiner_IgnoresTheTipNotificationForItsOwnBlock(t *testing.T) {
+	bc := chaintest.NewFundedChain(t, wallet.NewWallet(), 1)
+	pool := mempool.New(bc, mempool.DefaultConfig())
+	t.Cleanup(chain.SetTargetBits(4))
+
+	var m *Miner
+	direct := DirectConnect(bc, pool)
+	// 与节点相同，区块成为链顶后通知矿工
+	m = NewMiner(bc, pool, string(wallet.NewWallet().GetAddress()), DefaultPolicy(), func(b *chain.Block) error {
+		if err := direct(b); err != nil {
+			return err
+		}
+		m.NotifyTip()
+		return nil
+	})
+
+	height := bc.GetBestHeight()
+	require.NoError(t, m.mine(context.Background()))
+	require.Equal(t, height+1, bc.GetBestHeight())
+	require.Empty(t, m.newTip)
+}
@@ -0,0 +1,51 @@
+package mining
+
+import "time"
+
+// idleCheckInterval 为没有任何挖矿条件可能被满足时，矿工重新检查的间隔
+const idleCheckInterval = time.Minute
+
+// Policy 决定矿工何时开始挖一个新区块
+type Policy struct {
+	// MinTxCount 为内存池中交易达到多少笔时立即开始挖矿
+	MinTxCount int
+	// MaxWait 为交易不足 MinTxCount 时，最早进入内存池的交易最多等待多久就被打包；0 表示一直等待
+	MaxWait time.Duration
+	// EmptyBlockInterval 为距上一个区块多久后即使内存池为空也挖一个区块；0 表示不挖空块
+	EmptyBlockInterval time.Duration
+	// MaxBlockSize 为区块中交易的总字节数上限
+	MaxBlockSize int
+}
+
+// DefaultPolicy 返回默认挖矿策略：有两笔交易时立即挖矿，单笔交易最多等待 30 秒，不挖空块
+func DefaultPolicy() Policy {
+	return Policy{
+		MinTxCount:   2,
+		MaxWait:      30 * time.Second,
+		MaxBlockSize: DefaultMaxBlockSize,
+	}
+}
+
+// ShouldMine 判断是否应该开始挖矿。pending 为内存池交易数，oldest 为其中最早进入的时间，
+// lastBlock 为链顶区块的时间。
+func (p Policy) ShouldMine(pending int, oldest, lastBlock, now time.Time) bool {
+	if pending > 0 && pending >= p.MinTxCount {
+		return true
+	}
+	if pending > 0 && p.MaxWait > 0 && now.Sub(oldest) >= p.MaxWait {
+		return true
+	}
+	return p.EmptyBlockInterval > 0 && now.Sub(lastBlock) >= p.EmptyBlockInterval
+}
+
+// nextCheck 返回在没有新交易和新区块的情况下，距 ShouldMine 可能变为 true 的时间
+func (p Policy) nextCheck(pending int, oldest, lastBlock, now time.Time) time.Duration {
+	wait := idleCheckInterval
+	if pending > 0 && p.MaxWait > 0 {
+		wait = min(wait, oldest.Add(p.MaxWait).Sub(now))
+	}
+	if p.EmptyBlockInterval > 0 {
+		wait = min(wait, lastBlock.Add(p.EmptyBlockInterval).Sub(now))
+	}
+	return max(wait, 0)
+}
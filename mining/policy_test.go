@@ -0,0 +1,35 @@
+package mining
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_ShouldMine(t *testing.T) {
+	now := time.Now()
+	policy := Policy{MinTxCount: 2, MaxWait: 30 * time.Second, EmptyBlockInterval: 10 * time.Minute}
+
+	tests := []struct {
+		name      string
+		pending   int
+		oldest    time.Time
+		lastBlock time.Time
+		want      bool
+	}{
+		{"enough transactions", 2, now, now, true},
+		{"single transaction waiting", 1, now.Add(-10 * time.Second), now, false},
+		{"single transaction waited long enough", 1, now.Add(-30 * time.Second), now, true},
+		{"empty mempool", 0, now, now.Add(-time.Minute), false},
+		{"empty block interval elapsed", 0, now, now.Add(-10 * time.Minute), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, policy.ShouldMine(tt.pending, tt.oldest, tt.lastBlock, now))
+		})
+	}
+
+	require.Equal(t, 20*time.Second, policy.nextCheck(1, now.Add(-10*time.Second), now, now))
+	require.Equal(t, idleCheckInterval, Policy{MinTxCount: 2}.nextCheck(1, now, now, now))
+}
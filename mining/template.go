@@ -0,0 +1,94 @@
+// Package mining 负责从内存池组装区块模板，并按挖矿策略在独立的协程中挖矿。
+package mining
+
+import (
+	"encoding/hex"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/mempool"
+)
+
+// DefaultMaxBlockSize 为区块中交易序列化后的默认总字节数上限
+const DefaultMaxBlockSize = 1 << 20
+
+// Template 是一个等待工作量证明的区块
+type Template struct {
+	PrevHash []byte
+	Height   int
+	// Transactions 以 coinbase 开头，其余交易按费率从高到低选出，且父交易总排在子交易之前
+	Transactions []*chain.Transaction
+	// Fees 为所选交易的手续费之和，已计入 coinbase 输出
+	Fees int
+	Size int
+	// Invalid 为在当前链顶上已经无法通过验证的内存池交易，调用方应将其移出内存池
+	Invalid [][]byte
+}
+
+// NewTemplate 在 bc 的链顶之上组装区块模板，coinbase 奖励和手续费支付给 address。
+// 交易按费率从高到低选取，总大小不超过 maxSize；依赖其他内存池交易的交易只有在父交易被选中后才会被选中。
+func NewTemplate(bc *chain.BlockChain, pool *mempool.Pool, address string, maxSize int) *Template {
+	tip := bc.GetBestBlock()
+	tmpl := &Template{
+		PrevHash: tip.Hash,
+		Height:   tip.Height + 1,
+	}
+
+	coinbase := chain.NewCoinBaseTX(address, "")
+	tmpl.Size = len(coinbase.Serialize())
+
+	descs := pool.Descs()
+	inPool := make(map[string]bool, len(descs))
+	for _, desc := range descs {
+		inPool[hex.EncodeToString(desc.Tx.ID)] = true
+	}
+
+	var selected []*chain.Transaction
+	included := make(map[string]chain.Transaction)
+	// 与验证区块相同的检查：输入在 UTXO 集合或已选交易中、没有被重复花费、coinbase 已成熟、金额与签名有效
+	checker := bc.NewTxChecker(tmpl.Height)
+	remaining := descs
+	for progress := true; progress && len(remaining) > 0; {
+		progress = false
+		var deferred []*mempool.TxDesc
+		for _, desc := range remaining {
+			if !parentsIncluded(desc.Tx, inPool, included) {
+				// 父交易还没有被选中，等下一轮
+				deferred = append(deferred, desc)
+				continue
+			}
+			if maxSize > 0 && tmpl.Size+desc.Size > maxSize {
+				continue
+			}
+			txID := hex.EncodeToString(desc.Tx.ID)
+			if err := checker.Add(desc.Tx); err != nil {
+				tmpl.Invalid = append(tmpl.Invalid, desc.Tx.ID)
+				continue
+			}
+			selected = append(selected, desc.Tx)
+			included[txID] = *desc.Tx
+			tmpl.Size += desc.Size
+			tmpl.Fees += desc.Fee
+			progress = true
+		}
+		remaining = deferred
+	}
+
+	coinbase.Vout[0].Value += tmpl.Fees
+	coinbase.ID = coinbase.Hash()
+	tmpl.Transactions = append([]*chain.Transaction{coinbase}, selected...)
+	return tmpl
+}
+
+// parentsIncluded 判断 tx 引用的内存池交易是否都已被选入区块
+func parentsIncluded(tx *chain.Transaction, inPool map[string]bool, included map[string]chain.Transaction) bool {
+	for _, vin := range tx.Vin {
+		parentID := hex.EncodeToString(vin.Txid)
+		if !inPool[parentID] {
+			continue
+		}
+		if _, ok := included[parentID]; !ok {
+			return false
+		}
+	}
+	return true
+}
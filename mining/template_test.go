@@ -0,0 +1,88 @@
+package mining
+
+import (
+	"encoding/hex"
+	"testing"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/mempool"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+// spend 构造一笔花费 prev 第 index 个输出、支付 fee 手续费的交易
+func spend(t *testing.T, from *wallet.Wallet, prev *chain.Transaction, index, fee int, to string) *chain.Transaction {
+	tx := &chain.Transaction{
+		Vin:  []chain.TXInput{{Txid: prev.ID, Vout: index, PubKey: from.PublicKey}},
+		Vout: []chain.TXOutput{*chain.NewTXOutput(prev.Vout[index].Value-fee, to)},
+	}
+	tx.ID = tx.Hash()
+	tx.Sign(from.PrivateKey, map[string]chain.Transaction{hex.EncodeToString(prev.ID): *prev})
+	return tx
+}
+
+func TestNewTemplate(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	miner := string(wallet.NewWallet().GetAddress())
+	bc := chaintest.NewFundedChain(t, alice, 3)
+	pool := mempool.New(bc, mempool.DefaultConfig())
+
+	genesis, err := bc.GetBlock(bc.GenesisHash())
+	require.NoError(t, err)
+	tip := bc.GetBestBlock()
+	cheapParent := spend(t, alice, genesis.Transactions[0], 0, 1, string(bob.GetAddress()))
+	require.NoError(t, pool.Add(cheapParent))
+	// 子交易费率最高，但必须排在父交易之后
+	richChild := spend(t, bob, cheapParent, 0, 15, string(alice.GetAddress()))
+	require.NoError(t, pool.Add(richChild))
+	middle := spend(t, alice, genesis.Transactions[1], 0, 5, string(bob.GetAddress()))
+	require.NoError(t, pool.Add(middle))
+
+	tmpl := NewTemplate(bc, pool, miner, 0)
+	require.Equal(t, tip.Hash, tmpl.PrevHash)
+	require.Equal(t, tip.Height+1, tmpl.Height)
+	require.Equal(t, 21, tmpl.Fees)
+	require.Empty(t, tmpl.Invalid)
+	require.Len(t, tmpl.Transactions, 4)
+	require.True(t, tmpl.Transactions[0].IsCoinbase())
+	require.Equal(t, 20+21, tmpl.Transactions[0].Vout[0].Value)
+	require.Equal(t, middle.ID, tmpl.Transactions[1].ID)
+	require.Equal(t, cheapParent.ID, tmpl.Transactions[2].ID)
+	require.Equal(t, richChild.ID, tmpl.Transactions[3].ID)
+	require.NoError(t, bc.VerifyTransactions(tmpl.Transactions))
+
+	// 大小上限只够放下 coinbase 和一笔交易
+	limit := len(tmpl.Transactions[0].Serialize()) + len(middle.Serialize())
+	tmpl = NewTemplate(bc, pool, miner, limit)
+	require.Len(t, tmpl.Transactions, 2)
+	require.Equal(t, middle.ID, tmpl.Transactions[1].ID)
+}
+
+func TestNewTemplate_SkipsTransactionsSpentOnChain(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	miner := string(wallet.NewWallet().GetAddress())
+	bc := chaintest.NewFundedChain(t, alice, 2)
+	pool := mempool.New(bc, mempool.DefaultConfig())
+
+	genesis, err := bc.GetBlock(bc.GenesisHash())
+	require.NoError(t, err)
+	stale := spend(t, alice, genesis.Transactions[0], 0, 2, string(bob.GetAddress()))
+	require.NoError(t, pool.Add(stale))
+	fresh := spend(t, alice, genesis.Transactions[1], 0, 1, string(bob.GetAddress()))
+	require.NoError(t, pool.Add(fresh))
+
+	// 另一笔花费同一输出的交易已经上链，而内存池还没有更新
+	conflict := spend(t, alice, genesis.Transactions[0], 0, 1, miner)
+	UTXOSet := chain.UTXOSet{Blockchain: bc}
+	UTXOSet.Update(&chain.Block{Height: bc.GetBestHeight(), Transactions: []*chain.Transaction{conflict}})
+
+	tmpl := NewTemplate(bc, pool, miner, 0)
+	require.Equal(t, [][]byte{stale.ID}, tmpl.Invalid)
+	require.Len(t, tmpl.Transactions, 2)
+	require.Equal(t, fresh.ID, tmpl.Transactions[1].ID)
+	require.Equal(t, 1, tmpl.Fees)
+	require.NoError(t, bc.VerifyTransactions(tmpl.Transactions))
+}
@@ -0,0 +1,156 @@
+package mining
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/mempool"
+)
+
+// maxOutstandingWork 为同时保留的、尚未提交的模板数，超出时丢弃最早的模板
+const maxOutstandingWork = 64
+
+var (
+	ErrUnknownWork = errors.New("unknown or expired block template")
+	ErrStaleWork   = errors.New("block template is no longer on the chain tip")
+)
+
+// Work 是交给外部矿工的一份工作。矿工选择 Timestamp 和 Nonce，对
+// PrevHash || MerkleRoot || IntToHex(Timestamp) || IntToHex(Bits) || IntToHex(Nonce) || IntToHex(Version)
+// 做 SHA-256，结果小于 Target 即为有效解，然后通过 Submission 提交。
+// 矿工不需要链数据库或交易内容。
+type Work struct {
+	ID           string `json:"id"`
+	Version      int    `json:"version"`
+	Height       int    `json:"height"`
+	PrevHash     string `json:"prev_hash"`
+	MerkleRoot   string `json:"merkle_root"`
+	Timestamp    int64  `json:"timestamp"`
+	Bits         int    `json:"bits"`
+	Target       string `json:"target"`
+	Transactions int    `json:"transactions"`
+	Fees         int    `json:"fees"`
+}
+
+// Submission 是外部矿工提交的解
+type Submission struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Nonce     int    `json:"nonce"`
+}
+
+// WorkManager 为外部矿工生成工作，并验证、连接他们提交的区块
+type WorkManager struct {
+	mu        sync.Mutex
+	bc        *chain.BlockChain
+	pool      *mempool.Pool
+	maxSize   int
+	templates map[string]*Template
+	// order 记录模板的生成顺序，用于淘汰最早的模板
+	order []string
+	// connect 把提交的区块接到链上
+	connect ConnectFunc
+
+	now func() time.Time
+}
+
+// NewWorkManager 创建基于 bc 和 pool 的 WorkManager，模板大小不超过 maxSize。
+// 提交的区块交给 connect，为 nil 时使用 DirectConnect。
+func NewWorkManager(bc *chain.BlockChain, pool *mempool.Pool, maxSize int, connect ConnectFunc) *WorkManager {
+	if connect == nil {
+		connect = DirectConnect(bc, pool)
+	}
+	return &WorkManager{
+		bc:        bc,
+		pool:      pool,
+		maxSize:   maxSize,
+		templates: make(map[string]*Template),
+		connect:   connect,
+		now:       time.Now,
+	}
+}
+
+// GetWork 在当前链顶上组装一个 coinbase 支付给 address 的模板，并返回对应的工作
+func (w *WorkManager) GetWork(address string) *Work {
+	tmpl := NewTemplate(w.bc, w.pool, address, w.maxSize)
+	for _, id := range tmpl.Invalid {
+		w.pool.Remove(id)
+	}
+	block := tmpl.block(w.now().Unix(), 0)
+	merkleRoot := hex.EncodeToString(block.HashTransactions())
+	work := &Work{
+		ID:           merkleRoot,
+		Version:      block.Version,
+		Height:       tmpl.Height,
+		PrevHash:     hex.EncodeToString(tmpl.PrevHash),
+		MerkleRoot:   merkleRoot,
+		Timestamp:    block.TimeStamp,
+		Bits:         chain.TargetBits(),
+		Target:       fmt.Sprintf("%064x", chain.NewProofOfWork(block).Target()),
+		Transactions: len(tmpl.Transactions) - 1,
+		Fees:         tmpl.Fees,
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.templates[work.ID] = tmpl
+	w.order = append(w.order, work.ID)
+	for len(w.order) > maxOutstandingWork {
+		delete(w.templates, w.order[0])
+		w.order = w.order[1:]
+	}
+	return work
+}
+
+// Submit 用提交的解组装区块，交给 connect 验证并接到链顶
+func (w *WorkManager) Submit(sub Submission) (*chain.Block, error) {
+	w.mu.Lock()
+	tmpl, ok := w.templates[sub.ID]
+	w.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownWork
+	}
+
+	block := tmpl.block(sub.Timestamp, sub.Nonce)
+	block.Hash = chain.NewProofOfWork(block).HashWithNonce(sub.Nonce)
+	err := w.connect(block)
+	if errors.Is(err, chain.ErrStaleTip) {
+		w.forget(sub.ID)
+		return nil, ErrStaleWork
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 模板已经上链，同一份工作的其他解不再有效
+	w.forget(sub.ID)
+	return block, nil
+}
+
+func (w *WorkManager) forget(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.templates, id)
+	for i, workID := range w.order {
+		if workID == id {
+			w.order = append(w.order[:i], w.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// block 用模板的交易和给定的时间戳、nonce 组装区块，不计算哈希
+func (t *Template) block(timestamp int64, nonce int) *chain.Block {
+	return &chain.Block{
+		Version:      chain.BlockVersion,
+		TimeStamp:    timestamp,
+		PreBlockHash: t.PrevHash,
+		Nonce:        nonce,
+		Height:       t.Height,
+		Transactions: t.Transactions,
+	}
+}
@@ -0,0 +1,43 @@
+package mining
+
+import (
+	"encoding/hex"
+	"testing"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/mempool"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkManager_GetWorkAndSubmit(t *testing.T) {
+	alice := wallet.NewWallet()
+	miner := string(wallet.NewWallet().GetAddress())
+	bc := chaintest.NewFundedChain(t, alice, 1)
+	pool := mempool.New(bc, mempool.DefaultConfig())
+
+	genesis, err := bc.GetBlock(bc.GenesisHash())
+	require.NoError(t, err)
+	tip := bc.GetBestBlock()
+	payment := spend(t, alice, genesis.Transactions[0], 0, 3, miner)
+	require.NoError(t, pool.Add(payment))
+
+	work := NewWorkManager(bc, pool, 0, nil)
+	w := work.GetWork(miner)
+	require.Equal(t, tip.Height+1, w.Height)
+	require.Equal(t, hex.EncodeToString(tip.Hash), w.PrevHash)
+	require.Equal(t, w.ID, w.MerkleRoot)
+	require.Equal(t, chain.TargetBits(), w.Bits)
+	require.Equal(t, 1, w.Transactions)
+	require.Equal(t, 3, w.Fees)
+
+	_, err = work.Submit(Submission{ID: "unknown"})
+	require.ErrorIs(t, err, ErrUnknownWork)
+
+	// 目标值极小，nonce 0 几乎不可能满足工作量证明
+	_, err = work.Submit(Submission{ID: w.ID, Timestamp: w.Timestamp, Nonce: 0})
+	require.ErrorIs(t, err, chain.ErrInvalidPoW)
+	require.Equal(t, tip.Hash, bc.GetBestBlock().Hash)
+	require.True(t, pool.Has(payment.ID))
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// peersFile 为节点保存已知节点地址的文件
+const peersFile = "./components/peers_%s.dat"
+
+const (
+	// peersFileVersion 为地址文件的格式版本
+	peersFileVersion = 1
+	// maxKnownAddrs 为地址表最多保存的地址数，超出时淘汰最差的地址
+	maxKnownAddrs = 2000
+
+	// minRetryBackoff 和 maxRetryBackoff 为连接失败后重试间隔的下限和上限，
+	// 每连续失败一次间隔加倍
+	minRetryBackoff = time.Second
+	maxRetryBackoff = 10 * time.Minute
+
+	// staleAddrAge 为多久没有听说过的地址视为过期
+	staleAddrAge = 30 * 24 * time.Hour
+	// maxFailures 为从未连接成功的地址最多尝试的次数，超过后视为坏地址
+	maxFailures = 3
+	// maxFailuresAfterSuccess 为曾经连接成功的地址连续失败多少次后视为坏地址
+	maxFailuresAfterSuccess = 10
+)
+
+// knownAddress 为地址表中的一个地址及其连接统计
+type knownAddress struct {
+	Addr string
+	// Source 为告诉我们这个地址的节点，种子节点和直接连接的节点为地址本身
+	Source string
+	// LastSeen 为最近一次听说该节点在线的时间
+	LastSeen time.Time
+	// LastAttempt 和 LastSuccess 为最近一次尝试连接以及最近一次握手成功的时间
+	LastAttempt time.Time
+	LastSuccess time.Time
+	// Failures 为最近一次成功之后连续失败的次数，Tries 和 Successes 为累计次数
+	Failures  int
+	Tries     int
+	Successes int
+}
+
+// retryAt 返回下一次可以尝试连接的时间
+func (ka *knownAddress) retryAt() time.Time {
+	if ka.Failures == 0 {
+		return time.Time{}
+	}
+	backoff := maxRetryBackoff
+	if shift := ka.Failures - 1; shift < 20 {
+		backoff = min(minRetryBackoff<<shift, maxRetryBackoff)
+	}
+	return ka.LastAttempt.Add(backoff)
+}
+
+// isBad 判断地址是否不值得再分享给其他节点，地址表满时优先淘汰
+func (ka *knownAddress) isBad(now time.Time) bool {
+	if now.Sub(ka.LastSeen) > staleAddrAge && now.Sub(ka.LastSuccess) > staleAddrAge {
+		return true
+	}
+	if ka.LastSuccess.IsZero() {
+		return ka.Failures >= maxFailures
+	}
+	return ka.Failures >= maxFailuresAfterSuccess
+}
+
+// addrBook 为节点的地址表，记录听说过的节点以及与它们的连接情况，大小有上限
+type addrBook struct {
+	mu    sync.Mutex
+	addrs map[string]*knownAddress
+	max   int
+
+	now  func() time.Time
+	rand *rand.Rand
+}
+
+func newAddrBook(max int) *addrBook {
+	return &addrBook{
+		addrs: make(map[string]*knownAddress),
+		max:   max,
+		now:   time.Now,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// add 记录 source 告诉我们的地址 addr 在 lastSeen 时在线，返回 addr 是否是新地址
+func (b *addrBook) add(addr string, lastSeen time.Time, source string) bool {
+	if addr == "" {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ka, ok := b.addrs[addr]; ok {
+		if lastSeen.After(ka.LastSeen) {
+			ka.LastSeen = lastSeen
+		}
+		return false
+	}
+	if len(b.addrs) >= b.max {
+		b.evict()
+	}
+	b.addrs[addr] = &knownAddress{Addr: addr, Source: source, LastSeen: lastSeen}
+	return true
+}
+
+// evict 删除地址表中最差的地址：优先删除坏地址，其次是最久没有听说过的地址
+func (b *addrBook) evict() {
+	now := b.now()
+	var worst *knownAddress
+	for _, ka := range b.addrs {
+		if worst == nil {
+			worst = ka
+			continue
+		}
+		if bad, worstBad := ka.isBad(now), worst.isBad(now); bad != worstBad {
+			if bad {
+				worst = ka
+			}
+			continue
+		}
+		if ka.LastSeen.Before(worst.LastSeen) {
+			worst = ka
+		}
+	}
+	if worst != nil {
+		delete(b.addrs, worst.Addr)
+	}
+}
+
+// attempt 记录开始连接 addr。连接成功后调用 good，否则这次尝试被计为失败
+func (b *addrBook) attempt(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka, ok := b.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.LastAttempt = b.now()
+	ka.Tries++
+	ka.Failures++
+}
+
+// good 记录与 addr 握手成功
+func (b *addrBook) good(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka, ok := b.addrs[addr]
+	if !ok {
+		return
+	}
+	now := b.now()
+	ka.LastSeen = now
+	ka.LastSuccess = now
+	ka.Failures = 0
+	ka.Successes++
+}
+
+// candidate 随机选择一个可以尝试连接的地址，跳过 skip 返回 true 的地址和仍在退避中的地址。
+// 优先选择不是坏地址的地址，没有可选地址时返回 false。
+func (b *addrBook) candidate(skip func(string) bool) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	var good, bad []string
+	for addr, ka := range b.addrs {
+		if skip(addr) || now.Before(ka.retryAt()) {
+			continue
+		}
+		if ka.isBad(now) {
+			bad = append(bad, addr)
+		} else {
+			good = append(good, addr)
+		}
+	}
+	// map 的遍历顺序不固定，排序后再随机选择，方便测试时固定随机数
+	for _, list := range [][]string{good, bad} {
+		if len(list) > 0 {
+			sort.Strings(list)
+			return list[b.rand.Intn(len(list))], true
+		}
+	}
+	return "", false
+}
+
+// sample 随机返回最多 max 个不是坏地址的地址，用于回复 getaddr
+func (b *addrBook) sample(max int) []knownAddress {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	var addrs []knownAddress
+	for _, ka := range b.addrs {
+		if !ka.isBad(now) {
+			addrs = append(addrs, *ka)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Addr < addrs[j].Addr })
+	b.rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > max {
+		addrs = addrs[:max]
+	}
+	return addrs
+}
+
+// get 返回 addr 的连接统计
+func (b *addrBook) get(addr string) (knownAddress, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka, ok := b.addrs[addr]
+	if !ok {
+		return knownAddress{}, false
+	}
+	return *ka, true
+}
+
+// addresses 返回地址表中的所有地址，按字典序排列
+func (b *addrBook) addresses() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	addrs := make([]string, 0, len(b.addrs))
+	for addr := range b.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+type persistedAddrBook struct {
+	Version int
+	Addrs   []knownAddress
+}
+
+// save 将地址表写入 path，先写临时文件再重命名
+func (b *addrBook) save(path string) error {
+	b.mu.Lock()
+	data := persistedAddrBook{Version: peersFileVersion}
+	for _, ka := range b.addrs {
+		data.Addrs = append(data.Addrs, *ka)
+	}
+	b.mu.Unlock()
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load 读取 save 保存的地址表，文件不存在时什么也不做。返回读到的地址数。
+func (b *addrBook) load(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var data persistedAddrBook
+	if err = gob.NewDecoder(bytes.NewReader(content)).Decode(&data); err != nil {
+		return 0, err
+	}
+	if data.Version != peersFileVersion {
+		return 0, fmt.Errorf("unsupported peers file version %d", data.Version)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range data.Addrs {
+		ka := data.Addrs[i]
+		if ka.Addr == "" {
+			continue
+		}
+		if _, ok := b.addrs[ka.Addr]; !ok && len(b.addrs) >= b.max {
+			b.evict()
+		}
+		b.addrs[ka.Addr] = &ka
+	}
+	return len(data.Addrs), nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrBook_BoundsAndEviction(t *testing.T) {
+	now := time.Now()
+	book := newAddrBook(3)
+	book.now = func() time.Time { return now }
+
+	require.True(t, book.add("a:1", now.Add(-time.Hour), "seed"))
+	require.True(t, book.add("b:1", now.Add(-2*time.Hour), "seed"))
+	require.True(t, book.add("c:1", now, "seed"))
+	require.False(t, book.add("a:1", now, "seed"))
+	require.False(t, book.add("", now, "seed"))
+
+	// 满了之后淘汰最久没有听说过的地址
+	require.True(t, book.add("d:1", now, "seed"))
+	require.Equal(t, []string{"a:1", "c:1", "d:1"}, book.addresses())
+
+	// 坏地址比旧地址先被淘汰
+	for range maxFailures {
+		book.attempt("d:1")
+	}
+	require.True(t, book.add("e:1", now, "seed"))
+	require.Equal(t, []string{"a:1", "c:1", "e:1"}, book.addresses())
+}
+
+func TestAddrBook_RetryBackoff(t *testing.T) {
+	now := time.Now()
+	book := newAddrBook(maxKnownAddrs)
+	book.now = func() time.Time { return now }
+	none := func(string) bool { return false }
+
+	book.add("a:1", now, "seed")
+	addr, ok := book.candidate(none)
+	require.True(t, ok)
+	require.Equal(t, "a:1", addr)
+
+	// 连续失败后等待的时间加倍
+	book.attempt("a:1")
+	_, ok = book.candidate(none)
+	require.False(t, ok)
+	now = now.Add(minRetryBackoff)
+	_, ok = book.candidate(none)
+	require.True(t, ok)
+
+	book.attempt("a:1")
+	now = now.Add(minRetryBackoff)
+	_, ok = book.candidate(none)
+	require.False(t, ok)
+	now = now.Add(minRetryBackoff)
+	_, ok = book.candidate(none)
+	require.True(t, ok)
+
+	// 握手成功后不再退避
+	book.attempt("a:1")
+	book.good("a:1")
+	_, ok = book.candidate(none)
+	require.True(t, ok)
+	ka, _ := book.get("a:1")
+	require.Equal(t, 3, ka.Tries)
+	require.Equal(t, 1, ka.Successes)
+	require.Zero(t, ka.Failures)
+
+	_, ok = book.candidate(func(addr string) bool { return addr == "a:1" })
+	require.False(t, ok)
+}
+
+func TestAddrBook_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.dat")
+	book := newAddrBook(maxKnownAddrs)
+	for i := range 5 {
+		book.add(fmt.Sprintf("host:%d", i), time.Now(), "seed")
+	}
+	book.attempt("host:0")
+	book.good("host:0")
+	book.attempt("host:1")
+	require.NoError(t, book.save(path))
+
+	loaded := newAddrBook(maxKnownAddrs)
+	n, err := loaded.load(path)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.Equal(t, book.addresses(), loaded.addresses())
+	ka, ok := loaded.get("host:0")
+	require.True(t, ok)
+	require.Equal(t, 1, ka.Successes)
+	ka, _ = loaded.get("host:1")
+	require.Equal(t, 1, ka.Failures)
+
+	n, err = newAddrBook(maxKnownAddrs).load(filepath.Join(t.TempDir(), "missing.dat"))
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
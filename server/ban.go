@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// banListFile 为节点保存封禁列表的文件
+const banListFile = "./components/banlist_%s.dat"
+
+const (
+	// banListFileVersion 为封禁列表文件的格式版本
+	banListFileVersion = 1
+
+	defaultBanThreshold = 100
+	defaultBanDuration  = 24 * time.Hour
+)
+
+// 各种不良行为的分数，累计达到 Config.BanThreshold 的节点被封禁
+const (
+	// scoreMalformed 为无法解码或超长的消息
+	scoreMalformed = 20
+	// scoreProtocol 为违反协议但可能由版本差异造成的消息，例如握手前的消息、空的 inv 或校验和错误
+	scoreProtocol = 10
+	// scoreInvalidTx 为没有通过验证的交易，对方可能只是转发了它
+	scoreInvalidTx = 10
+	// scoreInvalidBlock 为没有通过验证的区块，发送者一定没有验证它，立即封禁
+	scoreInvalidBlock = 100
+)
+
+// BanEntry 为一条封禁记录。Addr 可以是节点的监听地址 host:port，也可以只是 host，后者封禁该主机的所有连接；
+// 还可以是 DID，封禁证明控制该 DID 的节点，无论它从哪里连接
+type BanEntry struct {
+	Addr    string    `json:"addr"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Until   time.Time `json:"until"`
+}
+
+// BanListPath 返回节点 nodeID 的封禁列表文件路径
+func BanListPath(nodeID string) string {
+	return fmt.Sprintf(banListFile, nodeID)
+}
+
+// banList 记录被封禁的地址，过期的记录在查询时删除
+type banList struct {
+	mu   sync.Mutex
+	bans map[string]BanEntry
+	now  func() time.Time
+}
+
+func newBanList() *banList {
+	return &banList{
+		bans: make(map[string]BanEntry),
+		now:  time.Now,
+	}
+}
+
+// ban 封禁 addr 直到 duration 之后，已有的封禁被覆盖
+func (b *banList) ban(addr string, duration time.Duration, reason string) BanEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	entry := BanEntry{Addr: addr, Reason: reason, Created: now, Until: now.Add(duration)}
+	b.bans[addr] = entry
+	return entry
+}
+
+// unban 解除对 addr 的封禁，返回 addr 之前是否被封禁
+func (b *banList) unban(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.bans[addr]
+	delete(b.bans, addr)
+	return ok
+}
+
+// clear 解除所有封禁，返回解除的数量
+func (b *banList) clear() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := len(b.bans)
+	b.bans = make(map[string]BanEntry)
+	return count
+}
+
+// isBanned 判断 addr 或它的主机部分是否被封禁
+func (b *banList) isBanned(addr string) bool {
+	if addr == "" {
+		return false
+	}
+	keys := []string{addr}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		keys = append(keys, host)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	for _, key := range keys {
+		entry, ok := b.bans[key]
+		if !ok {
+			continue
+		}
+		if now.Before(entry.Until) {
+			return true
+		}
+		delete(b.bans, key)
+	}
+	return false
+}
+
+// list 返回尚未过期的封禁，按地址排序
+func (b *banList) list() []BanEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	entries := make([]BanEntry, 0, len(b.bans))
+	for addr, entry := range b.bans {
+		if !now.Before(entry.Until) {
+			delete(b.bans, addr)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Addr < entries[j].Addr })
+	return entries
+}
+
+type persistedBanList struct {
+	Version int
+	Bans    []BanEntry
+}
+
+// save 将未过期的封禁写入 path，先写临时文件再重命名
+func (b *banList) save(path string) error {
+	data := persistedBanList{Version: banListFileVersion, Bans: b.list()}
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load 读取 save 保存的封禁列表，跳过已经过期的记录，文件不存在时什么也不做。返回读到的封禁数。
+func (b *banList) load(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var data persistedBanList
+	if err = gob.NewDecoder(bytes.NewReader(content)).Decode(&data); err != nil {
+		return 0, err
+	}
+	if data.Version != banListFileVersion {
+		return 0, fmt.Errorf("unsupported ban list file version %d", data.Version)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	loaded := 0
+	for _, entry := range data.Bans {
+		if entry.Addr == "" || !now.Before(entry.Until) {
+			continue
+		}
+		b.bans[entry.Addr] = entry
+		loaded++
+	}
+	return loaded, nil
+}
+
+// misbehaving 给 p 增加 score 分不良行为分数，累计达到 BanThreshold 时封禁并断开对方。BanThreshold 为 0 时不封禁。
+func (n *Node) misbehaving(p *Peer, score int, reason string) {
+	if score <= 0 {
+		return
+	}
+	total := p.addScore(score)
+	fmt.Printf("Misbehaving %s: %s (+%d, total %d)\n", p, reason, score, total)
+	if n.cfg.BanThreshold <= 0 || total < n.cfg.BanThreshold {
+		return
+	}
+	for _, key := range p.banKeys(n.permissioned()) {
+		n.Ban(key, n.cfg.BanDuration, reason)
+	}
+}
+
+// isBanned 判断地址 addr 是否被封禁
+func (n *Node) isBanned(addr string) bool {
+	return n.bans.isBanned(addr)
+}
+
+// Ban 封禁 addr 一段时间，断开与它的所有连接并删除这些连接发来的孤儿交易。addr 为 host:port 时只封禁该监听地址，为 host 时封禁整个主机，
+// 为 DID 时封禁该 DID 的节点。
+func (n *Node) Ban(addr string, duration time.Duration, reason string) BanEntry {
+	entry := n.bans.ban(addr, duration, reason)
+	fmt.Printf("Banned %s until %s: %s\n", addr, entry.Until.Format(time.DateTime), reason)
+	for _, peer := range n.Peers() {
+		if peer.matchesBan(addr) {
+			peer.Close()
+			n.removeOrphansFrom(peer)
+		}
+	}
+	n.saveBans()
+	return entry
+}
+
+// Unban 解除对 addr 的封禁，返回 addr 之前是否被封禁
+func (n *Node) Unban(addr string) bool {
+	ok := n.bans.unban(addr)
+	if ok {
+		n.saveBans()
+	}
+	return ok
+}
+
+// ClearBanned 解除所有封禁，返回解除的数量
+func (n *Node) ClearBanned() int {
+	count := n.bans.clear()
+	n.saveBans()
+	return count
+}
+
+// Banned 返回所有尚未过期的封禁
+func (n *Node) Banned() []BanEntry {
+	return n.bans.list()
+}
+
+func (n *Node) saveBans() {
+	if n.cfg.BansPath == "" {
+		return
+	}
+	if err := n.bans.save(n.cfg.BansPath); err != nil {
+		fmt.Printf("Failed to save ban list: %v\n", err)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanList_ExpiresAndPersists(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	bans := newBanList()
+	bans.now = func() time.Time { return now }
+
+	bans.ban("10.0.0.1", time.Hour, "host")
+	bans.ban("10.0.0.2:3000", 2*time.Hour, "listen address")
+	require.True(t, bans.isBanned("10.0.0.1:5555"), "a host ban covers every port")
+	require.True(t, bans.isBanned("10.0.0.2:3000"))
+	require.False(t, bans.isBanned("10.0.0.2:3001"))
+
+	path := filepath.Join(t.TempDir(), "banlist.dat")
+	require.NoError(t, bans.save(path))
+
+	now = now.Add(90 * time.Minute)
+	loaded := newBanList()
+	loaded.now = bans.now
+	count, err := loaded.load(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, count, "expired bans are not loaded")
+	require.False(t, loaded.isBanned("10.0.0.1:5555"))
+	require.True(t, loaded.isBanned("10.0.0.2:3000"))
+	require.Len(t, loaded.list(), 1)
+
+	require.True(t, loaded.unban("10.0.0.2:3000"))
+	require.Empty(t, loaded.list())
+}
+
+func TestNode_BansPeerSendingInvalidBlock(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	node := startTestNode(t, genesis, "")
+
+	v := testVersion(genesis)
+	v.AddrFrom = "127.0.0.1:1"
+	conn := handshake(t, node, v)
+
+	// 工作量证明无效的区块使对方立即被封禁
+	bogus := &chain.Block{
+		Hash:         []byte("bogus"),
+		PreBlockHash: genesis.Hash,
+		Height:       1,
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	require.NoError(t, writeMessage(conn, DefaultMagic, "block", gobEncode(block{v.AddrFrom, bogus.Serialize()})))
+	var err error
+	for err == nil {
+		_, err = readMessage(conn, DefaultMagic)
+	}
+	// 被动连接的对方声明的地址没有经过确认，封禁的是连接实际来自的主机
+	banned := node.Banned()
+	require.Len(t, banned, 1)
+	require.Equal(t, "127.0.0.1", banned[0].Addr)
+	require.False(t, node.isBanned("127.0.0.2:1"))
+	_, err = node.Chain().GetBlock(bogus.Hash)
+	require.Error(t, err)
+
+	// 被封禁的主机重新连接时被断开，换一个声明的地址也没有用
+	v.AddrFrom = "127.0.0.1:2"
+	again, err := net.Dial(protocol, node.Address())
+	require.NoError(t, err)
+	defer again.Close()
+	_ = again.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = writeMessage(again, DefaultMagic, "version", gobEncode(v))
+	_, err = readMessage(again, DefaultMagic)
+	require.Error(t, err)
+
+	require.True(t, node.Unban("127.0.0.1"))
+	handshake(t, node, v)
+}
+
+func TestPeer_BanKeysIncludeTheHostUnlessPermissioned(t *testing.T) {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	conn, err := net.Dial(protocol, ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	inbound := newPeer(nil, conn, "127.0.0.2:3000", true)
+	require.Equal(t, []string{"127.0.0.1"}, inbound.banKeys(false))
+	// 自己生成的 DID 不能代替地址，否则换一个 DID 就能绕过封禁
+	inbound.setDID("did:easyblock:peer")
+	require.Equal(t, []string{"127.0.0.1", "did:easyblock:peer"}, inbound.banKeys(false))
+	require.Equal(t, []string{"did:easyblock:peer"}, inbound.banKeys(true))
+
+	outbound := newPeer(nil, conn, "127.0.0.2:3000", false)
+	outbound.setDID("did:easyblock:peer")
+	require.Equal(t, []string{"127.0.0.2:3000", "did:easyblock:peer"}, outbound.banKeys(false))
+}
+
+func TestNode_AdminBanRoutes(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	node := startTestNode(t, genesis, "")
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	node.RegisterAdminRoutes(engine)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(http.MethodPost, "/admin/setban", `{"addr":"10.0.0.1","command":"add","duration":"1h"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.True(t, node.isBanned("10.0.0.1:3000"))
+
+	w = do(http.MethodGet, "/admin/listbanned", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Banned []BanEntry `json:"banned"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Banned, 1)
+	require.Equal(t, "10.0.0.1", list.Banned[0].Addr)
+
+	w = do(http.MethodPost, "/admin/setban", `{"addr":"10.0.0.2","command":"remove"}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	w = do(http.MethodPost, "/admin/setban", `{"addr":"10.0.0.2","command":"add","duration":"soon"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = do(http.MethodPost, "/admin/clearbanned", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, node.Banned())
+
+	// 管理接口不在外部矿工使用的 RPC 接口上
+	rpc := gin.New()
+	node.RegisterRoutes(rpc, nil)
+	w = httptest.NewRecorder()
+	rpc.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/clearbanned", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestNode_AdminListensOnlyOnLoopback(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	require.NoError(t, err)
+	cfg := DefaultConfig("test")
+	cfg.Address = ""
+	cfg.Seeds = nil
+	cfg.MempoolPath = ""
+	cfg.PeersPath = ""
+	cfg.BansPath = ""
+	cfg.IdentityPath = ""
+	cfg.AdminAddr = "0.0.0.0:0"
+	node := NewNode(cfg, chaintest.NewChain(t, genesis), ln)
+	require.ErrorContains(t, node.Start(context.Background()), "not a loopback address")
+	_ = ln.Close()
+}
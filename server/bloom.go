@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+)
+
+const (
+	// maxFilterSize 和 maxFilterHashes 限制轻节点加载的过滤器大小和哈希函数个数
+	maxFilterSize   = 36000
+	maxFilterHashes = 50
+	// maxFilterElement 为 filteradd 中单个元素的最大长度
+	maxFilterElement = 520
+)
+
+// bloomFilter 为轻节点交给全节点的布隆过滤器。全节点只发送与过滤器匹配的交易，
+// 过滤器会误报，轻节点因此不必向全节点透露确切的地址。
+type bloomFilter struct {
+	Bits   []byte
+	Hashes uint32
+	Tweak  uint32
+}
+
+// newBloomFilter 返回可以容纳 elements 个元素、误报率约为 fpRate 的过滤器
+func newBloomFilter(elements int, fpRate float64, tweak uint32) *bloomFilter {
+	elements = max(elements, 1)
+	fpRate = min(max(fpRate, 1e-9), 1)
+	bits := -float64(elements) * math.Log(fpRate) / (math.Ln2 * math.Ln2)
+	size := min(max(int(math.Ceil(bits/8)), 1), maxFilterSize)
+	hashes := min(max(uint32(float64(size*8)/float64(elements)*math.Ln2), 1), maxFilterHashes)
+	return &bloomFilter{Bits: make([]byte, size), Hashes: hashes, Tweak: tweak}
+}
+
+// validate 检查从网络收到的过滤器
+func (f *bloomFilter) validate() error {
+	switch {
+	case len(f.Bits) == 0 || len(f.Bits) > maxFilterSize:
+		return fmt.Errorf("filter size %d is not between 1 and %d bytes", len(f.Bits), maxFilterSize)
+	case f.Hashes == 0 || f.Hashes > maxFilterHashes:
+		return fmt.Errorf("filter uses %d hash functions, more than %d", f.Hashes, maxFilterHashes)
+	}
+	return nil
+}
+
+// positions 返回 data 在过滤器中的各个位置，第 i 个位置取自 sha256(tweak | i | data)。
+// 过滤器很小时双重哈希 h1 + i*h2 的各个位置会重复，误判率远高于预期，因此每个位置单独计算。
+func (f *bloomFilter) positions(data []byte) []uint64 {
+	buf := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(buf[:4], f.Tweak)
+	copy(buf[8:], data)
+
+	bits := uint64(len(f.Bits)) * 8
+	positions := make([]uint64, f.Hashes)
+	for i := range positions {
+		binary.BigEndian.PutUint32(buf[4:8], uint32(i))
+		sum := sha256.Sum256(buf)
+		positions[i] = binary.BigEndian.Uint64(sum[:8]) % bits
+	}
+	return positions
+}
+
+func (f *bloomFilter) add(data []byte) {
+	for _, pos := range f.positions(data) {
+		f.Bits[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+func (f *bloomFilter) contains(data []byte) bool {
+	for _, pos := range f.positions(data) {
+		if f.Bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesTx 判断交易的任一过滤元素是否在过滤器中
+func (f *bloomFilter) matchesTx(tx *chain.Transaction) bool {
+	for _, element := range tx.FilterElements() {
+		if f.contains(element) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterLoad 由轻节点发送，之后全节点只向它发送与过滤器匹配的交易
+type filterLoad struct {
+	AddrFrom string
+	Filter   bloomFilter
+}
+
+// filterAdd 向已加载的过滤器加入一个元素，例如钱包新生成的地址
+type filterAdd struct {
+	AddrFrom string
+	Element  []byte
+}
+
+// merkleBlock 回复 getdata filteredblock：区块头以及区块中与过滤器匹配的交易和它们的默克尔证明
+type merkleBlock struct {
+	AddrFrom string
+	Header   chain.BlockHeader
+	Matches  []filteredTx
+}
+
+type filteredTx struct {
+	Tx    []byte
+	Proof chain.MerkleProof
+}
+
+var errNoFilter = errors.New("no filter loaded")
+
+// setFilter 设置对方加载的过滤器，为 nil 时清除
+func (p *Peer) setFilter(f *bloomFilter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filter = f
+}
+
+// addToFilter 向对方的过滤器加入元素
+func (p *Peer) addToFilter(element []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.filter == nil {
+		return errNoFilter
+	}
+	p.filter.add(element)
+	return nil
+}
+
+// matchesFilter 判断交易是否与对方的过滤器匹配，没有过滤器时不匹配
+func (p *Peer) matchesFilter(tx *chain.Transaction) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.filter != nil && p.filter.matchesTx(tx)
+}
+
+func (n *Node) handleFilterLoad(p *Peer, request []byte) {
+	var payload filterLoad
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "filterload", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	if err := payload.Filter.validate(); err != nil {
+		n.sendReject(p, "filterload", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	p.setFilter(&payload.Filter)
+}
+
+func (n *Node) handleFilterAdd(p *Peer, request []byte) {
+	var payload filterAdd
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "filteradd", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	if len(payload.Element) > maxFilterElement {
+		n.sendReject(p, "filteradd", RejectMalformed, fmt.Sprintf("element is longer than %d bytes", maxFilterElement), nil)
+		n.misbehaving(p, scoreMalformed, "filter element too long")
+		return
+	}
+	if err := p.addToFilter(payload.Element); err != nil {
+		n.sendReject(p, "filteradd", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreProtocol, err.Error())
+	}
+}
+
+func (n *Node) handleFilterClear(p *Peer, request []byte) {
+	p.setFilter(nil)
+}
+
+// sendMerkleBlock 向 p 发送区块 b 中与它的过滤器匹配的交易及其默克尔证明
+func (n *Node) sendMerkleBlock(p *Peer, b *chain.Block) {
+	reply := merkleBlock{AddrFrom: n.address, Header: b.Header()}
+	for i, tx := range b.Transactions {
+		if !p.matchesFilter(tx) {
+			continue
+		}
+		proof, err := b.MerkleProof(i)
+		if err != nil {
+			fmt.Printf("Failed to prove transaction %x in block %x: %v\n", tx.ID, b.Hash, err)
+			return
+		}
+		reply.Matches = append(reply.Matches, filteredTx{tx.Serialize(), proof})
+	}
+	n.sendData(p, "merkleblock", gobEncode(reply))
+}
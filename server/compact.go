@@ -0,0 +1,342 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+)
+
+const (
+	// compactBlocksVersion 为支持紧凑区块的最低协议版本，其他节点仍然用 inv 宣布新区块
+	compactBlocksVersion = 4
+	// shortIDLength 为短交易 ID 使用的哈希字节数
+	shortIDLength = 6
+	// maxPartialBlocks 为同时等待缺失交易的紧凑区块数
+	maxPartialBlocks = 16
+)
+
+// cmpctBlock 为紧凑区块：区块头、除预先填充的交易以外每笔交易的短 ID，以及接收方一定没有的交易（coinbase）。
+// 接收方用内存池中的交易还原区块，只请求缺少的交易。
+type cmpctBlock struct {
+	AddrFrom string
+	Header   chain.BlockHeader
+	// Nonce 与区块哈希一起决定短 ID，每次宣布随机选择，避免不同交易的短 ID 总是相同
+	Nonce     uint64
+	ShortIDs  []uint64
+	Prefilled []prefilledTx
+}
+
+// prefilledTx 为紧凑区块中完整发送的交易，Index 为它在区块中的位置
+type prefilledTx struct {
+	Index int
+	Tx    []byte
+}
+
+// getBlockTxn 请求区块中位于 Indexes 的交易
+type getBlockTxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+// blockTxn 回复 getblocktxn，交易与请求的位置一一对应
+type blockTxn struct {
+	AddrFrom     string
+	BlockHash    []byte
+	Transactions [][]byte
+}
+
+// partialBlock 为正在还原的紧凑区块
+type partialBlock struct {
+	header chain.BlockHeader
+	txs    []*chain.Transaction
+	// missing 为已经向 peer 请求、尚未收到的交易位置
+	missing []int
+	peer    *Peer
+	sent    time.Time
+}
+
+// partialBlocks 保存等待缺失交易的紧凑区块，键为区块哈希
+type partialBlocks struct {
+	mu     sync.Mutex
+	blocks map[string]*partialBlock
+}
+
+// shortTxID 返回交易 txID 在区块 blockHash 的紧凑区块中的短 ID
+func shortTxID(blockHash []byte, nonce uint64, txID []byte) uint64 {
+	var salt [8]byte
+	binary.BigEndian.PutUint64(salt[:], nonce)
+	h := sha256.New()
+	h.Write(blockHash)
+	h.Write(salt[:])
+	h.Write(txID)
+	var id [8]byte
+	copy(id[8-shortIDLength:], h.Sum(nil)[:shortIDLength])
+	return binary.BigEndian.Uint64(id[:])
+}
+
+// newCmpctBlock 返回区块 b 的紧凑区块，coinbase 被预先填充
+func newCmpctBlock(addrFrom string, b *chain.Block, nonce uint64) cmpctBlock {
+	cb := cmpctBlock{AddrFrom: addrFrom, Header: b.Header(), Nonce: nonce}
+	for i, tx := range b.Transactions {
+		if i == 0 {
+			cb.Prefilled = append(cb.Prefilled, prefilledTx{0, tx.Serialize()})
+			continue
+		}
+		cb.ShortIDs = append(cb.ShortIDs, shortTxID(b.Hash, nonce, tx.ID))
+	}
+	return cb
+}
+
+// reconstruct 用预先填充的交易和 pool 中的交易还原紧凑区块的交易列表，返回无法还原的交易位置。
+// 多笔交易的短 ID 相同时无法确定是哪一笔，该位置也作为缺失的交易请求。
+func (cb *cmpctBlock) reconstruct(pool []*chain.Transaction) ([]*chain.Transaction, []int, error) {
+	total := len(cb.ShortIDs) + len(cb.Prefilled)
+	txs := make([]*chain.Transaction, total)
+	filled := make([]bool, total)
+	last := -1
+	for _, pre := range cb.Prefilled {
+		if pre.Index <= last || pre.Index >= total {
+			return nil, nil, fmt.Errorf("prefilled transaction index %d out of order", pre.Index)
+		}
+		last = pre.Index
+		tx, err := chain.DecodeTransaction(pre.Tx)
+		if err != nil {
+			return nil, nil, err
+		}
+		txs[pre.Index], filled[pre.Index] = &tx, true
+	}
+	if total == 0 || !filled[0] {
+		return nil, nil, errors.New("coinbase is not prefilled")
+	}
+
+	candidates := make(map[uint64]*chain.Transaction, len(pool))
+	collided := make(map[uint64]bool)
+	for _, tx := range pool {
+		id := shortTxID(cb.Header.Hash, cb.Nonce, tx.ID)
+		if _, ok := candidates[id]; ok {
+			collided[id] = true
+		}
+		candidates[id] = tx
+	}
+
+	var missing []int
+	next := 0
+	for i := range txs {
+		if filled[i] {
+			continue
+		}
+		id := cb.ShortIDs[next]
+		next++
+		if tx, ok := candidates[id]; ok && !collided[id] {
+			txs[i] = tx
+			continue
+		}
+		missing = append(missing, i)
+	}
+	return txs, missing, nil
+}
+
+// relayBlock 向除 from 之外、尚不知道区块 b 的节点转发它：支持紧凑区块的全节点收到紧凑区块，
+// 其他节点（包括轻节点）收到 inv
+func (n *Node) relayBlock(b *chain.Block, from *Peer) {
+	var compact []byte
+	for _, peer := range n.handshakedPeers() {
+		if peer == from || !peer.knownInventory.add(b.Hash) {
+			continue
+		}
+		command, payload := "inv", gobEncode(inv{n.address, "block", [][]byte{b.Hash}})
+		if v := peer.Version(); v != nil && v.Version >= compactBlocksVersion && !v.Services.Has(ServiceLight) {
+			if compact == nil {
+				compact = gobEncode(newCmpctBlock(n.address, b, rand.Uint64()))
+			}
+			command, payload = "cmpctblock", compact
+		}
+		if err := peer.Send(command, payload); err != nil {
+			fmt.Printf("Failed to relay block %x to %s: %v\n", b.Hash, peer, err)
+		}
+	}
+}
+
+// handleCmpctBlock 用内存池还原紧凑区块，缺少交易时向对方请求。前一区块未知时按区块头同步处理。
+func (n *Node) handleCmpctBlock(p *Peer, request []byte) {
+	var payload cmpctBlock
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "cmpctblock", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	n.registerPeer(p, payload.AddrFrom)
+	header := payload.Header
+	if err := chain.CheckHeader(&header); err != nil {
+		n.sendReject(p, "cmpctblock", RejectInvalid, err.Error(), header.Hash)
+		n.misbehaving(p, scoreInvalidBlock, err.Error())
+		return
+	}
+	p.knownInventory.add(header.Hash)
+	if n.bc.HasBlock(header.Hash) || n.orphans.has(header.Hash) {
+		return
+	}
+	if !n.bc.HasBlock(header.PreBlockHash) {
+		fmt.Printf("Compact block %x does not connect to our chain, requesting headers from %s\n", header.Hash, p)
+		n.sendGetHeaders(p)
+		return
+	}
+
+	txs, missing, err := payload.reconstruct(n.pool.Transactions())
+	if err != nil {
+		n.sendReject(p, "cmpctblock", RejectMalformed, err.Error(), header.Hash)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	if len(missing) == 0 {
+		n.completeCmpctBlock(p, header, txs)
+		return
+	}
+
+	fmt.Printf("Compact block %x is missing %d of %d transactions, requesting them from %s\n", header.Hash, len(missing), len(txs), p)
+	n.partials.add(&partialBlock{header: header, txs: txs, missing: missing, peer: p, sent: n.now()})
+	n.sendData(p, "getblocktxn", gobEncode(getBlockTxn{n.address, header.Hash, missing}))
+}
+
+// handleGetBlockTxn 回复区块中被请求的交易
+func (n *Node) handleGetBlockTxn(p *Peer, request []byte) {
+	var payload getBlockTxn
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "getblocktxn", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	n.registerPeer(p, payload.AddrFrom)
+
+	b, err := n.bc.GetBlock(payload.BlockHash)
+	if err != nil {
+		return
+	}
+	reply := blockTxn{AddrFrom: n.address, BlockHash: b.Hash}
+	for _, index := range payload.Indexes {
+		if index < 0 || index >= len(b.Transactions) {
+			n.sendReject(p, "getblocktxn", RejectMalformed, fmt.Sprintf("transaction index %d out of range", index), b.Hash)
+			n.misbehaving(p, scoreMalformed, "transaction index out of range")
+			return
+		}
+		reply.Transactions = append(reply.Transactions, b.Transactions[index].Serialize())
+	}
+	n.sendData(p, "blocktxn", gobEncode(reply))
+}
+
+// handleBlockTxn 用收到的交易补全紧凑区块
+func (n *Node) handleBlockTxn(p *Peer, request []byte) {
+	var payload blockTxn
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "blocktxn", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	n.registerPeer(p, payload.AddrFrom)
+
+	partial := n.partials.take(payload.BlockHash, p)
+	if partial == nil {
+		// 区块已经从其他途径收到，或者请求已经超时
+		return
+	}
+	if len(payload.Transactions) != len(partial.missing) {
+		n.sendReject(p, "blocktxn", RejectMalformed, "wrong number of transactions", payload.BlockHash)
+		n.misbehaving(p, scoreMalformed, "wrong number of block transactions")
+		n.requestData(p, "block", payload.BlockHash)
+		return
+	}
+	for i, data := range payload.Transactions {
+		tx, err := chain.DecodeTransaction(data)
+		if err != nil {
+			n.sendReject(p, "blocktxn", RejectMalformed, err.Error(), payload.BlockHash)
+			n.misbehaving(p, scoreMalformed, err.Error())
+			n.requestData(p, "block", payload.BlockHash)
+			return
+		}
+		partial.txs[partial.missing[i]] = &tx
+	}
+	n.completeCmpctBlock(p, partial.header, partial.txs)
+}
+
+// completeCmpctBlock 把还原的区块接到链上。默克尔根与区块头不一致说明短 ID 匹配到了错误的交易，改为请求完整的区块。
+func (n *Node) completeCmpctBlock(p *Peer, header chain.BlockHeader, txs []*chain.Transaction) {
+	b := &chain.Block{
+		Version:      header.Version,
+		TimeStamp:    header.TimeStamp,
+		PreBlockHash: header.PreBlockHash,
+		Hash:         header.Hash,
+		Nonce:        header.Nonce,
+		Height:       header.Height,
+		Transactions: txs,
+	}
+	if !bytes.Equal(b.HashTransactions(), header.MerkleRoot) {
+		fmt.Printf("Reconstructed block %x does not match its merkle root, requesting the full block from %s\n", b.Hash, p)
+		n.requestData(p, "block", b.Hash)
+		return
+	}
+	n.received(p, b.Hash)
+	n.blockArrived(p, b.Hash)
+	n.acceptBlock(p, b)
+	n.advanceSync()
+}
+
+// add 保存等待缺失交易的紧凑区块，超过 maxPartialBlocks 时丢弃最早的
+func (s *partialBlocks) add(partial *partialBlock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.blocks == nil {
+		s.blocks = make(map[string]*partialBlock)
+	}
+	for len(s.blocks) >= maxPartialBlocks {
+		var oldest string
+		for hash, b := range s.blocks {
+			if oldest == "" || b.sent.Before(s.blocks[oldest].sent) {
+				oldest = hash
+			}
+		}
+		delete(s.blocks, oldest)
+	}
+	s.blocks[string(partial.header.Hash)] = partial
+}
+
+// take 取出向 p 请求了缺失交易的紧凑区块
+func (s *partialBlocks) take(hash []byte, p *Peer) *partialBlock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	partial, ok := s.blocks[string(hash)]
+	if !ok || partial.peer != p {
+		return nil
+	}
+	delete(s.blocks, string(hash))
+	return partial
+}
+
+// checkPartialBlocks 对超过 requestTimeout 没有收到缺失交易的紧凑区块改为请求完整的区块
+func (n *Node) checkPartialBlocks(now time.Time) {
+	var expired []*partialBlock
+	n.partials.mu.Lock()
+	for hash, partial := range n.partials.blocks {
+		if now.Sub(partial.sent) > requestTimeout {
+			expired = append(expired, partial)
+			delete(n.partials.blocks, hash)
+		}
+	}
+	n.partials.mu.Unlock()
+
+	for _, partial := range expired {
+		if isClosed(partial.peer) || n.bc.HasBlock(partial.header.Hash) {
+			continue
+		}
+		n.requestData(partial.peer, "block", partial.header.Hash)
+	}
+}
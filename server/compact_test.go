@@ -0,0 +1,74 @@
+package server
+
+import (
+	"testing"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCmpctBlock_ReconstructsFromMempool(t *testing.T) {
+	address := string(wallet.NewWallet().GetAddress())
+	var txs []*chain.Transaction
+	for _, data := range []string{"", "first", "second", "third"} {
+		txs = append(txs, chain.NewCoinBaseTX(address, data))
+	}
+	b := &chain.Block{Hash: []byte("block"), PreBlockHash: []byte("parent"), Height: 1, Transactions: txs}
+
+	var compact cmpctBlock
+	require.NoError(t, decodePayload(gobEncode(newCmpctBlock("localhost:3000", b, 7)), &compact))
+	require.Len(t, compact.ShortIDs, 3)
+	require.Len(t, compact.Prefilled, 1, "only the coinbase is sent in full")
+
+	// 内存池中缺少第二笔交易
+	other := chain.NewCoinBaseTX(address, "unrelated")
+	rebuilt, missing, err := compact.reconstruct([]*chain.Transaction{txs[3], other, txs[1]})
+	require.NoError(t, err)
+	require.Equal(t, []int{2}, missing)
+
+	rebuilt[2] = txs[2]
+	restored := &chain.Block{Transactions: rebuilt}
+	require.Equal(t, compact.Header.MerkleRoot, restored.HashTransactions())
+
+	// 没有预先填充 coinbase 的紧凑区块无法还原
+	compact.Prefilled = nil
+	compact.ShortIDs = append(compact.ShortIDs, 1)
+	_, _, err = compact.reconstruct(nil)
+	require.Error(t, err)
+}
+
+func TestNode_ServesBlockTransactions(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	node := startTestNode(t, genesis, "")
+	conn := handshake(t, node, testVersion(genesis))
+
+	// 握手后节点还会发来 addr 等消息，跳过它们
+	readCommand := func(command string) []byte {
+		msg, err := readMessage(conn, DefaultMagic)
+		for err == nil && msg.Command != command {
+			msg, err = readMessage(conn, DefaultMagic)
+		}
+		require.NoError(t, err)
+		return msg.Payload
+	}
+
+	require.NoError(t, writeMessage(conn, DefaultMagic, "getblocktxn", gobEncode(getBlockTxn{"", genesis.Hash, []int{0}})))
+	var reply blockTxn
+	require.NoError(t, decodePayload(readCommand("blocktxn"), &reply))
+	require.Equal(t, genesis.Hash, reply.BlockHash)
+	require.Len(t, reply.Transactions, 1)
+	coinbase, err := chain.DecodeTransaction(reply.Transactions[0])
+	require.NoError(t, err)
+	require.Equal(t, genesis.Transactions[0].ID, coinbase.ID)
+
+	require.NoError(t, writeMessage(conn, DefaultMagic, "getblocktxn", gobEncode(getBlockTxn{"", genesis.Hash, []int{5}})))
+	var rej reject
+	require.NoError(t, decodePayload(readCommand("reject"), &rej))
+	require.Equal(t, "getblocktxn", rej.Message)
+	require.Equal(t, RejectMalformed, rej.Code)
+}
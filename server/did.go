@@ -13,11 +13,13 @@ import (
 	chaindid "github.com/qujing226/blockchain/did"
 	"github.com/qujing226/blockchain/wallet"
 	"github.com/redis/go-redis/v9"
+	"io"
 	"log"
 	"math/big"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -48,10 +50,54 @@ func InitConfig() {
 	kws, _ = wallet.NewKemWallets()
 }
 
-func StartDidService() {
-	server := gin.Default()
-	RegisterRoutes(server)
-	_ = server.Run(":8080")
+// didServiceAddr 为 DID 服务监听的地址
+const didServiceAddr = ":8080"
+
+// background 为处理请求时启动的、把 DID 文档发送到节点的协程，停止服务时等待它们结束
+var background sync.WaitGroup
+
+// StartDidService 在 didServiceAddr 上提供 DID 服务，直到 ctx 被取消。
+// 之后停止接受请求，等待正在处理的请求和已经发起的上链请求结束。
+func StartDidService(ctx context.Context) error {
+	engine := gin.Default()
+	RegisterRoutes(engine)
+	srv := &http.Server{Addr: didServiceAddr, Handler: engine}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down DID service...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	background.Wait()
+	return err
+}
+
+// CloseConfig 关闭 InitConfig 打开的区块链数据库和 Redis 连接
+func CloseConfig() {
+	if bc != nil {
+		bc.Close()
+	}
+	if c, ok := rdb.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// trackBackground 在后台执行 f，StartDidService 返回前等待它结束
+func trackBackground(f func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
 }
 
 func RegisterRoutes(s *gin.Engine) {
@@ -159,9 +205,9 @@ func CreateDidDocument(ctx *gin.Context) {
 	}
 	doc := chaindid.GenerateDidDocument(p)
 	// doc 上链
-	go func() {
+	trackBackground(func() {
 		SaveDocToBlockChain(&w, doc)
-	}()
+	})
 
 	ctx.JSON(200, gin.H{
 		"did_document": doc,
@@ -277,9 +323,11 @@ func SaveDocToBlockChain(w *wallet.Wallet, doc *did.Document) {
 		log.Println("serialize did document error")
 	}
 	tx := chain.NewDidDocumentTransaction(w, b)
-	// 向中心节点发送 did 交易
-	fmt.Println("正在将 DID document 发送至中心节点")
-	SendTx(tx)
+	// 向节点发送 did 交易，节点会转发给网络中的其他节点
+	fmt.Println("正在将 DID document 发送至节点")
+	if err := SendTx(tx); err != nil {
+		log.Println(err)
+	}
 }
 
 func UpdateDocToBlockChain(w *wallet.Wallet, doc *did.Document) {
@@ -288,9 +336,11 @@ func UpdateDocToBlockChain(w *wallet.Wallet, doc *did.Document) {
 		log.Println("serialize did document error")
 	}
 	tx := chain.NewDidDocumentTransaction(w, b)
-	// 向中心节点发送 did 交易
-	fmt.Println("正在将 DID document 发送至中心节点")
-	SendTx(tx)
+	// 向节点发送 did 交易，节点会转发给网络中的其他节点
+	fmt.Println("正在将 DID document 发送至节点")
+	if err := SendTx(tx); err != nil {
+		log.Println(err)
+	}
 }
 
 func UpdateDocWithKem(ctx *gin.Context) {
@@ -319,9 +369,9 @@ func UpdateDocWithKem(ctx *gin.Context) {
 	doc = chaindid.UpdateDidDocument(doc, kw.EncapsulationKey)
 
 	// 存储
-	go func() {
+	trackBackground(func() {
 		UpdateDocToBlockChain(&w, doc)
-	}()
+	})
 	fmt.Printf("%+v\n", doc)
 	ctx.JSON(http.StatusOK, gin.H{"did_document": doc})
 
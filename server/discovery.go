@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// maxAddrPerMsg 为一条 addr 消息最多包含的地址数
+	maxAddrPerMsg = 1000
+	// maxAddrRelay 为会被转发的 addr 消息最多包含的地址数，大的 addr 消息通常是对 getaddr 的回复
+	maxAddrRelay = 10
+	// addrRelayPeers 为每个新地址转发给的节点数
+	addrRelayPeers = 2
+	// addrRelayAge 为只转发最近多久内在线的地址
+	addrRelayAge = 10 * time.Minute
+	// maxAddrFuture 为地址时间戳最多可以超前本地时钟的时间，超出时视为很久以前
+	maxAddrFuture = 10 * time.Minute
+	// futureAddrPenalty 为时间戳超前的地址被当作多久之前在线
+	futureAddrPenalty = 5 * 24 * time.Hour
+
+	// connectInterval 为检查出站连接数的间隔
+	connectInterval = 5 * time.Second
+	// peersSaveInterval 为保存地址表的间隔
+	peersSaveInterval = 5 * time.Minute
+)
+
+// netAddress 为 addr 消息中的一个地址以及最近一次听说它在线的时间（Unix 秒）
+type netAddress struct {
+	Addr      string
+	Timestamp int64
+}
+
+// addr 用来分享已知节点的地址
+type addr struct {
+	AddrFrom string
+	AddrList []netAddress
+}
+
+// getAddr 请求对方分享它知道的节点地址
+type getAddr struct {
+	AddrFrom string
+}
+
+// PeersFilePath 返回节点 nodeID 的地址文件路径
+func PeersFilePath(nodeID string) string {
+	return fmt.Sprintf(peersFile, nodeID)
+}
+
+// sendAddr 通过 p 分享地址
+func (n *Node) sendAddr(p *Peer, addrs []netAddress) {
+	if len(addrs) == 0 {
+		return
+	}
+	if err := p.Send("addr", gobEncode(addr{n.address, addrs})); err != nil {
+		fmt.Printf("Failed to send addr to %s: %v\n", p, err)
+	}
+}
+
+// sendGetAddr 向 p 请求它知道的地址
+func (n *Node) sendGetAddr(p *Peer) {
+	if err := p.Send("getaddr", gobEncode(getAddr{n.address})); err != nil {
+		fmt.Printf("Failed to send getaddr to %s: %v\n", p, err)
+	}
+}
+
+// advertise 握手完成后通过 p 告诉对方本节点的地址
+func (n *Node) advertise(p *Peer) {
+	if n.address == "" {
+		return
+	}
+	n.sendAddr(p, []netAddress{{n.address, n.now().Unix()}})
+}
+
+// handleGetAddr 用地址表中随机的一部分地址回复 getaddr，每个连接只回复一次，
+// 避免对方反复请求得到整个地址表
+func (n *Node) handleGetAddr(p *Peer, request []byte) {
+	var payload getAddr
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "getaddr", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	if !p.markAddrAnswered() {
+		return
+	}
+
+	var addrs []netAddress
+	for _, ka := range n.book.sample(maxAddrPerMsg) {
+		if ka.Addr != p.Addr() {
+			addrs = append(addrs, netAddress{ka.Addr, ka.LastSeen.Unix()})
+		}
+	}
+	n.sendAddr(p, addrs)
+}
+
+// handleAddr 将收到的地址加入地址表。少量的新鲜地址（通常是节点对自己的广播）
+// 会转发给另外几个随机的节点，使地址在网络中传播。
+func (n *Node) handleAddr(p *Peer, request []byte) {
+	var payload addr
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "addr", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	if len(payload.AddrList) > maxAddrPerMsg {
+		n.sendReject(p, "addr", RejectMalformed, fmt.Sprintf("more than %d addresses", maxAddrPerMsg), nil)
+		n.misbehaving(p, scoreMalformed, "too many addresses")
+		return
+	}
+
+	now := n.now()
+	var fresh []netAddress
+	added := 0
+	for _, a := range payload.AddrList {
+		if a.Addr == "" || a.Addr == n.address {
+			continue
+		}
+		seen := time.Unix(a.Timestamp, 0)
+		if seen.After(now.Add(maxAddrFuture)) {
+			seen = now.Add(-futureAddrPenalty)
+		}
+		if n.book.add(a.Addr, seen, p.String()) {
+			added++
+		}
+		if now.Sub(seen) <= addrRelayAge {
+			fresh = append(fresh, netAddress{a.Addr, seen.Unix()})
+		}
+	}
+	if added > 0 {
+		fmt.Printf("Learned %d new addresses from %s, %d known\n", added, p, len(n.book.addresses()))
+		n.wakeConnector()
+	}
+	if len(payload.AddrList) <= maxAddrRelay {
+		n.relayAddrs(p, fresh)
+	}
+}
+
+// relayAddrs 将地址转发给除 from 之外随机的 addrRelayPeers 个已握手的节点
+func (n *Node) relayAddrs(from *Peer, addrs []netAddress) {
+	if len(addrs) == 0 {
+		return
+	}
+	var targets []*Peer
+	for _, peer := range n.handshakedPeers() {
+		if peer != from {
+			targets = append(targets, peer)
+		}
+	}
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if len(targets) > addrRelayPeers {
+		targets = targets[:addrRelayPeers]
+	}
+	for _, peer := range targets {
+		// 不把对方自己的地址发回给它
+		var relay []netAddress
+		for _, a := range addrs {
+			if a.Addr != peer.Addr() {
+				relay = append(relay, a)
+			}
+		}
+		n.sendAddr(peer, relay)
+	}
+}
+
+// wakeConnector 让连接管理协程立即检查出站连接数，例如在连接断开或学到新地址之后
+func (n *Node) wakeConnector() {
+	select {
+	case n.connectNow <- struct{}{}:
+	default:
+	}
+}
+
+// maintainOutbound 保持 cfg.MaxOutbound 个出站连接。地址从地址表中随机选择，
+// 连接失败的地址按连续失败次数指数退避后再重试；地址表中没有可用地址时重新尝试种子节点。
+func (n *Node) maintainOutbound(ctx context.Context) {
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+
+	for {
+		n.connectOutbound(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-n.connectNow:
+		}
+	}
+}
+
+func (n *Node) connectOutbound(ctx context.Context) {
+	tried := make(map[string]bool)
+	for n.outboundCount() < n.cfg.MaxOutbound && ctx.Err() == nil {
+		addr, ok := n.book.candidate(func(addr string) bool {
+			return tried[addr] || addr == n.address || n.connectedTo(addr) || n.isBanned(addr)
+		})
+		if !ok {
+			n.addSeeds()
+			return
+		}
+		tried[addr] = true
+		if _, err := n.peerFor(addr); err != nil {
+			fmt.Printf("%s is not available: %v\n", addr, err)
+		}
+	}
+}
+
+// addSeeds 将种子节点加入地址表，已有的种子节点不变
+func (n *Node) addSeeds() {
+	for _, seed := range n.cfg.Seeds {
+		if seed != n.address {
+			n.book.add(seed, n.now(), seed)
+		}
+	}
+}
+
+// outboundCount 返回本节点主动建立的连接数
+func (n *Node) outboundCount() int {
+	count := 0
+	for _, peer := range n.Peers() {
+		if !peer.Inbound() {
+			count++
+		}
+	}
+	return count
+}
+
+// inboundCount 返回对方发起的连接数
+func (n *Node) inboundCount() int {
+	return len(n.Peers()) - n.outboundCount()
+}
+
+// connectedTo 判断是否已有与 addr 的连接
+func (n *Node) connectedTo(addr string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, ok := n.peersByAddr[addr]
+	return ok
+}
+
+// savePeersPeriodically 定期将地址表写入磁盘
+func (n *Node) savePeersPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(peersSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.book.save(n.cfg.PeersPath); err != nil {
+			fmt.Printf("Failed to save peers: %v\n", err)
+		}
+	}
+}
+
+func (n *Node) savePeers() {
+	if err := n.book.save(n.cfg.PeersPath); err != nil {
+		fmt.Printf("Failed to save peers: %v\n", err)
+		return
+	}
+	fmt.Printf("Saved %d peer addresses to %s\n", len(n.book.addresses()), n.cfg.PeersPath)
+}
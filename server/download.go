@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+)
+
+// downloadWindow 为同步时最多请求到第一个尚未保存的区块之后多少个区块。
+// 提前到达的区块需要缓存到前面的区块保存之后，窗口限制了缓存的大小：
+// 区块消息最大 4MB，缓存最多占用约 128MB。窗口是 maxBlocksInFlight 的两倍，足够两个节点同时下载。
+const downloadWindow = 32
+
+// blockDownload 为等待下载的区块的请求状态
+type blockDownload struct {
+	// peer 为当前请求的节点，为 nil 时等待重新分配；sent 为请求发出的时间
+	peer *Peer
+	sent time.Time
+	// tried 为已经请求过的节点，重新分配时优先选择其他节点
+	tried map[*Peer]bool
+}
+
+// bufferedBlock 为提前到达、前一区块尚未保存的区块以及发送它的节点
+type bufferedBlock struct {
+	block *chain.Block
+	peer  *Peer
+}
+
+// hasBlockFor 判断 p 是否可能拥有区块头 h 对应的区块：对方宣布过或发来过该区块头，
+// 或者对方保存完整的历史并且握手时的高度不低于该区块
+func hasBlockFor(p *Peer, h *chain.BlockHeader) bool {
+	if p.knownInventory.has(h.Hash) {
+		return true
+	}
+	v := p.Version()
+	return v != nil && p.Services().Has(ServiceFull) && v.BestHeight >= h.Height
+}
+
+// scheduleBlocks 把下载窗口内尚未请求的区块分配给拥有它们的节点，每个节点最多同时请求 maxBlocksInFlight 个。
+// 优先选择没有请求过该区块的节点，其次选择正在请求的区块最少的节点。
+func (n *Node) scheduleBlocks() {
+	type assignment struct {
+		peer *Peer
+		hash []byte
+	}
+	var assigned []assignment
+	peers := n.handshakedPeers()
+	now := n.now()
+
+	s := &n.chainSync
+	s.mu.Lock()
+	window := s.pending
+	if len(window) > downloadWindow {
+		window = window[:downloadWindow]
+	}
+	inWindow := make(map[string]bool, len(window))
+	for i := range window {
+		inWindow[string(window[i].Hash)] = true
+	}
+	load := make(map[*Peer]int)
+	for key, d := range s.downloads {
+		switch {
+		case !inWindow[key]:
+			// 区块头已被新的分叉替换，仍在途中的区块到达后按普通区块处理
+			delete(s.downloads, key)
+		case d.peer != nil:
+			load[d.peer]++
+		}
+	}
+	for key := range s.buffered {
+		if !inWindow[key] {
+			delete(s.buffered, key)
+		}
+	}
+
+	for i := range window {
+		h := &window[i]
+		key := string(h.Hash)
+		if _, ok := s.buffered[key]; ok || n.orphans.has(h.Hash) {
+			continue
+		}
+		d, ok := s.downloads[key]
+		if ok && d.peer != nil {
+			continue
+		}
+		if !ok {
+			d = &blockDownload{tried: make(map[*Peer]bool)}
+		}
+
+		var best *Peer
+		for _, p := range peers {
+			if load[p] >= maxBlocksInFlight || !hasBlockFor(p, h) {
+				continue
+			}
+			if best == nil || (d.tried[best] && !d.tried[p]) || (d.tried[best] == d.tried[p] && load[p] < load[best]) {
+				best = p
+			}
+		}
+		if best == nil {
+			continue
+		}
+		d.peer, d.sent = best, now
+		d.tried[best] = true
+		s.downloads[key] = d
+		load[best]++
+		assigned = append(assigned, assignment{best, h.Hash})
+	}
+	s.mu.Unlock()
+
+	for _, a := range assigned {
+		n.sendGetData(a.peer, "block", a.hash)
+	}
+}
+
+// checkDownloads 把超时或所在连接已经断开的区块请求重新分配给其他节点，
+// 同一次检查中超时的请求记为对方的一次停滞，连续停滞 maxStalls 次的节点被断开
+func (n *Node) checkDownloads(now time.Time) {
+	stalled := make(map[*Peer]bool)
+
+	s := &n.chainSync
+	s.mu.Lock()
+	for key, d := range s.downloads {
+		if d.peer == nil {
+			continue
+		}
+		closed := isClosed(d.peer)
+		if !closed && now.Sub(d.sent) <= requestTimeout {
+			continue
+		}
+		if !closed {
+			fmt.Printf("Block %x from %s timed out, reassigning\n", []byte(key), d.peer)
+			stalled[d.peer] = true
+		}
+		d.peer = nil
+	}
+	s.mu.Unlock()
+
+	for peer := range stalled {
+		if stalls := peer.addStall(); stalls >= maxStalls {
+			fmt.Printf("%s stalled %d requests, disconnecting\n", peer, stalls)
+			peer.Close()
+		}
+	}
+	n.scheduleBlocks()
+}
+
+// blockArrived 在收到 p 发来的区块后结束对应的下载请求
+func (n *Node) blockArrived(p *Peer, hash []byte) {
+	s := &n.chainSync
+	s.mu.Lock()
+	d, ok := s.downloads[string(hash)]
+	if ok {
+		delete(s.downloads, string(hash))
+	}
+	s.mu.Unlock()
+
+	if ok && d.peer == p {
+		p.resetStalls()
+	}
+}
+
+// bufferBlock 缓存前一区块尚未保存、但在等待下载的区块头中的区块，返回区块是否被缓存
+func (n *Node) bufferBlock(p *Peer, b *chain.Block) bool {
+	s := &n.chainSync
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limit := min(len(s.pending), downloadWindow)
+	for i := 0; i < limit; i++ {
+		if string(s.pending[i].Hash) == string(b.Hash) {
+			s.buffered[string(b.Hash)] = bufferedBlock{b, p}
+			return true
+		}
+	}
+	return false
+}
+
+// connectBuffered 移除已经保存的区块头，依次把缓存中接在链上的区块接到链上
+func (n *Node) connectBuffered() {
+	s := &n.chainSync
+	for {
+		s.mu.Lock()
+		pending := s.pending
+		for len(pending) > 0 && n.bc.HasBlock(pending[0].Hash) {
+			delete(s.buffered, string(pending[0].Hash))
+			pending = pending[1:]
+		}
+		s.pending = pending
+		var next bufferedBlock
+		ok := false
+		if len(pending) > 0 {
+			key := string(pending[0].Hash)
+			if next, ok = s.buffered[key]; ok {
+				delete(s.buffered, key)
+			}
+		}
+		s.mu.Unlock()
+
+		if !ok || !n.acceptBlock(next.peer, next.block) {
+			return
+		}
+	}
+}
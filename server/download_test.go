@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+// readGetData 跳过其他消息，读取 count 个 getdata 请求的区块哈希
+func readGetData(t *testing.T, conn net.Conn, count int) map[string]bool {
+	requested := make(map[string]bool)
+	for len(requested) < count {
+		msg, err := readMessage(conn, DefaultMagic)
+		require.NoError(t, err)
+		if msg.Command != "getdata" {
+			continue
+		}
+		var payload getData
+		require.NoError(t, decodePayload(msg.Payload, &payload))
+		require.Equal(t, "block", payload.Type)
+		requested[string(payload.ID)] = true
+	}
+	return requested
+}
+
+func TestNode_SpreadsBlockDownloadsAndReassignsTimeouts(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	node := startTestNode(t, genesis, "")
+
+	const count = 2*maxBlocksInFlight + 8
+	var conns []net.Conn
+	for i := 1; i <= 2; i++ {
+		v := testVersion(genesis)
+		v.AddrFrom = fmt.Sprintf("127.0.0.1:%d", i)
+		v.BestHeight = count
+		conns = append(conns, handshake(t, node, v))
+		peerOf(t, node, v.AddrFrom)
+	}
+
+	// 区块头已经通过验证，等待下载对应的区块
+	var pending []chain.BlockHeader
+	prev := genesis.Hash
+	for height := 1; height <= count; height++ {
+		hash := []byte(fmt.Sprintf("block-%d", height))
+		pending = append(pending, chain.BlockHeader{Hash: hash, PreBlockHash: prev, Height: height})
+		prev = hash
+	}
+	node.chainSync.mu.Lock()
+	node.chainSync.pending = pending
+	node.chainSync.mu.Unlock()
+
+	// 每个节点最多同时被请求 maxBlocksInFlight 个区块，剩下的等待空出的位置
+	node.scheduleBlocks()
+	first := readGetData(t, conns[0], maxBlocksInFlight)
+	second := readGetData(t, conns[1], maxBlocksInFlight)
+	for hash := range first {
+		require.False(t, second[hash], "a block is requested from one peer at a time")
+	}
+	node.chainSync.mu.Lock()
+	require.Len(t, node.chainSync.downloads, 2*maxBlocksInFlight)
+	node.chainSync.mu.Unlock()
+
+	// 超时的请求改向没有请求过该区块的节点重发
+	node.checkDownloads(time.Now().Add(requestTimeout + time.Second))
+	require.Equal(t, first, readGetData(t, conns[1], maxBlocksInFlight))
+	require.Equal(t, second, readGetData(t, conns[0], maxBlocksInFlight))
+}
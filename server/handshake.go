@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// protocolVersion 为本节点使用的协议版本。新增消息类型时提高版本号，
+	// 只向版本不低于新消息所需版本的节点发送新消息。
+	protocolVersion = 4
+	// minProtocolVersion 为可以连接的最低协议版本，版本 1 的节点没有握手，版本 2 的节点用 getblocks 同步
+	minProtocolVersion = 3
+
+	// UserAgent 为本节点在 version 消息中报告的客户端名称
+	UserAgent = "/go-chain:0.4.0/"
+	// maxUserAgentLength 为接受的 user agent 最大长度
+	maxUserAgentLength = 256
+
+	// handshakeTimeout 为建立连接后等待对方 version 消息的最长时间
+	handshakeTimeout = 30 * time.Second
+	// maxTimeOffset 为对方时钟与本地时钟相差超过此值时打印警告
+	maxTimeOffset = 70 * time.Minute
+)
+
+// ServiceFlag 为节点在 version 消息中声明提供的服务，按位组合
+type ServiceFlag uint64
+
+const (
+	// ServiceFull 表示节点保存并可以提供完整的历史区块
+	ServiceFull ServiceFlag = 1 << iota
+	// ServicePruned 表示节点只有部分历史区块，例如由 UTXO 快照启动且历史尚未下载完
+	ServicePruned
+	// ServiceDIDResolver 表示节点可以解析 DID 文档
+	ServiceDIDResolver
+	// ServiceLight 表示节点是只下载区块头的轻节点
+	ServiceLight
+)
+
+var serviceNames = []struct {
+	flag ServiceFlag
+	name string
+}{
+	{ServiceFull, "full"},
+	{ServicePruned, "pruned"},
+	{ServiceDIDResolver, "did-resolver"},
+	{ServiceLight, "light"},
+}
+
+// Has 判断是否包含 flag 中的全部服务
+func (f ServiceFlag) Has(flag ServiceFlag) bool {
+	return f&flag == flag
+}
+
+func (f ServiceFlag) String() string {
+	var names []string
+	for _, s := range serviceNames {
+		if f.Has(s.flag) {
+			names = append(names, s.name)
+			f &^= s.flag
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint64(f)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// localServices 返回本节点提供的服务
+func (n *Node) localServices() ServiceFlag {
+	services := n.cfg.Services
+	if base, ok := n.bc.SnapshotBase(); ok && !base.Verified {
+		services |= ServicePruned
+	} else {
+		services |= ServiceFull
+	}
+	return services
+}
+
+// genesisHash 返回本链的创世区块哈希，尚不知道时返回 nil
+func (n *Node) genesisHash() []byte {
+	n.mu.Lock()
+	genesis := n.genesis
+	n.mu.Unlock()
+	if genesis != nil {
+		return genesis
+	}
+
+	genesis = n.bc.GenesisHash()
+	n.mu.Lock()
+	n.genesis = genesis
+	n.mu.Unlock()
+	return genesis
+}
+
+// newVersion 返回本节点的 version 消息
+func (n *Node) newVersion() version {
+	return version{
+		Version:     protocolVersion,
+		Services:    n.localServices(),
+		UserAgent:   UserAgent,
+		Timestamp:   n.now().Unix(),
+		GenesisHash: n.genesisHash(),
+		Magic:       n.cfg.Magic,
+		BestHeight:  n.bc.GetBestHeight(),
+		AddrFrom:    n.address,
+	}
+}
+
+// pushVersion 通过 p 发送本节点的 version 消息，其中带有要求对方签名的 challenge
+func (n *Node) pushVersion(p *Peer) {
+	v := n.newVersion()
+	v.Challenge = p.challenge
+	if err := p.Send("version", gobEncode(v)); err != nil {
+		fmt.Printf("Failed to send version to %s: %v\n", p, err)
+	}
+}
+
+// checkVersion 检查对方的 version 是否与本节点兼容，不兼容时返回拒绝代码和原因
+func (n *Node) checkVersion(v *version) (RejectCode, error) {
+	switch {
+	case v.Magic != n.cfg.Magic:
+		return RejectInvalid, fmt.Errorf("network magic 0x%08x does not match 0x%08x", v.Magic, n.cfg.Magic)
+	case v.Version < minProtocolVersion:
+		return RejectObsolete, fmt.Errorf("protocol version %d is older than %d", v.Version, minProtocolVersion)
+	case len(v.UserAgent) > maxUserAgentLength:
+		return RejectMalformed, fmt.Errorf("user agent is longer than %d bytes", maxUserAgentLength)
+	}
+	// 只有声明 pruned 的对方（例如刚由快照启动）可以不提供创世区块；本节点不知道创世区块时无法比较
+	if v.GenesisHash == nil {
+		if !v.Services.Has(ServicePruned) {
+			return RejectInvalid, errors.New("no genesis block from a node that is not pruned")
+		}
+	} else if genesis := n.genesisHash(); genesis != nil && !bytes.Equal(genesis, v.GenesisHash) {
+		return RejectInvalid, fmt.Errorf("genesis block %x does not match %x", v.GenesisHash, genesis)
+	}
+	return 0, nil
+}
+
+// handleVersion 处理握手的第一步。对方不兼容时回复 reject 并断开连接；
+// 否则记录对方的信息，被动连接先回复自己的 version，节点有身份时签名对方的 challenge，然后完成握手。
+// 许可链模式下等对方证明 DID 之后才完成握手。
+func (n *Node) handleVersion(p *Peer, request []byte) {
+	var payload version
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "version", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		p.closeAfterFlush()
+		return
+	}
+	if p.Version() != nil {
+		n.sendReject(p, "version", RejectDuplicate, "duplicate version message", nil)
+		return
+	}
+	if n.isBanned(payload.AddrFrom) {
+		fmt.Printf("%s is banned, disconnecting\n", payload.AddrFrom)
+		p.Close()
+		return
+	}
+	if code, err := n.checkVersion(&payload); err != nil {
+		n.sendReject(p, "version", code, err.Error(), nil)
+		p.closeAfterFlush()
+		return
+	}
+	if offset := n.now().Sub(time.Unix(payload.Timestamp, 0)); offset > maxTimeOffset || offset < -maxTimeOffset {
+		fmt.Printf("Clock of %s differs from ours by %v\n", p, offset.Round(time.Second))
+	}
+	p.setVersion(&payload)
+	n.registerPeer(p, payload.AddrFrom)
+	fmt.Printf("Peer %s: version %d, services %s, user agent %q, height %d, transport %s\n",
+		p, payload.Version, payload.Services, payload.UserAgent, payload.BestHeight, p.Transport())
+
+	if p.Inbound() {
+		n.pushVersion(p)
+	}
+	n.sendDIDAuth(p, payload.Challenge)
+	if n.permissioned() {
+		// 由 handleDIDAuth 完成握手
+		return
+	}
+	n.completeHandshake(p)
+}
+
+// completeHandshake 回复 verack，之后交换地址，对方的链更长时开始从对方同步区块头
+func (n *Node) completeHandshake(p *Peer) {
+	if err := p.Send("verack", nil); err != nil {
+		return
+	}
+	v := p.Version()
+
+	// 主动连接的一方确认了地址可用；被动连接的对方地址只是它自己声明的
+	if !p.Inbound() {
+		n.book.good(p.Addr())
+		n.sendGetAddr(p)
+	} else if v.AddrFrom != "" {
+		n.book.add(v.AddrFrom, n.now(), v.AddrFrom)
+	}
+	n.advertise(p)
+	if v.BestHeight > n.bc.GetBestHeight() && !v.Services.Has(ServiceLight) {
+		n.startSync(p)
+	}
+}
+
+// handleVerack 处理握手的第二步，之后与对方的握手完成
+func (n *Node) handleVerack(p *Peer, request []byte) {
+	p.setVerackReceived()
+}
+
+// expectVersion 在 handshakeTimeout 内没有收到对方的 version（许可链模式下还有 didauth）时断开连接
+func (n *Node) expectVersion(p *Peer) {
+	timer := time.NewTimer(handshakeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.Done():
+	case <-timer.C:
+		switch {
+		case p.Version() == nil:
+			fmt.Printf("No version from %s within %v, disconnecting\n", p, handshakeTimeout)
+			p.Close()
+		case n.permissioned() && p.DID() == "":
+			fmt.Printf("%s did not prove its DID within %v, disconnecting\n", p, handshakeTimeout)
+			p.Close()
+		}
+	}
+}
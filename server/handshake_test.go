@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+// testVersion 返回一个与 genesis 所在链兼容的 version
+func testVersion(genesis *chain.Block) version {
+	return version{
+		Version:     protocolVersion,
+		Services:    ServiceFull,
+		UserAgent:   "/test/",
+		Timestamp:   time.Now().Unix(),
+		GenesisHash: genesis.Hash,
+		Magic:       DefaultMagic,
+	}
+}
+
+// handshake 以 v 与 node 完成握手，返回握手后的连接
+func handshake(t *testing.T, node *Node, v version) net.Conn {
+	conn, err := net.Dial(protocol, node.Address())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, writeMessage(conn, DefaultMagic, "version", gobEncode(v)))
+	msg, err := readMessage(conn, DefaultMagic)
+	require.NoError(t, err)
+	require.Equal(t, "version", msg.Command)
+	var remote version
+	require.NoError(t, decodePayload(msg.Payload, &remote))
+	require.Equal(t, protocolVersion, remote.Version)
+	require.True(t, remote.Services.Has(ServiceFull))
+	require.Equal(t, node.Chain().GenesisHash(), remote.GenesisHash)
+
+	msg, err = readMessage(conn, DefaultMagic)
+	require.NoError(t, err)
+	require.Equal(t, "verack", msg.Command)
+	require.NoError(t, writeMessage(conn, DefaultMagic, "verack", nil))
+	return conn
+}
+
+func TestNode_Handshake(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	central := startTestNode(t, genesis, "")
+	peer := startTestNode(t, genesis, central.Address())
+	require.Eventually(t, func() bool {
+		peers := peer.Peers()
+		return len(peers) == 1 && peers[0].Handshaked()
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, UserAgent, peer.Peers()[0].UserAgent())
+	require.Equal(t, ServiceFull, peer.Peers()[0].Services())
+	require.Eventually(t, func() bool {
+		return slices.Contains(central.KnownNodes(), peer.Address())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	expectRejected := func(v version, code RejectCode) {
+		conn, err := net.Dial(protocol, central.Address())
+		require.NoError(t, err)
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		require.NoError(t, writeMessage(conn, DefaultMagic, "version", gobEncode(v)))
+		msg, err := readMessage(conn, DefaultMagic)
+		require.NoError(t, err)
+		require.Equal(t, "reject", msg.Command)
+		var payload reject
+		require.NoError(t, decodePayload(msg.Payload, &payload))
+		require.Equal(t, code, payload.Code)
+		// 不兼容的节点被断开
+		_, err = readMessage(conn, DefaultMagic)
+		require.Error(t, err)
+	}
+
+	other := testVersion(genesis)
+	other.GenesisHash = []byte("another genesis")
+	expectRejected(other, RejectInvalid)
+
+	old := testVersion(genesis)
+	old.Version = 1
+	expectRejected(old, RejectObsolete)
+
+	wrongNet := testVersion(genesis)
+	wrongNet.Magic = DefaultMagic + 1
+	expectRejected(wrongNet, RejectInvalid)
+
+	// 只有 pruned 节点可以不提供创世区块
+	noGenesis := testVersion(genesis)
+	noGenesis.GenesisHash = nil
+	expectRejected(noGenesis, RejectInvalid)
+	noGenesis.Services = ServicePruned
+	handshake(t, central, noGenesis)
+}
+
+func TestNode_RejectsMessagesBeforeVerack(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	node := startTestNode(t, genesis, "")
+	conn, err := net.Dial(protocol, node.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 发送 version 后不等 verack 就发送其他消息
+	require.NoError(t, writeMessage(conn, DefaultMagic, "version", gobEncode(testVersion(genesis))))
+	require.NoError(t, writeMessage(conn, DefaultMagic, "getaddr", nil))
+	for {
+		msg, err := readMessage(conn, DefaultMagic)
+		require.NoError(t, err)
+		if msg.Command != "reject" {
+			continue
+		}
+		var payload reject
+		require.NoError(t, decodePayload(msg.Payload, &payload))
+		require.Equal(t, "getaddr", payload.Message)
+		break
+	}
+	for {
+		if _, err = readMessage(conn, DefaultMagic); err != nil {
+			break
+		}
+	}
+}
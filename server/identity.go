@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/nuts-foundation/go-did/did"
+	chain "github.com/qujing226/blockchain/block_chain"
+	chaindid "github.com/qujing226/blockchain/did"
+	"github.com/qujing226/blockchain/wallet"
+)
+
+// nodeIdentityFile 为节点保存 DID 身份密钥的文件
+const nodeIdentityFile = "./components/node_identity_%s.dat"
+
+const (
+	// identityFileVersion 为身份文件的格式版本
+	identityFileVersion = 1
+	// authDomain 区分节点身份签名与其他用途的签名
+	authDomain = "go-chain node auth"
+)
+
+// NodeIdentity 为节点的 did:easyblock 身份。DID 由公钥哈希得出，握手时节点用私钥签名对方的 challenge 证明控制这个 DID。
+type NodeIdentity struct {
+	did string
+	key *ecdsa.PrivateKey
+}
+
+// NodeIdentityPath 返回节点 nodeID 的身份文件路径
+func NodeIdentityPath(nodeID string) string {
+	return fmt.Sprintf(nodeIdentityFile, nodeID)
+}
+
+// NewNodeIdentity 生成一个新的节点身份
+func NewNodeIdentity() (*NodeIdentity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &NodeIdentity{did: chaindid.DIDFromPublicKey(&key.PublicKey), key: key}, nil
+}
+
+type persistedIdentity struct {
+	Version int
+	D       []byte
+}
+
+// LoadOrCreateNodeIdentity 读取 path 中的节点身份，文件不存在时生成一个新身份并保存
+func LoadOrCreateNodeIdentity(path string) (*NodeIdentity, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := NewNodeIdentity()
+		if err != nil {
+			return nil, err
+		}
+		return id, id.save(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var data persistedIdentity
+	if err = gob.NewDecoder(bytes.NewReader(content)).Decode(&data); err != nil {
+		return nil, err
+	}
+	if data.Version != identityFileVersion {
+		return nil, fmt.Errorf("unsupported identity file version %d", data.Version)
+	}
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(data.D)
+	if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("identity file contains an invalid private key")
+	}
+	key := &ecdsa.PrivateKey{D: d}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(data.D)
+	return &NodeIdentity{did: chaindid.DIDFromPublicKey(&key.PublicKey), key: key}, nil
+}
+
+// save 将私钥写入 path，只有所有者可以读取
+func (id *NodeIdentity) save(path string) error {
+	var content bytes.Buffer
+	data := persistedIdentity{Version: identityFileVersion, D: fixedBytes(id.key.D.Bytes(), 32)}
+	if err := gob.NewEncoder(&content).Encode(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// DID 返回节点的 DID
+func (id *NodeIdentity) DID() string {
+	return id.did
+}
+
+// PublicKey 返回 64 字节的公钥 X || Y
+func (id *NodeIdentity) PublicKey() []byte {
+	return publicKeyBytes(&id.key.PublicKey)
+}
+
+// Document 返回节点身份的 DID 文档
+func (id *NodeIdentity) Document() *did.Document {
+	return chaindid.GenerateDidDocument(&id.key.PublicKey)
+}
+
+// DocumentTransaction 返回把节点的 DID 文档写入链上的交易
+func (id *NodeIdentity) DocumentTransaction() (*chain.Transaction, error) {
+	data, err := chaindid.SerializeDidDocument(id.Document())
+	if err != nil {
+		return nil, err
+	}
+	w := &wallet.Wallet{PrivateKey: *id.key, PublicKey: id.PublicKey()}
+	return chain.NewDidDocumentTransaction(w, data), nil
+}
+
+// authenticate 返回证明控制 DID 的 didauth：对对方的 challenge 和加密会话标识签名
+func (id *NodeIdentity) authenticate(challenge, session []byte) (didAuth, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, id.key, authDigest(challenge, session))
+	if err != nil {
+		return didAuth{}, err
+	}
+	signature := append(fixedBytes(r.Bytes(), 32), fixedBytes(s.Bytes(), 32)...)
+	return didAuth{DID: id.did, PublicKey: id.PublicKey(), Signature: signature}, nil
+}
+
+// authDigest 返回 didauth 签名的摘要。加密连接的会话标识也被签名，中间人无法把签名转发到另一个连接上。
+func authDigest(challenge, session []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(authDomain))
+	h.Write(challenge)
+	h.Write(session)
+	return h.Sum(nil)
+}
+
+func publicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	return append(fixedBytes(pub.X.Bytes(), 32), fixedBytes(pub.Y.Bytes(), 32)...)
+}
+
+// verify 检查 didauth 中的公钥与 DID 对应，签名是对 challenge 和 session 的有效签名
+func (a *didAuth) verify(challenge, session []byte) (*ecdsa.PublicKey, error) {
+	if len(challenge) == 0 {
+		return nil, errors.New("no challenge was sent")
+	}
+	pub, err := wallet.BytesToPublicKey(a.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, errors.New("public key is not on the curve")
+	}
+	if chaindid.DIDFromPublicKey(pub) != a.DID {
+		return nil, fmt.Errorf("%s does not belong to the public key", a.DID)
+	}
+	if len(a.Signature) != 64 {
+		return nil, fmt.Errorf("signature length %d, expected 64", len(a.Signature))
+	}
+	r := new(big.Int).SetBytes(a.Signature[:32])
+	s := new(big.Int).SetBytes(a.Signature[32:])
+	if !ecdsa.Verify(pub, authDigest(challenge, session), r, s) {
+		return nil, errors.New("invalid signature")
+	}
+	return pub, nil
+}
+
+// permissioned 判断节点是否只与 AllowedDIDs 中的节点通信
+func (n *Node) permissioned() bool {
+	return len(n.cfg.AllowedDIDs) > 0
+}
+
+// Identity 返回节点的 DID 身份，没有配置身份时返回 nil
+func (n *Node) Identity() *NodeIdentity {
+	return n.identity
+}
+
+// sendDIDAuth 用节点身份签名对方 version 中的 challenge 并发给对方
+func (n *Node) sendDIDAuth(p *Peer, challenge []byte) {
+	if n.identity == nil || len(challenge) == 0 {
+		return
+	}
+	auth, err := n.identity.authenticate(challenge, p.session())
+	if err != nil {
+		fmt.Printf("Failed to sign challenge of %s: %v\n", p, err)
+		return
+	}
+	n.sendData(p, "didauth", gobEncode(auth))
+}
+
+// handleDIDAuth 验证对方对我们 challenge 的签名，记录对方的 DID。
+// 链上有该 DID 的文档时公钥必须在文档中；许可链模式下 DID 还必须在 AllowedDIDs 中，验证通过后才完成握手。
+func (n *Node) handleDIDAuth(p *Peer, request []byte) {
+	var payload didAuth
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "didauth", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	if p.DID() != "" {
+		n.sendReject(p, "didauth", RejectDuplicate, "duplicate didauth message", nil)
+		return
+	}
+	pub, err := payload.verify(p.challenge, p.session())
+	if err != nil {
+		n.sendReject(p, "didauth", RejectInvalid, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, "DID authentication failed: "+err.Error())
+		p.closeAfterFlush()
+		return
+	}
+	if n.isBanned(payload.DID) {
+		fmt.Printf("%s is banned, disconnecting\n", payload.DID)
+		p.Close()
+		return
+	}
+	if n.permissioned() && !slices.Contains(n.cfg.AllowedDIDs, payload.DID) {
+		n.sendReject(p, "didauth", RejectInvalid, fmt.Sprintf("%s is not allowed", payload.DID), nil)
+		p.closeAfterFlush()
+		return
+	}
+	if doc := n.findDIDDocument(payload.DID); doc != nil && !chaindid.VerifyDidDocument(doc, *pub) {
+		n.sendReject(p, "didauth", RejectInvalid, "public key is not in the DID document on chain", nil)
+		p.closeAfterFlush()
+		return
+	}
+
+	p.setDID(payload.DID)
+	fmt.Printf("Peer %s authenticated as %s\n", p, payload.DID)
+	if n.permissioned() {
+		n.completeHandshake(p)
+	}
+}
+
+// findDIDDocument 返回链上 targetDID 的最新文档，没有时返回 nil。
+// 握手时在读取消息的协程中调用，因此查询索引而不是扫描整条链。
+func (n *Node) findDIDDocument(targetDID string) *did.Document {
+	return n.dids.lookup(n.bc, targetDID)
+}
+
+// didIndex 缓存链上每个 DID 的最新文档。第一次更新时扫描整条链，
+// 之后只读取上次更新以来的新区块；链顶切换到另一条分叉时重新扫描。
+type didIndex struct {
+	mu   sync.Mutex
+	docs map[string]*did.Document
+	// tip 为索引已经包含的链顶
+	tip []byte
+}
+
+// lookup 更新索引后返回 targetDID 的最新文档，没有时返回 nil
+func (x *didIndex) lookup(bc *chain.BlockChain, targetDID string) *did.Document {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.updateLocked(bc)
+	return x.docs[targetDID]
+}
+
+// update 把 bc 链顶之前的新区块加入索引
+func (x *didIndex) update(bc *chain.BlockChain) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.updateLocked(bc)
+}
+
+func (x *didIndex) updateLocked(bc *chain.BlockChain) {
+	tip := bc.GetBestBlock()
+	if bytes.Equal(tip.Hash, x.tip) {
+		return
+	}
+	// 从链顶向前读取，每个 DID 只保留最先遇到（最新）的文档
+	found := make(map[string]*did.Document)
+	extends := false
+	for block := tip; ; {
+		if x.tip != nil && bytes.Equal(block.Hash, x.tip) {
+			extends = true
+			break
+		}
+		for _, tx := range block.Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			for _, data := range tx.Payload {
+				doc, err := chaindid.DeserializeDidDocument([]byte(data))
+				if err != nil || doc.ID.String() == "" {
+					continue
+				}
+				if _, ok := found[doc.ID.String()]; !ok {
+					found[doc.ID.String()] = doc
+				}
+			}
+		}
+		if len(block.PreBlockHash) == 0 {
+			break
+		}
+		prev, err := bc.GetBlock(block.PreBlockHash)
+		if err != nil {
+			// 由快照启动的链没有更早的区块
+			break
+		}
+		block = &prev
+	}
+
+	if extends {
+		for id, doc := range found {
+			x.docs[id] = doc
+		}
+	} else {
+		x.docs = found
+	}
+	x.tip = tip.Hash
+}
+
+// anchorIdentity 在链上还没有节点的 DID 文档时把它放入内存池，并转发给新连接的节点，直到文档出现在链上
+func (n *Node) anchorIdentity() {
+	if n.identity == nil {
+		return
+	}
+	n.mu.Lock()
+	pending, anchored := n.identityTx, n.identityAnchored
+	n.mu.Unlock()
+	if anchored {
+		return
+	}
+	if pending != nil && n.pool.Has(pending) {
+		// relayInventory 跳过已经知道这笔交易的节点
+		n.relayInventory("tx", [][]byte{pending}, nil)
+		return
+	}
+	if n.findDIDDocument(n.identity.DID()) != nil {
+		n.mu.Lock()
+		n.identityAnchored = true
+		n.mu.Unlock()
+		return
+	}
+
+	tx, err := n.identity.DocumentTransaction()
+	if err != nil {
+		fmt.Printf("Failed to create DID document transaction: %v\n", err)
+		return
+	}
+	if _, _, err = n.pool.ProcessTransaction(tx, n.address); err != nil {
+		fmt.Printf("Failed to add DID document of %s to mempool: %v\n", n.identity.DID(), err)
+		return
+	}
+	fmt.Printf("Anchoring %s on chain in transaction %x\n", n.identity.DID(), tx.ID)
+	n.mu.Lock()
+	n.identityTx = tx.ID
+	n.mu.Unlock()
+	n.relayInventory("tx", [][]byte{tx.ID}, nil)
+}
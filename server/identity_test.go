@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeIdentity_PersistsAndAuthenticates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.dat")
+	id, err := LoadOrCreateNodeIdentity(path)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(id.DID(), "did:easyblock:"))
+	loaded, err := LoadOrCreateNodeIdentity(path)
+	require.NoError(t, err)
+	require.Equal(t, id.DID(), loaded.DID())
+
+	challenge, session := []byte("challenge"), []byte("session")
+	auth, err := loaded.authenticate(challenge, session)
+	require.NoError(t, err)
+	_, err = auth.verify(challenge, session)
+	require.NoError(t, err)
+
+	// 签名只对这个 challenge 和这个加密会话有效
+	_, err = auth.verify([]byte("other challenge"), session)
+	require.Error(t, err)
+	_, err = auth.verify(challenge, []byte("relayed session"))
+	require.Error(t, err)
+
+	// 不能用自己的密钥冒充别人的 DID
+	other, err := NewNodeIdentity()
+	require.NoError(t, err)
+	auth.DID = other.DID()
+	_, err = auth.verify(challenge, session)
+	require.ErrorContains(t, err, "does not belong")
+}
+
+// authenticateAs 以 id 的身份与 node 握手，返回连接和对 didauth 的回复（连接被关闭时为 nil）
+func authenticateAs(t *testing.T, node *Node, genesis *chain.Block, id *NodeIdentity) *message {
+	conn, err := net.Dial(protocol, node.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, writeMessage(conn, DefaultMagic, "version", gobEncode(testVersion(genesis))))
+	msg, err := readMessage(conn, DefaultMagic)
+	require.NoError(t, err)
+	require.Equal(t, "version", msg.Command)
+	var remote version
+	require.NoError(t, decodePayload(msg.Payload, &remote))
+	require.Len(t, remote.Challenge, 32)
+
+	auth, err := id.authenticate(remote.Challenge, nil)
+	require.NoError(t, err)
+	require.NoError(t, writeMessage(conn, DefaultMagic, "didauth", gobEncode(auth)))
+	for {
+		msg, err = readMessage(conn, DefaultMagic)
+		if err != nil {
+			return nil
+		}
+		if msg.Command == "verack" || msg.Command == "reject" {
+			return msg
+		}
+	}
+}
+
+func TestNode_AuthenticatesPeersByDID(t *testing.T) {
+	genesis := &chain.Block{Hash: []byte("genesis"), PreBlockHash: []byte{}}
+	dir := t.TempDir()
+	peerID, err := LoadOrCreateNodeIdentity(filepath.Join(dir, "peer.dat"))
+	require.NoError(t, err)
+	allowed, err := NewNodeIdentity()
+	require.NoError(t, err)
+	stranger, err := NewNodeIdentity()
+	require.NoError(t, err)
+
+	central := startTestNodeWith(t, genesis, "", func(cfg *Config) {
+		cfg.IdentityPath = filepath.Join(dir, "central.dat")
+		cfg.AllowedDIDs = []string{peerID.DID(), allowed.DID()}
+	})
+	peer := startTestNodeWith(t, genesis, central.Address(), func(cfg *Config) {
+		cfg.IdentityPath = filepath.Join(dir, "peer.dat")
+		cfg.Transport.Encrypt = true
+	})
+
+	// 双方都看到对方的 DID，加密连接的签名绑定了会话
+	require.Eventually(t, func() bool {
+		infos := central.PeerInfo()
+		return len(infos) == 1 && infos[0].DID == peerID.DID() && infos[0].Transport == "aes-gcm"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		infos := peer.PeerInfo()
+		return len(infos) == 1 && infos[0].DID == central.Identity().DID()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 许可链模式只接受允许的 DID
+	reply := authenticateAs(t, central, genesis, stranger)
+	require.NotNil(t, reply)
+	require.Equal(t, "reject", reply.Command)
+	require.Equal(t, "verack", authenticateAs(t, central, genesis, allowed).Command)
+
+	// 封禁 DID 之后，该节点从任何地址连接都被断开
+	central.Ban(allowed.DID(), time.Hour, "test")
+	require.Nil(t, authenticateAs(t, central, genesis, allowed))
+	central.Ban(peerID.DID(), time.Hour, "test")
+	require.Eventually(t, func() bool {
+		return len(central.PeerInfo()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDIDIndex_ReadsOnlyNewBlocks(t *testing.T) {
+	first, err := NewNodeIdentity()
+	require.NoError(t, err)
+	second, err := NewNodeIdentity()
+	require.NoError(t, err)
+	firstTx, err := first.DocumentTransaction()
+	require.NoError(t, err)
+	secondTx, err := second.DocumentTransaction()
+	require.NoError(t, err)
+
+	miner := string(wallet.NewWallet().GetAddress())
+	genesis := &chain.Block{Hash: []byte("genesis"), PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(miner, ""), firstTx}}
+	bc := chaintest.NewChain(t, genesis)
+
+	var index didIndex
+	require.Equal(t, first.DID(), index.lookup(bc, first.DID()).ID.String())
+	require.Nil(t, index.lookup(bc, second.DID()))
+
+	t.Cleanup(chain.SetTargetBits(4))
+	block := chain.NewBlock([]*chain.Transaction{chain.NewCoinBaseTX(miner, ""), secondTx}, genesis.Hash, 1)
+	require.NoError(t, bc.SubmitBlock(block))
+	require.Equal(t, second.DID(), index.lookup(bc, second.DID()).ID.String())
+	require.NotNil(t, index.lookup(bc, first.DID()), "documents from earlier blocks stay in the index")
+	require.Equal(t, block.Hash, index.tip)
+}
+
+func TestNode_AnchorsIdentityInMempool(t *testing.T) {
+	genesis := &chain.Block{Hash: []byte("genesis"), PreBlockHash: []byte{}}
+	node := startTestNodeWith(t, genesis, "", func(cfg *Config) {
+		cfg.IdentityPath = filepath.Join(t.TempDir(), "identity.dat")
+	})
+
+	node.anchorIdentity()
+	node.mu.Lock()
+	pending := node.identityTx
+	node.mu.Unlock()
+	require.NotNil(t, pending)
+	require.True(t, node.Mempool().Has(pending))
+
+	// 交易仍在内存池中时不会重复创建
+	node.anchorIdentity()
+	require.Equal(t, 1, node.Mempool().Count())
+}
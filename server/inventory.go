@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxKnownInventory 为每个连接记录的对方已知的交易和区块哈希数，超出时忘记最早的哈希
+const maxKnownInventory = 5000
+
+// inventorySet 为有上限的哈希集合，记录对方已经有或者已经向对方发送过的交易和区块
+type inventorySet struct {
+	mu    sync.Mutex
+	items map[string]struct{}
+	// order 为环形缓冲区，按加入顺序记录哈希，next 为下一个写入位置
+	order []string
+	next  int
+}
+
+func newInventorySet(max int) *inventorySet {
+	return &inventorySet{
+		items: make(map[string]struct{}, max),
+		order: make([]string, 0, max),
+	}
+}
+
+// add 加入哈希，返回之前是否不在集合中
+func (s *inventorySet) add(hash []byte) bool {
+	key := string(hash)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[key]; ok {
+		return false
+	}
+	if len(s.order) < cap(s.order) {
+		s.order = append(s.order, key)
+	} else {
+		delete(s.items, s.order[s.next])
+		s.order[s.next] = key
+		s.next = (s.next + 1) % len(s.order)
+	}
+	s.items[key] = struct{}{}
+	return true
+}
+
+func (s *inventorySet) has(hash []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.items[string(hash)]
+	return ok
+}
+
+// relayInventory 向除 from 之外所有已握手、且尚不知道这些哈希的节点发送 inv。
+// 节点收到 inv 后用 getdata 请求它没有的交易或区块。from 为 nil 时发给所有节点。
+// 轻节点无法验证未确认的交易，只通过 merkleblock 收到已上链的交易。
+func (n *Node) relayInventory(kind string, hashes [][]byte, from *Peer) {
+	for _, peer := range n.handshakedPeers() {
+		if peer == from || (kind == "tx" && peer.Services().Has(ServiceLight)) {
+			continue
+		}
+		var items [][]byte
+		for _, hash := range hashes {
+			if peer.knownInventory.add(hash) {
+				items = append(items, hash)
+			}
+		}
+		if len(items) == 0 {
+			continue
+		}
+		if err := peer.Send("inv", gobEncode(inv{n.address, kind, items})); err != nil {
+			fmt.Printf("Failed to relay %s inventory to %s: %v\n", kind, peer, err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInventorySet_ForgetsOldestWhenFull(t *testing.T) {
+	set := newInventorySet(2)
+	require.True(t, set.add([]byte("a")))
+	require.False(t, set.add([]byte("a")))
+	require.True(t, set.add([]byte("b")))
+	require.True(t, set.add([]byte("c")))
+
+	require.False(t, set.has([]byte("a")))
+	require.True(t, set.has([]byte("b")))
+	require.True(t, set.has([]byte("c")))
+
+	require.True(t, set.add([]byte("d")))
+	require.False(t, set.has([]byte("b")))
+	require.True(t, set.has([]byte("c")))
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// pingInterval 为向每个节点发送 ping 的间隔
+	pingInterval = 2 * time.Minute
+	// pingTimeout 为等待 pong 的最长时间，超时说明连接已经失效
+	pingTimeout = 2 * time.Minute
+	// requestTimeout 为等待 getdata 请求的交易或区块的最长时间
+	requestTimeout = 30 * time.Second
+	// maxRequestTries 为一个交易或区块最多向几个节点请求
+	maxRequestTries = 3
+	// maxStalls 为节点连续多少次没有按时回复请求后断开连接
+	maxStalls = 3
+	// keepAliveInterval 为检查 ping 和请求是否超时的间隔
+	keepAliveInterval = 5 * time.Second
+)
+
+// ping 用于检查连接是否仍然有效并测量往返延迟，对方用相同的 Nonce 回复 pong
+type ping struct {
+	Nonce uint64
+}
+
+type pong struct {
+	Nonce uint64
+}
+
+// request 为一个已发出、尚未收到回复的 getdata 请求
+type request struct {
+	kind string
+	hash []byte
+	// peer 为当前请求的节点，sent 为请求发出的时间
+	peer *Peer
+	sent time.Time
+	// sources 为宣布过拥有该数据的节点，tried 为已经请求过的节点
+	sources []*Peer
+	tried   map[*Peer]bool
+}
+
+// keepAlive 定期向节点发送 ping，断开不回复 pong 的节点，重试超时的请求和紧凑区块，检查同步状态并清理过期的孤块
+func (n *Node) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.Tick()
+		}
+	}
+}
+
+// Tick 按节点时钟的当前时间执行一次 keepAlive 的检查。使用模拟时钟时，时钟前进后调用 Tick 触发超时处理。
+func (n *Node) Tick() {
+	now := n.now()
+	n.checkPings(now)
+	n.checkRequests(now)
+	n.checkSync()
+	n.checkPartialBlocks(now)
+	n.anchorIdentity()
+	if expired := n.orphans.expire(); expired > 0 {
+		fmt.Printf("Expired %d orphan blocks\n", expired)
+	}
+}
+
+// checkPings 对距离上次 ping 已超过 pingInterval 的节点发送 ping，断开 pong 超时的节点
+func (n *Node) checkPings(now time.Time) {
+	for _, peer := range n.handshakedPeers() {
+		nonce, sent := peer.pendingPing()
+		switch {
+		case nonce != 0 && now.Sub(sent) > pingTimeout:
+			fmt.Printf("%s did not answer ping within %v, disconnecting\n", peer, pingTimeout)
+			peer.Close()
+		case nonce == 0 && now.Sub(sent) >= pingInterval:
+			n.sendPing(peer, now)
+		}
+	}
+}
+
+// sendPing 向 p 发送带随机 nonce 的 ping
+func (n *Node) sendPing(p *Peer, now time.Time) {
+	nonce := rand.Uint64() | 1
+	p.setPendingPing(nonce, now)
+	if err := p.Send("ping", gobEncode(ping{nonce})); err != nil {
+		fmt.Printf("Failed to send ping to %s: %v\n", p, err)
+	}
+}
+
+func (n *Node) handlePing(p *Peer, request []byte) {
+	var payload ping
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "ping", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	n.sendData(p, "pong", gobEncode(pong{payload.Nonce}))
+}
+
+// handlePong 在 nonce 与最近一次 ping 相同时记录往返延迟
+func (n *Node) handlePong(p *Peer, request []byte) {
+	var payload pong
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "pong", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	if !p.answerPing(payload.Nonce, n.now()) {
+		fmt.Printf("Unexpected pong nonce %d from %s\n", payload.Nonce, p)
+	}
+}
+
+// requestData 向 p 请求交易或区块。已经在向其他节点请求时只把 p 记为备选来源，
+// 请求超时后改向备选来源请求。
+func (n *Node) requestData(p *Peer, kind string, hash []byte) {
+	key := string(hash)
+	n.mu.Lock()
+	if req, ok := n.requests[key]; ok {
+		if !req.tried[p] {
+			req.sources = append(req.sources, p)
+		}
+		n.mu.Unlock()
+		return
+	}
+	n.requests[key] = &request{
+		kind:  kind,
+		hash:  hash,
+		peer:  p,
+		sent:  n.now(),
+		tried: map[*Peer]bool{p: true},
+	}
+	n.mu.Unlock()
+
+	n.sendGetData(p, kind, hash)
+}
+
+// received 在收到 p 发来的交易或区块后结束对应的请求
+func (n *Node) received(p *Peer, hash []byte) {
+	n.mu.Lock()
+	req, ok := n.requests[string(hash)]
+	if ok {
+		delete(n.requests, string(hash))
+	}
+	n.mu.Unlock()
+
+	if ok && req.peer == p {
+		p.resetStalls()
+	}
+}
+
+// checkRequests 处理超时或所在连接已经断开的请求：记录对方的一次停滞，
+// 连续停滞 maxStalls 次的节点被断开；请求改向尚未尝试过的来源重发，没有来源时放弃。
+func (n *Node) checkRequests(now time.Time) {
+	type retry struct {
+		peer *Peer
+		kind string
+		hash []byte
+	}
+	var retries []retry
+	var stalled []*Peer
+
+	n.mu.Lock()
+	for key, req := range n.requests {
+		closed := isClosed(req.peer)
+		if !closed && now.Sub(req.sent) <= requestTimeout {
+			continue
+		}
+		if !closed {
+			stalled = append(stalled, req.peer)
+		}
+
+		var next *Peer
+		for len(req.sources) > 0 && next == nil {
+			candidate := req.sources[0]
+			req.sources = req.sources[1:]
+			if !req.tried[candidate] && !isClosed(candidate) {
+				next = candidate
+			}
+		}
+		if next == nil || len(req.tried) >= maxRequestTries {
+			fmt.Printf("Giving up on %s %x\n", req.kind, req.hash)
+			delete(n.requests, key)
+			continue
+		}
+		req.peer = next
+		req.sent = now
+		req.tried[next] = true
+		retries = append(retries, retry{next, req.kind, req.hash})
+	}
+	n.mu.Unlock()
+
+	for _, peer := range stalled {
+		if stalls := peer.addStall(); stalls >= maxStalls {
+			fmt.Printf("%s stalled %d requests, disconnecting\n", peer, stalls)
+			peer.Close()
+		}
+	}
+	for _, r := range retries {
+		fmt.Printf("Retrying %s %x from %s\n", r.kind, r.hash, r.peer)
+		n.sendGetData(r.peer, r.kind, r.hash)
+	}
+}
+
+func isClosed(p *Peer) bool {
+	select {
+	case <-p.Done():
+		return true
+	default:
+		return false
+	}
+}
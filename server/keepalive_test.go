@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+// peerOf 等待 n 与 addr 完成握手并返回对应的连接
+func peerOf(t *testing.T, n *Node, addr string) *Peer {
+	var found *Peer
+	require.Eventually(t, func() bool {
+		for _, peer := range n.handshakedPeers() {
+			if peer.Addr() == addr {
+				found = peer
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+	return found
+}
+
+func TestNode_PingMeasuresLatencyAndDropsSilentPeers(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	seed := startTestNode(t, genesis, "")
+	node := startTestNode(t, genesis, seed.Address())
+	p := peerOf(t, node, seed.Address())
+
+	node.sendPing(p, time.Now())
+	require.Eventually(t, func() bool {
+		nonce, _ := p.pendingPing()
+		return nonce == 0 && p.Latency() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 没有按时回复 pong 的连接被断开
+	p.setPendingPing(42, time.Now().Add(-pingTimeout-time.Second))
+	node.checkPings(time.Now())
+	require.True(t, isClosed(p))
+}
+
+func TestNode_RetriesStalledRequestsAndDisconnectsStallers(t *testing.T) {
+	alice := wallet.NewWallet()
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(alice.GetAddress()), "")},
+	}
+	blocks := chaintest.MatureBlocks(t, genesis)
+	seed := startTestNode(t, genesis, "", blocks...)
+	holder := startTestNode(t, genesis, seed.Address(), blocks...)
+	staller := startTestNode(t, genesis, seed.Address(), blocks...)
+	toHolder := peerOf(t, seed, holder.Address())
+	toStaller := peerOf(t, seed, staller.Address())
+
+	// 只有 holder 有这笔交易
+	UTXOSet := chain.UTXOSet{Blockchain: holder.Chain()}
+	payment, err := chain.NewUTXOTransactionWithSelector(alice, string(wallet.NewWallet().GetAddress()), 5, &UTXOSet, chain.LargestFirst{}, chain.CoinSelectionParams{})
+	require.NoError(t, err)
+	require.NoError(t, holder.Mempool().Add(payment))
+
+	seed.requestData(toStaller, "tx", payment.ID)
+	seed.requestData(toHolder, "tx", payment.ID)
+	seed.checkRequests(time.Now().Add(requestTimeout + time.Second))
+	require.Eventually(t, func() bool {
+		return seed.Mempool().Has(payment.ID)
+	}, 5*time.Second, 10*time.Millisecond)
+	seed.mu.Lock()
+	require.Empty(t, seed.requests)
+	seed.mu.Unlock()
+
+	// 连续不回复请求的节点被断开
+	for i := 1; i < maxStalls; i++ {
+		require.False(t, isClosed(toStaller))
+		seed.requestData(toStaller, "tx", []byte{byte(i)})
+		seed.checkRequests(time.Now().Add(requestTimeout + time.Second))
+	}
+	require.True(t, isClosed(toStaller))
+	require.False(t, isClosed(toHolder))
+}
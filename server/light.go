@@ -0,0 +1,346 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/nuts-foundation/go-did/did"
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/wallet"
+)
+
+const (
+	// filteredBlockBatch 为轻节点一次请求的 filteredblock 数
+	filteredBlockBatch = 100
+	// defaultFalsePositiveRate 为轻节点过滤器的默认误报率
+	defaultFalsePositiveRate = 0.0001
+)
+
+// LightConfig 为轻节点的配置
+type LightConfig struct {
+	Magic uint32
+	// Nodes 为依次尝试的全节点地址
+	Nodes []string
+	// GenesisHash 不为空时只接受以它为创世区块的链，否则信任第一个连接的全节点
+	GenesisHash []byte
+	// StartHeight 为开始扫描交易的高度，钱包创建之前的区块不需要扫描
+	StartHeight int
+	// FalsePositiveRate 为过滤器的误报率。越高越难从过滤器推断出钱包的地址，但下载的无关交易越多
+	FalsePositiveRate float64
+	// Transport 为与全节点连接的加密配置
+	Transport TransportConfig
+}
+
+// DefaultLightConfig 返回连接 nodes 的默认轻节点配置
+func DefaultLightConfig(nodes ...string) LightConfig {
+	return LightConfig{
+		Magic:             DefaultMagic,
+		Nodes:             nodes,
+		FalsePositiveRate: defaultFalsePositiveRate,
+		Transport:         DefaultTransportConfig(),
+	}
+}
+
+// LightClient 为只保存区块头的轻节点：从全节点下载并验证区块头，再用布隆过滤器请求与钱包地址或 DID
+// 相关的交易，每笔交易都用区块头中的默克尔根验证。适用于无法保存完整区块链的移动端和浏览器钱包。
+type LightClient struct {
+	cfg     LightConfig
+	headers *chain.HeaderChain
+	// watched 为关注的公钥哈希和 DID，txs 为最近一次同步找到的相关交易
+	watched [][]byte
+	txs     []chain.SPVTransaction
+}
+
+// NewLightClient 创建使用区块头链 headers 的轻节点，headers 由调用方关闭
+func NewLightClient(cfg LightConfig, headers *chain.HeaderChain) *LightClient {
+	return &LightClient{cfg: cfg, headers: headers}
+}
+
+// WatchAddress 关注支付给地址 address 以及花费它的交易
+func (c *LightClient) WatchAddress(address string) error {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(address)
+	if err != nil {
+		return err
+	}
+	c.watched = append(c.watched, pubKeyHash)
+	return nil
+}
+
+// WatchDID 关注包含 DID 文档 did 的交易
+func (c *LightClient) WatchDID(did string) {
+	c.watched = append(c.watched, []byte(did))
+}
+
+// Headers 返回轻节点的区块头链
+func (c *LightClient) Headers() *chain.HeaderChain {
+	return c.headers
+}
+
+// Transactions 返回最近一次同步找到的相关交易，按高度排列
+func (c *LightClient) Transactions() []chain.SPVTransaction {
+	return c.txs
+}
+
+// Balance 返回地址 address 在最近一次同步时的余额，address 必须已经被关注
+func (c *LightClient) Balance(address string, minConf int) (chain.Balance, error) {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(address)
+	if err != nil {
+		return chain.Balance{}, err
+	}
+	return chain.SPVBalance(c.txs, pubKeyHash, c.headers.Height(), minConf), nil
+}
+
+// DidDocument 返回最近一次同步找到的、did 最新的 DID 文档
+func (c *LightClient) DidDocument(targetDID string) *did.Document {
+	return chain.FindDidDocumentInTransactions(c.txs, targetDID)
+}
+
+// Sync 依次尝试 cfg.Nodes 中的全节点，下载新的区块头，并从 StartHeight 开始重新扫描相关交易。
+// 每次同步都重新扫描，区块头链发生重组时不会留下分叉上的交易。
+func (c *LightClient) Sync(ctx context.Context) error {
+	if len(c.cfg.Nodes) == 0 {
+		return errors.New("no full nodes to sync from")
+	}
+	var errs []error
+	for _, addr := range c.cfg.Nodes {
+		err := c.syncFrom(ctx, addr)
+		if err == nil {
+			return nil
+		}
+		fmt.Printf("Light sync from %s failed: %v\n", addr, err)
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lightSession 为轻节点与一个全节点之间的连接，请求和回复依次进行
+type lightSession struct {
+	c    *LightClient
+	conn net.Conn
+	addr string
+}
+
+func (c *LightClient) syncFrom(ctx context.Context, addr string) error {
+	var dialer net.Dialer
+	raw, err := dialer.DialContext(ctx, protocol, addr)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	stop := context.AfterFunc(ctx, func() { _ = raw.Close() })
+	defer stop()
+
+	conn, err := c.cfg.Transport.dial(raw, c.cfg.Magic)
+	if err != nil {
+		return fmt.Errorf("transport handshake: %w", err)
+	}
+
+	s := &lightSession{c: c, conn: conn, addr: addr}
+	if err = s.handshake(); err != nil {
+		return err
+	}
+	if err = s.syncHeaders(); err != nil {
+		return err
+	}
+	if err = s.loadFilter(); err != nil {
+		return err
+	}
+	return s.scan()
+}
+
+func (s *lightSession) send(command string, payload []byte) error {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeMessage(s.conn, s.c.cfg.Magic, command, payload)
+}
+
+// read 读取下一条 command 消息，期间回复 ping 并跳过其他消息，对方的 reject 作为错误返回
+func (s *lightSession) read(command string) (*message, error) {
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(requestTimeout))
+		msg, err := readMessage(s.conn, s.c.cfg.Magic)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Command {
+		case command:
+			return msg, nil
+		case "ping":
+			var payload ping
+			if err = decodePayload(msg.Payload, &payload); err == nil {
+				err = s.send("pong", gobEncode(pong{payload.Nonce}))
+			}
+		case "reject":
+			var payload reject
+			if err = decodePayload(msg.Payload, &payload); err == nil {
+				err = fmt.Errorf("%s rejected %s: %s", s.addr, payload.Message, payload.Reason)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// handshake 以轻节点的身份完成握手，对方必须是保存完整历史、与本地创世区块一致的全节点
+func (s *lightSession) handshake() error {
+	genesis := s.c.genesisHash()
+	services := ServiceLight
+	if genesis == nil {
+		// 全节点只接受 pruned 节点不提供创世区块，轻节点此时没有任何区块
+		services |= ServicePruned
+	}
+	hello := version{
+		Version:     protocolVersion,
+		Services:    services,
+		UserAgent:   UserAgent,
+		Timestamp:   time.Now().Unix(),
+		GenesisHash: genesis,
+		Magic:       s.c.cfg.Magic,
+		BestHeight:  max(s.c.headers.Height(), 0),
+	}
+	if err := s.send("version", gobEncode(hello)); err != nil {
+		return err
+	}
+	msg, err := s.read("version")
+	if err != nil {
+		return err
+	}
+	var remote version
+	if err = decodePayload(msg.Payload, &remote); err != nil {
+		return err
+	}
+	if !remote.Services.Has(ServiceFull) {
+		return fmt.Errorf("%s does not serve the full history (services %s)", s.addr, remote.Services)
+	}
+	if genesis != nil && !bytes.Equal(genesis, remote.GenesisHash) {
+		return fmt.Errorf("genesis block %x does not match %x", remote.GenesisHash, genesis)
+	}
+	if _, err = s.read("verack"); err != nil {
+		return err
+	}
+	return s.send("verack", nil)
+}
+
+// syncHeaders 用区块定位器下载对方主链上的区块头，直到对方没有更多
+func (s *lightSession) syncHeaders() error {
+	for {
+		if err := s.send("getheaders", gobEncode(getHeaders{Locator: s.c.headers.BlockLocator()})); err != nil {
+			return err
+		}
+		msg, err := s.read("headers")
+		if err != nil {
+			return err
+		}
+		var payload headers
+		if err = decodePayload(msg.Payload, &payload); err != nil {
+			return err
+		}
+		if len(payload.Headers) > 0 && s.c.headers.Height() < 0 && s.c.cfg.GenesisHash != nil &&
+			!bytes.Equal(payload.Headers[0].Hash, s.c.cfg.GenesisHash) {
+			return fmt.Errorf("genesis block %x does not match %x", payload.Headers[0].Hash, s.c.cfg.GenesisHash)
+		}
+		if _, err = s.c.headers.AddHeaders(payload.Headers); err != nil {
+			return err
+		}
+		if len(payload.Headers) < maxHeadersPerMsg {
+			return nil
+		}
+	}
+}
+
+// loadFilter 把关注的公钥哈希和 DID 放入布隆过滤器交给对方
+func (s *lightSession) loadFilter() error {
+	filter := newBloomFilter(len(s.c.watched), s.c.cfg.FalsePositiveRate, rand.Uint32())
+	for _, element := range s.c.watched {
+		filter.add(element)
+	}
+	return s.send("filterload", gobEncode(filterLoad{Filter: *filter}))
+}
+
+// scan 按批请求主链上从 StartHeight 开始的 filteredblock，验证默克尔证明并保留真正相关的交易
+func (s *lightSession) scan() error {
+	var txs []chain.SPVTransaction
+	tip := s.c.headers.Height()
+	for from := max(s.c.cfg.StartHeight, 0); from <= tip; from += filteredBlockBatch {
+		var batch []chain.BlockHeader
+		for height := from; height <= tip && height < from+filteredBlockBatch; height++ {
+			h, ok := s.c.headers.HeaderAt(height)
+			if !ok {
+				return fmt.Errorf("missing header at height %d", height)
+			}
+			batch = append(batch, h)
+			if err := s.send("getdata", gobEncode(getData{Type: "filteredblock", ID: h.Hash})); err != nil {
+				return err
+			}
+		}
+		for _, h := range batch {
+			found, err := s.readMerkleBlock(h)
+			if err != nil {
+				return err
+			}
+			txs = append(txs, found...)
+		}
+	}
+	s.c.txs = txs
+	return nil
+}
+
+// readMerkleBlock 读取区块 h 的 merkleblock，返回其中与关注的数据相关的交易。
+// 默克尔证明无效说明对方在伪造交易。
+func (s *lightSession) readMerkleBlock(h chain.BlockHeader) ([]chain.SPVTransaction, error) {
+	msg, err := s.read("merkleblock")
+	if err != nil {
+		return nil, err
+	}
+	var payload merkleBlock
+	if err = decodePayload(msg.Payload, &payload); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(payload.Header.Hash, h.Hash) {
+		return nil, fmt.Errorf("expected merkleblock %x, got %x", h.Hash, payload.Header.Hash)
+	}
+
+	var found []chain.SPVTransaction
+	for _, match := range payload.Matches {
+		tx, err := chain.DecodeTransaction(match.Tx)
+		if err != nil {
+			return nil, err
+		}
+		if !chain.VerifyMerkleProof(h.MerkleRoot, &tx, match.Proof) {
+			return nil, fmt.Errorf("transaction %x has an invalid merkle proof for block %x", tx.ID, h.Hash)
+		}
+		// 过滤器会误报，只保留确实与关注的数据相关的交易
+		if s.c.watches(&tx) {
+			found = append(found, chain.SPVTransaction{Tx: &tx, BlockHash: h.Hash, Height: h.Height})
+		}
+	}
+	return found, nil
+}
+
+// watches 判断交易是否与关注的公钥哈希或 DID 相关
+func (c *LightClient) watches(tx *chain.Transaction) bool {
+	for _, element := range tx.FilterElements() {
+		for _, watched := range c.watched {
+			if bytes.Equal(element, watched) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// genesisHash 返回本地区块头链或配置中的创世区块哈希，都没有时返回 nil
+func (c *LightClient) genesisHash() []byte {
+	if genesis := c.headers.GenesisHash(); genesis != nil {
+		return genesis
+	}
+	return c.cfg.GenesisHash
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter_MatchesWatchedTransactions(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	f := newBloomFilter(1, 0.0001, 7)
+	require.NoError(t, f.validate())
+	pubKeyHash, err := wallet.AddressToPubKeyHash(string(alice.GetAddress()))
+	require.NoError(t, err)
+	f.add(pubKeyHash)
+
+	require.True(t, f.contains(pubKeyHash))
+	require.True(t, f.matchesTx(chain.NewCoinBaseTX(string(alice.GetAddress()), "")))
+	require.False(t, f.matchesTx(chain.NewCoinBaseTX(string(bob.GetAddress()), "")))
+
+	f.Hashes = maxFilterHashes + 1
+	require.Error(t, f.validate())
+}
+
+func TestLightClient_SyncsHeadersAndFilteredTransactions(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(alice.GetAddress()), "")},
+	}
+	node := startTestNode(t, genesis, "")
+
+	sync := func(address string) *LightClient {
+		headers, err := chain.OpenHeaderChain(filepath.Join(t.TempDir(), "headers.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { headers.Close() })
+
+		client := NewLightClient(DefaultLightConfig(node.Address()), headers)
+		require.NoError(t, client.WatchAddress(address))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, client.Sync(ctx))
+		require.Equal(t, 0, headers.Height())
+		require.Equal(t, genesis.Hash, headers.GenesisHash())
+		return client
+	}
+
+	client := sync(string(alice.GetAddress()))
+	require.Len(t, client.Transactions(), 1)
+	balance, err := client.Balance(string(alice.GetAddress()), 1)
+	require.NoError(t, err)
+	require.Equal(t, chain.Balance{Immature: 20}, balance)
+
+	require.Empty(t, sync(string(bob.GetAddress())).Transactions())
+}
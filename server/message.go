@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMagic 为默认网络的魔数，不同网络的节点因魔数不同而无法互相通信
+const DefaultMagic uint32 = 0xd1d0c41a
+
+// 消息格式：magic(4) | command(12) | payload 长度(4) | checksum(4) | payload。
+// 整数均为小端序，checksum 为 payload 两次 SHA-256 的前 4 个字节。
+const (
+	checksumLength = 4
+	headerLength   = 4 + commandLength + 4 + checksumLength
+
+	// defaultMaxPayload 为 maxPayloadLengths 中没有列出的命令的最大长度
+	defaultMaxPayload = 1 << 10
+)
+
+// maxPayloadLengths 为各命令 payload 的最大长度，超过时不读取 payload 直接断开连接
+var maxPayloadLengths = map[string]int{
+	"version":     4 << 10,
+	"verack":      0,
+	"didauth":     1 << 10,
+	"addr":        256 << 10,
+	"getaddr":     1 << 10,
+	"inv":         4 << 20,
+	"getheaders":  8 << 10,
+	"headers":     1 << 20,
+	"getdata":     1 << 10,
+	"cmpctblock":  1 << 20,
+	"getblocktxn": 256 << 10,
+	"blocktxn":    4 << 20,
+	"block":       4 << 20,
+	"tx":          1 << 20,
+	"filterload":  40 << 10,
+	"filteradd":   1 << 10,
+	"filterclear": 0,
+	"merkleblock": 4 << 20,
+	"reject":      2 << 10,
+}
+
+// maxPayloadFor 返回 command 的 payload 最大长度
+func maxPayloadFor(command string) int {
+	if limit, ok := maxPayloadLengths[command]; ok {
+		return limit
+	}
+	return defaultMaxPayload
+}
+
+var (
+	ErrBadMagic        = errors.New("message has wrong network magic")
+	ErrBadChecksum     = errors.New("message checksum mismatch")
+	ErrMessageTooLarge = errors.New("message payload is too large")
+	ErrBadCommand      = errors.New("message command is malformed")
+)
+
+// message 是一条完整的网络消息
+type message struct {
+	Command string
+	Payload []byte
+}
+
+// checksum 返回 payload 的校验和
+func checksum(payload []byte) [checksumLength]byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	var sum [checksumLength]byte
+	copy(sum[:], second[:checksumLength])
+	return sum
+}
+
+// writeMessage 将一条消息按帧格式写入 w
+func writeMessage(w io.Writer, magic uint32, command string, payload []byte) error {
+	if len(command) > commandLength {
+		return fmt.Errorf("command %q is longer than %d bytes", command, commandLength)
+	}
+	if len(payload) > maxPayloadFor(command) {
+		return fmt.Errorf("%w: %s payload of %d bytes", ErrMessageTooLarge, command, len(payload))
+	}
+	header := make([]byte, headerLength)
+	binary.LittleEndian.PutUint32(header[0:4], magic)
+	copy(header[4:4+commandLength], commandToBytes(command))
+	binary.LittleEndian.PutUint32(header[4+commandLength:8+commandLength], uint32(len(payload)))
+	sum := checksum(payload)
+	copy(header[8+commandLength:], sum[:])
+
+	_, err := io.Copy(w, bytes.NewReader(append(header, payload...)))
+	return err
+}
+
+// validCommand 检查命令由可打印的 ASCII 字符组成，且其后只有 0 填充
+func validCommand(b []byte) bool {
+	end := bytes.IndexByte(b, 0)
+	if end < 0 {
+		end = len(b)
+	}
+	for i, c := range b {
+		if (i < end && (c < 0x21 || c > 0x7e)) || (i >= end && c != 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// readMessage 从 r 读取一条消息并校验魔数、长度和校验和。
+// 返回 ErrMessageTooLarge 或 ErrBadChecksum 时 message 中只有 Command，供调用方回复 reject。
+func readMessage(r io.Reader, magic uint32) (*message, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != magic {
+		return nil, ErrBadMagic
+	}
+	if !validCommand(header[4 : 4+commandLength]) {
+		return nil, ErrBadCommand
+	}
+	command := bytesToCommand(header[4 : 4+commandLength])
+	length := binary.LittleEndian.Uint32(header[4+commandLength : 8+commandLength])
+	if int64(length) > int64(maxPayloadFor(command)) {
+		return &message{Command: command}, fmt.Errorf("%w: %s payload of %d bytes", ErrMessageTooLarge, command, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if sum := checksum(payload); !bytes.Equal(sum[:], header[8+commandLength:]) {
+		// payload 已被完整读出，连接上的后续消息仍然可以读取
+		return &message{Command: command}, ErrBadChecksum
+	}
+	return &message{Command: command, Payload: payload}, nil
+}
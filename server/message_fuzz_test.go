@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+)
+
+func FuzzReadMessage(f *testing.F) {
+	var valid bytes.Buffer
+	_ = writeMessage(&valid, DefaultMagic, "inv", gobEncode(inv{"localhost:3000", "block", [][]byte{{1, 2, 3}}}))
+	f.Add(valid.Bytes())
+	f.Add([]byte{0x01, 0x02})
+	f.Add(make([]byte, headerLength))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := readMessage(bytes.NewReader(data), DefaultMagic)
+		if err != nil {
+			return
+		}
+		// 能被读出的消息重新编码后与输入的前缀相同
+		var buf bytes.Buffer
+		if err = writeMessage(&buf, DefaultMagic, msg.Command, msg.Payload); err != nil {
+			t.Fatalf("re-encoding %q failed: %v", msg.Command, err)
+		}
+		if !bytes.HasPrefix(data, buf.Bytes()) {
+			t.Fatalf("re-encoded %q does not match the input", msg.Command)
+		}
+	})
+}
+
+// FuzzDecodePayloads 检查来自网络的任意内容都不会让解码器 panic
+func FuzzDecodePayloads(f *testing.F) {
+	cbTx := chain.NewCoinBaseTX("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", "")
+	b := &chain.Block{Hash: []byte("hash"), PreBlockHash: []byte{}, Transactions: []*chain.Transaction{cbTx}}
+	f.Add(gobEncode(version{Version: protocolVersion, Services: ServiceFull, UserAgent: UserAgent, GenesisHash: b.Hash, Magic: DefaultMagic, BestHeight: 1, AddrFrom: "localhost:3000"}))
+	f.Add(gobEncode(inv{"localhost:3000", "tx", [][]byte{cbTx.ID}}))
+	f.Add(gobEncode(getData{"localhost:3000", "block", b.Hash}))
+	f.Add(gobEncode(getHeaders{"localhost:3000", [][]byte{b.Hash}, nil}))
+	f.Add(gobEncode(headers{"localhost:3000", []chain.BlockHeader{b.Header()}}))
+	f.Add(gobEncode(newCmpctBlock("localhost:3000", b, 1)))
+	f.Add(gobEncode(getBlockTxn{"localhost:3000", b.Hash, []int{0}}))
+	f.Add(gobEncode(blockTxn{"localhost:3000", b.Hash, [][]byte{cbTx.Serialize()}}))
+	f.Add(gobEncode(tx{"localhost:3000", cbTx.Serialize()}))
+	f.Add(gobEncode(block{"localhost:3000", b.Serialize()}))
+	f.Add(gobEncode(reject{"localhost:3000", "tx", RejectInvalid, "bad signature", cbTx.ID}))
+	f.Add(gobEncode(didAuth{"did:easyblock:4Ka8WQ7dCNvFH7Aq5sSUjvmXDm5", make([]byte, 64), make([]byte, 64)}))
+	f.Add(b.Serialize())
+	f.Add(cbTx.Serialize())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_ = decodePayload(data, &version{})
+		_ = decodePayload(data, &addr{})
+		_ = decodePayload(data, &getHeaders{})
+		_ = decodePayload(data, &headers{})
+		_ = decodePayload(data, &getData{})
+		_ = decodePayload(data, &inv{})
+		_ = decodePayload(data, &reject{})
+		_ = decodePayload(data, &getBlockTxn{})
+		_ = decodePayload(data, &blockTxn{})
+
+		var compact cmpctBlock
+		if decodePayload(data, &compact) == nil {
+			_, _, _ = compact.reconstruct([]*chain.Transaction{cbTx})
+		}
+
+		var auth didAuth
+		if decodePayload(data, &auth) == nil {
+			_, _ = auth.verify([]byte("challenge"), nil)
+		}
+
+		var txMsg tx
+		if decodePayload(data, &txMsg) == nil {
+			_, _ = chain.DecodeTransaction(txMsg.Transaction)
+		}
+		var blockMsg block
+		if decodePayload(data, &blockMsg) == nil {
+			_, _ = chain.DecodeBlock(blockMsg.Block)
+		}
+		_, _ = chain.DecodeTransaction(data)
+		_, _ = chain.DecodeBlock(data)
+	})
+}
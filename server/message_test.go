@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeMessage(&buf, DefaultMagic, "version", []byte("hello")))
+	require.NoError(t, writeMessage(&buf, DefaultMagic, "verack", nil))
+	require.Equal(t, 2*headerLength+5, buf.Len())
+
+	msg, err := readMessage(&buf, DefaultMagic)
+	require.NoError(t, err)
+	require.Equal(t, &message{Command: "version", Payload: []byte("hello")}, msg)
+	msg, err = readMessage(&buf, DefaultMagic)
+	require.NoError(t, err)
+	require.Equal(t, "verack", msg.Command)
+	require.Empty(t, msg.Payload)
+}
+
+func TestMessage_RejectsCorruptFrames(t *testing.T) {
+	frame := func() []byte {
+		var buf bytes.Buffer
+		require.NoError(t, writeMessage(&buf, DefaultMagic, "tx", []byte("payload")))
+		return buf.Bytes()
+	}
+
+	_, err := readMessage(bytes.NewReader(frame()), DefaultMagic+1)
+	require.ErrorIs(t, err, ErrBadMagic)
+
+	corrupt := frame()
+	corrupt[len(corrupt)-1] ^= 0xff
+	_, err = readMessage(bytes.NewReader(corrupt), DefaultMagic)
+	require.ErrorIs(t, err, ErrBadChecksum)
+
+	huge := frame()
+	binary.LittleEndian.PutUint32(huge[4+commandLength:], math.MaxUint32)
+	_, err = readMessage(bytes.NewReader(huge), DefaultMagic)
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+
+	// 每种命令有各自的上限
+	overTx := frame()
+	binary.LittleEndian.PutUint32(overTx[4+commandLength:], uint32(maxPayloadFor("tx")+1))
+	msg, err := readMessage(bytes.NewReader(overTx), DefaultMagic)
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+	require.Equal(t, "tx", msg.Command)
+	require.ErrorIs(t, writeMessage(&bytes.Buffer{}, DefaultMagic, "getdata", make([]byte, maxPayloadFor("getdata")+1)), ErrMessageTooLarge)
+
+	badCommand := frame()
+	copy(badCommand[4:], "t\x00x")
+	_, err = readMessage(bytes.NewReader(badCommand), DefaultMagic)
+	require.ErrorIs(t, err, ErrBadCommand)
+
+	require.Error(t, writeMessage(&bytes.Buffer{}, DefaultMagic, "averylongcommand", nil))
+}
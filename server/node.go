@@ -0,0 +1,798 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/mempool"
+	"github.com/qujing226/blockchain/mining"
+)
+
+const (
+	snapshotVerifyInterval = 30 * time.Second
+	mempoolExpireInterval  = 10 * time.Minute
+	mempoolSaveInterval    = 5 * time.Minute
+	// shutdownTimeout 为停止时等待 RPC 请求结束的最长时间
+	shutdownTimeout = 10 * time.Second
+
+	defaultMaxOutbound = 8
+	defaultMaxInbound  = 64
+)
+
+// defaultSeeds 为节点启动时连接的节点。
+// 新节点必须知道从何处开始发现其他节点，之后的地址来自地址表。
+var defaultSeeds = []string{"localhost:3000"}
+
+// Config 为节点的配置
+type Config struct {
+	NodeID string
+	// Magic 为网络魔数，魔数不同的节点无法通信
+	Magic uint32
+	// Address 为本节点的地址，其他节点通过它连接本节点；为空时使用监听器的地址
+	Address string
+	// Seeds 为启动时已知的节点。地址表中没有可以连接的地址时重新尝试种子节点。
+	Seeds []string
+	// MaxOutbound 为主动建立的连接数目标，MaxInbound 为接受的连接数上限
+	MaxOutbound int
+	MaxInbound  int
+	// PeersPath 为保存地址表的文件，为空时不保存
+	PeersPath string
+	// BanThreshold 为不良行为分数的上限，达到后对方被封禁 BanDuration，为 0 时不封禁；
+	// BansPath 为保存封禁列表的文件，为空时不保存
+	BanThreshold int
+	BanDuration  time.Duration
+	BansPath     string
+	// Services 为除完整/裁剪节点之外额外声明的服务，例如 ServiceDIDResolver
+	Services ServiceFlag
+	// Transport 为节点之间连接的加密配置
+	Transport TransportConfig
+	// IdentityPath 为保存节点 DID 身份密钥的文件，不存在时自动生成；为空时节点没有身份，不向对方证明自己
+	IdentityPath string
+	// AllowedDIDs 不为空时节点工作在许可链模式，只与在握手中证明控制其中某个 DID 的节点通信
+	AllowedDIDs []string
+
+	// MinerAddress 不为空时节点按 Policy 挖矿，奖励支付给 MinerAddress
+	MinerAddress string
+	Policy       mining.Policy
+	// RPCAddr 不为空时在该地址上提供外部矿工和内存池查询使用的 HTTP 接口
+	RPCAddr string
+	// AdminAddr 不为空时在该地址上提供节点信息与封禁管理接口，只能是回环地址
+	AdminAddr string
+
+	Mempool mempool.Config
+	// MempoolPath 为保存内存池的文件，为空时不保存
+	MempoolPath string
+	// VerifySnapshot 为 true 时，由 UTXO 快照启动的节点在后台下载快照之前的历史区块并核对快照
+	VerifySnapshot bool
+
+	// Dial 用于建立出站连接，为空时使用 TCP。模拟网络用它把节点连接到内存中的管道上。
+	Dial func(addr string) (net.Conn, error)
+	// Now 为节点判断超时、过期和封禁使用的时钟，为空时使用 time.Now
+	Now func() time.Time
+}
+
+// DefaultConfig 返回节点 nodeID 的默认配置，节点地址为 localhost:nodeID
+func DefaultConfig(nodeID string) Config {
+	return Config{
+		NodeID:      nodeID,
+		Magic:       DefaultMagic,
+		Address:     fmt.Sprintf("localhost:%s", nodeID),
+		Seeds:       defaultSeeds,
+		MaxOutbound: defaultMaxOutbound,
+		MaxInbound:  defaultMaxInbound,
+		PeersPath:   PeersFilePath(nodeID),
+
+		BanThreshold: defaultBanThreshold,
+		BanDuration:  defaultBanDuration,
+		BansPath:     BanListPath(nodeID),
+		Transport:    DefaultTransportConfig(),
+		IdentityPath: NodeIdentityPath(nodeID),
+
+		Policy:      mining.DefaultPolicy(),
+		Mempool:     mempool.DefaultConfig(),
+		MempoolPath: mempool.FilePath(nodeID),
+
+		VerifySnapshot: true,
+	}
+}
+
+// Node 是一个区块链节点，它拥有自己的链、内存池、已知节点和配置。
+// 同一进程中可以运行多个 Node。
+type Node struct {
+	cfg     Config
+	address string
+	bc      *chain.BlockChain
+	ln      net.Listener
+	// pool 存储所有通过验证的交易，直到被挖出块。
+	pool *mempool.Pool
+	// miner 只在矿工节点上创建，它在独立的协程中按挖矿策略打包内存池中的交易。
+	miner *mining.Miner
+	rpc   *http.Server
+	// admin 为只监听回环地址的管理接口
+	admin *http.Server
+
+	// book 为已知节点的地址表，connectNow 用于唤醒维持出站连接的协程
+	book       *addrBook
+	connectNow chan struct{}
+	// chainSync 为区块头优先同步的状态，blockMu 保证收到的区块依次接到链上并更新 UTXO 集合
+	chainSync headerSync
+	blockMu   sync.Mutex
+	// orphans 为前一区块未知、等待祖先下载的区块
+	orphans *orphanBlockPool
+	// partials 为等待缺失交易的紧凑区块
+	partials partialBlocks
+	// bans 为被封禁的地址和 DID
+	bans *banList
+	// identity 为节点的 DID 身份，没有配置时为 nil
+	identity *NodeIdentity
+	// dids 为链上 DID 文档的索引，握手时用它验证对方的公钥
+	dids didIndex
+
+	mu sync.Mutex
+	// requests 为已发出、尚未收到回复的 getdata 请求，键为交易或区块哈希
+	requests map[string]*request
+	// genesis 为创世区块哈希，握手时用于确认双方在同一条链上
+	genesis []byte
+	// peers 为所有打开的连接，peersByAddr 为对方监听地址 -> 连接
+	peers       map[*Peer]struct{}
+	peersByAddr map[string]*Peer
+	// stopping 表示节点正在停止，之后建立的连接立即关闭
+	stopping bool
+	// handshaking 为正在进行传输层握手、尚未登记的被动连接数，同样计入 MaxInbound
+	handshaking int
+	// identityTx 为内存池中写入节点 DID 文档的交易，identityAnchored 表示文档已经在链上
+	identityTx       []byte
+	identityAnchored bool
+
+	// done 在节点停止工作时关闭，err 为导致节点停止的错误
+	done     <-chan struct{}
+	err      error
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// NewNode 创建一个使用 bc、在 ln 上接受连接的节点。ln 由节点在停止时关闭，bc 由调用方关闭。
+func NewNode(cfg Config, bc *chain.BlockChain, ln net.Listener) *Node {
+	n := &Node{
+		cfg:        cfg,
+		address:    cfg.Address,
+		bc:         bc,
+		ln:         ln,
+		pool:       mempool.New(bc, cfg.Mempool),
+		book:       newAddrBook(maxKnownAddrs),
+		connectNow: make(chan struct{}, 1),
+		bans:       newBanList(),
+		orphans:    newOrphanBlockPool(),
+
+		requests:    make(map[string]*request),
+		peers:       make(map[*Peer]struct{}),
+		peersByAddr: make(map[string]*Peer),
+	}
+	if cfg.Now != nil {
+		n.book.now = cfg.Now
+		n.bans.now = cfg.Now
+		n.orphans.now = cfg.Now
+	}
+	n.chainSync.downloads = make(map[string]*blockDownload)
+	n.chainSync.buffered = make(map[string]bufferedBlock)
+	if n.address == "" {
+		n.address = ln.Addr().String()
+	}
+	if cfg.MinerAddress != "" {
+		n.miner = mining.NewMiner(bc, n.pool, cfg.MinerAddress, cfg.Policy, n.connectMinedBlock)
+	}
+	if cfg.RPCAddr != "" {
+		work := mining.NewWorkManager(bc, n.pool, cfg.Policy.MaxBlockSize, func(b *chain.Block) error {
+			if err := n.connectMinedBlock(b); err != nil {
+				return err
+			}
+			fmt.Printf("Block %x submitted by external miner\n", b.Hash)
+			return nil
+		})
+		engine := gin.Default()
+		n.RegisterRoutes(engine, work)
+		n.rpc = &http.Server{Addr: cfg.RPCAddr, Handler: engine}
+	}
+	if cfg.AdminAddr != "" {
+		engine := gin.Default()
+		n.RegisterAdminRoutes(engine)
+		n.admin = &http.Server{Addr: cfg.AdminAddr, Handler: engine}
+	}
+	return n
+}
+
+// httpServers 返回节点配置的 HTTP 服务
+func (n *Node) httpServers() []*http.Server {
+	var servers []*http.Server
+	for _, srv := range []*http.Server{n.rpc, n.admin} {
+		if srv != nil {
+			servers = append(servers, srv)
+		}
+	}
+	return servers
+}
+
+// listenHTTP 为每个 HTTP 服务打开监听器，管理接口的监听地址必须是回环地址
+func (n *Node) listenHTTP() ([]net.Listener, error) {
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, ln := range listeners {
+			_ = ln.Close()
+		}
+	}
+	for _, srv := range n.httpServers() {
+		ln, err := net.Listen(protocol, srv.Addr)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+		if addr, ok := ln.Addr().(*net.TCPAddr); srv == n.admin && (!ok || !addr.IP.IsLoopback()) {
+			closeAll()
+			return nil, fmt.Errorf("admin address %s is not a loopback address", srv.Addr)
+		}
+	}
+	return listeners, nil
+}
+
+// now 返回节点时钟的当前时间
+func (n *Node) now() time.Time {
+	if n.cfg.Now != nil {
+		return n.cfg.Now()
+	}
+	return time.Now()
+}
+
+// dial 按 cfg.Dial 建立到 addr 的连接
+func (n *Node) dial(addr string) (net.Conn, error) {
+	if n.cfg.Dial != nil {
+		return n.cfg.Dial(addr)
+	}
+	return net.DialTimeout(protocol, addr, dialTimeout)
+}
+
+// Address 返回本节点的地址
+func (n *Node) Address() string {
+	return n.address
+}
+
+// Chain 返回节点使用的区块链
+func (n *Node) Chain() *chain.BlockChain {
+	return n.bc
+}
+
+// Mempool 返回节点的内存池
+func (n *Node) Mempool() *mempool.Pool {
+	return n.pool
+}
+
+// GenerateBlock 立即在链顶之上挖出一个区块，奖励支付给 address，区块接到链上后转发给其他节点。
+// 组装模板到区块接到链上的整个过程都持有 blockMu，期间收到的区块等待它完成。
+func (n *Node) GenerateBlock(ctx context.Context, address string) (*chain.Block, error) {
+	n.blockMu.Lock()
+	tmpl := mining.NewTemplate(n.bc, n.pool, address, n.cfg.Policy.MaxBlockSize)
+	for _, id := range tmpl.Invalid {
+		n.pool.Remove(id)
+	}
+	b, err := n.bc.NewBlockContext(ctx, tmpl.Transactions)
+	if err == nil {
+		_, err = n.connectBlockLocked(b)
+	}
+	n.blockMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Generated block %x at height %d\n", b.Hash, b.Height)
+	n.blockConnected(b, nil)
+	return b, nil
+}
+
+// Connect 与 addr 建立连接并开始握手，已经连接时什么也不做
+func (n *Node) Connect(addr string) error {
+	if addr == n.address {
+		return errors.New("cannot connect to self")
+	}
+	_, err := n.peerFor(addr)
+	return err
+}
+
+// KnownNodes 返回地址表中的所有地址
+func (n *Node) KnownNodes() []string {
+	return n.book.addresses()
+}
+
+// Start 加载保存的内存池，启动后台任务并开始接受连接，不会阻塞。
+// ctx 被取消或调用 Stop 后节点停止工作。
+func (n *Node) Start(ctx context.Context) error {
+	httpLns, err := n.listenHTTP()
+	if err != nil {
+		return err
+	}
+	if n.cfg.IdentityPath != "" {
+		identity, err := LoadOrCreateNodeIdentity(n.cfg.IdentityPath)
+		if err != nil {
+			for _, ln := range httpLns {
+				_ = ln.Close()
+			}
+			return fmt.Errorf("load node identity: %w", err)
+		}
+		n.identity = identity
+	}
+	ctx, n.cancel = context.WithCancel(ctx)
+	n.done = ctx.Done()
+
+	if n.cfg.MempoolPath != "" {
+		loaded, dropped, err := n.pool.LoadFromFile(n.cfg.MempoolPath)
+		if err != nil {
+			fmt.Printf("Failed to load mempool from %s: %v\n", n.cfg.MempoolPath, err)
+		} else if loaded+dropped > 0 {
+			fmt.Printf("Loaded %d transactions into mempool, dropped %d expired or invalid\n", loaded, dropped)
+		}
+	}
+
+	if n.cfg.PeersPath != "" {
+		if loaded, err := n.book.load(n.cfg.PeersPath); err != nil {
+			fmt.Printf("Failed to load peers from %s: %v\n", n.cfg.PeersPath, err)
+		} else if loaded > 0 {
+			fmt.Printf("Loaded %d peer addresses\n", loaded)
+		}
+	}
+	if n.cfg.BansPath != "" {
+		if loaded, err := n.bans.load(n.cfg.BansPath); err != nil {
+			fmt.Printf("Failed to load ban list from %s: %v\n", n.cfg.BansPath, err)
+		} else if loaded > 0 {
+			fmt.Printf("Loaded %d bans\n", loaded)
+		}
+	}
+	n.addSeeds()
+	// 接受连接之前建立 DID 文档索引，握手时不再扫描整条链
+	n.dids.update(n.bc)
+
+	n.goBackground(func() { n.acceptConnections(ctx) })
+	n.goBackground(func() { n.maintainOutbound(ctx) })
+	n.goBackground(func() { n.keepAlive(ctx) })
+	n.goBackground(func() { n.expireMempool(ctx) })
+	if n.cfg.VerifySnapshot {
+		n.goBackground(func() {
+			if err := n.verifySnapshotInBackground(ctx); err != nil {
+				n.fail(err)
+			}
+		})
+	}
+	if n.cfg.MempoolPath != "" {
+		n.goBackground(func() { n.saveMempoolPeriodically(ctx) })
+	}
+	if n.cfg.PeersPath != "" {
+		n.goBackground(func() { n.savePeersPeriodically(ctx) })
+	}
+	if n.miner != nil {
+		n.goBackground(func() { n.miner.Run(ctx) })
+	}
+	for i, srv := range n.httpServers() {
+		ln := httpLns[i]
+		n.goBackground(func() {
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fmt.Printf("HTTP server on %s stopped: %v\n", srv.Addr, err)
+			}
+		})
+	}
+	n.goBackground(func() {
+		<-ctx.Done()
+		n.mu.Lock()
+		n.stopping = true
+		n.mu.Unlock()
+		_ = n.ln.Close()
+		for _, srv := range n.httpServers() {
+			// 等待正在处理的请求结束，例如外部矿工提交的区块
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				_ = srv.Close()
+			}
+			cancel()
+		}
+		for _, peer := range n.Peers() {
+			peer.Close()
+		}
+	})
+
+	n.printInformation()
+	return nil
+}
+
+// Stop 停止接受连接和后台任务，等待它们退出后保存内存池和地址表。可以重复调用。
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		if n.cancel != nil {
+			n.cancel()
+		} else {
+			_ = n.ln.Close()
+		}
+		n.wg.Wait()
+		// Stop 之后仍可能有发送方建立的连接，一并关闭
+		for _, peer := range n.Peers() {
+			peer.Close()
+		}
+
+		if n.cfg.MempoolPath != "" {
+			n.saveMempool()
+		}
+		if n.cfg.PeersPath != "" {
+			n.savePeers()
+		}
+	})
+}
+
+// Done 返回在节点停止工作时关闭的 channel，节点启动前返回 nil
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+// Err 返回导致节点停止工作的错误，节点正常停止时返回 nil
+func (n *Node) Err() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.err
+}
+
+// fail 记录一个无法继续运行的错误并让节点停止工作，调用方应随后调用 Stop
+func (n *Node) fail(err error) {
+	fmt.Printf("Node failed: %v\n", err)
+	n.mu.Lock()
+	if n.err == nil {
+		n.err = err
+	}
+	n.mu.Unlock()
+	n.cancel()
+}
+
+func (n *Node) goBackground(f func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
+	}()
+}
+
+func (n *Node) acceptConnections(ctx context.Context) {
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("Accept failed: %v\n", err)
+			continue
+		}
+		if remote := conn.RemoteAddr().String(); n.isBanned(remote) {
+			fmt.Printf("%s is banned, refusing connection\n", remote)
+			_ = conn.Close()
+			continue
+		}
+		if !n.reserveInbound() {
+			fmt.Printf("Too many inbound connections, refusing %s\n", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		n.goBackground(func() { n.acceptPeer(ctx, conn) })
+	}
+}
+
+// reserveInbound 在开始传输层握手之前为被动连接占用一个名额，名额已满时返回 false。
+// 握手中的连接也计入 MaxInbound，否则不回应的连接可以让握手协程和密钥交换无限增加。
+func (n *Node) reserveInbound() bool {
+	inbound := n.inboundCount()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if inbound+n.handshaking >= n.cfg.MaxInbound {
+		return false
+	}
+	n.handshaking++
+	return true
+}
+
+// releaseInbound 在握手结束后释放 reserveInbound 占用的名额，成功时连接此前已经登记
+func (n *Node) releaseInbound() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.handshaking--
+}
+
+// acceptPeer 在对方开始加密传输时完成密钥交换，然后登记连接。节点停止时放弃尚未完成的握手。
+// 调用方已经通过 reserveInbound 占用了名额。
+func (n *Node) acceptPeer(ctx context.Context, raw net.Conn) {
+	defer n.releaseInbound()
+	stop := context.AfterFunc(ctx, func() { _ = raw.Close() })
+	conn, err := n.cfg.Transport.accept(raw, n.cfg.Magic)
+	stop()
+	if err != nil {
+		fmt.Printf("Transport handshake with %s failed: %v\n", raw.RemoteAddr(), err)
+		_ = raw.Close()
+		return
+	}
+	n.addPeer(conn, "", true)
+}
+
+// Peers 返回所有打开的连接
+func (n *Node) Peers() []*Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	peers := make([]*Peer, 0, len(n.peers))
+	for peer := range n.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// PeerInfo 返回已完成握手的连接的概况，按地址排序
+func (n *Node) PeerInfo() []PeerInfo {
+	var infos []PeerInfo
+	for _, peer := range n.handshakedPeers() {
+		v := peer.Version()
+		infos = append(infos, PeerInfo{
+			Addr:      peer.String(),
+			DID:       peer.DID(),
+			Inbound:   peer.Inbound(),
+			Services:  v.Services.String(),
+			UserAgent: v.UserAgent,
+			Version:   v.Version,
+			Height:    v.BestHeight,
+			LatencyMs: peer.Latency().Milliseconds(),
+			Score:     peer.Score(),
+			Transport: peer.Transport(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+	return infos
+}
+
+// handshakedPeers 返回已完成握手的连接
+func (n *Node) handshakedPeers() []*Peer {
+	var peers []*Peer
+	for _, peer := range n.Peers() {
+		if peer.Handshaked() {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// addPeer 登记一个新连接并启动它的读写循环，连接关闭后自动注销。节点正在停止时直接关闭连接。
+func (n *Node) addPeer(conn net.Conn, addr string, inbound bool) *Peer {
+	peer := newPeer(n, conn, addr, inbound)
+
+	n.mu.Lock()
+	if n.stopping {
+		n.mu.Unlock()
+		peer.Close()
+		return peer
+	}
+	n.peers[peer] = struct{}{}
+	if _, ok := n.peersByAddr[addr]; addr != "" && !ok {
+		n.peersByAddr[addr] = peer
+	}
+	n.mu.Unlock()
+
+	// 主动连接的一方先发送 version
+	if !inbound {
+		n.pushVersion(peer)
+	}
+	n.goBackground(peer.readLoop)
+	n.goBackground(peer.writeLoop)
+	n.goBackground(func() { n.expectVersion(peer) })
+	n.goBackground(func() {
+		<-peer.Done()
+		n.removePeer(peer)
+	})
+	return peer
+}
+
+// removePeer 注销已关闭的连接并删除它发来的孤儿交易，出站连接断开后尽快补上
+func (n *Node) removePeer(peer *Peer) {
+	n.mu.Lock()
+	delete(n.peers, peer)
+	if addr := peer.Addr(); addr != "" && n.peersByAddr[addr] == peer {
+		delete(n.peersByAddr, addr)
+	}
+	n.mu.Unlock()
+	n.removeOrphansFrom(peer)
+
+	if !peer.Inbound() {
+		n.wakeConnector()
+	}
+}
+
+// removeOrphansFrom 删除 peer 发来的孤儿交易，它们的父交易不会再从这个连接到达
+func (n *Node) removeOrphansFrom(peer *Peer) {
+	if removed := n.pool.RemoveOrphansFrom(peer.orphanSource()); removed > 0 {
+		fmt.Printf("Removed %d orphan transactions from %s\n", removed, peer)
+	}
+}
+
+// registerPeer 在收到对方消息后记录被动连接的对方监听地址，之后发往该地址的消息复用这个连接
+func (n *Node) registerPeer(peer *Peer, addr string) {
+	if addr == "" || peer.Addr() != "" {
+		return
+	}
+	peer.setAddr(addr)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.peersByAddr[addr]; !ok {
+		n.peersByAddr[addr] = peer
+	}
+}
+
+// peerFor 返回与 addr 的连接，没有时建立一个新连接
+func (n *Node) peerFor(addr string) (*Peer, error) {
+	n.mu.Lock()
+	peer, ok := n.peersByAddr[addr]
+	n.mu.Unlock()
+	if ok {
+		return peer, nil
+	}
+	if addr == "" {
+		return nil, errors.New("empty peer address")
+	}
+
+	// 握手成功后 handleVersion 调用 book.good，否则这次尝试计为失败
+	n.book.attempt(addr)
+	raw, err := n.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := n.cfg.Transport.dial(raw, n.cfg.Magic)
+	if err != nil {
+		_ = raw.Close()
+		return nil, fmt.Errorf("transport handshake: %w", err)
+	}
+	n.mu.Lock()
+	existing, ok := n.peersByAddr[addr]
+	n.mu.Unlock()
+	if ok {
+		// 拨号期间已经有了连接
+		_ = conn.Close()
+		return existing, nil
+	}
+	return n.addPeer(conn, addr, false), nil
+}
+
+// requestHistory 向一个已握手的节点请求快照基块之前的区块头，之后按高度下载历史区块
+func (n *Node) requestHistory(base *chain.SnapshotBase) {
+	peers := n.handshakedPeers()
+	if len(peers) == 0 {
+		return
+	}
+	payload := gobEncode(getHeaders{AddrFrom: n.address, HashStop: base.Hash})
+	n.sendData(peers[rand.Intn(len(peers))], "getheaders", payload)
+}
+
+// expireMempool 定期清理在内存池中停留过久的交易以及等不到父交易的孤儿交易
+func (n *Node) expireMempool(ctx context.Context) {
+	ticker := time.NewTicker(mempoolExpireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if expired := n.pool.Expire(); len(expired) > 0 {
+			fmt.Printf("Expired %d transactions from mempool\n", len(expired))
+		}
+		if expired := n.pool.ExpireOrphans(); expired > 0 {
+			fmt.Printf("Expired %d orphan transactions\n", expired)
+		}
+	}
+}
+
+// saveMempoolPeriodically 定期将内存池写入磁盘，节点异常退出时最多丢失一个周期内的交易
+func (n *Node) saveMempoolPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(mempoolSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.pool.SaveToFile(n.cfg.MempoolPath); err != nil {
+			fmt.Printf("Failed to save mempool: %v\n", err)
+		}
+	}
+}
+
+func (n *Node) saveMempool() {
+	if err := n.pool.SaveToFile(n.cfg.MempoolPath); err != nil {
+		fmt.Printf("Failed to save mempool: %v\n", err)
+		return
+	}
+	fmt.Printf("Saved %d mempool transactions to %s\n", n.pool.Count(), n.cfg.MempoolPath)
+}
+
+// verifySnapshotInBackground 用于由 UTXO 快照启动的节点。
+// 节点从快照高度起正常验证新区块，同时定期向其他节点请求历史区块，
+// 历史完整后重放并核对快照承诺哈希，快照与历史不符时返回错误。
+func (n *Node) verifySnapshotInBackground(ctx context.Context) error {
+	ticker := time.NewTicker(snapshotVerifyInterval)
+	defer ticker.Stop()
+
+	for {
+		base, ok := n.bc.SnapshotBase()
+		if !ok || base.Verified {
+			return nil
+		}
+
+		err := n.bc.VerifySnapshotHistory()
+		switch {
+		case err == nil:
+			fmt.Printf("UTXO snapshot at height %d verified against history\n", base.Height)
+			return nil
+		case errors.Is(err, chain.ErrHistoryIncomplete):
+			n.requestHistory(base)
+		default:
+			return fmt.Errorf("UTXO snapshot at height %d is invalid: %w", base.Height, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// StartServer 按 cfg 启动节点并一直运行，直到收到 SIGINT 或 SIGTERM。
+// 收到信号后恢复默认的信号处理，关闭过程中再次收到信号时立即退出。
+func StartServer(cfg Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
+	if err := RunServer(ctx, cfg); err != nil {
+		log.Panic(err)
+	}
+}
+
+// RunServer 按 cfg 运行节点直到 ctx 被取消。之后节点停止接受连接，等待正在处理的消息、RPC 请求和挖矿结束，
+// 保存内存池和地址表，最后关闭数据库。
+func RunServer(ctx context.Context, cfg Config) error {
+	ln, err := net.Listen(protocol, cfg.Address)
+	if err != nil {
+		return err
+	}
+	bc := chain.NewBlockChain(cfg.NodeID)
+	defer bc.Close()
+
+	node := NewNode(cfg, bc, ln)
+	if err = node.Start(ctx); err != nil {
+		_ = ln.Close()
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-node.Done():
+	}
+	fmt.Println("Shutting down...")
+	node.Stop()
+	fmt.Println("Node stopped")
+	return node.Err()
+}
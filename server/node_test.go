@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/mining"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+// startTestNode 在随机端口上启动一个节点，seed 为空时该节点只以自己为种子
+func startTestNode(t *testing.T, genesis *chain.Block, seed string, blocks ...*chain.Block) *Node {
+	return startTestNodeWith(t, genesis, seed, func(*Config) {}, blocks...)
+}
+
+// startTestNodeWith 与 startTestNode 相同，但在启动前由 configure 修改配置
+func startTestNodeWith(t *testing.T, genesis *chain.Block, seed string, configure func(*Config), blocks ...*chain.Block) *Node {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	require.NoError(t, err)
+	if seed == "" {
+		seed = ln.Addr().String()
+	}
+
+	cfg := DefaultConfig("test")
+	cfg.Address = ""
+	cfg.Seeds = []string{seed}
+	cfg.MempoolPath = ""
+	cfg.PeersPath = ""
+	cfg.BansPath = ""
+	cfg.IdentityPath = ""
+	configure(&cfg)
+	node := NewNode(cfg, chaintest.NewChain(t, genesis, blocks...), ln)
+	require.NoError(t, node.Start(context.Background()))
+	t.Cleanup(node.Stop)
+	return node
+}
+
+func TestNode_RelaysTransactionsBetweenNodesInOneProcess(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(alice.GetAddress()), "")},
+	}
+
+	blocks := chaintest.MatureBlocks(t, genesis)
+	central := startTestNode(t, genesis, "", blocks...)
+	peer := startTestNode(t, genesis, central.Address(), blocks...)
+	require.Eventually(t, func() bool {
+		return slices.Contains(central.KnownNodes(), peer.Address())
+	}, 5*time.Second, 10*time.Millisecond)
+	// 交易只转发给完成握手的节点
+	peerOf(t, central, peer.Address())
+
+	UTXOSet := chain.UTXOSet{Blockchain: central.Chain()}
+	payment, err := chain.NewUTXOTransactionWithSelector(alice, string(bob.GetAddress()), 5, &UTXOSet, chain.LargestFirst{}, chain.CoinSelectionParams{})
+	require.NoError(t, err)
+
+	payload := gobEncode(tx{"", payment.Serialize()})
+	require.NoError(t, send(central.Address(), DefaultMagic, "tx", payload))
+
+	require.Eventually(t, func() bool {
+		return central.Mempool().Has(payment.ID) && peer.Mempool().Has(payment.ID)
+	}, 5*time.Second, 10*time.Millisecond)
+	// 节点通过对方建立的连接转发 inv，双方之间只有一个连接
+	require.Len(t, peer.Peers(), 1)
+
+	central.Stop()
+	require.Error(t, send(central.Address(), DefaultMagic, "tx", payload))
+}
+
+func TestNode_DiscoversPeersAndSurvivesSeedShutdown(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	seed := startTestNode(t, genesis, "")
+	first := startTestNode(t, genesis, seed.Address())
+	second := startTestNode(t, genesis, seed.Address())
+
+	// first 和 second 只知道种子节点，通过地址广播找到对方并建立连接
+	connected := func(n *Node, addr string) bool {
+		for _, peer := range n.handshakedPeers() {
+			if peer.Addr() == addr {
+				return true
+			}
+		}
+		return false
+	}
+	require.Eventually(t, func() bool {
+		return connected(first, second.Address()) && connected(second, first.Address())
+	}, 10*time.Second, 10*time.Millisecond)
+
+	seed.Stop()
+	require.Eventually(t, func() bool {
+		return !connected(first, seed.Address()) && !connected(second, seed.Address())
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, connected(first, second.Address()))
+
+	// 种子节点的连接失败被记录下来，之后按退避时间重试
+	require.Eventually(t, func() bool {
+		ka, ok := first.book.get(seed.Address())
+		return ok && ka.Failures > 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNode_AnyNodeAcceptsAndRelaysTransactions(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(alice.GetAddress()), "")},
+	}
+	blocks := chaintest.MatureBlocks(t, genesis)
+	seed := startTestNode(t, genesis, "", blocks...)
+	nodes := []*Node{seed, startTestNode(t, genesis, seed.Address(), blocks...), startTestNode(t, genesis, seed.Address(), blocks...)}
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			if len(node.handshakedPeers()) < 2 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// 钱包把交易提交给任意一个节点，不可达的节点被跳过
+	UTXOSet := chain.UTXOSet{Blockchain: seed.Chain()}
+	payment, err := chain.NewUTXOTransactionWithSelector(alice, string(bob.GetAddress()), 5, &UTXOSet, chain.LargestFirst{}, chain.CoinSelectionParams{})
+	require.NoError(t, err)
+	require.NoError(t, SendTx(payment, "127.0.0.1:1", nodes[2].Address()))
+
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			if !node.Mempool().Has(payment.ID) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	// 每个连接都记录了对方已经知道这笔交易，不会再次转发
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			for _, peer := range node.handshakedPeers() {
+				if !peer.knownInventory.has(payment.ID) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRunServer_SavesStateAndClosesChainOnShutdown(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll("components", 0755))
+	genesis := &chain.Block{Hash: []byte("genesis"), PreBlockHash: []byte{}}
+	dbPath := filepath.Join("components", "blockchain_test.db")
+	bc, err := chain.CreateBlockchainAt(dbPath, genesis)
+	require.NoError(t, err)
+	UTXOSet := chain.UTXOSet{Blockchain: bc}
+	UTXOSet.Reindex()
+	bc.Close()
+
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	require.NoError(t, err)
+	cfg := DefaultConfig("test")
+	cfg.Address = ln.Addr().String()
+	cfg.Seeds = nil
+	require.NoError(t, ln.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- RunServer(ctx, cfg) }()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial(protocol, cfg.Address)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	peer := startTestNode(t, genesis, cfg.Address)
+	require.Eventually(t, func() bool {
+		return len(peer.handshakedPeers()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("RunServer did not return after cancel")
+	}
+
+	// 内存池和地址表已保存，数据库锁已释放
+	require.FileExists(t, cfg.MempoolPath)
+	book := newAddrBook(maxKnownAddrs)
+	loaded, err := book.load(cfg.PeersPath)
+	require.NoError(t, err)
+	require.Equal(t, 1, loaded)
+	_, ok := book.get(peer.Address())
+	require.True(t, ok)
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestNode_StopsOnFatalError(t *testing.T) {
+	node := startTestNode(t, &chain.Block{Hash: []byte("genesis"), PreBlockHash: []byte{}}, "")
+	require.NoError(t, node.Err())
+
+	node.fail(chain.ErrSnapshotMismatch)
+	select {
+	case <-node.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not stop")
+	}
+	node.Stop()
+	require.ErrorIs(t, node.Err(), chain.ErrSnapshotMismatch)
+}
+
+func TestNode_ConnectsMinedBlocksThroughTheBlockPath(t *testing.T) {
+	alice := wallet.NewWallet()
+	miner := string(wallet.NewWallet().GetAddress())
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(alice.GetAddress()), "")},
+	}
+	blocks := chaintest.MatureBlocks(t, genesis)
+	seed := startTestNode(t, genesis, "", blocks...)
+	peer := startTestNode(t, genesis, seed.Address(), blocks...)
+	peerOf(t, seed, peer.Address())
+	t.Cleanup(chain.SetTargetBits(4))
+
+	UTXOSet := chain.UTXOSet{Blockchain: seed.Chain()}
+	payment, err := chain.NewUTXOTransactionWithSelector(alice, miner, 5, &UTXOSet, chain.LargestFirst{}, chain.CoinSelectionParams{})
+	require.NoError(t, err)
+	require.NoError(t, seed.Mempool().Add(payment))
+
+	// 两个矿工在同一个链顶上挖出区块，先接上的成为链顶，另一个只作为分叉保存
+	mine := func() *chain.Block {
+		tmpl := mining.NewTemplate(seed.Chain(), seed.Mempool(), miner, 0)
+		b, err := seed.Chain().NewBlockContext(context.Background(), tmpl.Transactions)
+		require.NoError(t, err)
+		return b
+	}
+	first, second := mine(), mine()
+	require.NoError(t, seed.connectMinedBlock(first))
+	require.ErrorIs(t, seed.connectMinedBlock(second), chain.ErrStaleTip)
+	require.Equal(t, first.Hash, seed.Chain().GetBestBlock().Hash)
+	require.False(t, seed.Mempool().Has(payment.ID))
+
+	require.Eventually(t, func() bool {
+		return slices.Equal(peer.Chain().GetBestBlock().Hash, first.Hash)
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+)
+
+const (
+	// maxOrphanBlocks 和 maxOrphanBlockBytes 限制孤块池中的区块数和区块的总大小
+	maxOrphanBlocks     = 100
+	maxOrphanBlockBytes = 32 << 20
+	// orphanBlockExpiry 为孤块等待前一区块的最长时间
+	orphanBlockExpiry = 20 * time.Minute
+)
+
+// orphanBlock 是一个前一区块未知的区块
+type orphanBlock struct {
+	block   *chain.Block
+	peer    *Peer
+	size    int
+	expires time.Time
+}
+
+// orphanBlockPool 在内存中保存前一区块未知的区块，前一区块保存后再把它们接到链上。
+// 池满时丢弃最早到达的孤块。
+type orphanBlockPool struct {
+	mu sync.Mutex
+	// blocks 为区块哈希 -> 孤块，byPrev 为前一区块哈希 -> 以它为前一区块的孤块哈希
+	blocks map[string]*orphanBlock
+	byPrev map[string]map[string]struct{}
+	size   int
+	now    func() time.Time
+}
+
+func newOrphanBlockPool() *orphanBlockPool {
+	return &orphanBlockPool{
+		blocks: make(map[string]*orphanBlock),
+		byPrev: make(map[string]map[string]struct{}),
+		now:    time.Now,
+	}
+}
+
+// add 加入 p 发来的孤块，返回孤块是否是新加入的。超过总大小限制的区块不被保存。
+func (o *orphanBlockPool) add(b *chain.Block, p *Peer, size int) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	hash := string(b.Hash)
+	if _, ok := o.blocks[hash]; ok || size > maxOrphanBlockBytes {
+		return false
+	}
+	for len(o.blocks) >= maxOrphanBlocks || o.size+size > maxOrphanBlockBytes {
+		o.remove(o.oldest())
+	}
+
+	o.blocks[hash] = &orphanBlock{block: b, peer: p, size: size, expires: o.now().Add(orphanBlockExpiry)}
+	o.size += size
+	prev := string(b.PreBlockHash)
+	if o.byPrev[prev] == nil {
+		o.byPrev[prev] = make(map[string]struct{})
+	}
+	o.byPrev[prev][hash] = struct{}{}
+	return true
+}
+
+// has 判断孤块池中是否有指定区块
+func (o *orphanBlockPool) has(hash []byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	_, ok := o.blocks[string(hash)]
+	return ok
+}
+
+// root 返回 hash 所在的孤块链中最早的孤块，它的前一区块就是需要下载的祖先
+func (o *orphanBlockPool) root(hash []byte) *chain.Block {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	orphan, ok := o.blocks[string(hash)]
+	if !ok {
+		return nil
+	}
+	for {
+		parent, ok := o.blocks[string(orphan.block.PreBlockHash)]
+		if !ok {
+			return orphan.block
+		}
+		orphan = parent
+	}
+}
+
+// takeChildren 从池中取出以 prev 为前一区块的孤块
+func (o *orphanBlockPool) takeChildren(prev []byte) []*orphanBlock {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var children []*orphanBlock
+	for hash := range o.byPrev[string(prev)] {
+		children = append(children, o.blocks[hash])
+		o.remove(hash)
+	}
+	return children
+}
+
+// expire 删除超过 orphanBlockExpiry 仍未等到前一区块的孤块，返回被删除的数量
+func (o *orphanBlockPool) expire() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+	var expired []string
+	for hash, orphan := range o.blocks {
+		if now.After(orphan.expires) {
+			expired = append(expired, hash)
+		}
+	}
+	for _, hash := range expired {
+		o.remove(hash)
+	}
+	return len(expired)
+}
+
+// count 返回孤块池中的区块数
+func (o *orphanBlockPool) count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.blocks)
+}
+
+func (o *orphanBlockPool) oldest() string {
+	var oldestHash string
+	var oldest *orphanBlock
+	for hash, orphan := range o.blocks {
+		if oldest == nil || orphan.expires.Before(oldest.expires) {
+			oldestHash, oldest = hash, orphan
+		}
+	}
+	return oldestHash
+}
+
+func (o *orphanBlockPool) remove(hash string) {
+	orphan, ok := o.blocks[hash]
+	if !ok {
+		return
+	}
+	delete(o.blocks, hash)
+	o.size -= orphan.size
+	prev := string(orphan.block.PreBlockHash)
+	delete(o.byPrev[prev], hash)
+	if len(o.byPrev[prev]) == 0 {
+		delete(o.byPrev, prev)
+	}
+}
+
+// addOrphanBlock 把 p 发来的孤块放入孤块池，并向 p 请求本地主链与孤块之间缺少的区块头
+func (n *Node) addOrphanBlock(p *Peer, b *chain.Block) {
+	if !n.orphans.add(b, p, len(b.Serialize())) {
+		return
+	}
+	root := n.orphans.root(b.Hash)
+	if root == nil {
+		// 孤块刚加入就被其他孤块挤出了池
+		return
+	}
+	fmt.Printf("Block %x is an orphan, requesting its ancestors from %s\n", b.Hash, p)
+	n.sendData(p, "getheaders", gobEncode(getHeaders{AddrFrom: n.address, Locator: n.locator(), HashStop: root.PreBlockHash}))
+}
+
+// acceptBlock 把 p 发来的区块接到链上，区块保存后依次接上以它为祖先的孤块。返回区块是否已经在本地。
+func (n *Node) acceptBlock(p *Peer, b *chain.Block) bool {
+	if !n.processBlock(p, b) {
+		return false
+	}
+	queue := [][]byte{b.Hash}
+	for len(queue) > 0 {
+		children := n.orphans.takeChildren(queue[0])
+		queue = queue[1:]
+		for _, orphan := range children {
+			if n.processBlock(orphan.peer, orphan.block) {
+				queue = append(queue, orphan.block.Hash)
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+// orphanChain 构造 count 个接在 parent 之后的区块，不需要工作量证明
+func orphanChain(prefix string, parent []byte, count int) []*chain.Block {
+	var blocks []*chain.Block
+	for i := 0; i < count; i++ {
+		b := &chain.Block{Hash: []byte(fmt.Sprintf("%s-%d", prefix, i)), PreBlockHash: parent, Height: i + 1}
+		blocks = append(blocks, b)
+		parent = b.Hash
+	}
+	return blocks
+}
+
+func TestOrphanBlockPool_ConnectsChildrenAndFindsRoot(t *testing.T) {
+	orphans := newOrphanBlockPool()
+	blocks := orphanChain("main", []byte("missing"), 3)
+	fork := orphanChain("fork", blocks[0].Hash, 1)[0]
+
+	// 乱序到达的孤块
+	for _, b := range []*chain.Block{blocks[2], blocks[0], fork, blocks[1]} {
+		require.True(t, orphans.add(b, nil, 100))
+	}
+	require.False(t, orphans.add(blocks[1], nil, 100), "an orphan is only added once")
+	require.Equal(t, blocks[0], orphans.root(blocks[2].Hash))
+	require.Nil(t, orphans.root([]byte("unknown")))
+
+	children := orphans.takeChildren([]byte("missing"))
+	require.Len(t, children, 1)
+	require.Equal(t, blocks[0], children[0].block)
+	require.Len(t, orphans.takeChildren(blocks[0].Hash), 2, "both forks wait for the same parent")
+	require.Equal(t, 1, orphans.count())
+	require.True(t, orphans.has(blocks[2].Hash))
+}
+
+func TestOrphanBlockPool_BoundsAndExpiry(t *testing.T) {
+	orphans := newOrphanBlockPool()
+	now := time.Unix(1700000000, 0)
+	orphans.now = func() time.Time { return now }
+
+	blocks := orphanChain("main", []byte("missing"), maxOrphanBlocks+1)
+	for _, b := range blocks {
+		now = now.Add(time.Second)
+		orphans.add(b, nil, 1)
+	}
+	require.Equal(t, maxOrphanBlocks, orphans.count())
+	require.False(t, orphans.has(blocks[0].Hash), "the oldest orphan is evicted first")
+
+	// 总大小超过限制时同样丢弃最早的孤块，单个超过限制的区块不被保存
+	large := orphanChain("large", []byte("missing"), 2)
+	require.True(t, orphans.add(large[0], nil, maxOrphanBlockBytes-10))
+	require.Equal(t, 11, orphans.count())
+	require.False(t, orphans.add(large[1], nil, maxOrphanBlockBytes+1))
+
+	now = now.Add(orphanBlockExpiry + time.Minute)
+	require.Equal(t, 11, orphans.expire())
+	require.Zero(t, orphans.count())
+}
+
+func TestNode_RemovesOrphanTransactionsOfClosedPeers(t *testing.T) {
+	alice := wallet.NewWallet()
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(alice.GetAddress()), "")},
+	}
+	node := startTestNode(t, genesis, "")
+	orphan := func(parent string) *chain.Transaction {
+		tx := &chain.Transaction{
+			Vin:  []chain.TXInput{{Txid: []byte(parent), Vout: 0, PubKey: alice.PublicKey}},
+			Vout: []chain.TXOutput{*chain.NewTXOutput(5, string(alice.GetAddress()))},
+		}
+		tx.ID = tx.Hash()
+		return tx
+	}
+
+	v := testVersion(genesis)
+	v.AddrFrom = "127.0.0.1:1"
+	conn := handshake(t, node, v)
+	require.NoError(t, writeMessage(conn, DefaultMagic, "tx", gobEncode(tx{v.AddrFrom, orphan("first parent").Serialize()})))
+	require.Eventually(t, func() bool { return node.Mempool().OrphanCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// 连接断开后它发来的孤儿交易被删除
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool { return node.Mempool().OrphanCount() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// 被封禁的节点发来的孤儿交易同样被删除
+	conn = handshake(t, node, v)
+	require.NoError(t, writeMessage(conn, DefaultMagic, "tx", gobEncode(tx{v.AddrFrom, orphan("second parent").Serialize()})))
+	require.Eventually(t, func() bool { return node.Mempool().OrphanCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+	node.Ban("127.0.0.1", time.Hour, "test")
+	require.Zero(t, node.Mempool().OrphanCount())
+}
@@ -0,0 +1,462 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	chaindid "github.com/qujing226/blockchain/did"
+)
+
+const (
+	// sendQueueSize 为每个节点待发送消息队列的长度，队列满时 Send 阻塞
+	sendQueueSize = 128
+	// sendQueueTimeout 为队列满时 Send 最多等待的时间，超时说明对方处理不过来，断开连接
+	sendQueueTimeout = 30 * time.Second
+	// writeTimeout 为写出一条消息的最长时间
+	writeTimeout = 30 * time.Second
+	// dialTimeout 为建立连接的最长时间
+	dialTimeout = 5 * time.Second
+)
+
+var (
+	ErrPeerClosed    = errors.New("peer connection is closed")
+	ErrSendQueueFull = errors.New("peer send queue is full")
+)
+
+// PeerInfo 为一个已握手连接的概况
+type PeerInfo struct {
+	Addr string `json:"addr"`
+	// DID 为对方在握手中证明控制的 DID，对方没有身份时为空
+	DID       string `json:"did,omitempty"`
+	Inbound   bool   `json:"inbound"`
+	Services  string `json:"services"`
+	UserAgent string `json:"user_agent"`
+	Version   int    `json:"version"`
+	Height    int    `json:"height"`
+	LatencyMs int64  `json:"latency_ms"`
+	Score     int    `json:"score"`
+	Transport string `json:"transport"`
+}
+
+// Peer 是与另一个节点之间的长连接。读循环依次处理收到的消息，写循环依次发出队列中的消息。
+type Peer struct {
+	node    *Node
+	conn    net.Conn
+	inbound bool
+
+	mu sync.Mutex
+	// addr 为对方的监听地址。主动连接时为拨号地址，被动连接时在收到对方消息后才知道
+	addr string
+	// draining 表示连接将在发送队列中的消息发完后关闭
+	draining bool
+	// version 为对方在握手中发来的 version，verackReceived 表示对方已确认我们的 version
+	version        *version
+	verackReceived bool
+	// addrAnswered 表示已经回复过对方的 getaddr
+	addrAnswered bool
+	// challenge 为我们 version 中要求对方签名的随机数，did 为对方证明控制的 DID，尚未证明时为空
+	challenge []byte
+	did       string
+
+	// knownInventory 为对方已经有的交易和区块，转发时跳过它们
+	knownInventory *inventorySet
+
+	// pingNonce 为尚未收到 pong 的 ping，为 0 表示没有；pingSent 为最近一次 ping 的时间
+	pingNonce uint64
+	pingSent  time.Time
+	latency   time.Duration
+	// stalls 为对方连续没有按时回复的请求数
+	stalls int
+	// score 为对方累计的不良行为分数
+	score int
+	// filter 为轻节点加载的布隆过滤器，merkleblock 中只包含与它匹配的交易
+	filter *bloomFilter
+
+	sendQueue chan *message
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPeer(n *Node, conn net.Conn, addr string, inbound bool) *Peer {
+	return &Peer{
+		node:      n,
+		conn:      conn,
+		inbound:   inbound,
+		addr:      addr,
+		sendQueue: make(chan *message, sendQueueSize),
+		challenge: chaindid.GenerateChallenge(),
+
+		knownInventory: newInventorySet(maxKnownInventory),
+		quit:           make(chan struct{}),
+	}
+}
+
+// Addr 返回对方的监听地址，尚不知道时返回空字符串
+func (p *Peer) Addr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.addr
+}
+
+func (p *Peer) setAddr(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.addr = addr
+}
+
+// String 返回便于打印的对方地址
+func (p *Peer) String() string {
+	if addr := p.Addr(); addr != "" {
+		return addr
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+// orphanSource 为孤儿池记录的来源。按连接而不是对方声称的地址记录，连接断开时删除它发来的孤儿交易
+func (p *Peer) orphanSource() string {
+	return p.conn.RemoteAddr().String()
+}
+
+// Version 返回对方握手时发来的 version，尚未收到时返回 nil
+func (p *Peer) Version() *version {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.version
+}
+
+func (p *Peer) setVersion(v *version) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.version = v
+}
+
+func (p *Peer) setVerackReceived() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.verackReceived = true
+}
+
+// verackSeen 判断对方是否已确认我们的 version
+func (p *Peer) verackSeen() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.verackReceived
+}
+
+// markAddrAnswered 记录回复了对方的 getaddr，已经回复过时返回 false
+func (p *Peer) markAddrAnswered() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.addrAnswered {
+		return false
+	}
+	p.addrAnswered = true
+	return true
+}
+
+// Handshaked 判断双方是否都已收到并确认了对方的 version，许可链模式下对方还必须已经证明了 DID
+func (p *Peer) Handshaked() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.version != nil && p.verackReceived && (p.did != "" || !p.node.permissioned())
+}
+
+// DID 返回对方在握手中证明控制的 DID，对方没有身份或尚未证明时返回空字符串
+func (p *Peer) DID() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.did
+}
+
+func (p *Peer) setDID(did string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.did = did
+}
+
+// Services 返回对方声明提供的服务
+func (p *Peer) Services() ServiceFlag {
+	if v := p.Version(); v != nil {
+		return v.Services
+	}
+	return 0
+}
+
+// UserAgent 返回对方的客户端名称
+func (p *Peer) UserAgent() string {
+	if v := p.Version(); v != nil {
+		return v.UserAgent
+	}
+	return ""
+}
+
+// Latency 返回最近一次 ping 的往返时间，尚未测量时返回 0
+func (p *Peer) Latency() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.latency
+}
+
+func (p *Peer) pendingPing() (uint64, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pingNonce, p.pingSent
+}
+
+func (p *Peer) setPendingPing(nonce uint64, sent time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pingNonce = nonce
+	p.pingSent = sent
+}
+
+// answerPing 在 nonce 与尚未回复的 ping 相同时记录延迟并返回 true
+func (p *Peer) answerPing(nonce uint64, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pingNonce == 0 || nonce != p.pingNonce {
+		return false
+	}
+	p.pingNonce = 0
+	p.latency = now.Sub(p.pingSent)
+	return true
+}
+
+// addStall 记录一次没有按时回复的请求，返回连续停滞的次数
+func (p *Peer) addStall() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stalls++
+	return p.stalls
+}
+
+func (p *Peer) resetStalls() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stalls = 0
+}
+
+// addScore 增加对方的不良行为分数，返回累计的分数
+func (p *Peer) addScore(score int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.score += score
+	return p.score
+}
+
+// Score 返回对方累计的不良行为分数
+func (p *Peer) Score() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.score
+}
+
+// remoteHost 返回连接对端的主机地址
+func (p *Peer) remoteHost() string {
+	addr := p.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// banKeys 返回封禁对方时使用的键。主动连接的对方封禁我们拨通的地址，被动连接的对方封禁实际连接来自的主机：
+// 被动连接的对方在 version 中声明的地址没有经过确认，按它封禁可能封掉其他节点。
+// 对方证明了 DID 时还封禁 DID，换 IP 也无法绕过。许可链模式下只封禁 DID；
+// 否则 DID 可以随意生成，对方换一个 DID 就能重新连接，因此同时封禁地址。
+func (p *Peer) banKeys(permissioned bool) []string {
+	did := p.DID()
+	if did != "" && permissioned {
+		return []string{did}
+	}
+	key := p.remoteHost()
+	if addr := p.Addr(); addr != "" && !p.Inbound() {
+		key = addr
+	}
+	if did != "" {
+		return []string{key, did}
+	}
+	return []string{key}
+}
+
+// matchesBan 判断对 addr 的封禁是否适用于这个连接
+func (p *Peer) matchesBan(addr string) bool {
+	if addr == p.remoteHost() || (addr == p.DID() && addr != "") {
+		return true
+	}
+	listen := p.Addr()
+	if listen == "" || p.Inbound() {
+		return false
+	}
+	if host, _, err := net.SplitHostPort(listen); err == nil && host == addr {
+		return true
+	}
+	return listen == addr
+}
+
+// Encrypted 判断连接是否使用加密传输
+func (p *Peer) Encrypted() bool {
+	_, ok := p.conn.(*secureConn)
+	return ok
+}
+
+// session 返回加密连接的会话标识，未加密时返回 nil
+func (p *Peer) session() []byte {
+	if conn, ok := p.conn.(*secureConn); ok {
+		return conn.Session()
+	}
+	return nil
+}
+
+// Transport 返回连接使用的加密算法，未加密时返回 plaintext
+func (p *Peer) Transport() string {
+	if conn, ok := p.conn.(*secureConn); ok {
+		return conn.Suite().String()
+	}
+	return "plaintext"
+}
+
+// Inbound 判断连接是否由对方发起
+func (p *Peer) Inbound() bool {
+	return p.inbound
+}
+
+// Send 将消息放入发送队列。队列满时阻塞，起到背压作用；
+// 等待超过 sendQueueTimeout 仍然放不进去时断开连接并返回 ErrSendQueueFull。
+func (p *Peer) Send(command string, payload []byte) error {
+	msg := &message{Command: command, Payload: payload}
+	select {
+	case <-p.quit:
+		return ErrPeerClosed
+	default:
+	}
+	select {
+	case p.sendQueue <- msg:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(sendQueueTimeout)
+	defer timer.Stop()
+	select {
+	case p.sendQueue <- msg:
+		return nil
+	case <-p.quit:
+		return ErrPeerClosed
+	case <-timer.C:
+		fmt.Printf("Send queue to %s is full, disconnecting\n", p)
+		p.Close()
+		return ErrSendQueueFull
+	}
+}
+
+// Close 关闭连接，可以重复调用
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		_ = p.conn.Close()
+	})
+}
+
+// closeAfterFlush 在写循环发出队列中已有的消息（例如 reject）之后关闭连接
+func (p *Peer) closeAfterFlush() {
+	p.mu.Lock()
+	p.draining = true
+	p.mu.Unlock()
+
+	select {
+	case p.sendQueue <- nil:
+	default:
+		p.Close()
+	}
+}
+
+func (p *Peer) flushing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.draining
+}
+
+// Done 返回连接关闭时被关闭的通道
+func (p *Peer) Done() <-chan struct{} {
+	return p.quit
+}
+
+func (p *Peer) readLoop() {
+	defer func() {
+		if !p.flushing() {
+			p.Close()
+		}
+	}()
+
+	for {
+		msg, err := readMessage(p.conn, p.node.cfg.Magic)
+		switch {
+		case errors.Is(err, ErrBadChecksum):
+			// 只丢弃这一条消息
+			p.node.sendReject(p, msg.Command, RejectMalformed, err.Error(), nil)
+			p.node.misbehaving(p, scoreProtocol, err.Error())
+			continue
+		case errors.Is(err, ErrMessageTooLarge):
+			// payload 没有被读取，无法再找到下一条消息的开头
+			p.node.sendReject(p, msg.Command, RejectMalformed, err.Error(), nil)
+			p.node.misbehaving(p, scoreMalformed, err.Error())
+			p.closeAfterFlush()
+			return
+		case err != nil:
+			select {
+			case <-p.quit:
+			default:
+				fmt.Printf("Connection to %s closed: %v\n", p, err)
+			}
+			return
+		}
+		p.node.handleMessage(p, msg)
+		if p.flushing() {
+			return
+		}
+	}
+}
+
+func (p *Peer) writeLoop() {
+	defer p.Close()
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		case msg := <-p.sendQueue:
+			if msg == nil {
+				// closeAfterFlush 放入的结束标记
+				return
+			}
+			_ = p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := writeMessage(p.conn, p.node.cfg.Magic, msg.Command, msg.Payload); err != nil {
+				fmt.Printf("Failed to send %s to %s: %v\n", msg.Command, p, err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/qujing226/blockchain/mempool"
+)
+
+// RejectCode 为 reject 消息中的原因代码
+type RejectCode uint8
+
+const (
+	// RejectMalformed 表示消息无法解码或校验和错误
+	RejectMalformed RejectCode = 0x01
+	// RejectInvalid 表示交易或区块没有通过验证
+	RejectInvalid RejectCode = 0x10
+	// RejectObsolete 表示对方的协议版本过旧
+	RejectObsolete RejectCode = 0x11
+	// RejectDuplicate 表示交易或区块已经存在
+	RejectDuplicate RejectCode = 0x12
+	// RejectNonstandard 表示交易有效但不符合本节点的转发策略
+	RejectNonstandard RejectCode = 0x40
+	// RejectInsufficientFee 表示交易手续费不足
+	RejectInsufficientFee RejectCode = 0x42
+)
+
+func (c RejectCode) String() string {
+	switch c {
+	case RejectMalformed:
+		return "malformed"
+	case RejectInvalid:
+		return "invalid"
+	case RejectObsolete:
+		return "obsolete"
+	case RejectDuplicate:
+		return "duplicate"
+	case RejectNonstandard:
+		return "nonstandard"
+	case RejectInsufficientFee:
+		return "insufficient fee"
+	default:
+		return fmt.Sprintf("unknown code 0x%02x", uint8(c))
+	}
+}
+
+// reject 告诉对方它发来的某条消息被拒绝以及原因
+type reject struct {
+	AddrFrom string
+	// Message 为被拒绝消息的命令
+	Message string
+	Code    RejectCode
+	Reason  string
+	// Data 为被拒绝的交易或区块的哈希，可以为空
+	Data []byte
+}
+
+// decodePayload 将 gob 编码的消息内容解码到 v
+func decodePayload(payload []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+}
+
+// sendReject 直接通过 p 的连接发送 reject 消息，对方的监听地址未知时也可以回复
+func (n *Node) sendReject(p *Peer, command string, code RejectCode, reason string, data []byte) {
+	fmt.Printf("Rejecting %s from %s: %s (%s)\n", command, p, reason, code)
+	payload := gobEncode(reject{n.address, command, code, reason, data})
+	if err := p.Send("reject", payload); err != nil {
+		fmt.Printf("Failed to send reject to %s: %v\n", p, err)
+	}
+}
+
+func (n *Node) handleReject(p *Peer, request []byte) {
+	var payload reject
+	if err := decodePayload(request, &payload); err != nil {
+		// 不对 reject 再回复 reject，避免两个节点互相拒绝
+		fmt.Printf("Malformed reject from %s: %v\n", p, err)
+		return
+	}
+	if len(payload.Data) > 0 {
+		fmt.Printf("%s rejected our %s %x: %s (%s)\n", p, payload.Message, payload.Data, payload.Reason, payload.Code)
+	} else {
+		fmt.Printf("%s rejected our %s: %s (%s)\n", p, payload.Message, payload.Reason, payload.Code)
+	}
+}
+
+// txRejectCode 返回内存池拒绝交易的错误对应的原因代码
+func txRejectCode(err error) RejectCode {
+	switch {
+	case errors.Is(err, mempool.ErrAlreadyHave), errors.Is(err, mempool.ErrAlreadyInChain):
+		return RejectDuplicate
+	case errors.Is(err, mempool.ErrFeeTooLow), errors.Is(err, mempool.ErrPoolFull):
+		return RejectInsufficientFee
+	case errors.Is(err, mempool.ErrOrphanTooLarge), errors.Is(err, mempool.ErrImmatureSpend):
+		// 对方的链顶可能比本节点高，coinbase 在它看来已经成熟
+		return RejectNonstandard
+	default:
+		return RejectInvalid
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_RejectsMalformedMessages(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	node := startTestNode(t, genesis, "")
+
+	conn := handshake(t, node, testVersion(genesis))
+
+	// 握手后节点还会发来 addr 等消息，跳过它们
+	readReject := func() reject {
+		msg, err := readMessage(conn, DefaultMagic)
+		for err == nil && msg.Command != "reject" {
+			msg, err = readMessage(conn, DefaultMagic)
+		}
+		require.NoError(t, err)
+		var payload reject
+		require.NoError(t, decodePayload(msg.Payload, &payload))
+		return payload
+	}
+
+	// 无法解码的交易
+	require.NoError(t, writeMessage(conn, DefaultMagic, "tx", []byte{0x01, 0x02, 0x03}))
+	rej := readReject()
+	require.Equal(t, "tx", rej.Message)
+	require.Equal(t, RejectMalformed, rej.Code)
+
+	// 未知命令
+	require.NoError(t, writeMessage(conn, DefaultMagic, "bogus", nil))
+	rej = readReject()
+	require.Equal(t, "bogus", rej.Message)
+
+	// 超长的消息无法跳过，节点回复 reject 后断开连接
+	var frame bytes.Buffer
+	require.NoError(t, writeMessage(&frame, DefaultMagic, "getdata", nil))
+	header := frame.Bytes()
+	binary.LittleEndian.PutUint32(header[4+commandLength:], uint32(maxPayloadFor("getdata")+1))
+	_, err := conn.Write(header)
+	require.NoError(t, err)
+	rej = readReject()
+	require.Equal(t, "getdata", rej.Message)
+	require.Equal(t, RejectMalformed, rej.Code)
+	_, err = readMessage(conn, DefaultMagic)
+	require.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/mining"
+	"github.com/qujing226/blockchain/wallet"
+)
+
+// RegisterRoutes 注册节点的 HTTP 接口：外部矿工使用的 getblocktemplate / submitblock 以及内存池与余额查询
+func (n *Node) RegisterRoutes(s *gin.Engine, work *mining.WorkManager) {
+	s.POST("/mining/getblocktemplate", n.getBlockTemplate(work))
+	s.POST("/mining/submitblock", submitBlock(work))
+
+	s.GET("/mempool/info", n.getMempoolInfo)
+	s.GET("/mempool/txs", n.getMempoolTxs)
+	s.GET("/wallet/balance", n.getBalance)
+}
+
+// RegisterAdminRoutes 注册节点信息与封禁管理接口。这些接口没有认证，只能在 Config.AdminAddr 的回环地址上提供。
+func (n *Node) RegisterAdminRoutes(s *gin.Engine) {
+	s.GET("/admin/getpeerinfo", n.getPeerInfo)
+	s.GET("/admin/listbanned", n.listBanned)
+	s.POST("/admin/setban", n.setBan)
+	s.POST("/admin/clearbanned", n.clearBanned)
+}
+
+// getBlockTemplate 返回一份新的工作。请求中的 address 为 coinbase 收款地址，缺省时使用节点的挖矿地址。
+func (n *Node) getBlockTemplate(work *mining.WorkManager) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req struct {
+			Address string `json:"address"`
+		}
+		if err := ctx.ShouldBindJSON(&req); err != nil && ctx.Request.ContentLength > 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "请求格式错误", "error": err.Error()})
+			return
+		}
+		if req.Address == "" {
+			req.Address = n.cfg.MinerAddress
+		}
+		if req.Address == "" || !wallet.ValidateAddress(req.Address) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid coinbase address"})
+			return
+		}
+		ctx.JSON(http.StatusOK, work.GetWork(req.Address))
+	}
+}
+
+// submitBlock 接收外部矿工对某份工作的解，验证通过后区块被接到链顶并广播
+func submitBlock(work *mining.WorkManager) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var sub mining.Submission
+		if err := ctx.BindJSON(&sub); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "请求格式错误", "error": err.Error()})
+			return
+		}
+		b, err := work.Submit(sub)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, mining.ErrStaleWork) || errors.Is(err, mining.ErrUnknownWork) {
+				status = http.StatusConflict
+			}
+			ctx.JSON(status, gin.H{"message": "block rejected", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"hash": hex.EncodeToString(b.Hash), "height": b.Height})
+	}
+}
+
+func (n *Node) getMempoolInfo(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, n.pool.Info())
+}
+
+func (n *Node) getMempoolTxs(ctx *gin.Context) {
+	type txInfo struct {
+		ID      string `json:"id"`
+		Size    int    `json:"size"`
+		Fee     int    `json:"fee"`
+		FeeRate int    `json:"fee_rate"`
+		Added   int64  `json:"added"`
+		Height  int    `json:"height"`
+	}
+	descs := n.pool.Descs()
+	txs := make([]txInfo, 0, len(descs))
+	for _, desc := range descs {
+		txs = append(txs, txInfo{
+			ID:      hex.EncodeToString(desc.Tx.ID),
+			Size:    desc.Size,
+			Fee:     desc.Fee,
+			FeeRate: desc.FeeRate,
+			Added:   desc.Added.Unix(),
+			Height:  desc.Height,
+		})
+	}
+	ctx.JSON(http.StatusOK, gin.H{"transactions": txs})
+}
+
+// getBalance 返回 address 的余额，内存池中的交易计入未上链的收款与支出。minconf 缺省为 1。
+func (n *Node) getBalance(ctx *gin.Context) {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(ctx.Query("address"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid address", "error": err.Error()})
+		return
+	}
+	minConf := 1
+	if value := ctx.Query("minconf"); value != "" {
+		if minConf, err = strconv.Atoi(value); err != nil || minConf < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid minconf"})
+			return
+		}
+	}
+	UTXOSet := chain.UTXOSet{Blockchain: n.bc}
+	ctx.JSON(http.StatusOK, UTXOSet.Balance(pubKeyHash, minConf, n.pool.Transactions()))
+}
+
+func (n *Node) getPeerInfo(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"peers": n.PeerInfo()})
+}
+
+func (n *Node) listBanned(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"banned": n.Banned()})
+}
+
+// SetBanRequest 为 setban 的请求。Command 为 add 或 remove，Duration 为 time.ParseDuration 格式，缺省时使用节点配置的封禁时长
+type SetBanRequest struct {
+	Addr     string `json:"addr"`
+	Command  string `json:"command"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// setBan 手动封禁或解除封禁一个地址
+func (n *Node) setBan(ctx *gin.Context) {
+	var req SetBanRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "请求格式错误", "error": err.Error()})
+		return
+	}
+	if req.Addr == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "addr is required"})
+		return
+	}
+
+	switch req.Command {
+	case "add":
+		duration := n.cfg.BanDuration
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid duration", "error": fmt.Sprint(err)})
+				return
+			}
+			duration = d
+		}
+		if req.Reason == "" {
+			req.Reason = "manually banned"
+		}
+		ctx.JSON(http.StatusOK, n.Ban(req.Addr, duration, req.Reason))
+	case "remove":
+		if !n.Unban(req.Addr) {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": "address is not banned"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"addr": req.Addr})
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "command must be add or remove"})
+	}
+}
+
+func (n *Node) clearBanned(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"cleared": n.ClearBanned()})
+}
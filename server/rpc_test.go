@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/block_chain/chaintest"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_BalanceRouteIncludesMempool(t *testing.T) {
+	alice := wallet.NewWallet()
+	bob := wallet.NewWallet()
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(alice.GetAddress()), "")},
+	}
+	node := startTestNode(t, genesis, "", chaintest.MatureBlocks(t, genesis)...)
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	node.RegisterRoutes(engine, nil)
+
+	UTXOSet := chain.UTXOSet{Blockchain: node.Chain()}
+	payment, err := chain.NewUTXOTransactionWithSelector(alice, string(bob.GetAddress()), 5, &UTXOSet, chain.LargestFirst{}, chain.CoinSelectionParams{})
+	require.NoError(t, err)
+	require.NoError(t, node.Mempool().Add(payment))
+
+	balance := func(address string) chain.Balance {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/wallet/balance?address="+address+"&minconf=1", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var b chain.Balance
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+		return b
+	}
+	require.Equal(t, chain.Balance{Confirmed: 20, PendingIncoming: 15, PendingOutgoing: 20}, balance(string(alice.GetAddress())))
+	require.Equal(t, chain.Balance{PendingIncoming: 5}, balance(string(bob.GetAddress())))
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/wallet/balance?address=nobody", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -3,11 +3,10 @@ package server
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/fatih/color"
 	"github.com/qujing226/blockchain/block_chain"
-	"io"
 	"log"
 	"net"
 	"time"
@@ -15,28 +14,9 @@ import (
 
 const (
 	protocol      = "tcp"
-	nodeVersion   = 1
 	commandLength = 12
 )
 
-var (
-	nodeAddress string
-	// miningAddress 只会在矿工节点上设置。如果有两笔或者更多的交易则开始挖矿。
-	miningAddress string
-	// knowNodes 是区块链的节点池
-	// “localhost:3000”这是对中心节点的地址进行硬编码：因为每个节点必须知道从何处开始初始化。
-	knownNodes = []string{"localhost:3000"}
-	// blocksInTransit 跟踪已下载的块。这能够让我们从不同的节点下载块。
-	// 在将块置于传送状态时，我们给 inv 消息的发送者发送 getData 命令并更新 blocksInTransit。
-	blocksInTransit [][]byte
-	// memPool 存储所有交易，直到被挖出块。
-	memPool = make(map[string]chain.Transaction)
-)
-
-type addr struct {
-	AddrList []string
-}
-
 // block 用来发送 Block 消息。
 type block struct {
 	AddrFrom string
@@ -49,11 +29,6 @@ type tx struct {
 	Transaction []byte
 }
 
-// getBlocks 用来请求 BlockHashes。
-type getBlocks struct {
-	AddrFrom string
-}
-
 // getData 用于某个块或交易的请求，它可以仅包含一个块或交易的 ID。
 type getData struct {
 	AddrFrom string
@@ -69,406 +44,471 @@ type inv struct {
 }
 
 // 节点通过消息（message）进行交流。 当一个新的节点开始运行时，
-// 它会从一个 DNS 种子获取几个节点，发送 version 消息
+// 它会从一个 DNS 种子获取几个节点，发送 version 消息。
+// 对方检查协议版本、网络和创世区块后回复自己的 version 和 verack，握手完成。
 type version struct {
-	Version    int
-	BestHeight int
-	AddrFrom   string
+	Version   int
+	Services  ServiceFlag
+	UserAgent string
+	// Timestamp 为发送方的本地时间（Unix 秒）
+	Timestamp int64
+	// GenesisHash 为发送方的创世区块哈希，不知道时为空
+	GenesisHash []byte
+	Magic       uint32
+	BestHeight  int
+	AddrFrom    string
+	// Challenge 为要求对方用 DID 密钥签名的随机数，对方有身份时回复 didauth
+	Challenge []byte
 }
 
-// sendVersion 用于发送本节点的版本信息。
-// 如果当前节点不是中心节点，则必须向中心节点发送version信息
-// 通过 Height 来进行确认本节点是否是最新的节点。
-func sendVersion(addr string, bc *chain.BlockChain) {
-	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(version{
-		Version:    nodeVersion,
-		BestHeight: bestHeight,
-		AddrFrom:   nodeAddress,
-	})
-	request := append(commandToBytes("version"), payload...)
-
-	sendData(addr, request)
+// didAuth 证明发送者控制 DID：PublicKey 为 DID 对应的公钥，Signature 为对对方 challenge 的签名
+type didAuth struct {
+	DID       string
+	PublicKey []byte
+	Signature []byte
 }
 
 // sendInv 用于发送 inv 消息。
 // inv 来向其他节点展示当前节点有什么块和交易。它没有包含完整的区块链和交易，仅仅是哈希而已。
-func sendInv(addr, command string, items [][]byte) {
-	inventory := inv{nodeAddress, command, items}
-	payload := gobEncode(inventory)
-	request := append(commandToBytes("inv"), payload...)
-
-	sendData(addr, request)
-}
-
-// sendGetBlocks 用于发送 getBlocks 消息。期望对方返回所有 BlockHashes。
-func sendGetBlocks(addr string) {
-	payload := gobEncode(getBlocks{nodeAddress})
-	request := append(commandToBytes("getblocks"), payload...)
-
-	sendData(addr, request)
+func (n *Node) sendInv(p *Peer, kind string, items [][]byte) {
+	payload := gobEncode(inv{n.address, kind, items})
+	n.sendData(p, "inv", payload)
 }
 
 // sendGetData 用于发送 getData 消息。
-func sendGetData(addr, kind string, id []byte) {
-	payload := gobEncode(getData{nodeAddress, kind, id})
-	request := append(commandToBytes("getdata"), payload...)
-
-	sendData(addr, request)
+func (n *Node) sendGetData(p *Peer, kind string, id []byte) {
+	payload := gobEncode(getData{n.address, kind, id})
+	n.sendData(p, "getdata", payload)
 }
 
 // sendBlock 用于发送一个 block 消息。
 // block 消息指定了节点地址，附带一个块的二进制序列。
-func sendBlock(addr string, b *chain.Block) {
-	data := block{nodeAddress, b.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
-
-	sendData(addr, request)
+func (n *Node) sendBlock(p *Peer, b *chain.Block) {
+	p.knownInventory.add(b.Hash)
+	n.received(p, b.Hash)
+	payload := gobEncode(block{n.address, b.Serialize()})
+	n.sendData(p, "block", payload)
 }
 
 // sendTx 用于发送一个 tx 消息。
-func sendTx(addr string, t *chain.Transaction) {
-	data := tx{nodeAddress, t.Serialize()}
-	payload := gobEncode(data)
-	// 尝试通过json进行编码
-	//payload, err := json.Marshal(data)
-	//if err != nil {
-	//	fmt.Println("json marshal error")
-	//}
-
-	request := append(commandToBytes("tx"), payload...)
-	sendData(addr, request)
-}
-
-func SendTx(tx *chain.Transaction) {
-	sendTx(knownNodes[0], tx)
+func (n *Node) sendTx(p *Peer, t *chain.Transaction) {
+	p.knownInventory.add(t.ID)
+	payload := gobEncode(tx{n.address, t.Serialize()})
+	n.sendData(p, "tx", payload)
 }
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
-	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updateNodes []string
 
-		for _, node := range knownNodes {
-			if node != addr {
-				updateNodes = append(updateNodes, node)
-			}
+// SendTx 将交易提交给 addrs 中第一个可以连接的节点，addrs 为空时使用默认种子节点。
+// 每个节点都会验证交易并转发给其他节点，供钱包等不运行节点的调用方使用。
+func SendTx(t *chain.Transaction, addrs ...string) error {
+	if len(addrs) == 0 {
+		addrs = defaultSeeds
+	}
+	payload := gobEncode(tx{"", t.Serialize()})
+	var err error
+	for _, addr := range addrs {
+		if err = send(addr, DefaultMagic, "tx", payload); err == nil {
+			return nil
 		}
-		knownNodes = updateNodes
-
-		return
+		fmt.Printf("%s is not available\n", addr)
 	}
-	defer conn.Close()
+	return fmt.Errorf("no node accepted the transaction: %w", err)
+}
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
+// sendData 通过 p 的连接发送一条消息，回复总是发给请求来自的连接
+func (n *Node) sendData(p *Peer, command string, payload []byte) {
+	if err := p.Send(command, payload); err != nil {
+		fmt.Printf("Failed to queue %s for %s: %v\n", command, p, err)
 	}
 }
 
-// handlerVersion 通过比较本节点的版本号和远程节点的版本号（height）进行处理
-// 如果本节点的版本号小于远程节点的版本号，则发送 getBlocks 消息。否则发送version
-func handlerVersion(request []byte, bc *chain.BlockChain) {
-	var buff bytes.Buffer
-	var payload version
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+// send 建立一个临时连接发送一条消息后关闭，用于不运行节点的调用方。
+// 节点只处理握手之后的消息，因此先以不保存任何区块的 pruned 节点身份完成握手：
+// 发送 version，等到对方的 version 和 verack 后回复 verack。
+func send(addr string, magic uint32, command string, payload []byte) error {
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
-	if myBestHeight < foreignerBestHeight {
-		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	hello := version{
+		Version:   protocolVersion,
+		Services:  ServicePruned,
+		UserAgent: UserAgent,
+		Timestamp: time.Now().Unix(),
+		Magic:     magic,
 	}
-
-	// sendAddr(payload.AddrFrom)
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+	if err = writeMessage(conn, magic, "version", gobEncode(hello)); err != nil {
+		return err
 	}
-}
-
-func handleAddr(request []byte) {
-	var buff bytes.Buffer
-	var payload addr
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	var gotVersion, gotVerack bool
+	for !gotVersion || !gotVerack {
+		msg, err := readMessage(conn, magic)
+		if err != nil {
+			return err
+		}
+		switch msg.Command {
+		case "version":
+			gotVersion = true
+		case "verack":
+			gotVerack = true
+		case "reject":
+			var r reject
+			if err := decodePayload(msg.Payload, &r); err != nil {
+				return err
+			}
+			return fmt.Errorf("%s rejected %s: %s", addr, r.Message, r.Reason)
+		}
 	}
-	knownNodes = append(knownNodes, payload.AddrList...)
-	fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
-	requestBlocks()
-}
-
-// handleGetBlocks 用于处理 getBlocks 消息。
-// 它通过 inv 消息向 <对方> 返回 <当前节点> 所有的 BlockHashes。
-func handleGetBlocks(request []byte, bc *chain.BlockChain) {
-	var buff bytes.Buffer
-	var payload getBlocks
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err = writeMessage(conn, magic, "verack", nil); err != nil {
+		return err
 	}
-
-	blocks := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, "block", blocks)
+	return writeMessage(conn, magic, command, payload)
 }
 
 // handleInv 用于处理 inv 消息。
-// inv 消息来源于对方，它包含对方的所有 BlockHashes。
-func handleInv(request []byte, bc *chain.BlockChain) {
-	var buff bytes.Buffer
+// inv 消息来源于对方，它包含对方新的区块或交易的哈希。
+func (n *Node) handleInv(p *Peer, request []byte) {
 	var payload inv
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "inv", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
 	}
+	n.registerPeer(p, payload.AddrFrom)
 
 	fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
+	if len(payload.Items) == 0 {
+		n.sendReject(p, "inv", RejectMalformed, "empty inventory", nil)
+		n.misbehaving(p, scoreProtocol, "empty inventory")
+		return
+	}
 
-	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	for _, item := range payload.Items {
+		p.knownInventory.add(item)
+	}
 
-		var newInTransit [][]byte
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+	if payload.Type == "block" {
+		// 有本地没有的区块时先请求区块头，验证后再按高度下载区块
+		for _, hash := range payload.Items {
+			if !n.bc.HasBlock(hash) {
+				n.sendGetHeaders(p)
+				break
 			}
 		}
-		blocksInTransit = newInTransit
 	} else if payload.Type == "tx" {
-		txID := payload.Items[0]
-		txIDHex := hex.EncodeToString(txID)
-		if memPool[txIDHex].ID == nil {
-			fmt.Printf("Transaction %s not found in memPool, sending getData request\n", txIDHex)
-			sendGetData(payload.AddrFrom, "tx", txID)
-		} else {
-			fmt.Printf("Transaction %s has found in memPool\n", txIDHex)
+		for _, txID := range payload.Items {
+			if n.pool.Has(txID) || n.pool.HasOrphan(txID) {
+				continue
+			}
+			fmt.Printf("Transaction %x not found in mempool, sending getData request\n", txID)
+			n.requestData(p, "tx", txID)
 		}
 	}
 }
 
 // handleGetData 用于处理 getData 消息。
-func handleGetData(request []byte, bc *chain.BlockChain) {
-	var buff bytes.Buffer
+func (n *Node) handleGetData(p *Peer, request []byte) {
 	var payload getData
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "getdata", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
 	}
+	n.registerPeer(p, payload.AddrFrom)
 
 	if payload.Type == "block" {
-		block, err := bc.GetBlock([]byte(payload.ID))
+		block, err := n.bc.GetBlock([]byte(payload.ID))
 		if err != nil {
 			return
 		}
 
-		sendBlock(payload.AddrFrom, &block)
+		n.sendBlock(p, &block)
 	}
 
-	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memPool[txID]
-		sendTx(payload.AddrFrom, &tx)
+	// 轻节点请求区块中与它的过滤器匹配的交易
+	if payload.Type == "filteredblock" {
+		block, err := n.bc.GetBlock(payload.ID)
+		if err != nil {
+			return
+		}
+		n.sendMerkleBlock(p, &block)
+	}
 
+	if payload.Type == "tx" {
+		tx, ok := n.pool.Get(payload.ID)
+		if !ok {
+			fmt.Printf("Transaction %x not found in mempool\n", payload.ID)
+			return
+		}
+		n.sendTx(p, tx)
 	}
 }
 
-// handleBlock 用于处理 block 消息。
-func handleBlock(request []byte, bc *chain.BlockChain) {
-	var buff bytes.Buffer
-	var payload block
+// connectBlock 验证区块并保存，切换分叉时更新内存池，返回区块是否成为链顶。
+// UTXO 集合由 AcceptBlock 与链顶一起更新。
+func (n *Node) connectBlock(b *chain.Block) (bool, error) {
+	n.blockMu.Lock()
+	defer n.blockMu.Unlock()
+
+	return n.connectBlockLocked(b)
+}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+// connectBlockLocked 与 connectBlock 相同，调用方持有 blockMu
+func (n *Node) connectBlockLocked(b *chain.Block) (bool, error) {
+	oldTip := n.bc.GetBestBlock()
+	reorg, err := n.bc.AcceptBlock(b)
 	if err != nil {
-		log.Panic(err)
+		return false, err
 	}
-	blockData := payload.Block
-	b := chain.DeSerializeBlock(blockData)
-
-	fmt.Println("a new block received!")
-	bc.AddBlock(b)
-
-	fmt.Printf("Added block %x \n", b.Hash)
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := chain.UTXOSet{Blockchain: bc}
-		UTXOSet.Reindex()
+	switch {
+	case reorg:
+		// 内存池基于新链重新验证，
+		// 离开主链的区块中的交易回到内存池
+		fmt.Printf("Switched to a longer chain at block %x\n", b.Hash)
+		disconnected, err := n.bc.SideBranch(oldTip.Hash)
+		if err != nil {
+			fmt.Printf("Failed to load disconnected blocks: %v\n", err)
+		}
+		restored, removed := n.pool.Reorg(disconnected)
+		fmt.Printf("Returned %d transactions to the mempool, removed %d that conflict with the new chain\n", restored, removed)
+	case bytes.Equal(n.bc.GetBestBlock().Hash, b.Hash):
+		fmt.Printf("Added block %x \n", b.Hash)
+	default:
+		return false, nil
 	}
+	return true, nil
 }
 
-func handleTx(request []byte, bc *chain.BlockChain) {
-	var buff bytes.Buffer
-	var payload tx
+// connectMinedBlock 是本节点的矿工和外部矿工使用的 mining.ConnectFunc：
+// 区块与收到的区块经过同一条加锁的路径接到链上，成为链顶后更新内存池并转发。
+func (n *Node) connectMinedBlock(b *chain.Block) error {
+	tip, err := n.connectBlock(b)
+	if err != nil {
+		return err
+	}
+	if !tip {
+		// 挖矿期间链顶已经改变，区块只作为分叉保存
+		return chain.ErrStaleTip
+	}
+	n.blockConnected(b, nil)
+	return nil
+}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+// handleBlock 用于处理 block 消息。
+func (n *Node) handleBlock(p *Peer, request []byte) {
+	var payload block
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "block", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	n.registerPeer(p, payload.AddrFrom)
+	blockData := payload.Block
+	b, err := chain.DecodeBlock(blockData)
 	if err != nil {
-		log.Panic(err)
+		n.sendReject(p, "block", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
 	}
-	//err := json.Unmarshal(request[commandLength:], &payload)
-	//if err != nil {
-	//	log.Panic(err)
-	//}
+	p.knownInventory.add(b.Hash)
+	n.received(p, b.Hash)
+	n.blockArrived(p, b.Hash)
 
-	txData := payload.Transaction
-	tx := chain.DeserializeTransaction(txData)
-	memPool[hex.EncodeToString(tx.ID)] = tx
-
-	// 如果是中心节点，就将挖矿信息推广到除自身和挖矿节点之外的节点。
-	// 中心节点是不会挖矿的。
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddFrom {
-				sendInv(node, "tx", [][]byte{tx.ID})
-			}
+	n.acceptBlock(p, b)
+	n.advanceSync()
+}
+
+// processBlock 把 p 发来的区块接到链上，返回区块是否已经在本地。
+// 同步时提前到达的区块被缓存，等前面的区块保存后再处理；其他前一区块未知的区块放入孤块池。
+func (n *Node) processBlock(p *Peer, b *chain.Block) bool {
+	tip, err := n.connectBlock(b)
+	switch {
+	case errors.Is(err, chain.ErrDuplicateBlock):
+		// 已经从其他节点收到过这个区块
+		return true
+	case errors.Is(err, chain.ErrOrphanBlock):
+		if !n.bufferBlock(p, b) {
+			n.addOrphanBlock(p, b)
 		}
-	} else {
-		// miningAddress 只会在矿工节点上设置。如果有两笔或者更多的交易则开始挖矿。
-		if len(memPool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*chain.Transaction
-
-			for id := range memPool {
-				tx := memPool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
+		return false
+	case err != nil:
+		n.sendReject(p, "block", RejectInvalid, err.Error(), b.Hash)
+		n.misbehaving(p, scoreInvalidBlock, err.Error())
+		n.dropPendingHeaders()
+		return false
+	case !tip:
+		// 分叉上的区块和快照之前的历史区块只保存，不转发
+		fmt.Printf("Stored block %x, not on the main chain\n", b.Hash)
+		return true
+	}
 
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
-			// 验证后的交易被放到一个块里，同时还有附带奖励的 coinbase 交易。
-			// 当块被挖出来以后，UTXO 集会被重新索引。
-			cbTx := chain.NewCoinBaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
+	n.blockConnected(b, p)
+	return true
+}
 
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := chain.UTXOSet{Blockchain: bc}
-			UTXOSet.Reindex()
+// blockConnected 在区块 b 成为链顶后调用：把区块中的交易移出内存池，
+// 接受以它们为父交易的孤儿交易，然后通知矿工，并把区块转发给 from 以外的节点。from 为 nil 表示区块由本节点挖出。
+func (n *Node) blockConnected(b *chain.Block, from *Peer) {
+	n.pool.RemoveBlock(b)
+	var blockTxs [][]byte
+	for _, tx := range b.Transactions {
+		blockTxs = append(blockTxs, tx.ID)
+	}
+	if promoted := n.pool.ProcessOrphans(blockTxs); len(promoted) > 0 {
+		fmt.Printf("Accepted %d orphan transactions after block %x\n", len(promoted), b.Hash)
+	}
+	// 交易池更新之后再通知矿工，新模板不会包含已经上链的交易
+	if n.miner != nil {
+		n.miner.NotifyTip()
+	}
 
-			fmt.Println("New block mined!")
+	n.relayBlock(b, from)
+}
 
-			// 删除已经挖出的块里的交易
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(memPool, txID)
-			}
+func (n *Node) handleTx(p *Peer, request []byte) {
+	var payload tx
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "tx", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	n.registerPeer(p, payload.AddFrom)
 
-			// 当前节点所连接到的所有其他节点，接收带有新块哈希的 inv 消息。
-			// 在处理完消息后，它们可以对块进行请求。
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, "block", [][]byte{newBlock.Hash})
-				}
-			}
-			if len(memPool) > 0 {
-				goto MineTransactions
-			}
+	txData := payload.Transaction
+	tx, err := chain.DecodeTransaction(txData)
+	if err != nil {
+		n.sendReject(p, "tx", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	p.knownInventory.add(tx.ID)
+	n.received(p, tx.ID)
+	accepted, missing, err := n.pool.ProcessTransaction(&tx, p.orphanSource())
+	if err != nil {
+		code := txRejectCode(err)
+		n.sendReject(p, "tx", code, err.Error(), tx.ID)
+		if code == RejectInvalid {
+			n.misbehaving(p, scoreInvalidTx, err.Error())
 		}
+		return
+	}
+	// 父交易尚未见过时交易进入孤儿池，向发送方请求缺失的父交易
+	for _, parent := range missing {
+		fmt.Printf("Transaction %x is an orphan, requesting parent %x\n", tx.ID, parent)
+		n.requestData(p, "tx", parent)
+	}
+	if len(accepted) == 0 {
+		return
+	}
+
+	// 每个节点都把新交易转发给还不知道它们的节点
+	var ids [][]byte
+	for _, tx := range accepted {
+		ids = append(ids, tx.ID)
+	}
+	n.relayInventory("tx", ids, p)
+	if n.miner != nil {
+		// 是否开始挖矿由矿工协程按挖矿策略决定
+		n.miner.NotifyTx()
 	}
 }
-func handleConnection(conn net.Conn, bc *chain.BlockChain) {
-	fmt.Printf("--> Received message from %s | Time: %v\n", conn.RemoteAddr(), time.Now().Format(" 15:04:05"))
 
-	request, err := io.ReadAll(conn)
-	if err != nil {
-		log.Panic(err)
+// handleMessage 在 p 的读循环中依次处理收到的消息。
+// 处理过程中的 panic 只断开这个连接，不会让整个节点退出。
+func (n *Node) handleMessage(p *Peer, msg *message) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic while handling %s from %s: %v\n", msg.Command, p, r)
+			p.Close()
+		}
+	}()
+	fmt.Printf("--> Received %s from %s | Time: %v\n", msg.Command, p, time.Now().Format(" 15:04:05"))
+
+	// 对方的 version 被接受之前只处理 version，对方确认我们的 version 之前只处理握手消息
+	if !p.verackSeen() {
+		switch msg.Command {
+		case "version", "reject":
+		case "verack", "didauth":
+			if p.Version() != nil {
+				break
+			}
+			fallthrough
+		default:
+			n.sendReject(p, msg.Command, RejectMalformed, "message before version handshake", nil)
+			n.misbehaving(p, scoreProtocol, "message before version handshake")
+			p.closeAfterFlush()
+			return
+		}
+	}
+	// 许可链模式下对方证明 DID 之前忽略其他消息，对方不知道我们的模式，这些消息不算不良行为
+	if n.permissioned() && p.DID() == "" {
+		switch msg.Command {
+		case "version", "verack", "didauth", "reject":
+		default:
+			return
+		}
 	}
-	command := bytesToCommand(request[:commandLength])
-	fmt.Printf("--> Message : %s command, Dealing...\n", command)
 
-	switch command {
+	switch msg.Command {
 	case "addr":
-		handleAddr(request)
+		n.handleAddr(p, msg.Payload)
+	case "getaddr":
+		n.handleGetAddr(p, msg.Payload)
 	case "block":
-		handleBlock(request, bc)
+		n.handleBlock(p, msg.Payload)
 	case "inv":
-		handleInv(request, bc)
-	case "getblocks":
-		handleGetBlocks(request, bc)
+		n.handleInv(p, msg.Payload)
+	case "getheaders":
+		n.handleGetHeaders(p, msg.Payload)
+	case "headers":
+		n.handleHeaders(p, msg.Payload)
 	case "getdata":
-		handleGetData(request, bc)
+		n.handleGetData(p, msg.Payload)
+	case "cmpctblock":
+		n.handleCmpctBlock(p, msg.Payload)
+	case "getblocktxn":
+		n.handleGetBlockTxn(p, msg.Payload)
+	case "blocktxn":
+		n.handleBlockTxn(p, msg.Payload)
 	case "tx":
-		handleTx(request, bc)
+		n.handleTx(p, msg.Payload)
+	case "didauth":
+		n.handleDIDAuth(p, msg.Payload)
+	case "filterload":
+		n.handleFilterLoad(p, msg.Payload)
+	case "filteradd":
+		n.handleFilterAdd(p, msg.Payload)
+	case "filterclear":
+		n.handleFilterClear(p, msg.Payload)
 	case "version":
-		handlerVersion(request, bc)
+		n.handleVersion(p, msg.Payload)
+	case "verack":
+		n.handleVerack(p, msg.Payload)
+	case "reject":
+		n.handleReject(p, msg.Payload)
+	case "ping":
+		n.handlePing(p, msg.Payload)
+	case "pong":
+		n.handlePong(p, msg.Payload)
 	default:
-		fmt.Println("Unknown command received!")
+		n.sendReject(p, msg.Command, RejectMalformed, "unknown command", nil)
 	}
-	_ = conn.Close()
 }
 
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	miningAddress = minerAddress
-	ln, err := net.Listen(protocol, nodeAddress)
-	if err != nil {
-		panic(err)
-	}
-	defer ln.Close()
-
-	bc := chain.NewBlockChain(nodeID)
-	if nodeAddress != knownNodes[0] {
-
-		sendVersion(knownNodes[0], bc)
-	}
-
-	printInformation(nodeID, minerAddress)
-
-	for {
-		conn, err := ln.Accept()
-
-		if err != nil {
-			log.Panic(err)
-		}
-		go handleConnection(conn, bc)
-	}
-}
-
-// ... 其他导入和代码 ...
-
-func printInformation(nodeID string, minerAddress string) {
+func (n *Node) printInformation() {
 	green := color.New(color.FgGreen).SprintFunc()
 	yellow := color.New(color.FgYellow).SprintFunc()
-	cyan := color.New(color.FgCyan).SprintFunc()
 	magenta := color.New(color.FgMagenta).SprintFunc()
 
 	fmt.Printf("%s %s %s\n", green("==="), green("Date:"), green(time.Now().Format("2006-01-02 15:04:05")))
-	fmt.Printf("%s %s %s %s %s\n", green("==="), yellow("Node:"), yellow(nodeID), yellow("is Handling Connection... | address:"), yellow(nodeAddress))
-	if minerAddress != "" {
+	fmt.Printf("%s %s %s %s %s\n", green("==="), yellow("Node:"), yellow(n.cfg.NodeID), yellow("is Handling Connection... | address:"), yellow(n.address))
+	if n.cfg.MinerAddress != "" {
 		fmt.Printf("%s %s\n", green("==="), magenta("INFO: This is a miner Node!"))
 	}
-	if nodeAddress == knownNodes[0] {
-		fmt.Printf("%s %s\n", green("==="), cyan("INFO: This is the Genesis Node!"))
+	if n.identity != nil {
+		fmt.Printf("%s %s %s\n", green("==="), yellow("DID:"), yellow(n.identity.DID()))
 	}
 	fmt.Println(green("==="))
 }
@@ -488,9 +528,7 @@ func gobEncode(data any) []byte {
 // commandToBytes 用于将命令(string)编码成二进制流。
 func commandToBytes(command string) []byte {
 	var bytes [commandLength]byte
-	for i, c := range command {
-		bytes[i] = byte(c)
-	}
+	copy(bytes[:], command)
 	return bytes[:]
 }
 
@@ -507,19 +545,3 @@ func bytesToCommand(bytes []byte) string {
 
 	return fmt.Sprintf("%s", command)
 }
-
-// nodeIsKnown 用于判断节点是否已经存在于 knownNodes 中。
-func nodeIsKnown(addr string) bool {
-	for _, val := range knownNodes {
-		if val == addr {
-			return true
-		}
-	}
-	return false
-}
-
-func requestBlocks() {
-	for _, node := range knownNodes {
-		sendGetBlocks(node)
-	}
-}
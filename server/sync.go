@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+)
+
+const (
+	// maxHeadersPerMsg 为一条 headers 消息最多包含的区块头数
+	maxHeadersPerMsg = 2000
+	// maxLocatorSize 为 getheaders 中区块定位器的最大长度
+	maxLocatorSize = 101
+	// maxBlocksInFlight 为同步时每个节点同时被请求的区块数
+	maxBlocksInFlight = 16
+	// maxPendingHeaders 为等待下载区块的区块头达到多少时暂停请求更多区块头
+	maxPendingHeaders = 2 * maxHeadersPerMsg
+)
+
+// errUnconnectedHeaders 表示收到的区块头接不到本地的链或已有的区块头上
+var errUnconnectedHeaders = errors.New("headers do not connect to known blocks")
+
+// getHeaders 请求 Locator 中第一个在对方主链上的区块之后的区块头，最多 maxHeadersPerMsg 个，
+// HashStop 不为空时到它为止。Locator 为空时从对方最早的区块开始。
+type getHeaders struct {
+	AddrFrom string
+	Locator  [][]byte
+	HashStop []byte
+}
+
+// headers 回复 getheaders，区块头按高度排列。为空表示对方没有更多的区块
+type headers struct {
+	AddrFrom string
+	Headers  []chain.BlockHeader
+}
+
+// headerSync 为区块头优先同步的状态：先下载并验证区块头，再从分叉点开始向多个节点并行下载区块，
+// 按高度依次接到链上
+type headerSync struct {
+	mu sync.Mutex
+	// peer 为正在从其下载区块头的节点
+	peer *Peer
+	// pending 为已验证、区块尚未保存到本地的区块头，按高度排列
+	pending []chain.BlockHeader
+	// more 表示 peer 上一次回复了满额的区块头，可能还有更多
+	more bool
+	// downloads 为下载窗口内已经请求的区块，buffered 为提前到达、等待前面的区块保存的区块，键为区块哈希
+	downloads map[string]*blockDownload
+	buffered  map[string]bufferedBlock
+}
+
+// locator 返回请求区块头时使用的定位器，已有等待下载的区块头时从最后一个区块头之后继续
+func (n *Node) locator() [][]byte {
+	locator := n.bc.BlockLocator()
+	n.chainSync.mu.Lock()
+	defer n.chainSync.mu.Unlock()
+	if len(n.chainSync.pending) > 0 {
+		locator = append([][]byte{n.chainSync.pending[len(n.chainSync.pending)-1].Hash}, locator...)
+	}
+	return locator
+}
+
+// sendGetHeaders 向 p 请求本地定位器之后的区块头
+func (n *Node) sendGetHeaders(p *Peer) {
+	n.sendData(p, "getheaders", gobEncode(getHeaders{AddrFrom: n.address, Locator: n.locator()}))
+}
+
+// startSync 在没有正在同步的节点时开始从 p 下载区块头
+func (n *Node) startSync(p *Peer) {
+	n.chainSync.mu.Lock()
+	if n.chainSync.peer != nil && !isClosed(n.chainSync.peer) {
+		n.chainSync.mu.Unlock()
+		return
+	}
+	n.chainSync.peer = p
+	n.chainSync.mu.Unlock()
+
+	fmt.Printf("Syncing headers from %s\n", p)
+	n.sendGetHeaders(p)
+}
+
+// checkSync 定期检查同步状态：同步节点断开后换一个节点继续，并重新分配超时的区块请求
+func (n *Node) checkSync() {
+	peers := n.handshakedPeers()
+	if len(peers) == 0 {
+		return
+	}
+	n.chainSync.mu.Lock()
+	peer := n.chainSync.peer
+	if peer != nil && isClosed(peer) {
+		n.chainSync.peer = nil
+		peer = nil
+	}
+	n.chainSync.mu.Unlock()
+
+	best := n.bc.GetBestHeight()
+	for _, p := range peers {
+		if v := p.Version(); peer == nil && v != nil && v.BestHeight > best && !v.Services.Has(ServiceLight) {
+			n.startSync(p)
+			peer = p
+		}
+	}
+	n.checkDownloads(n.now())
+}
+
+// handleGetHeaders 回复定位器之后、本地主链上的区块头，只有对方缺少的部分会被发送
+func (n *Node) handleGetHeaders(p *Peer, request []byte) {
+	var payload getHeaders
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "getheaders", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	if len(payload.Locator) > maxLocatorSize {
+		n.sendReject(p, "getheaders", RejectMalformed, fmt.Sprintf("locator is longer than %d", maxLocatorSize), nil)
+		n.misbehaving(p, scoreMalformed, "locator too long")
+		return
+	}
+	n.registerPeer(p, payload.AddrFrom)
+
+	found := n.bc.LocateHeaders(payload.Locator, payload.HashStop, maxHeadersPerMsg)
+	n.sendData(p, "headers", gobEncode(headers{n.address, found}))
+}
+
+// handleHeaders 验证收到的区块头并分配对应区块的下载。
+// 满额的回复说明对方还有更多区块头，等待下载的区块头不多时继续请求。
+func (n *Node) handleHeaders(p *Peer, request []byte) {
+	var payload headers
+	if err := decodePayload(request, &payload); err != nil {
+		n.sendReject(p, "headers", RejectMalformed, err.Error(), nil)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+	if len(payload.Headers) > maxHeadersPerMsg {
+		n.sendReject(p, "headers", RejectMalformed, fmt.Sprintf("more than %d headers", maxHeadersPerMsg), nil)
+		n.misbehaving(p, scoreMalformed, "too many headers")
+		return
+	}
+	n.registerPeer(p, payload.AddrFrom)
+
+	added, err := n.connectHeaders(payload.Headers)
+	switch {
+	case errors.Is(err, errUnconnectedHeaders):
+		// 对方的链可能在我们请求之后发生了变化，用新的定位器重新请求
+		fmt.Printf("Headers from %s do not connect, requesting again\n", p)
+		n.sendGetHeaders(p)
+		return
+	case err != nil:
+		n.sendReject(p, "headers", RejectInvalid, err.Error(), nil)
+		n.misbehaving(p, scoreInvalidBlock, err.Error())
+		return
+	}
+	for _, h := range payload.Headers {
+		p.knownInventory.add(h.Hash)
+	}
+
+	n.chainSync.mu.Lock()
+	if n.chainSync.peer == nil || isClosed(n.chainSync.peer) {
+		n.chainSync.peer = p
+	}
+	syncing := n.chainSync.peer == p
+	if syncing {
+		n.chainSync.more = len(payload.Headers) == maxHeadersPerMsg
+	}
+	more := syncing && n.chainSync.more && len(n.chainSync.pending) < maxPendingHeaders
+	if more {
+		// 回复到达之前不再重复请求
+		n.chainSync.more = false
+	}
+	total := len(n.chainSync.pending)
+	n.chainSync.mu.Unlock()
+
+	if added > 0 {
+		fmt.Printf("Received %d new headers from %s, %d blocks to download\n", added, p, total)
+	}
+	if more {
+		n.sendGetHeaders(p)
+	}
+	n.scheduleBlocks()
+}
+
+// connectHeaders 验证 hs 的工作量证明以及前后相连，并把本地还没有的区块加入等待下载的区块头。
+// 第一个区块头必须接在本地的区块、等待下载的区块头或者为创世区块上，否则返回 errUnconnectedHeaders。
+func (n *Node) connectHeaders(hs []chain.BlockHeader) (int, error) {
+	if len(hs) == 0 {
+		return 0, nil
+	}
+	for i := range hs {
+		h := &hs[i]
+		if err := chain.CheckHeader(h); err != nil {
+			return 0, fmt.Errorf("header %x: %w", h.Hash, err)
+		}
+		if i > 0 && (!bytes.Equal(h.PreBlockHash, hs[i-1].Hash) || h.Height != hs[i-1].Height+1) {
+			return 0, fmt.Errorf("header %x does not follow %x", h.Hash, hs[i-1].Hash)
+		}
+	}
+
+	n.chainSync.mu.Lock()
+	defer n.chainSync.mu.Unlock()
+
+	first := hs[0]
+	pending := n.chainSync.pending
+	parent := -1
+	for i := range pending {
+		if bytes.Equal(pending[i].Hash, first.PreBlockHash) {
+			parent = i
+			break
+		}
+	}
+	switch {
+	case parent >= 0:
+		if first.Height != pending[parent].Height+1 {
+			return 0, fmt.Errorf("header %x has height %d after %d", first.Hash, first.Height, pending[parent].Height)
+		}
+		// 之后的区块头可能属于另一条分叉，以新收到的为准
+		pending = pending[:parent+1]
+	case len(first.PreBlockHash) == 0:
+		if first.Height != 0 {
+			return 0, fmt.Errorf("header %x without parent has height %d", first.Hash, first.Height)
+		}
+		pending = nil
+	default:
+		prev, err := n.bc.GetBlock(first.PreBlockHash)
+		if err != nil {
+			return 0, errUnconnectedHeaders
+		}
+		if first.Height != prev.Height+1 {
+			return 0, fmt.Errorf("header %x has height %d after %d", first.Hash, first.Height, prev.Height)
+		}
+		// 接在本地区块上的区块头开始一条新的下载序列
+		pending = nil
+	}
+
+	added := 0
+	for _, h := range hs {
+		if n.bc.HasBlock(h.Hash) {
+			continue
+		}
+		pending = append(pending, h)
+		added++
+	}
+	n.chainSync.pending = pending
+	return added, nil
+}
+
+// advanceSync 在区块保存到本地后调用：接上缓存的区块，继续请求区块头并分配区块的下载
+func (n *Node) advanceSync() {
+	n.connectBuffered()
+
+	n.chainSync.mu.Lock()
+	syncPeer := n.chainSync.peer
+	more := n.chainSync.more && len(n.chainSync.pending) < maxHeadersPerMsg && syncPeer != nil && !isClosed(syncPeer)
+	if more {
+		// 回复到达之前不再重复请求
+		n.chainSync.more = false
+	}
+	n.chainSync.mu.Unlock()
+
+	if more {
+		n.sendGetHeaders(syncPeer)
+	}
+	n.scheduleBlocks()
+}
+
+// dropPendingHeaders 在下载的区块没有通过验证时丢弃等待下载的区块头，它们所在的链是无效的
+func (n *Node) dropPendingHeaders() {
+	n.chainSync.mu.Lock()
+	defer n.chainSync.mu.Unlock()
+
+	n.chainSync.pending = nil
+	n.chainSync.more = false
+	clear(n.chainSync.downloads)
+	clear(n.chainSync.buffered)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_ServesHeadersAndBansInvalidOnes(t *testing.T) {
+	genesis := &chain.Block{
+		Hash:         []byte("genesis"),
+		PreBlockHash: []byte{},
+		Transactions: []*chain.Transaction{chain.NewCoinBaseTX(string(wallet.NewWallet().GetAddress()), "")},
+	}
+	node := startTestNode(t, genesis, "")
+
+	v := testVersion(genesis)
+	v.AddrFrom = "127.0.0.1:1"
+	conn := handshake(t, node, v)
+
+	// 握手后节点还会发来 addr 等消息，跳过它们
+	readCommand := func(command string) []byte {
+		msg, err := readMessage(conn, DefaultMagic)
+		for err == nil && msg.Command != command {
+			msg, err = readMessage(conn, DefaultMagic)
+		}
+		require.NoError(t, err)
+		return msg.Payload
+	}
+	getHeadersFor := func(locator [][]byte) []chain.BlockHeader {
+		require.NoError(t, writeMessage(conn, DefaultMagic, "getheaders", gobEncode(getHeaders{v.AddrFrom, locator, nil})))
+		var payload headers
+		require.NoError(t, decodePayload(readCommand("headers"), &payload))
+		return payload.Headers
+	}
+
+	// 空的定位器从最早的区块开始
+	found := getHeadersFor(nil)
+	require.Len(t, found, 1)
+	require.Equal(t, genesis.Hash, found[0].Hash)
+
+	// 定位器中已经包含链顶时没有更多的区块头
+	require.Empty(t, getHeadersFor([][]byte{genesis.Hash}))
+
+	// 工作量证明无效的区块头使发送者被封禁并断开
+	bogus := chain.BlockHeader{Hash: []byte("bogus"), PreBlockHash: genesis.Hash, Height: 1}
+	require.NoError(t, writeMessage(conn, DefaultMagic, "headers", gobEncode(headers{v.AddrFrom, []chain.BlockHeader{bogus}})))
+	var err error
+	for err == nil {
+		_, err = readMessage(conn, DefaultMagic)
+	}
+	require.Len(t, node.Banned(), 1)
+}
@@ -0,0 +1,435 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	chaindid "github.com/qujing226/blockchain/did"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// 加密传输在 version 之前完成密钥交换，之后连接上的所有消息都放在加密记录中：
+//
+//	dialer -> listener: tag(4) | cipher(1) | X25519 公钥(32) | Kyber-768 公钥(1184)
+//	listener -> dialer: tag(4) | cipher(1) | X25519 公钥(32) | Kyber-768 密文(1088)
+//
+// 双方的 X25519 和 Kyber 密钥都是每个连接临时生成的。会话密钥由 X25519 与 Kyber 的共享密钥一起经 HKDF 得出，
+// 只要两者之一没有被攻破，会话就是安全的：X25519 防止 Kyber 实现的缺陷，Kyber 防止量子计算机。
+// 记录格式为 长度(4) | AEAD 密文，明文的第一个字节为标志位。
+const (
+	transportTagXor = 0x4b594245 // "KYBE"
+
+	x25519KeySize    = 32
+	kyberPubKeySize  = 1184
+	kyberCipherSize  = 1088
+	transportHelloSz = 4 + 1 + x25519KeySize + kyberPubKeySize
+	transportReplySz = 4 + 1 + x25519KeySize + kyberCipherSize
+
+	// maxRecordPayload 为一条记录最多携带的明文字节数，更长的写入拆成多条记录
+	maxRecordPayload = 64 << 10
+	// recordOverhead 为标志位和 AEAD 认证标签的长度
+	recordOverhead = 1 + 16
+
+	// recordRekey 表示发送方在这条记录之后更换密钥
+	recordRekey byte = 1 << 0
+
+	defaultRekeyBytes    = 1 << 30
+	defaultRekeyInterval = time.Hour
+)
+
+var (
+	ErrEncryptionRequired = errors.New("peer did not start an encrypted transport")
+	ErrBadRecord          = errors.New("encrypted record is malformed")
+)
+
+// CipherSuite 为加密传输使用的对称加密算法
+type CipherSuite uint8
+
+const (
+	CipherAESGCM CipherSuite = iota + 1
+	CipherChaCha20Poly1305
+)
+
+func (s CipherSuite) String() string {
+	switch s {
+	case CipherAESGCM:
+		return "aes-gcm"
+	case CipherChaCha20Poly1305:
+		return "chacha20-poly1305"
+	}
+	return fmt.Sprintf("cipher(%d)", uint8(s))
+}
+
+// ParseCipherSuite 将 aes-gcm 或 chacha20-poly1305 解析为 CipherSuite
+func ParseCipherSuite(name string) (CipherSuite, error) {
+	for _, s := range []CipherSuite{CipherAESGCM, CipherChaCha20Poly1305} {
+		if strings.EqualFold(name, s.String()) {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher %q", name)
+}
+
+func (s CipherSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("unsupported %s", s)
+}
+
+// TransportConfig 为节点之间连接的加密配置
+type TransportConfig struct {
+	// Encrypt 表示主动建立的连接使用加密传输。被动连接总是接受加密传输，
+	// 因此网络可以逐个节点地开启加密
+	Encrypt bool
+	// RequireEncryption 表示拒绝未加密的被动连接，包括钱包提交交易时建立的明文临时连接
+	RequireEncryption bool
+	// Cipher 为主动连接时使用的对称加密算法，被动连接使用对方选择的算法
+	Cipher CipherSuite
+	// RekeyBytes 和 RekeyInterval 为一个密钥最多加密的字节数和最长使用时间，达到任一限制后更换密钥
+	RekeyBytes    int64
+	RekeyInterval time.Duration
+}
+
+// DefaultTransportConfig 返回不主动加密、使用 AES-GCM 的默认配置
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		Cipher:        CipherAESGCM,
+		RekeyBytes:    defaultRekeyBytes,
+		RekeyInterval: defaultRekeyInterval,
+	}
+}
+
+// transportTag 为网络 magic 的加密握手标记，它与明文消息开头的 magic 不同，被动连接据此区分两者
+func transportTag(magic uint32) uint32 {
+	return magic ^ transportTagXor
+}
+
+// dial 在主动建立的连接 conn 上开始加密传输，不加密时原样返回 conn
+func (c TransportConfig) dial(conn net.Conn, magic uint32) (net.Conn, error) {
+	if !c.Encrypt {
+		return conn, nil
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	suite := c.Cipher
+	if suite == 0 {
+		suite = CipherAESGCM
+	}
+	if _, err := suite.newAEAD(make([]byte, 32)); err != nil {
+		return nil, err
+	}
+	xKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	kemPrivate, kemPublic, err := chaindid.GenerateKEM()
+	if err != nil {
+		return nil, err
+	}
+
+	hello := make([]byte, 0, transportHelloSz)
+	hello = binary.LittleEndian.AppendUint32(hello, transportTag(magic))
+	hello = append(hello, byte(suite))
+	hello = append(hello, xKey.PublicKey().Bytes()...)
+	hello = append(hello, kemPublic[:]...)
+	if _, err = conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, transportReplySz)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(reply[:4]) != transportTag(magic) || CipherSuite(reply[4]) != suite {
+		return nil, errors.New("unexpected encrypted transport reply")
+	}
+	xShared, err := x25519Shared(xKey, reply[5:5+x25519KeySize])
+	if err != nil {
+		return nil, err
+	}
+	var ciphertext [kyberCipherSize]byte
+	copy(ciphertext[:], reply[5+x25519KeySize:])
+	kemShared, err := chaindid.DecryptWithKEM(kemPrivate, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return newSecureConn(conn, c, suite, xShared, kemShared[:], hello, reply, true)
+}
+
+// accept 识别被动连接的对方是否开始加密传输并完成密钥交换。
+// 对方发送明文消息且不要求加密时返回保留了已读字节的明文连接。
+func (c TransportConfig) accept(conn net.Conn, magic uint32) (net.Conn, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	buffered := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	start, err := buffered.r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(start) != transportTag(magic) {
+		if c.RequireEncryption {
+			return nil, ErrEncryptionRequired
+		}
+		return buffered, nil
+	}
+
+	hello := make([]byte, transportHelloSz)
+	if _, err = io.ReadFull(buffered, hello); err != nil {
+		return nil, err
+	}
+	suite := CipherSuite(hello[4])
+	if _, err = suite.newAEAD(make([]byte, 32)); err != nil {
+		return nil, err
+	}
+	xKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	xShared, err := x25519Shared(xKey, hello[5:5+x25519KeySize])
+	if err != nil {
+		return nil, err
+	}
+	var kemPublic [kyberPubKeySize]byte
+	copy(kemPublic[:], hello[5+x25519KeySize:])
+	kemShared, ciphertext, err := chaindid.EncryptWithKEM(kemPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 0, transportReplySz)
+	reply = binary.LittleEndian.AppendUint32(reply, transportTag(magic))
+	reply = append(reply, byte(suite))
+	reply = append(reply, xKey.PublicKey().Bytes()...)
+	reply = append(reply, ciphertext[:]...)
+	if _, err = conn.Write(reply); err != nil {
+		return nil, err
+	}
+	return newSecureConn(buffered, c, suite, xShared, kemShared[:], hello, reply, false)
+}
+
+func x25519Shared(private *ecdh.PrivateKey, peer []byte) ([]byte, error) {
+	public, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	return private.ECDH(public)
+}
+
+// bufferedConn 从 r 读取，r 中可能还有识别连接类型时预读的字节
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// cipherState 为一个方向上的密钥。nonce 为记录序号，每次更换密钥时从 0 开始。
+type cipherState struct {
+	suite CipherSuite
+	key   []byte
+	aead  cipher.AEAD
+	seq   uint64
+	// bytes 和 since 为当前密钥已经加密的字节数和开始使用的时间，generation 为更换密钥的次数
+	bytes      int64
+	since      time.Time
+	generation int
+}
+
+func newCipherState(suite CipherSuite, key []byte) (*cipherState, error) {
+	aead, err := suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherState{suite: suite, key: key, aead: aead, since: time.Now()}, nil
+}
+
+func (s *cipherState) nonce() []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], s.seq)
+	s.seq++
+	return nonce
+}
+
+// rekey 由当前密钥单向派生下一个密钥，旧密钥泄露不会暴露之后的记录，新密钥泄露也不会暴露之前的记录
+func (s *cipherState) rekey() error {
+	key, err := hkdf.Key(sha256.New, s.key, nil, "go-chain transport rekey", len(s.key))
+	if err != nil {
+		return err
+	}
+	aead, err := s.suite.newAEAD(key)
+	if err != nil {
+		return err
+	}
+	s.key, s.aead, s.seq, s.bytes, s.since = key, aead, 0, 0, time.Now()
+	s.generation++
+	return nil
+}
+
+// secureConn 是加密传输的连接，Read 和 Write 分别只能由一个协程调用，两者之间可以并发
+type secureConn struct {
+	net.Conn
+	suite CipherSuite
+	// session 为握手记录的哈希，双方相同，可以用来把身份认证绑定到这个连接
+	session       []byte
+	rekeyBytes    int64
+	rekeyInterval time.Duration
+
+	readMu  sync.Mutex
+	in      *cipherState
+	pending []byte
+
+	writeMu sync.Mutex
+	out     *cipherState
+}
+
+func newSecureConn(conn net.Conn, cfg TransportConfig, suite CipherSuite, xShared, kemShared, hello, reply []byte, dialer bool) (*secureConn, error) {
+	transcript := sha256.New()
+	transcript.Write(hello)
+	transcript.Write(reply)
+	session := transcript.Sum(nil)
+
+	secret := append(append([]byte{}, xShared...), kemShared...)
+	keys, err := hkdf.Key(sha256.New, secret, session, "go-chain transport", 64)
+	if err != nil {
+		return nil, err
+	}
+	// 前 32 字节用于 dialer 发往 listener 的方向
+	sendKey, recvKey := keys[:32], keys[32:]
+	if !dialer {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	out, err := newCipherState(suite, sendKey)
+	if err != nil {
+		return nil, err
+	}
+	in, err := newCipherState(suite, recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &secureConn{
+		Conn:          conn,
+		suite:         suite,
+		session:       session,
+		rekeyBytes:    cfg.RekeyBytes,
+		rekeyInterval: cfg.RekeyInterval,
+		in:            in,
+		out:           out,
+	}
+	if c.rekeyBytes <= 0 {
+		c.rekeyBytes = defaultRekeyBytes
+	}
+	if c.rekeyInterval <= 0 {
+		c.rekeyInterval = defaultRekeyInterval
+	}
+	return c, nil
+}
+
+// Write 将 b 拆成记录加密后写出，当前密钥达到字节数或时间限制时在记录中通知对方并更换密钥
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxRecordPayload)]
+		b = b[len(chunk):]
+
+		var flags byte
+		c.out.bytes += int64(len(chunk))
+		if c.out.bytes >= c.rekeyBytes || time.Since(c.out.since) >= c.rekeyInterval {
+			flags |= recordRekey
+		}
+		plaintext := append([]byte{flags}, chunk...)
+		record := make([]byte, 4, 4+len(plaintext)+c.out.aead.Overhead())
+		record = c.out.aead.Seal(record, c.out.nonce(), plaintext, nil)
+		binary.LittleEndian.PutUint32(record[:4], uint32(len(record)-4))
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		if flags&recordRekey != 0 {
+			if err := c.out.rekey(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Read 返回解密后的数据，记录被篡改、重放或重新排序时认证失败并返回错误
+func (c *secureConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *secureConn) readRecord() error {
+	var header [4]byte
+	if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+		return err
+	}
+	length := binary.LittleEndian.Uint32(header[:])
+	if length < uint32(c.in.aead.Overhead()+1) || length > maxRecordPayload+recordOverhead {
+		return fmt.Errorf("%w: length %d", ErrBadRecord, length)
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(c.Conn, record); err != nil {
+		return err
+	}
+	plaintext, err := c.in.aead.Open(record[:0], c.in.nonce(), record, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRecord, err)
+	}
+	if plaintext[0]&recordRekey != 0 {
+		if err = c.in.rekey(); err != nil {
+			return err
+		}
+	}
+	c.pending = plaintext[1:]
+	return nil
+}
+
+// Session 返回双方相同的会话标识
+func (c *secureConn) Session() []byte {
+	return bytes.Clone(c.session)
+}
+
+// Suite 返回连接使用的对称加密算法
+func (c *secureConn) Suite() CipherSuite {
+	return c.suite
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/stretchr/testify/require"
+)
+
+// tamperConn 在 tamper 为 true 时翻转写出数据的最后一个字节
+type tamperConn struct {
+	net.Conn
+	tamper atomic.Bool
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	if c.tamper.Load() {
+		b = bytes.Clone(b)
+		b[len(b)-1] ^= 1
+	}
+	return c.Conn.Write(b)
+}
+
+// securePair 在内存连接上完成加密握手，返回主动和被动两端
+func securePair(t *testing.T, cfg TransportConfig) (*secureConn, *secureConn, *tamperConn) {
+	left, right := net.Pipe()
+	t.Cleanup(func() { _ = left.Close(); _ = right.Close() })
+	raw := &tamperConn{Conn: left}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := cfg.accept(right, DefaultMagic)
+		if err != nil {
+			_ = right.Close()
+		}
+		accepted <- conn
+	}()
+	dialed, err := cfg.dial(raw, DefaultMagic)
+	require.NoError(t, err)
+	listener := <-accepted
+	require.NotNil(t, listener)
+	return dialed.(*secureConn), listener.(*secureConn), raw
+}
+
+func TestTransport_EncryptsAndRotatesKeys(t *testing.T) {
+	for _, suite := range []CipherSuite{CipherAESGCM, CipherChaCha20Poly1305} {
+		t.Run(suite.String(), func(t *testing.T) {
+			cfg := TransportConfig{Encrypt: true, Cipher: suite, RekeyBytes: 256}
+			dialer, listener, _ := securePair(t, cfg)
+			require.Equal(t, suite, listener.Suite())
+			require.Equal(t, dialer.Session(), listener.Session())
+
+			payload := bytes.Repeat([]byte("did:example:123 "), 64<<10/16+1)
+			done := make(chan error, 1)
+			go func() {
+				for i := 0; i < 10; i++ {
+					if err := writeMessage(dialer, DefaultMagic, "tx", payload); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- writeMessage(dialer, DefaultMagic, "verack", nil)
+			}()
+			for i := 0; i < 10; i++ {
+				msg, err := readMessage(listener, DefaultMagic)
+				require.NoError(t, err)
+				require.Equal(t, payload, msg.Payload)
+			}
+			msg, err := readMessage(listener, DefaultMagic)
+			require.NoError(t, err)
+			require.Equal(t, "verack", msg.Command)
+			require.NoError(t, <-done)
+
+			// 每条消息都超过 RekeyBytes，发送后更换了密钥，接收方跟着更换
+			require.Equal(t, 10, dialer.out.generation)
+			require.Equal(t, dialer.out.generation, listener.in.generation)
+			require.Equal(t, dialer.out.key, listener.in.key)
+			require.Zero(t, listener.out.generation)
+		})
+	}
+}
+
+func TestTransport_RejectsTamperedRecords(t *testing.T) {
+	cfg := DefaultTransportConfig()
+	cfg.Encrypt = true
+	dialer, listener, raw := securePair(t, cfg)
+	raw.tamper.Store(true)
+	go func() { _, _ = dialer.Write([]byte("verack")) }()
+
+	_, err := listener.Read(make([]byte, 16))
+	require.ErrorIs(t, err, ErrBadRecord)
+}
+
+func TestNode_EncryptedTransportBetweenNodes(t *testing.T) {
+	genesis := &chain.Block{Hash: []byte("genesis"), PreBlockHash: []byte{}}
+	central := startTestNodeWith(t, genesis, "", func(cfg *Config) {
+		cfg.Transport.Encrypt = true
+		cfg.Transport.RequireEncryption = true
+	})
+	peer := startTestNodeWith(t, genesis, central.Address(), func(cfg *Config) {
+		cfg.Transport.Encrypt = true
+		cfg.Transport.Cipher = CipherChaCha20Poly1305
+	})
+
+	require.Eventually(t, func() bool {
+		for _, p := range central.handshakedPeers() {
+			if p.Addr() == peer.Address() {
+				return p.Encrypted() && p.Transport() == "chacha20-poly1305"
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// central 拒绝明文连接，peer 仍然接受
+	conn, err := net.Dial(protocol, central.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, writeMessage(conn, DefaultMagic, "version", gobEncode(testVersion(genesis))))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = readMessage(conn, DefaultMagic)
+	require.Error(t, err)
+	handshake(t, peer, testVersion(genesis))
+}
+
+func TestNode_CountsTransportHandshakesTowardsMaxInbound(t *testing.T) {
+	genesis := &chain.Block{Hash: []byte("genesis"), PreBlockHash: []byte{}}
+	// 种子地址无法连接，节点不会连接自己而占用名额
+	node := startTestNodeWith(t, genesis, "127.0.0.1:1", func(cfg *Config) {
+		cfg.MaxInbound = 1
+	})
+
+	// 不发送任何数据的连接停在传输层握手中，仍然占用唯一的名额
+	silent, err := net.Dial(protocol, node.Address())
+	require.NoError(t, err)
+	defer silent.Close()
+	require.Eventually(t, func() bool {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		return node.handshaking == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	refused, err := net.Dial(protocol, node.Address())
+	require.NoError(t, err)
+	defer refused.Close()
+	_ = refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = refused.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// 握手失败后名额被释放
+	require.NoError(t, silent.Close())
+	require.Eventually(t, func() bool {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		return node.handshaking == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	handshake(t, node, testVersion(genesis))
+}
@@ -0,0 +1,53 @@
+package simnet
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock 为模拟网络的时钟，只在调用 Advance 时前进。
+// 节点用它判断 ping、请求和孤块是否超时，链路用它计算消息的延迟。
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+	// changed 在时钟前进时被关闭并替换，用于唤醒等待的链路
+	changed chan struct{}
+}
+
+// NewClock 返回从 start 开始的时钟
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start, changed: make(chan struct{})}
+}
+
+// Now 返回时钟的当前时间
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance 将时钟向前拨 d
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+}
+
+// waitUntil 等待时钟到达 t，done 被关闭时返回 false
+func (c *Clock) waitUntil(t time.Time, done <-chan struct{}) bool {
+	for {
+		c.mu.Lock()
+		now, changed := c.now, c.changed
+		c.mu.Unlock()
+		if !now.Before(t) {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-done:
+			return false
+		}
+	}
+}
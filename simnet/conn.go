@@ -0,0 +1,174 @@
+package simnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// headerLength 和 commandLength 与 server 的消息格式一致：魔数(4) | 命令(12) | 长度(4) | 校验和(4)
+	headerLength  = 24
+	commandLength = 12
+	// maxFrameLength 为链路转发的最大消息，超过时按连接出错处理
+	maxFrameLength = 64 << 20
+	// linkBuffer 为每个方向上排队等待送达的消息数
+	linkBuffer = 4096
+)
+
+// ErrUnreachable 在目标节点不存在、已经停止或处于另一个分区时由 Dial 返回
+var ErrUnreachable = errors.New("simnet: host unreachable")
+
+// Message 描述链路上的一条消息，用于丢弃过滤器
+type Message struct {
+	From, To string
+	Command  string
+}
+
+// addr 为模拟网络中的地址，就是节点的名字
+type addr string
+
+func (a addr) Network() string { return "simnet" }
+func (a addr) String() string  { return string(a) }
+
+// addrConn 为 net.Pipe 的一端加上模拟网络的地址，节点据此记录和封禁对方
+type addrConn struct {
+	net.Conn
+	local, remote addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// listener 为节点在模拟网络中的监听器
+type listener struct {
+	name  addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newListener(name string) *listener {
+	return &listener{name: addr(name), conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.name
+}
+
+// frame 为链路上等待送达的一条消息
+type frame struct {
+	data    []byte
+	command string
+	// at 为消息送达的时间
+	at time.Time
+}
+
+// readFrame 从 r 读取一条完整的消息，返回消息的字节和命令
+func readFrame(r io.Reader) ([]byte, string, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, "", err
+	}
+	length := binary.LittleEndian.Uint32(header[4+commandLength : 8+commandLength])
+	if length > maxFrameLength {
+		return nil, "", fmt.Errorf("simnet: frame of %d bytes", length)
+	}
+	data := make([]byte, headerLength+int(length))
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[headerLength:]); err != nil {
+		return nil, "", err
+	}
+	command := strings.TrimRight(string(header[4:4+commandLength]), "\x00")
+	return data, command, nil
+}
+
+// dial 建立从 from 到 to 的连接：双方各持有一个 net.Pipe 的一端，
+// 中间的两个方向分别由 forward 转发，转发时加上延迟并按分区和丢弃规则丢掉消息。
+func (sn *Network) dial(from, to string) (net.Conn, error) {
+	sn.mu.Lock()
+	ln, ok := sn.listeners[to]
+	reachable := ok && sn.reachable(from, to)
+	sn.mu.Unlock()
+	if !reachable {
+		return nil, fmt.Errorf("dial %s: %w", to, ErrUnreachable)
+	}
+
+	dialer, dialerEnd := net.Pipe()
+	accepted, acceptedEnd := net.Pipe()
+	select {
+	case ln.conns <- &addrConn{Conn: accepted, local: addr(to), remote: addr(from)}:
+	case <-ln.done:
+		_ = dialer.Close()
+		_ = accepted.Close()
+		return nil, fmt.Errorf("dial %s: %w", to, ErrUnreachable)
+	}
+	sn.forward(dialerEnd, acceptedEnd, from, to)
+	sn.forward(acceptedEnd, dialerEnd, to, from)
+	return &addrConn{Conn: dialer, local: addr(from), remote: addr(to)}, nil
+}
+
+// forward 把 from 写入 src 的消息转发到 dst。消息在时钟到达发送时间加延迟后依次送达；
+// 任意一端关闭后，已经排队的消息送达，然后关闭两端。
+func (sn *Network) forward(src, dst net.Conn, from, to string) {
+	queue := make(chan frame, linkBuffer)
+	done := make(chan struct{})
+
+	sn.wg.Add(2)
+	go func() {
+		defer sn.wg.Done()
+		defer close(queue)
+		for {
+			data, command, err := readFrame(src)
+			if err != nil {
+				return
+			}
+			if sn.shouldDrop(Message{From: from, To: to, Command: command}) {
+				continue
+			}
+			select {
+			case queue <- frame{data: data, command: command, at: sn.clock.Now().Add(sn.latencyOf(from, to))}:
+			case <-done:
+				return
+			case <-sn.closed:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer sn.wg.Done()
+		defer func() {
+			close(done)
+			_ = src.Close()
+			_ = dst.Close()
+		}()
+		for f := range queue {
+			if !sn.clock.waitUntil(f.at, sn.closed) {
+				return
+			}
+			if _, err := dst.Write(f.data); err != nil {
+				return
+			}
+			sn.delivered(f.command)
+		}
+	}()
+}
@@ -0,0 +1,390 @@
+// Package simnet 在一个进程中运行由多个节点组成的模拟网络，用于集成测试。
+//
+// 节点之间通过内存中的管道通信，链路可以设置延迟、按规则或按比例丢弃消息、划分分区；
+// 所有节点共享一个只在 Advance 时前进的时钟，并使用很低的挖矿难度。
+// 节点本身仍在真实的协程中运行，等待类的辅助函数按真实时间轮询。
+package simnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	chain "github.com/qujing226/blockchain/block_chain"
+	"github.com/qujing226/blockchain/server"
+	"github.com/qujing226/blockchain/wallet"
+)
+
+const (
+	// DefaultTargetBits 为模拟网络默认的挖矿难度，挖一个区块平均只需要几百次哈希
+	DefaultTargetBits = 8
+	// DefaultTimeout 为等待类辅助函数默认的最长等待时间
+	DefaultTimeout = 10 * time.Second
+
+	genesisCoinbaseData = "simnet genesis"
+	pollInterval        = 10 * time.Millisecond
+)
+
+// Options 为模拟网络的配置
+type Options struct {
+	// Nodes 为节点数，节点依次命名为 node0、node1……
+	Nodes int
+	// TargetBits 为挖矿难度，为 0 时使用 DefaultTargetBits。难度对整个进程生效，同一时间只应运行一个模拟网络。
+	TargetBits int
+	// Dir 为保存各节点数据库的目录，为空时使用临时目录并在 Close 时删除
+	Dir string
+	// Seed 为丢弃消息使用的随机数种子
+	Seed int64
+	// Timeout 为等待类辅助函数的最长等待时间，为 0 时使用 DefaultTimeout
+	Timeout time.Duration
+	// Configure 在节点创建前修改第 i 个节点的配置。链路只转发明文消息，不能打开传输加密。
+	Configure func(i int, cfg *server.Config)
+}
+
+// Node 为模拟网络中的一个节点，Wallet 收取该节点挖出区块的奖励
+type Node struct {
+	*server.Node
+	Name   string
+	Wallet *wallet.Wallet
+}
+
+// WalletAddress 返回节点钱包的地址
+func (n *Node) WalletAddress() string {
+	return string(n.Wallet.GetAddress())
+}
+
+// Tip 返回节点的链顶区块
+func (n *Node) Tip() *chain.Block {
+	return n.Chain().GetBestBlock()
+}
+
+// Network 为一个模拟网络。节点之间默认没有连接，由 Connect 或 ConnectAll 建立。
+type Network struct {
+	clock   *Clock
+	nodes   []*Node
+	chains  []*chain.BlockChain
+	timeout time.Duration
+
+	dir         string
+	removeDir   bool
+	restoreBits func()
+
+	mu        sync.Mutex
+	listeners map[string]*listener
+	// groups 为节点所在的分区，为 nil 时没有分区
+	groups      map[string]int
+	latency     time.Duration
+	linkLatency map[[2]string]time.Duration
+	dropRate    float64
+	dropFilter  func(Message) bool
+	rand        *rand.Rand
+	counts      map[string]int
+
+	wg        sync.WaitGroup
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// New 创建并启动一个模拟网络。所有节点共享同一个创世区块，创世奖励属于 node0。
+func New(opts Options) (*Network, error) {
+	if opts.Nodes <= 0 {
+		return nil, errors.New("simnet: at least one node is required")
+	}
+	if opts.TargetBits == 0 {
+		opts.TargetBits = DefaultTargetBits
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	sn := &Network{
+		clock:       NewClock(time.Now()),
+		timeout:     opts.Timeout,
+		dir:         opts.Dir,
+		listeners:   make(map[string]*listener),
+		linkLatency: make(map[[2]string]time.Duration),
+		rand:        rand.New(rand.NewSource(opts.Seed)),
+		counts:      make(map[string]int),
+		closed:      make(chan struct{}),
+	}
+	if sn.dir == "" {
+		dir, err := os.MkdirTemp("", "simnet")
+		if err != nil {
+			return nil, err
+		}
+		sn.dir, sn.removeDir = dir, true
+	}
+	sn.restoreBits = chain.SetTargetBits(opts.TargetBits)
+
+	wallets := make([]*wallet.Wallet, opts.Nodes)
+	for i := range wallets {
+		wallets[i] = wallet.NewWallet()
+	}
+	genesis := chain.NewGenesisBlock(chain.NewCoinBaseTX(string(wallets[0].GetAddress()), genesisCoinbaseData))
+
+	for i := 0; i < opts.Nodes; i++ {
+		name := fmt.Sprintf("node%d", i)
+		bc, err := chain.CreateBlockchainAt(filepath.Join(sn.dir, name+".db"), genesis)
+		if err != nil {
+			sn.Close()
+			return nil, err
+		}
+		sn.chains = append(sn.chains, bc)
+		UTXOSet := chain.UTXOSet{Blockchain: bc}
+		UTXOSet.Reindex()
+
+		cfg := server.DefaultConfig(name)
+		cfg.Address = name
+		cfg.Seeds = nil
+		// 拓扑完全由测试决定，节点不自动建立出站连接
+		cfg.MaxOutbound = 0
+		cfg.PeersPath, cfg.BansPath, cfg.MempoolPath, cfg.IdentityPath = "", "", "", ""
+		cfg.Dial = func(addr string) (net.Conn, error) { return sn.dial(name, addr) }
+		cfg.Now = sn.clock.Now
+		if opts.Configure != nil {
+			opts.Configure(i, &cfg)
+		}
+
+		ln := newListener(name)
+		sn.mu.Lock()
+		sn.listeners[name] = ln
+		sn.mu.Unlock()
+		node := server.NewNode(cfg, bc, ln)
+		if err = node.Start(context.Background()); err != nil {
+			sn.Close()
+			return nil, err
+		}
+		sn.nodes = append(sn.nodes, &Node{Node: node, Name: name, Wallet: wallets[i]})
+	}
+	return sn, nil
+}
+
+// Close 停止所有节点，关闭数据库并恢复挖矿难度
+func (sn *Network) Close() {
+	sn.closeOnce.Do(func() {
+		for _, node := range sn.nodes {
+			node.Stop()
+		}
+		close(sn.closed)
+		sn.wg.Wait()
+		for _, bc := range sn.chains {
+			bc.Close()
+		}
+		if sn.removeDir {
+			_ = os.RemoveAll(sn.dir)
+		}
+		sn.restoreBits()
+	})
+}
+
+// Nodes 返回所有节点
+func (sn *Network) Nodes() []*Node {
+	return sn.nodes
+}
+
+// Node 返回第 i 个节点
+func (sn *Network) Node(i int) *Node {
+	return sn.nodes[i]
+}
+
+// Clock 返回模拟网络的时钟
+func (sn *Network) Clock() *Clock {
+	return sn.clock
+}
+
+// Advance 将时钟向前拨 d，然后让每个节点执行一次超时检查
+func (sn *Network) Advance(d time.Duration) {
+	sn.clock.Advance(d)
+	for _, node := range sn.nodes {
+		node.Tick()
+	}
+}
+
+// Connect 让 a 主动连接 b，并等待双方完成握手
+func (sn *Network) Connect(a, b *Node) error {
+	if err := a.Connect(b.Name); err != nil {
+		return err
+	}
+	return sn.WaitFor(func() bool {
+		return connected(a, b) && connected(b, a)
+	})
+}
+
+// ConnectAll 把所有节点两两连接起来
+func (sn *Network) ConnectAll() error {
+	for i, a := range sn.nodes {
+		for _, b := range sn.nodes[i+1:] {
+			if err := sn.Connect(a, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// connected 判断 a 是否已经与 b 完成握手
+func connected(a, b *Node) bool {
+	for _, info := range a.PeerInfo() {
+		if info.Addr == b.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// MineBlocks 在节点 n 的链顶上依次挖出 k 个区块并转发给其他节点，奖励支付给 n 的钱包
+func (sn *Network) MineBlocks(n *Node, k int) ([]*chain.Block, error) {
+	blocks := make([]*chain.Block, 0, k)
+	for i := 0; i < k; i++ {
+		b, err := n.GenerateBlock(context.Background(), n.WalletAddress())
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// TipsEqual 判断 nodes 的链顶是否相同
+func TipsEqual(nodes ...*Node) bool {
+	for _, node := range nodes[min(1, len(nodes)):] {
+		if string(node.Tip().Hash) != string(nodes[0].Tip().Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitForTips 等待 nodes 的链顶相同，nodes 为空时等待所有节点
+func (sn *Network) WaitForTips(nodes ...*Node) error {
+	if len(nodes) == 0 {
+		nodes = sn.nodes
+	}
+	if err := sn.WaitFor(func() bool { return TipsEqual(nodes...) }); err != nil {
+		tips := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			tip := node.Tip()
+			tips = append(tips, fmt.Sprintf("%s at %d (%x)", node.Name, tip.Height, tip.Hash))
+		}
+		return fmt.Errorf("%w: tips differ: %s", err, strings.Join(tips, ", "))
+	}
+	return nil
+}
+
+// WaitFor 按真实时间轮询，直到 cond 返回 true 或超时
+func (sn *Network) WaitFor(cond func() bool) error {
+	deadline := time.Now().Add(sn.timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("simnet: condition not met within %v", sn.timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+	return nil
+}
+
+// Partition 把节点分到 groups 中，不同分区之间的消息被丢弃，连接也无法建立。
+// 不在任何分区中的节点彼此相通，但与各分区隔离。
+func (sn *Network) Partition(groups ...[]*Node) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	sn.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			sn.groups[node.Name] = i + 1
+		}
+	}
+}
+
+// Heal 取消分区，之后发出的消息可以正常送达
+func (sn *Network) Heal() {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.groups = nil
+}
+
+// reachable 判断 from 发出的消息能否到达 to，调用方持有 sn.mu
+func (sn *Network) reachable(from, to string) bool {
+	return sn.groups == nil || sn.groups[from] == sn.groups[to]
+}
+
+// SetLatency 设置所有链路的默认延迟，延迟按模拟时钟计算
+func (sn *Network) SetLatency(d time.Duration) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.latency = d
+}
+
+// SetLinkLatency 设置 a 与 b 之间链路的延迟，优先于默认延迟
+func (sn *Network) SetLinkLatency(a, b *Node, d time.Duration) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.linkLatency[linkKey(a.Name, b.Name)] = d
+}
+
+func (sn *Network) latencyOf(from, to string) time.Duration {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	if d, ok := sn.linkLatency[linkKey(from, to)]; ok {
+		return d
+	}
+	return sn.latency
+}
+
+func linkKey(a, b string) [2]string {
+	pair := [2]string{a, b}
+	slices.Sort(pair[:])
+	return pair
+}
+
+// SetDropRate 设置随机丢弃消息的比例，取值为 0 到 1
+func (sn *Network) SetDropRate(rate float64) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.dropRate = rate
+}
+
+// DropIf 丢弃所有使 filter 返回 true 的消息，filter 为 nil 时不再按规则丢弃。filter 不能调用 Network 的方法。
+func (sn *Network) DropIf(filter func(Message) bool) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.dropFilter = filter
+}
+
+// shouldDrop 判断 msg 是否因为分区、丢弃规则或随机丢弃而不送达
+func (sn *Network) shouldDrop(msg Message) bool {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	switch {
+	case !sn.reachable(msg.From, msg.To):
+		return true
+	case sn.dropFilter != nil && sn.dropFilter(msg):
+		return true
+	default:
+		return sn.dropRate > 0 && sn.rand.Float64() < sn.dropRate
+	}
+}
+
+// delivered 记录一条已经送达的消息
+func (sn *Network) delivered(command string) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.counts[command]++
+}
+
+// Delivered 返回网络中已经送达的 command 消息数
+func (sn *Network) Delivered(command string) int {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	return sn.counts[command]
+}
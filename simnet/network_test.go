@@ -0,0 +1,97 @@
+package simnet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newNetwork(t *testing.T, nodes int) *Network {
+	sn, err := New(Options{Nodes: nodes, Dir: t.TempDir(), Seed: 1})
+	require.NoError(t, err)
+	t.Cleanup(sn.Close)
+	return sn
+}
+
+func TestNetwork_RelaysBlocksAlongALine(t *testing.T) {
+	sn := newNetwork(t, 3)
+	// node0 - node1 - node2，node2 只能通过 node1 收到区块
+	require.NoError(t, sn.Connect(sn.Node(0), sn.Node(1)))
+	require.NoError(t, sn.Connect(sn.Node(1), sn.Node(2)))
+
+	blocks, err := sn.MineBlocks(sn.Node(0), 3)
+	require.NoError(t, err)
+	require.NoError(t, sn.WaitForTips())
+	require.Equal(t, blocks[2].Hash, sn.Node(2).Tip().Hash)
+	require.Equal(t, 3, sn.Node(2).Tip().Height)
+}
+
+func TestNetwork_ReorgsAfterPartitionHeals(t *testing.T) {
+	sn := newNetwork(t, 4)
+	require.NoError(t, sn.ConnectAll())
+	left := []*Node{sn.Node(0), sn.Node(1)}
+	right := []*Node{sn.Node(2), sn.Node(3)}
+
+	sn.Partition(left, right)
+	_, err := sn.MineBlocks(sn.Node(0), 2)
+	require.NoError(t, err)
+	_, err = sn.MineBlocks(sn.Node(2), 3)
+	require.NoError(t, err)
+	require.NoError(t, sn.WaitForTips(left...))
+	require.NoError(t, sn.WaitForTips(right...))
+	require.False(t, TipsEqual(sn.Node(0), sn.Node(2)))
+
+	// 分区恢复后右侧的下一个区块对左侧是孤块，左侧取回祖先后切换到更长的链
+	sn.Heal()
+	blocks, err := sn.MineBlocks(sn.Node(3), 1)
+	require.NoError(t, err)
+	require.NoError(t, sn.WaitForTips())
+	require.Equal(t, blocks[0].Hash, sn.Node(0).Tip().Hash)
+	require.Equal(t, 4, sn.Node(1).Tip().Height)
+}
+
+func TestNetwork_FetchesAncestorsOfOrphans(t *testing.T) {
+	sn := newNetwork(t, 2)
+	require.NoError(t, sn.Connect(sn.Node(0), sn.Node(1)))
+
+	// node1 错过前两个区块，第三个区块到达时是孤块
+	sn.DropIf(func(m Message) bool { return m.To == "node1" })
+	_, err := sn.MineBlocks(sn.Node(0), 2)
+	require.NoError(t, err)
+	sn.DropIf(nil)
+	require.Zero(t, sn.Node(1).Tip().Height)
+
+	_, err = sn.MineBlocks(sn.Node(0), 1)
+	require.NoError(t, err)
+	require.NoError(t, sn.WaitForTips())
+	require.Equal(t, 3, sn.Node(1).Tip().Height)
+}
+
+func TestNetwork_DeliversAfterLatencyOnTheSimulatedClock(t *testing.T) {
+	sn := newNetwork(t, 2)
+	require.NoError(t, sn.Connect(sn.Node(0), sn.Node(1)))
+	sn.SetLatency(time.Second)
+
+	_, err := sn.MineBlocks(sn.Node(0), 1)
+	require.NoError(t, err)
+	require.Never(t, func() bool { return TipsEqual(sn.Nodes()...) }, 200*time.Millisecond, 10*time.Millisecond)
+
+	sn.Advance(time.Second)
+	require.NoError(t, sn.WaitForTips())
+}
+
+func TestNetwork_DisconnectsPeersThatStopAnsweringPings(t *testing.T) {
+	sn := newNetwork(t, 2)
+	require.NoError(t, sn.Connect(sn.Node(0), sn.Node(1)))
+	sn.DropIf(func(m Message) bool { return m.Command == "pong" })
+
+	// 握手后的第一次检查发出 ping，时钟越过 pingTimeout 后连接被断开
+	sn.Advance(time.Second)
+	require.NoError(t, sn.WaitFor(func() bool { return sn.Delivered("ping") >= 2 }))
+	require.Len(t, sn.Node(0).PeerInfo(), 1)
+	sn.Advance(3 * time.Minute)
+	require.NoError(t, sn.WaitFor(func() bool {
+		return len(sn.Node(0).PeerInfo()) == 0 && len(sn.Node(1).PeerInfo()) == 0
+	}))
+}
@@ -81,6 +81,20 @@ func ValidateAddress(address string) bool {
 
 	return bytes.Compare(actualChecksum, targetCheckSum) == 0
 }
+
+// AddressToPubKeyHash 校验地址并返回其中的公钥哈希，轻钱包用它构造过滤器和统计余额
+func AddressToPubKeyHash(address string) ([]byte, error) {
+	payload := base58.Decode(address)
+	if len(payload) <= 1+addressChecksumLen {
+		return nil, fmt.Errorf("invalid address %q", address)
+	}
+	pubKeyHash := payload[1 : len(payload)-addressChecksumLen]
+	if !bytes.Equal(payload[len(payload)-addressChecksumLen:], checksum(payload[:len(payload)-addressChecksumLen])) {
+		return nil, fmt.Errorf("invalid address %q: checksum mismatch", address)
+	}
+	return pubKeyHash, nil
+}
+
 func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	curve := elliptic.P256()
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)